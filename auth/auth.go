@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of the authenticated requests
+const (
+	// APIKeyHeader holds the secret of a static key, which can
+	// also be sent as a bearer token in the Authorization header
+	APIKeyHeader = "X-Api-Key"
+
+	// KeyIDHeader, TimestampHeader and SignatureHeader hold the
+	// HMAC-SHA256 signature of a request made with the secret of a key,
+	// ContentSHA256Header holds the SHA-256 of the signed body
+	KeyIDHeader         = "X-Picfit-Key-Id"
+	TimestampHeader     = "X-Picfit-Timestamp"
+	SignatureHeader     = "X-Picfit-Signature"
+	ContentSHA256Header = "X-Picfit-Content-Sha256"
+)
+
+var (
+	// ErrMissingCredentials is an error when a request holds no key
+	ErrMissingCredentials = errors.New("Missing credentials")
+
+	// ErrInvalidCredentials is an error when the key or the signature of a request is invalid
+	ErrInvalidCredentials = errors.New("Invalid credentials")
+
+	// ErrExpiredRequest is an error when the timestamp of a signed request is too far from now
+	ErrExpiredRequest = errors.New("Request timestamp is out of range")
+)
+
+// Allows returns true if the key has the scope or the admin scope
+func (k *Key) Allows(scope string) bool {
+	for i := range k.Scopes {
+		if k.Scopes[i] == scope || k.Scopes[i] == AdminScope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticator authenticates requests with API keys
+type Authenticator struct {
+	// Now returns the time compared to the timestamp of signed requests
+	Now func() time.Time
+
+	keys         []Key
+	maxClockSkew time.Duration
+}
+
+// New returns an Authenticator from config, nil when there is no key
+func New(cfg *Config) (*Authenticator, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	keys := append([]Key{}, cfg.Keys...)
+
+	if cfg.KeysFile != "" {
+		content, err := ioutil.ReadFile(cfg.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var fileKeys []Key
+		if err := json.Unmarshal(content, &fileKeys); err != nil {
+			return nil, fmt.Errorf("unable to parse keys file %s: %v", cfg.KeysFile, err)
+		}
+
+		keys = append(keys, fileKeys...)
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	ids := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, errors.New("API keys require an id and a secret")
+		}
+
+		if ids[key.ID] {
+			return nil, fmt.Errorf("API key %s is duplicated", key.ID)
+		}
+		ids[key.ID] = true
+
+		for _, scope := range key.Scopes {
+			if scope != UploadScope && scope != DeleteScope && scope != AdminScope {
+				return nil, fmt.Errorf("scope %s of API key %s does not exist", scope, key.ID)
+			}
+		}
+	}
+
+	maxClockSkew := cfg.MaxClockSkew
+	if maxClockSkew == 0 {
+		maxClockSkew = DefaultMaxClockSkew
+	}
+
+	return &Authenticator{
+		Now:          time.Now,
+		keys:         keys,
+		maxClockSkew: maxClockSkew,
+	}, nil
+}
+
+// Authenticate returns the key of a request, sent as a static key or
+// used to sign the request headers
+func (a *Authenticator) Authenticate(r *http.Request) (*Key, error) {
+	if id := r.Header.Get(KeyIDHeader); id != "" {
+		return a.verifySignature(r, id)
+	}
+
+	secret := r.Header.Get(APIKeyHeader)
+	if authorization := r.Header.Get("Authorization"); secret == "" && strings.HasPrefix(authorization, "Bearer ") {
+		secret = strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	if secret == "" {
+		return nil, ErrMissingCredentials
+	}
+
+	// every key is compared so the time does not depend on the matching key
+	var found *Key
+	for i := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(a.keys[i].Secret), []byte(secret)) == 1 {
+			found = &a.keys[i]
+		}
+	}
+
+	if found == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return found, nil
+}
+
+func (a *Authenticator) verifySignature(r *http.Request, id string) (*Key, error) {
+	var key *Key
+	for i := range a.keys {
+		if a.keys[i].ID == id {
+			key = &a.keys[i]
+		}
+	}
+
+	if key == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	timestamp := r.Header.Get(TimestampHeader)
+
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	digest := strings.ToLower(r.Header.Get(ContentSHA256Header))
+	if digest == "" {
+		digest = ContentSHA256(nil)
+	}
+
+	expected := Sign(key.Secret, r.Method, r.URL.RequestURI(), timestamp, digest)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(SignatureHeader))) {
+		return nil, ErrInvalidCredentials
+	}
+
+	skew := a.Now().Sub(time.Unix(t, 0))
+	if skew > a.maxClockSkew || skew < -a.maxClockSkew {
+		return nil, ErrExpiredRequest
+	}
+
+	// the body is only read once the signature is verified
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if ContentSHA256(body) != digest {
+		return nil, ErrInvalidCredentials
+	}
+
+	return key, nil
+}
+
+// Sign returns the hexadecimal HMAC-SHA256 of a request made with a secret,
+// it covers the method, the request URI, the unix timestamp and the
+// hexadecimal SHA-256 of the body of the request
+func Sign(secret string, method string, uri string, timestamp string, digest string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{method, uri, timestamp, digest}, "\n")))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ContentSHA256 returns the hexadecimal SHA-256 of a body
+func ContentSHA256(body []byte) string {
+	sum := sha256.Sum256(body)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// SignRequest sets the headers signing a request and its body with a key
+func SignRequest(r *http.Request, key Key, now time.Time) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	digest := ContentSHA256(body)
+
+	r.Header.Set(KeyIDHeader, key.ID)
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(ContentSHA256Header, digest)
+	r.Header.Set(SignatureHeader, Sign(key.Secret, r.Method, r.URL.RequestURI(), timestamp, digest))
+
+	return nil
+}
+
+// readBody returns the body of a request, which is replaced so it can be read again
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticate(t *testing.T) {
+	authenticator, err := New(&Config{
+		Keys: []Key{
+			{ID: "uploader", Secret: "s3cr3t", Scopes: []string{UploadScope}},
+			{ID: "root", Secret: "r00t", Scopes: []string{AdminScope}},
+		},
+	})
+	assert.Nil(t, err)
+
+	now := time.Unix(1600000000, 0)
+	authenticator.Now = func() time.Time { return now }
+
+	request := func(headers map[string]string) *http.Request {
+		r, _ := http.NewRequest("DELETE", "http://example.com/foo/bar.png?x=1", nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return r
+	}
+
+	key, err := authenticator.Authenticate(request(map[string]string{APIKeyHeader: "s3cr3t"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "uploader", key.ID)
+	assert.True(t, key.Allows(UploadScope))
+	assert.False(t, key.Allows(DeleteScope))
+
+	key, err = authenticator.Authenticate(request(map[string]string{"Authorization": "Bearer r00t"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "root", key.ID)
+	assert.True(t, key.Allows(DeleteScope))
+
+	_, err = authenticator.Authenticate(request(nil))
+	assert.Equal(t, ErrMissingCredentials, err)
+
+	_, err = authenticator.Authenticate(request(map[string]string{APIKeyHeader: "wrong"}))
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	// signed requests
+	r := request(nil)
+	assert.Nil(t, SignRequest(r, Key{ID: "root", Secret: "r00t"}, now.Add(-time.Minute)))
+	key, err = authenticator.Authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "root", key.ID)
+
+	r = request(nil)
+	assert.Nil(t, SignRequest(r, Key{ID: "root", Secret: "r00t"}, now.Add(-time.Hour)))
+	_, err = authenticator.Authenticate(r)
+	assert.Equal(t, ErrExpiredRequest, err)
+
+	r = request(nil)
+	assert.Nil(t, SignRequest(r, Key{ID: "root", Secret: "wrong"}, now))
+	_, err = authenticator.Authenticate(r)
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	r = request(nil)
+	assert.Nil(t, SignRequest(r, Key{ID: "unknown", Secret: "r00t"}, now))
+	_, err = authenticator.Authenticate(r)
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	// the signature covers the request uri
+	r = request(nil)
+	assert.Nil(t, SignRequest(r, Key{ID: "root", Secret: "r00t"}, now))
+	r.URL.Path = "/foo/other.png"
+	_, err = authenticator.Authenticate(r)
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	// the signature covers the body, which can be read again
+	upload := func(body string) *http.Request {
+		r, _ := http.NewRequest("PUT", "http://example.com/upload/bar.png", strings.NewReader(body))
+		return r
+	}
+
+	r = upload("image")
+	assert.Nil(t, SignRequest(r, Key{ID: "root", Secret: "r00t"}, now))
+	key, err = authenticator.Authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "root", key.ID)
+
+	body, err := ioutil.ReadAll(r.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "image", string(body))
+
+	signed := upload("image")
+	assert.Nil(t, SignRequest(signed, Key{ID: "root", Secret: "r00t"}, now))
+
+	r = upload("other")
+	r.Header = signed.Header
+	_, err = authenticator.Authenticate(r)
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	r = upload("other")
+	r.Header = signed.Header.Clone()
+	r.Header.Set(ContentSHA256Header, ContentSHA256([]byte("other")))
+	_, err = authenticator.Authenticate(r)
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestNew(t *testing.T) {
+	authenticator, err := New(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, authenticator)
+
+	authenticator, err = New(&Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, authenticator)
+
+	for _, keys := range [][]Key{
+		{{ID: "", Secret: "s3cr3t"}},
+		{{ID: "1", Secret: ""}},
+		{{ID: "1", Secret: "a"}, {ID: "1", Secret: "b"}},
+		{{ID: "1", Secret: "a", Scopes: []string{"read"}}},
+	} {
+		_, err := New(&Config{Keys: keys})
+		assert.NotNil(t, err, "%v", keys)
+	}
+
+	dir, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`[{"id": "file", "secret": "f1l3", "scopes": ["delete"]}]`), 0600))
+
+	authenticator, err = New(&Config{KeysFile: path})
+	assert.Nil(t, err)
+
+	r, _ := http.NewRequest("DELETE", "http://example.com/foo.png", nil)
+	r.Header.Set(APIKeyHeader, "f1l3")
+
+	key, err := authenticator.Authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "file", key.ID)
+	assert.True(t, key.Allows(DeleteScope))
+
+	_, err = New(&Config{KeysFile: filepath.Join(dir, "missing.json")})
+	assert.NotNil(t, err)
+}
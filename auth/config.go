@@ -0,0 +1,29 @@
+package auth
+
+import "time"
+
+// Scopes of the keys, admin grants every scope
+const (
+	UploadScope = "upload"
+	DeleteScope = "delete"
+	AdminScope  = "admin"
+)
+
+// DefaultMaxClockSkew is the default maximum difference between the
+// timestamp of a signed request and the time it is received
+const DefaultMaxClockSkew = 5 * time.Minute
+
+// Key is an API key identified by ID
+type Key struct {
+	ID     string   `mapstructure:"id" json:"id"`
+	Secret string   `mapstructure:"secret" json:"secret"`
+	Scopes []string `mapstructure:"scopes" json:"scopes"`
+}
+
+// Config is a struct to configure the API keys, KeysFile is a JSON file
+// holding a list of keys loaded in addition to Keys
+type Config struct {
+	Keys         []Key         `mapstructure:"keys"`
+	KeysFile     string        `mapstructure:"keys_file"`
+	MaxClockSkew time.Duration `mapstructure:"max_clock_skew"`
+}
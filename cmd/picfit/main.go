@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"time"
 
 	"github.com/thoas/picfit/constants"
 	"github.com/thoas/picfit/server"
@@ -43,6 +45,19 @@ func main() {
 					Name:  "key",
 					Usage: "The signing key",
 				},
+				cli.StringFlag{
+					Name:  "kid",
+					Usage: "The identifier of the signing key, sent in the kid parameter",
+				},
+				cli.DurationFlag{
+					Name:  "expires",
+					Usage: "The duration after which the signature expires, e.g. 24h",
+				},
+				cli.StringFlag{
+					Name:  "algorithm",
+					Value: signature.SHA1,
+					Usage: "The signature algorithm, sha1 or sha256",
+				},
 			},
 			Action: func(c *cli.Context) {
 				key := c.String("key")
@@ -58,14 +73,22 @@ func main() {
 
 				queryString := c.Args()[0]
 
-				sig, err := signature.SignRaw(key, queryString)
+				if kid := c.String("kid"); kid != "" {
+					queryString = fmt.Sprintf("%s&%s=%s", queryString, constants.KeyIDParamName, url.QueryEscape(kid))
+				}
+
+				if expires := c.Duration("expires"); expires != 0 {
+					queryString = fmt.Sprintf("%s&%s=%d", queryString, constants.ExpiresParamName, time.Now().Add(expires).Unix())
+				}
+
+				sig, err := signature.SignRawWith(c.String("algorithm"), key, queryString)
 
 				if err != nil {
 					fmt.Println(err.Error())
 					os.Exit(1)
 				}
 
-				appended := signature.AppendSign(key, queryString)
+				appended := fmt.Sprintf("%s&%s=%s", queryString, constants.SigParamName, sig)
 
 				fmt.Fprintf(os.Stdout, "Query String: %s\n", queryString)
 				fmt.Fprintf(os.Stdout, "Signature: %s\n", sig)
@@ -3,14 +3,21 @@ package config
 import (
 	"bytes"
 	"fmt"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 
+	"github.com/thoas/picfit/auth"
 	"github.com/thoas/picfit/constants"
 	engineconfig "github.com/thoas/picfit/engine/config"
 	"github.com/thoas/picfit/logger"
+	"github.com/thoas/picfit/metadata"
+	"github.com/thoas/picfit/ratelimit"
+	"github.com/thoas/picfit/signature"
 	"github.com/thoas/picfit/storage"
 	"github.com/thoas/picfit/store"
+	"github.com/thoas/picfit/tracing"
 )
 
 // Shard is a struct to allow shard location when files are uploaded
@@ -28,16 +35,53 @@ type AllowedSize struct {
 
 // Options is a struct to add options to the application
 type Options struct {
-	AllowedIPAddresses  []string      `mapstructure:"allowed_ip_addresses"`
-	EnablePprof         bool          `mapstructure:"enable_pprof"`
-	EnableUpload        bool          `mapstructure:"enable_upload"`
-	EnableDelete        bool          `mapstructure:"enable_delete"`
-	EnableCascadeDelete bool          `mapstructure:"enable_cascade_delete"`
-	EnableStats         bool          `mapstructure:"enable_stats"`
-	EnableHealth        bool          `mapstructure:"enable_health"`
-	AllowedSizes        []AllowedSize `mapstructure:"allowed_sizes"`
-	DefaultUserAgent    string        `mapstructure:"default_user_agent"`
-	MimetypeDetector    string        `mapstructure:"mimetype_detector"`
+	AllowedIPAddresses     []string                  `mapstructure:"allowed_ip_addresses"`
+	EnablePprof            bool                      `mapstructure:"enable_pprof"`
+	EnableUpload           bool                      `mapstructure:"enable_upload"`
+	EnableDelete           bool                      `mapstructure:"enable_delete"`
+	EnableCascadeDelete    bool                      `mapstructure:"enable_cascade_delete"`
+	EnableStats            bool                      `mapstructure:"enable_stats"`
+	EnableHealth           bool                      `mapstructure:"enable_health"`
+	EnableMetrics          bool                      `mapstructure:"enable_metrics"`
+	AllowedSizes           []AllowedSize             `mapstructure:"allowed_sizes"`
+	DefaultUserAgent       string                    `mapstructure:"default_user_agent"`
+	MimetypeDetector       string                    `mapstructure:"mimetype_detector"`
+	FetchMaxSize           int64                     `mapstructure:"fetch_max_size"`
+	FetchTimeout           time.Duration             `mapstructure:"fetch_timeout"`
+	FetchConnectTimeout    time.Duration             `mapstructure:"fetch_connect_timeout"`
+	FetchMaxRedirects      int                       `mapstructure:"fetch_max_redirects"`
+	URLSources             *storage.URLSourcesConfig `mapstructure:"url_sources"`
+	TransformWorkers       int                       `mapstructure:"transform_workers"`
+	TransformQueueSize     int                       `mapstructure:"transform_queue_size"`
+	StoreWorkers           int                       `mapstructure:"store_workers"`
+	StoreQueueSize         int                       `mapstructure:"store_queue_size"`
+	RetryAfter             time.Duration             `mapstructure:"retry_after"`
+	ProcessingTimeout      time.Duration             `mapstructure:"processing_timeout"`
+	UploadBatchWorkers     int                       `mapstructure:"upload_batch_workers"`
+	UploadBatchMaxFiles    int                       `mapstructure:"upload_batch_max_files"`
+	ContentAddressedUpload bool                      `mapstructure:"content_addressed_upload"`
+}
+
+// Server is a struct to configure the http server, zero values fall back to their default
+type Server struct {
+	ReadTimeout       time.Duration `mapstructure:"read_timeout"`
+	ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+	WriteTimeout      time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout       time.Duration `mapstructure:"idle_timeout"`
+	MaxHeaderBytes    int           `mapstructure:"max_header_bytes"`
+	ShutdownTimeout   time.Duration `mapstructure:"shutdown_timeout"`
+	Socket            string
+}
+
+// TLS is a struct to serve requests over TLS, client certificates
+// signed by ClientCAFile are verified when it is provided
+type TLS struct {
+	CertFile       string        `mapstructure:"cert_file"`
+	KeyFile        string        `mapstructure:"key_file"`
+	MinVersion     string        `mapstructure:"min_version"`
+	ClientCAFile   string        `mapstructure:"client_ca_file"`
+	ClientAuth     string        `mapstructure:"client_auth"`
+	ReloadInterval time.Duration `mapstructure:"reload_interval"`
 }
 
 // Sentry is a struct to configure sentry using a dsn
@@ -51,9 +95,12 @@ type Config struct {
 	Debug          bool
 	Engine         *engineconfig.Config
 	Sentry         *Sentry
-	SecretKey      string `mapstructure:"secret_key"`
+	SecretKey      string          `mapstructure:"secret_key"`
+	SigningKeys    []signature.Key `mapstructure:"signing_keys"`
 	Shard          *Shard
 	Port           int
+	Server         *Server
+	TLS            *TLS
 	Options        *Options
 	AllowedOrigins []string `mapstructure:"allowed_origins"`
 	AllowedMethods []string `mapstructure:"allowed_methods"`
@@ -61,6 +108,10 @@ type Config struct {
 	Storage        *storage.Config
 	KVStore        *store.Config
 	Logger         logger.Config
+	Tracing        *tracing.Config
+	RateLimit      *ratelimit.Config `mapstructure:"rate_limit"`
+	Auth           *auth.Config      `mapstructure:"auth"`
+	Metadata       *metadata.Config  `mapstructure:"metadata"`
 }
 
 // DefaultConfig returns a default config instance
@@ -77,10 +128,21 @@ func DefaultConfig() *Config {
 			Format:          "",
 		},
 		Options: &Options{
-			EnableDelete:     false,
-			EnableUpload:     false,
-			DefaultUserAgent: fmt.Sprint(DefaultUserAgent, "/", constants.Version),
-			MimetypeDetector: DefaultMimetypeDetector,
+			EnableDelete:        false,
+			EnableUpload:        false,
+			DefaultUserAgent:    fmt.Sprint(DefaultUserAgent, "/", constants.Version),
+			MimetypeDetector:    DefaultMimetypeDetector,
+			FetchMaxSize:        DefaultFetchMaxSize,
+			FetchTimeout:        DefaultFetchTimeout,
+			FetchConnectTimeout: DefaultFetchConnectTimeout,
+			FetchMaxRedirects:   DefaultFetchMaxRedirects,
+			TransformWorkers:    DefaultTransformWorkers(),
+			TransformQueueSize:  DefaultTransformQueueSize,
+			StoreWorkers:        DefaultStoreWorkers,
+			StoreQueueSize:      DefaultStoreQueueSize,
+			RetryAfter:          DefaultRetryAfter,
+			UploadBatchWorkers:  DefaultUploadBatchWorkers,
+			UploadBatchMaxFiles: DefaultUploadBatchMaxFiles,
 		},
 		Port: DefaultPort,
 		KVStore: &store.Config{
@@ -124,7 +186,17 @@ func load(content string, isPath bool) (*Config, error) {
 		}
 	}
 
-	err = viper.Unmarshal(&config)
+	// durations are given as strings such as "30s"
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		WeaklyTypedInput: true,
+		Result:           &config,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = decoder.Decode(viper.AllSettings())
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadFromContentDurations(t *testing.T) {
+	cfg, err := LoadFromContent(`{
+	  "options": {
+		"fetch_timeout": "30s",
+		"fetch_connect_timeout": "500ms",
+		"retry_after": "5s"
+	  }
+	}`)
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, cfg.Options.FetchTimeout)
+	assert.Equal(t, 500*time.Millisecond, cfg.Options.FetchConnectTimeout)
+	assert.Equal(t, 5*time.Second, cfg.Options.RetryAfter)
+}
@@ -1,5 +1,10 @@
 package config
 
+import (
+	"runtime"
+	"time"
+)
+
 // DefaultFormat is the default image format
 const DefaultFormat = "png"
 
@@ -24,3 +29,69 @@ const DefaultShardDepth = 0
 
 // DefaultShardRestOnly is the default shard rest behaviour
 const DefaultShardRestOnly = true
+
+// DefaultFetchMaxSize is the default maximum size in bytes of an image retrieved from an URL
+const DefaultFetchMaxSize = 50 * 1024 * 1024
+
+// DefaultFetchTimeout is the default timeout to retrieve an image from an URL
+const DefaultFetchTimeout = 30 * time.Second
+
+// DefaultFetchConnectTimeout is the default timeout to connect to the server of an image URL
+const DefaultFetchConnectTimeout = 5 * time.Second
+
+// DefaultFetchMaxRedirects is the default maximum number of redirects followed to retrieve an image
+const DefaultFetchMaxRedirects = 10
+
+// DefaultTransformWorkers returns the default number of images transformed concurrently
+func DefaultTransformWorkers() int {
+	return runtime.NumCPU()
+}
+
+// DefaultTransformQueueSize is the default number of images waiting to be transformed
+const DefaultTransformQueueSize = 100
+
+// DefaultStoreWorkers is the default number of images stored concurrently in the background
+const DefaultStoreWorkers = 4
+
+// DefaultStoreQueueSize is the default number of images waiting to be stored in the background
+const DefaultStoreQueueSize = 100
+
+// DefaultUploadBatchWorkers is the default number of files of a batch uploaded concurrently
+const DefaultUploadBatchWorkers = 4
+
+// DefaultUploadBatchMaxFiles is the default maximum number of files of a batch upload
+const DefaultUploadBatchMaxFiles = 100
+
+// DefaultRetryAfter is the default delay advised to clients when the server is busy
+const DefaultRetryAfter = 5 * time.Second
+
+// DefaultReadTimeout is the default maximum duration to read a request
+const DefaultReadTimeout = 30 * time.Second
+
+// DefaultReadHeaderTimeout is the default maximum duration to read the headers of a request
+const DefaultReadHeaderTimeout = 10 * time.Second
+
+// DefaultWriteTimeout is the default maximum duration to write a response
+const DefaultWriteTimeout = 60 * time.Second
+
+// DefaultIdleTimeout is the default maximum duration a keep-alive connection stays idle
+const DefaultIdleTimeout = 120 * time.Second
+
+// DefaultMaxHeaderBytes is the default maximum size in bytes of the headers of a request
+const DefaultMaxHeaderBytes = 1 << 20
+
+// DefaultShutdownTimeout is the default maximum duration to drain requests and stores on shutdown
+const DefaultShutdownTimeout = 30 * time.Second
+
+// DefaultTLSMinVersion is the default minimum version of TLS accepted
+const DefaultTLSMinVersion = "1.2"
+
+// DefaultTLSReloadInterval is the default interval between two checks of the certificate files
+const DefaultTLSReloadInterval = 10 * time.Second
+
+const (
+	// RequireClientAuth requires a valid client certificate
+	RequireClientAuth = "require"
+	// OptionalClientAuth verifies the client certificate when one is given
+	OptionalClientAuth = "optional"
+)
@@ -32,3 +32,35 @@ var StickPositions = []string{
 	BottomRight,
 	BottomLeft,
 }
+
+const (
+	Center    = "center"
+	North     = "north"
+	South     = "south"
+	East      = "east"
+	West      = "west"
+	NorthEast = "north-east"
+	NorthWest = "north-west"
+	SouthEast = "south-east"
+	SouthWest = "south-west"
+)
+
+var Gravities = []string{
+	Center,
+	North,
+	South,
+	East,
+	West,
+	NorthEast,
+	NorthWest,
+	SouthEast,
+	SouthWest,
+}
+
+// SmartCrop is the crop mode keeping the most interesting region of an image
+const SmartCrop = "smart"
+
+var CropModes = []string{
+	Center,
+	SmartCrop,
+}
@@ -3,5 +3,23 @@ package constants
 const (
 	ForceParamName     = "force"
 	SigParamName       = "sig"
+	KeyIDParamName     = "kid"
+	ExpiresParamName   = "expires"
 	OperationParamName = "op"
+	FormatParamName    = "fmt"
+	AcceptParamName    = "accept"
+)
+
+// AutoFormat is the value of the format parameter which negotiates
+// the output format with the Accept header of the request
+const AutoFormat = "auto"
+
+// Keys of the image metadata set in the request context for the access log
+const (
+	CacheContextKey      = "cache"
+	SourceSizeContextKey = "source_size"
+	OutputSizeContextKey = "output_size"
+	FormatContextKey     = "format"
+	BackendContextKey    = "backend"
+	KeyIDContextKey      = "key_id"
 )
@@ -1,6 +1,8 @@
 package backend
 
 import (
+	"context"
+
 	"github.com/disintegration/imaging"
 	"github.com/pkg/errors"
 	"github.com/thoas/picfit/image"
@@ -9,6 +11,10 @@ import (
 // MethodNotImplementedError is an error returned if method is not implemented
 var MethodNotImplementedError = errors.New("Not implemented")
 
+// WEBP is the WebP output format, imaging does not provide one so its value
+// is kept far from the formats of imaging, it is only handled when encoding
+const WEBP = imaging.Format(1 << 16)
+
 // Options is the engine options
 type Options struct {
 	Upscale  bool
@@ -16,23 +22,39 @@ type Options struct {
 	Quality  int
 	Width    int
 	Height   int
+	X        int
+	Y        int
+	Gravity  string
+	Crop     string
 	Position string
 	Stick    string
 	Color    string
 	Degree   int
 	Images   []image.ImageFile
 	Sigma    float64
+	Text     string
+	Opacity  int
+	Padding  int
+	Scale    int
+	Tile     bool
+
+	// AutoOrient applies the EXIF orientation of an uploaded image and
+	// Normalize encodes it again even if it is not resized
+	AutoOrient bool
+	Normalize  bool
 }
 
 // Engine is an interface to define an image engine
 type Backend interface {
 	String() string
-	Resize(img *image.ImageFile, options *Options) ([]byte, error)
-	UploadResize(img *image.ImageFile, options *Options) ([]byte, int, int, error)
-	Thumbnail(img *image.ImageFile, options *Options) ([]byte, error)
-	Flip(img *image.ImageFile, options *Options) ([]byte, error)
-	Rotate(img *image.ImageFile, options *Options) ([]byte, error)
-	Fit(img *image.ImageFile, options *Options) ([]byte, error)
-	Flat(background *image.ImageFile, options *Options) ([]byte, error)
-	Blur(background *image.ImageFile, options *Options) ([]byte, error)
+	Resize(ctx context.Context, img *image.ImageFile, options *Options) ([]byte, error)
+	UploadResize(ctx context.Context, img *image.ImageFile, options *Options) ([]byte, int, int, error)
+	Thumbnail(ctx context.Context, img *image.ImageFile, options *Options) ([]byte, error)
+	Flip(ctx context.Context, img *image.ImageFile, options *Options) ([]byte, error)
+	Rotate(ctx context.Context, img *image.ImageFile, options *Options) ([]byte, error)
+	Fit(ctx context.Context, img *image.ImageFile, options *Options) ([]byte, error)
+	Flat(ctx context.Context, background *image.ImageFile, options *Options) ([]byte, error)
+	Blur(ctx context.Context, background *image.ImageFile, options *Options) ([]byte, error)
+	Crop(ctx context.Context, img *image.ImageFile, options *Options) ([]byte, error)
+	Watermark(ctx context.Context, img *image.ImageFile, options *Options) ([]byte, error)
 }
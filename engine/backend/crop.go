@@ -0,0 +1,64 @@
+package backend
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/thoas/picfit/constants"
+)
+
+// cropRectangle returns the region to keep from an image of the given size.
+// When a gravity is set, a Width x Height window is anchored on it,
+// otherwise the explicit X, Y, Width, Height rectangle is used.
+// A zero Width or Height extends the region to the image edge.
+func cropRectangle(width int, height int, options *Options) (image.Rectangle, error) {
+	bounds := image.Rect(0, 0, width, height)
+
+	w, h := options.Width, options.Height
+
+	if options.Gravity == "" {
+		if w == 0 {
+			w = width - options.X
+		}
+		if h == 0 {
+			h = height - options.Y
+		}
+
+		rect := image.Rect(options.X, options.Y, options.X+w, options.Y+h).Intersect(bounds)
+		if rect.Empty() {
+			return image.Rectangle{}, fmt.Errorf("Crop rectangle %dx%d+%d+%d is outside of the image (%dx%d)",
+				w, h, options.X, options.Y, width, height)
+		}
+
+		return rect, nil
+	}
+
+	if w == 0 || w > width {
+		w = width
+	}
+	if h == 0 || h > height {
+		h = height
+	}
+
+	var x, y int
+
+	switch options.Gravity {
+	case constants.NorthWest, constants.West, constants.SouthWest:
+		x = 0
+	case constants.NorthEast, constants.East, constants.SouthEast:
+		x = width - w
+	default:
+		x = (width - w) / 2
+	}
+
+	switch options.Gravity {
+	case constants.NorthWest, constants.North, constants.NorthEast:
+		y = 0
+	case constants.SouthWest, constants.South, constants.SouthEast:
+		y = height - h
+	default:
+		y = (height - h) / 2
+	}
+
+	return image.Rect(x, y, x+w, y+h), nil
+}
@@ -2,12 +2,13 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"image/gif"
-	"math"
 	"os/exec"
 
+	"github.com/thoas/picfit/constants"
 	"github.com/thoas/picfit/image"
 )
 
@@ -21,28 +22,65 @@ func (b *Gifsicle) String() string {
 }
 
 // Fit implements Backend.
-func (b *Gifsicle) Fit(*image.ImageFile, *Options) ([]byte, error) {
+func (b *Gifsicle) Fit(context.Context, *image.ImageFile, *Options) ([]byte, error) {
 	return nil, MethodNotImplementedError
 }
 
 // Flat implements Backend.
-func (b *Gifsicle) Flat(*image.ImageFile, *Options) ([]byte, error) {
+func (b *Gifsicle) Flat(context.Context, *image.ImageFile, *Options) ([]byte, error) {
 	return nil, MethodNotImplementedError
 }
 
 // Flip implements Backend.
-func (b *Gifsicle) Flip(*image.ImageFile, *Options) ([]byte, error) {
+func (b *Gifsicle) Flip(context.Context, *image.ImageFile, *Options) ([]byte, error) {
 	return nil, MethodNotImplementedError
 }
 
 // Blur implements Backend.
-func (b *Gifsicle) Blur(*image.ImageFile, *Options) ([]byte, error) {
+func (b *Gifsicle) Blur(context.Context, *image.ImageFile, *Options) ([]byte, error) {
 	return nil, MethodNotImplementedError
 }
 
+// Crop implements Backend.
+func (b *Gifsicle) Crop(ctx context.Context, imgfile *image.ImageFile, opts *Options) ([]byte, error) {
+	cfg, err := gif.DecodeConfig(bytes.NewReader(imgfile.Source))
+	if err != nil {
+		return nil, err
+	}
+
+	rect, err := cropRectangle(cfg.Width, cfg.Height, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, b.Path,
+		"--crop", fmt.Sprintf("%d,%d+%dx%d", rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy()),
+	)
+	cmd.Stdin = bytes.NewReader(imgfile.Source)
+	stdout := new(bytes.Buffer)
+	cmd.Stdout = stdout
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+
+	var target *exec.ExitError
+	if err := cmd.Run(); ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if errors.As(err, &target) && target.Exited() {
+		return nil, errors.New(stderr.String())
+	} else if err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// Watermark implements Backend, the frames are drawn in pure Go.
+func (b *Gifsicle) Watermark(ctx context.Context, imgfile *image.ImageFile, opts *Options) ([]byte, error) {
+	return (&GoImage{}).Watermark(ctx, imgfile, opts)
+}
+
 // Resize implements Backend.
-func (b *Gifsicle) Resize(imgfile *image.ImageFile, opts *Options) ([]byte, error) {
-	cmd := exec.Command(b.Path,
+func (b *Gifsicle) Resize(ctx context.Context, imgfile *image.ImageFile, opts *Options) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, b.Path,
 		"--resize", fmt.Sprintf("%dx%d", opts.Width, opts.Height),
 	)
 	cmd.Stdin = bytes.NewReader(imgfile.Source)
@@ -52,7 +90,9 @@ func (b *Gifsicle) Resize(imgfile *image.ImageFile, opts *Options) ([]byte, erro
 	cmd.Stderr = stderr
 
 	var target *exec.ExitError
-	if err := cmd.Run(); errors.As(err, &target) && target.Exited() {
+	if err := cmd.Run(); ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if errors.As(err, &target) && target.Exited() {
 		return nil, errors.New(stderr.String())
 	} else if err != nil {
 		return nil, err
@@ -61,19 +101,18 @@ func (b *Gifsicle) Resize(imgfile *image.ImageFile, opts *Options) ([]byte, erro
 }
 
 // UploadResize implements Backend.
-func (b *Gifsicle) UploadResize(imgfile *image.ImageFile, opts *Options) ([]byte, int, int, error) {
+func (b *Gifsicle) UploadResize(ctx context.Context, imgfile *image.ImageFile, opts *Options) ([]byte, int, int, error) {
 	img, err := gif.Decode(bytes.NewReader(imgfile.Source))
 	if err != nil {
 		return nil, 0, 0, err
 	}
 	bounds := img.Bounds()
-	if float64(bounds.Dx()) == math.Max(float64(bounds.Dx()), float64(bounds.Dy())) {
-		opts.Width = 2000
-	} else {
-		opts.Height = 2000
+	width, height := uploadSize(bounds.Dx(), bounds.Dy(), opts)
+	if width == bounds.Dx() && height == bounds.Dy() && !opts.Normalize {
+		return imgfile.Source, width, height, nil
 	}
-	cmd := exec.Command(b.Path,
-		"--resize", fmt.Sprintf("%dx%d", opts.Width, opts.Height),
+	cmd := exec.CommandContext(ctx, b.Path,
+		"--resize", fmt.Sprintf("%dx%d", width, height),
 	)
 	cmd.Stdin = bytes.NewReader(imgfile.Source)
 	stdout := new(bytes.Buffer)
@@ -82,7 +121,9 @@ func (b *Gifsicle) UploadResize(imgfile *image.ImageFile, opts *Options) ([]byte
 	cmd.Stderr = stderr
 
 	var target *exec.ExitError
-	if err := cmd.Run(); errors.As(err, &target) && target.Exited() {
+	if err := cmd.Run(); ctx.Err() != nil {
+		return nil, 0, 0, ctx.Err()
+	} else if errors.As(err, &target) && target.Exited() {
 		return nil, 0, 0, errors.New(stderr.String())
 	} else if err != nil {
 		return nil, 0, 0, err
@@ -95,20 +136,24 @@ func (b *Gifsicle) UploadResize(imgfile *image.ImageFile, opts *Options) ([]byte
 }
 
 // Rotate implements Backend.
-func (b *Gifsicle) Rotate(*image.ImageFile, *Options) ([]byte, error) {
+func (b *Gifsicle) Rotate(context.Context, *image.ImageFile, *Options) ([]byte, error) {
 	return nil, MethodNotImplementedError
 }
 
 // Thumbnail implements Backend.
-func (b *Gifsicle) Thumbnail(imgfile *image.ImageFile, opts *Options) ([]byte, error) {
+func (b *Gifsicle) Thumbnail(ctx context.Context, imgfile *image.ImageFile, opts *Options) ([]byte, error) {
 	img, err := gif.Decode(bytes.NewReader(imgfile.Source))
 	if err != nil {
 		return nil, err
 	}
 	bounds := img.Bounds()
 	left, top, cropw, croph := computecrop(bounds.Dx(), bounds.Dy(), opts.Width, opts.Height)
+	if opts.Crop == constants.SmartCrop {
+		rect := smartCrop(img, opts.Width, opts.Height)
+		left, top, cropw, croph = rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy()
+	}
 
-	cmd := exec.Command(b.Path,
+	cmd := exec.CommandContext(ctx, b.Path,
 		"--crop", fmt.Sprintf("%d,%d+%dx%d", left, top, cropw, croph),
 		"--resize", fmt.Sprintf("%dx%d", opts.Width, opts.Height),
 	)
@@ -119,7 +164,9 @@ func (b *Gifsicle) Thumbnail(imgfile *image.ImageFile, opts *Options) ([]byte, e
 	cmd.Stderr = stderr
 
 	var target *exec.ExitError
-	if err := cmd.Run(); errors.As(err, &target) && target.Exited() {
+	if err := cmd.Run(); ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if errors.As(err, &target) && target.Exited() {
 		return nil, errors.New(stderr.String())
 	} else if err != nil {
 		return nil, err
@@ -2,8 +2,10 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
+	"image/color"
 	"image/color/palette"
 	"image/draw"
 	"image/gif"
@@ -14,6 +16,8 @@ import (
 
 	"github.com/disintegration/imaging"
 
+	"github.com/thoas/picfit/constants"
+	"github.com/thoas/picfit/engine/backend/webp"
 	imagefile "github.com/thoas/picfit/image"
 
 	"golang.org/x/image/bmp"
@@ -61,16 +65,6 @@ func scale(img image.Image, options *Options, trans Transformation) image.Image
 	return img
 }
 
-func maxResizeOptions(img image.Image, options *Options) *Options {
-	width, height := imageSize(img)
-	if float64(width) == math.Max(float64(width), float64(height)) {
-		options.Width = 2000
-	} else {
-		options.Height = 2000
-	}
-	return options
-}
-
 func imageToPaletted(img image.Image) *image.Paletted {
 	b := img.Bounds()
 	pm := image.NewPaletted(b, palette.Plan9)
@@ -82,7 +76,7 @@ func (e *GoImage) String() string {
 	return "goimage"
 }
 
-func (e *GoImage) engGIF(first image.Image, img *imagefile.ImageFile, options *Options, trans Transformation) ([]byte, int, int, error) {
+func (e *GoImage) engGIF(ctx context.Context, first image.Image, img *imagefile.ImageFile, options *Options, trans Transformation) ([]byte, int, int, error) {
 	factor := scalingFactorImage(first, options.Width, options.Height)
 
 	srcW, srcH := imageSize(first)
@@ -96,14 +90,11 @@ func (e *GoImage) engGIF(first image.Image, img *imagefile.ImageFile, options *O
 		return nil, 0, 0, err
 	}
 
-	firstFrame := g.Image[0].Bounds()
-	b := image.Rect(0, 0, firstFrame.Dx(), firstFrame.Dy())
-	im := image.NewRGBA(b)
-
-	for i, frame := range g.Image {
-		bounds := frame.Bounds()
-		draw.Draw(im, bounds, frame, bounds.Min, draw.Over)
-		g.Image[i] = imageToPaletted(scale(im, options, trans))
+	err = transformFrames(ctx, g, func(im image.Image) image.Image {
+		return scale(im, options, trans)
+	})
+	if err != nil {
+		return nil, 0, 0, err
 	}
 
 	if options.Width == 0 {
@@ -128,18 +119,39 @@ func (e *GoImage) engGIF(first image.Image, img *imagefile.ImageFile, options *O
 	return buf.Bytes(), options.Width, options.Height, nil
 }
 
-func (e *GoImage) TransformGIF(img *imagefile.ImageFile, options *Options, trans Transformation) ([]byte, int, int, error) {
+// transformFrames draws each frame of the GIF over the previous ones and
+// replaces it with the paletted result of the given function, it stops
+// with the error of ctx once ctx is done.
+func transformFrames(ctx context.Context, g *gif.GIF, fn func(image.Image) image.Image) error {
+	firstFrame := g.Image[0].Bounds()
+	b := image.Rect(0, 0, firstFrame.Dx(), firstFrame.Dy())
+	im := image.NewRGBA(b)
+
+	for i, frame := range g.Image {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		bounds := frame.Bounds()
+		draw.Draw(im, bounds, frame, bounds.Min, draw.Over)
+		g.Image[i] = imageToPaletted(fn(im))
+	}
+
+	return nil
+}
+
+func (e *GoImage) TransformGIF(ctx context.Context, img *imagefile.ImageFile, options *Options, trans Transformation) ([]byte, int, int, error) {
 	first, err := gif.Decode(bytes.NewReader(img.Source))
 	if err != nil {
 		return nil, 0, 0, err
 	}
 
-	return e.engGIF(first, img, options, trans)
+	return e.engGIF(ctx, first, img, options, trans)
 }
 
-func (e *GoImage) Resize(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *GoImage) Resize(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	if options.Format == imaging.GIF {
-		content, _, _, err := e.TransformGIF(img, options, imaging.Resize)
+		content, _, _, err := e.TransformGIF(ctx, img, options, imaging.Resize)
 		if err != nil {
 			return nil, err
 		}
@@ -155,37 +167,63 @@ func (e *GoImage) Resize(img *imagefile.ImageFile, options *Options) ([]byte, er
 	return e.transform(image, options, imaging.Resize)
 }
 
-func (e *GoImage) UploadResize(img *imagefile.ImageFile, options *Options) ([]byte, int, int, error) {
-
-	out := img.Source
-
-	if options.Format == imaging.GIF {
+// UploadResize fits an uploaded image in the width and height of options,
+// it is only encoded again when it is resized or normalized
+func (e *GoImage) UploadResize(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, int, int, error) {
+	if options.Format == imaging.GIF && bytes.HasPrefix(img.Source, []byte("GIF8")) {
 		first, err := gif.Decode(bytes.NewReader(img.Source))
 		if err != nil {
 			return nil, 0, 0, err
 		}
 
-		return e.engGIF(first, img, maxResizeOptions(first, options), imaging.Resize)
+		width, height := imageSize(first)
+		options.Width, options.Height = uploadSize(width, height, options)
+		if options.Width == width && options.Height == height && !options.Normalize {
+			return img.Source, width, height, nil
+		}
+
+		// the frames are always transformed once the size is computed
+		options.Upscale = true
+
+		return e.engGIF(ctx, first, img, options, imaging.Resize)
 	}
 
-	image, err := e.Source(img)
+	src, err := e.uploadSource(img, options.AutoOrient)
 	if err != nil {
 		return nil, 0, 0, err
 	}
 
-	imageOut := scale(image, maxResizeOptions(image, options), imaging.Resize)
-	width, height := imageSize(imageOut)
+	width, height := imageSize(src)
+	w, h := uploadSize(width, height, options)
+	if w == width && h == height && !uploadEncoded(img, options) {
+		return img.Source, width, height, nil
+	}
 
-	if image.Bounds().Size() != imageOut.Bounds().Size() {
-		out, err = e.ToBytes(imageOut, options.Format, options.Quality)
-		if err != nil {
-			return nil, 0, 0, err
-		}
+	if w != width || h != height {
+		src = imaging.Resize(src, w, h, imaging.Lanczos)
+	}
+
+	// jpeg has no transparency, transparent pixels are white
+	if options.Format == imaging.JPEG {
+		src = imaging.Overlay(imaging.New(w, h, color.White), src, image.Point{}, 1.0)
+	}
+
+	out, err := e.ToBytes(src, options.Format, options.Quality)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return out, w, h, nil
+}
 
-		return out, width, height, nil
+// uploadSource decodes an uploaded image, its EXIF orientation is only
+// applied with autoOrient
+func (e *GoImage) uploadSource(img *imagefile.ImageFile, autoOrient bool) (image.Image, error) {
+	if autoOrient {
+		return e.Source(img)
 	}
 
-	return out, width, height, nil
+	return imaging.Decode(bytes.NewReader(img.Source))
 }
 
 func (e *GoImage) transform(img image.Image, options *Options, trans Transformation) ([]byte, error) {
@@ -196,7 +234,7 @@ func (e *GoImage) Source(img *imagefile.ImageFile) (image.Image, error) {
 	return decode(bytes.NewReader(img.Source))
 }
 
-func (e *GoImage) Rotate(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *GoImage) Rotate(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	image, err := e.Source(img)
 	if err != nil {
 		return nil, err
@@ -212,7 +250,7 @@ func (e *GoImage) Rotate(img *imagefile.ImageFile, options *Options) ([]byte, er
 	return e.ToBytes(transform(image), options.Format, options.Quality)
 }
 
-func (e *GoImage) Flip(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *GoImage) Flip(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	image, err := e.Source(img)
 	if err != nil {
 		return nil, err
@@ -228,7 +266,7 @@ func (e *GoImage) Flip(img *imagefile.ImageFile, options *Options) ([]byte, erro
 	return e.ToBytes(transform(image), options.Format, options.Quality)
 }
 
-func (e *GoImage) Blur(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *GoImage) Blur(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	image, err := e.Source(img)
 	if err != nil {
 		return nil, err
@@ -244,9 +282,14 @@ func (e *GoImage) Blur(img *imagefile.ImageFile, options *Options) ([]byte, erro
 	return e.ToBytes(imaging.Blur(image, sigma), options.Format, options.Quality)
 }
 
-func (e *GoImage) Thumbnail(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *GoImage) Thumbnail(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	if options.Format == imaging.GIF {
-		content, _, _, err := e.TransformGIF(img, options, imaging.Thumbnail)
+		first, err := gif.Decode(bytes.NewReader(img.Source))
+		if err != nil {
+			return nil, err
+		}
+
+		content, _, _, err := e.engGIF(ctx, first, img, options, thumbnailTransformation(first, options))
 		if err != nil {
 			return nil, err
 		}
@@ -259,12 +302,26 @@ func (e *GoImage) Thumbnail(img *imagefile.ImageFile, options *Options) ([]byte,
 		return nil, err
 	}
 
-	return e.transform(image, options, imaging.Thumbnail)
+	return e.transform(image, options, thumbnailTransformation(image, options))
 }
 
-func (e *GoImage) Fit(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+// thumbnailTransformation returns the thumbnail transformation of img, which
+// crops its center or, with the smart crop mode, its most interesting region
+func thumbnailTransformation(img image.Image, options *Options) Transformation {
+	if options.Crop != constants.SmartCrop {
+		return imaging.Thumbnail
+	}
+
+	rect := smartCrop(img, options.Width, options.Height)
+
+	return func(img image.Image, width int, height int, filter imaging.ResampleFilter) *image.NRGBA {
+		return imaging.Thumbnail(imaging.Crop(img, rect), width, height, filter)
+	}
+}
+
+func (e *GoImage) Fit(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	if options.Format == imaging.GIF {
-		content, _, _, err := e.TransformGIF(img, options, imaging.Thumbnail)
+		content, _, _, err := e.TransformGIF(ctx, img, options, imaging.Thumbnail)
 		if err != nil {
 			return nil, err
 		}
@@ -280,6 +337,59 @@ func (e *GoImage) Fit(img *imagefile.ImageFile, options *Options) ([]byte, error
 	return e.transform(image, options, imaging.Fit)
 }
 
+func (e *GoImage) Crop(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
+	if options.Format == imaging.GIF {
+		return e.cropGIF(ctx, img, options)
+	}
+
+	image, err := e.Source(img)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := imageSize(image)
+
+	rect, err := cropRectangle(width, height, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.ToBytes(imaging.Crop(image, rect), options.Format, options.Quality)
+}
+
+func (e *GoImage) cropGIF(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(img.Source))
+	if err != nil {
+		return nil, err
+	}
+
+	firstFrame := g.Image[0].Bounds()
+
+	rect, err := cropRectangle(firstFrame.Dx(), firstFrame.Dy(), options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = transformFrames(ctx, g, func(im image.Image) image.Image {
+		return imaging.Crop(im, rect)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	g.Config.Width = rect.Dx()
+	g.Config.Height = rect.Dy()
+
+	buf := bytes.Buffer{}
+
+	err = gif.EncodeAll(&buf, g)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
 func (e *GoImage) ToBytes(img image.Image, format imaging.Format, quality int) ([]byte, error) {
 	buf := &bytes.Buffer{}
 
@@ -321,6 +431,9 @@ func encode(w io.Writer, img image.Image, format imaging.Format, quality int) er
 		err = tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
 	case imaging.BMP:
 		err = bmp.Encode(w, img)
+	case WEBP:
+		// the highest quality is encoded losslessly
+		err = webp.Encode(w, img, &webp.Options{Lossless: quality >= 100, Quality: quality})
 	default:
 		err = imaging.ErrUnsupportedFormat
 	}
@@ -0,0 +1,55 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/gif"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+
+	imagefile "github.com/thoas/picfit/image"
+)
+
+func TestTransformFramesCanceled(t *testing.T) {
+	source, err := ioutil.ReadFile(path.Join("..", "..", "tests", "fixtures", "giphy.gif"))
+	assert.Nil(t, err)
+
+	g, err := gif.DecodeAll(bytes.NewReader(source))
+	assert.Nil(t, err)
+	assert.True(t, len(g.Image) > 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the context is canceled while the second frame is transformed
+	var frames int
+	err = transformFrames(ctx, g, func(img image.Image) image.Image {
+		frames++
+		if frames == 2 {
+			cancel()
+		}
+		return img
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 2, frames)
+}
+
+func TestGoImageCanceled(t *testing.T) {
+	source, err := ioutil.ReadFile(path.Join("..", "..", "tests", "fixtures", "giphy.gif"))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = (&GoImage{}).Resize(ctx, &imagefile.ImageFile{Source: source, Filepath: "giphy.gif"}, &Options{
+		Format: imaging.GIF,
+		Width:  50,
+		Height: 50,
+	})
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,380 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	colorful "github.com/lucasb-eyer/go-colorful"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+
+	"github.com/thoas/picfit/constants"
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// minTextSize is the smallest font size of a text watermark, in pixels
+const minTextSize = 12
+
+var (
+	watermarkFont     *sfnt.Font
+	watermarkFontErr  error
+	watermarkFontOnce sync.Once
+)
+
+// textFont returns the bundled TrueType font used to render text watermarks.
+func textFont() (*sfnt.Font, error) {
+	watermarkFontOnce.Do(func() {
+		watermarkFont, watermarkFontErr = sfnt.Parse(goregular.TTF)
+	})
+
+	return watermarkFont, watermarkFontErr
+}
+
+// Watermark draws a logo, the first image of the options, or a text over
+// the image, on every frame of animated GIFs.
+func (e *GoImage) Watermark(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
+	var logo image.Image
+	if len(options.Images) > 0 {
+		var err error
+		logo, err = e.Source(&options.Images[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.Format == imaging.GIF {
+		g, err := gif.DecodeAll(bytes.NewReader(img.Source))
+		if err != nil {
+			return nil, err
+		}
+
+		mark, err := watermarkImage(logo, g.Config.Width, g.Config.Height, options)
+		if err != nil {
+			return nil, err
+		}
+
+		err = transformFrames(ctx, g, func(im image.Image) image.Image {
+			dst := imaging.Clone(im)
+			drawWatermark(dst, mark, options)
+			return dst
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		buf := bytes.Buffer{}
+
+		err = gif.EncodeAll(&buf, g)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	source, err := e.Source(img)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := imaging.Clone(source)
+
+	mark, err := watermarkImage(logo, dst.Bounds().Dx(), dst.Bounds().Dy(), options)
+	if err != nil {
+		return nil, err
+	}
+
+	drawWatermark(dst, mark, options)
+
+	return e.ToBytes(dst, options.Format, options.Quality)
+}
+
+// watermarkImage returns the watermark to draw on an image of the given size,
+// scaled to the options scale percentage of its width without exceeding
+// its height minus the padding.
+func watermarkImage(logo image.Image, width int, height int, options *Options) (image.Image, error) {
+	maxHeight := math.Max(1, float64(height-2*options.Padding))
+
+	if logo != nil {
+		if options.Scale > 0 {
+			var (
+				size = logo.Bounds().Size()
+				w    = math.Max(1, float64(width*options.Scale)/100)
+				h    = w * float64(size.Y) / float64(size.X)
+			)
+
+			if h > maxHeight {
+				w = math.Max(1, w*maxHeight/h)
+				h = maxHeight
+			}
+
+			return imaging.Resize(logo, int(w), int(math.Max(1, h)), imaging.Lanczos), nil
+		}
+
+		return logo, nil
+	}
+
+	if options.Text == "" {
+		return nil, fmt.Errorf("Watermark needs a logo or a text")
+	}
+
+	f, err := textFont()
+	if err != nil {
+		return nil, err
+	}
+
+	size := math.Max(minTextSize, float64(height)/20)
+	if options.Scale > 0 {
+		// the text width is proportional to the font size
+		advance, err := textWidth(f, options.Text, size)
+		if err != nil {
+			return nil, err
+		}
+		if advance > 0 {
+			size = math.Max(1, size*float64(width*options.Scale)/100/advance)
+		}
+	}
+
+	// narrow texts scaled to the width would be taller than the image
+	lineHeight, err := textHeight(f, size)
+	if err != nil {
+		return nil, err
+	}
+	if lineHeight > maxHeight {
+		size = math.Max(1, size*maxHeight/lineHeight)
+	}
+
+	return renderText(f, options.Text, size, textColor(options.Color))
+}
+
+// textWidth returns the width in pixels of the text rendered at the given size.
+func textWidth(f *sfnt.Font, text string, size float64) (float64, error) {
+	var (
+		buf   sfnt.Buffer
+		ppem  = floatToFixed(size)
+		width fixed.Int26_6
+		prev  sfnt.GlyphIndex
+	)
+
+	for i, r := range text {
+		index, err := f.GlyphIndex(&buf, r)
+		if err != nil {
+			return 0, err
+		}
+
+		if i > 0 {
+			if kern, err := f.Kern(&buf, prev, index, ppem, font.HintingNone); err == nil {
+				width += kern
+			}
+		}
+
+		advance, err := f.GlyphAdvance(&buf, index, ppem, font.HintingNone)
+		if err != nil {
+			return 0, err
+		}
+
+		width += advance
+		prev = index
+	}
+
+	return fixedToFloat(width), nil
+}
+
+// textHeight returns the height in pixels of a line rendered at the given size.
+func textHeight(f *sfnt.Font, size float64) (float64, error) {
+	var buf sfnt.Buffer
+
+	metrics, err := f.Metrics(&buf, floatToFixed(size), font.HintingNone)
+	if err != nil {
+		return 0, err
+	}
+
+	return fixedToFloat(metrics.Ascent + metrics.Descent), nil
+}
+
+// renderText draws the text on a transparent image fitting it, the glyph
+// outlines of the font are rasterized as an alpha mask.
+func renderText(f *sfnt.Font, text string, size float64, c color.Color) (image.Image, error) {
+	var (
+		buf  sfnt.Buffer
+		ppem = floatToFixed(size)
+	)
+
+	metrics, err := f.Metrics(&buf, ppem, font.HintingNone)
+	if err != nil {
+		return nil, err
+	}
+
+	advance, err := textWidth(f, text, size)
+	if err != nil {
+		return nil, err
+	}
+
+	width := int(math.Ceil(advance))
+	height := (metrics.Ascent + metrics.Descent).Ceil()
+	if width < 1 || height < 1 {
+		return nil, fmt.Errorf("Watermark text %q cannot be rendered", text)
+	}
+
+	rasterizer := vector.NewRasterizer(width, height)
+	rasterizer.DrawOp = draw.Src
+
+	var (
+		dot  = fixed.Point26_6{Y: metrics.Ascent}
+		prev sfnt.GlyphIndex
+	)
+
+	for i, r := range text {
+		index, err := f.GlyphIndex(&buf, r)
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 {
+			if kern, err := f.Kern(&buf, prev, index, ppem, font.HintingNone); err == nil {
+				dot.X += kern
+			}
+		}
+
+		segments, err := f.LoadGlyph(&buf, index, ppem, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		point := func(p fixed.Point26_6) (float32, float32) {
+			return float32(fixedToFloat(dot.X + p.X)), float32(fixedToFloat(dot.Y + p.Y))
+		}
+
+		for _, segment := range segments {
+			switch segment.Op {
+			case sfnt.SegmentOpMoveTo:
+				rasterizer.MoveTo(point(segment.Args[0]))
+			case sfnt.SegmentOpLineTo:
+				rasterizer.LineTo(point(segment.Args[0]))
+			case sfnt.SegmentOpQuadTo:
+				x1, y1 := point(segment.Args[0])
+				x2, y2 := point(segment.Args[1])
+				rasterizer.QuadTo(x1, y1, x2, y2)
+			case sfnt.SegmentOpCubeTo:
+				x1, y1 := point(segment.Args[0])
+				x2, y2 := point(segment.Args[1])
+				x3, y3 := point(segment.Args[2])
+				rasterizer.CubeTo(x1, y1, x2, y2, x3, y3)
+			}
+		}
+		rasterizer.ClosePath()
+
+		advance, err := f.GlyphAdvance(&buf, index, ppem, font.HintingNone)
+		if err != nil {
+			return nil, err
+		}
+
+		dot.X += advance
+		prev = index
+	}
+
+	mask := image.NewAlpha(image.Rect(0, 0, width, height))
+	rasterizer.Draw(mask, mask.Bounds(), image.Opaque, image.ZP)
+
+	dst := image.NewNRGBA(mask.Bounds())
+	draw.DrawMask(dst, dst.Bounds(), image.NewUniform(c), image.ZP, mask, image.ZP, draw.Src)
+
+	return dst, nil
+}
+
+// textColor returns the color of a text watermark, white by default.
+func textColor(c string) color.Color {
+	if c == "" {
+		return color.White
+	}
+
+	col, err := colorful.Hex(fmt.Sprintf("#%s", c))
+	if err != nil {
+		return color.White
+	}
+
+	return col
+}
+
+// minTileSize is the minimum size in pixels a tile takes before its padding,
+// tiny watermarks are not drawn once per pixel of the image.
+const minTileSize = 16
+
+// drawWatermark draws the watermark over dst, anchored by the gravity of the
+// options or repeated on the whole image when tiled.
+func drawWatermark(dst draw.Image, mark image.Image, options *Options) {
+	var (
+		bounds = dst.Bounds()
+		size   = mark.Bounds().Size()
+		mask   = image.NewUniform(color.Alpha{uint8(options.Opacity * 255 / 100)})
+	)
+
+	paste := func(position image.Point) {
+		draw.DrawMask(dst, image.Rectangle{position, position.Add(size)},
+			mark, mark.Bounds().Min, mask, image.ZP, draw.Over)
+	}
+
+	if options.Tile {
+		step := size
+		if step.X < minTileSize {
+			step.X = minTileSize
+		}
+		if step.Y < minTileSize {
+			step.Y = minTileSize
+		}
+
+		for y := bounds.Min.Y + options.Padding; y < bounds.Max.Y; y += step.Y + options.Padding {
+			for x := bounds.Min.X + options.Padding; x < bounds.Max.X; x += step.X + options.Padding {
+				paste(image.Point{x, y})
+			}
+		}
+		return
+	}
+
+	paste(watermarkPosition(bounds, size, options.Gravity, options.Padding))
+}
+
+// watermarkPosition returns the top left corner of a watermark of the given
+// size anchored on the gravity, at padding pixels from the image edges.
+func watermarkPosition(bounds image.Rectangle, size image.Point, gravity string, padding int) image.Point {
+	var x, y int
+
+	switch gravity {
+	case constants.NorthWest, constants.West, constants.SouthWest:
+		x = bounds.Min.X + padding
+	case constants.NorthEast, constants.East, constants.SouthEast:
+		x = bounds.Max.X - size.X - padding
+	default:
+		x = bounds.Min.X + (bounds.Dx()-size.X)/2
+	}
+
+	switch gravity {
+	case constants.NorthWest, constants.North, constants.NorthEast:
+		y = bounds.Min.Y + padding
+	case constants.SouthWest, constants.South, constants.SouthEast:
+		y = bounds.Max.Y - size.Y - padding
+	default:
+		y = bounds.Min.Y + (bounds.Dy()-size.Y)/2
+	}
+
+	return image.Point{x, y}
+}
+
+func fixedToFloat(v fixed.Int26_6) float64 {
+	return float64(v) / 64
+}
+
+func floatToFixed(v float64) fixed.Int26_6 {
+	return fixed.Int26_6(v * 64)
+}
@@ -0,0 +1,210 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thoas/picfit/constants"
+	imagefile "github.com/thoas/picfit/image"
+)
+
+func uniformPNG(t *testing.T, width int, height int, c color.Color) *imagefile.ImageFile {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, png.Encode(buf, imaging.New(width, height, c)))
+
+	return &imagefile.ImageFile{Source: buf.Bytes(), Filepath: "image.png"}
+}
+
+// changed returns the bounds of the pixels which differ between a and b.
+func changed(a image.Image, b image.Image) image.Rectangle {
+	var r image.Rectangle
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			if color.NRGBAModel.Convert(a.At(x, y)) != color.NRGBAModel.Convert(b.At(x, y)) {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+func TestWatermarkText(t *testing.T) {
+	source := uniformPNG(t, 200, 100, color.Black)
+	original, _ := decode(bytes.NewReader(source.Source))
+
+	content, err := (&GoImage{}).Watermark(context.Background(), source, &Options{
+		Format:  imaging.PNG,
+		Text:    "picfit",
+		Opacity: 100,
+		Padding: 5,
+		Gravity: constants.SouthEast,
+	})
+	assert.Nil(t, err)
+
+	img, err := decode(bytes.NewReader(content))
+	assert.Nil(t, err)
+	assert.Equal(t, original.Bounds(), img.Bounds())
+
+	r := changed(original, img)
+	assert.False(t, r.Empty())
+	assert.True(t, r.Min.X > 100 && r.Min.Y > 50, "%v is not in the bottom right corner", r)
+	assert.True(t, r.Max.X <= 195 && r.Max.Y <= 95, "%v is in the padding", r)
+
+	// the text scales with the image
+	content, err = (&GoImage{}).Watermark(context.Background(), source, &Options{
+		Format:  imaging.PNG,
+		Text:    "picfit",
+		Opacity: 100,
+		Scale:   80,
+		Gravity: constants.Center,
+	})
+	assert.Nil(t, err)
+
+	img, _ = decode(bytes.NewReader(content))
+	r = changed(original, img)
+	assert.True(t, r.Dx() > 120 && r.Dx() <= 160, "%v is not 80%% of the width", r)
+
+	// a transparent watermark does not change the image
+	content, err = (&GoImage{}).Watermark(context.Background(), source, &Options{
+		Format:  imaging.PNG,
+		Text:    "picfit",
+		Opacity: 0,
+	})
+	assert.Nil(t, err)
+
+	img, _ = decode(bytes.NewReader(content))
+	assert.True(t, changed(original, img).Empty())
+}
+
+func TestWatermarkLogo(t *testing.T) {
+	source := uniformPNG(t, 100, 100, color.White)
+	original, _ := decode(bytes.NewReader(source.Source))
+
+	logo := uniformPNG(t, 10, 10, color.NRGBA{255, 0, 0, 255})
+
+	for _, test := range []struct {
+		gravity string
+		rect    image.Rectangle
+	}{
+		{constants.NorthWest, image.Rect(2, 2, 12, 12)},
+		{constants.North, image.Rect(45, 2, 55, 12)},
+		{constants.NorthEast, image.Rect(88, 2, 98, 12)},
+		{constants.West, image.Rect(2, 45, 12, 55)},
+		{constants.Center, image.Rect(45, 45, 55, 55)},
+		{constants.East, image.Rect(88, 45, 98, 55)},
+		{constants.SouthWest, image.Rect(2, 88, 12, 98)},
+		{constants.South, image.Rect(45, 88, 55, 98)},
+		{constants.SouthEast, image.Rect(88, 88, 98, 98)},
+	} {
+		content, err := (&GoImage{}).Watermark(context.Background(), source, &Options{
+			Format:  imaging.PNG,
+			Images:  []imagefile.ImageFile{*logo},
+			Opacity: 50,
+			Padding: 2,
+			Gravity: test.gravity,
+		})
+		assert.Nil(t, err)
+
+		img, _ := decode(bytes.NewReader(content))
+		assert.Equal(t, test.rect, changed(original, img), test.gravity)
+
+		// half transparent red over white
+		c := color.NRGBAModel.Convert(img.At(test.rect.Min.X, test.rect.Min.Y)).(color.NRGBA)
+		assert.Equal(t, uint8(255), c.R)
+		assert.InDelta(t, 128, int(c.G), 2)
+	}
+
+	// tiles are separated by the padding
+	content, err := (&GoImage{}).Watermark(context.Background(), source, &Options{
+		Format:  imaging.PNG,
+		Images:  []imagefile.ImageFile{*logo},
+		Opacity: 100,
+		Padding: 10,
+		Scale:   20,
+		Tile:    true,
+	})
+	assert.Nil(t, err)
+
+	img, _ := decode(bytes.NewReader(content))
+	for _, p := range []image.Point{{10, 10}, {29, 29}, {40, 40}, {70, 10}, {89, 89}} {
+		assert.Equal(t, color.NRGBA{255, 0, 0, 255}, color.NRGBAModel.Convert(img.At(p.X, p.Y)), "%v", p)
+	}
+	for _, p := range []image.Point{{5, 5}, {35, 35}, {15, 35}, {95, 95}} {
+		assert.Equal(t, color.NRGBA{255, 255, 255, 255}, color.NRGBAModel.Convert(img.At(p.X, p.Y)), "%v", p)
+	}
+
+	// tiny tiles are spaced by their minimum size
+	content, err = (&GoImage{}).Watermark(context.Background(), source, &Options{
+		Format:  imaging.PNG,
+		Images:  []imagefile.ImageFile{*uniformPNG(t, 1, 1, color.NRGBA{255, 0, 0, 255})},
+		Opacity: 100,
+		Tile:    true,
+	})
+	assert.Nil(t, err)
+
+	img, _ = decode(bytes.NewReader(content))
+	for _, p := range []image.Point{{0, 0}, {16, 0}, {0, 16}, {96, 96}} {
+		assert.Equal(t, color.NRGBA{255, 0, 0, 255}, color.NRGBAModel.Convert(img.At(p.X, p.Y)), "%v", p)
+	}
+	for _, p := range []image.Point{{1, 0}, {8, 8}, {15, 15}, {17, 16}} {
+		assert.Equal(t, color.NRGBA{255, 255, 255, 255}, color.NRGBAModel.Convert(img.At(p.X, p.Y)), "%v", p)
+	}
+}
+
+func TestWatermarkImageHeight(t *testing.T) {
+	// a narrow text scaled to the width of a wide image
+	mark, err := watermarkImage(nil, 4000, 100, &Options{Text: "|", Scale: 100, Padding: 10})
+	assert.Nil(t, err)
+	assert.True(t, mark.Bounds().Dy() <= 81, "%v is taller than the image", mark.Bounds())
+
+	// a tall logo scaled to the width of a wide image
+	logo, _ := decode(bytes.NewReader(uniformPNG(t, 10, 100, color.Black).Source))
+	mark, err = watermarkImage(logo, 1000, 100, &Options{Scale: 50, Padding: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 8, 80), mark.Bounds())
+}
+
+func TestWatermarkGIF(t *testing.T) {
+	source, err := ioutil.ReadFile(path.Join("..", "..", "tests", "fixtures", "giphy.gif"))
+	assert.Nil(t, err)
+
+	content, err := (&GoImage{}).Watermark(context.Background(), &imagefile.ImageFile{Source: source, Filepath: "giphy.gif"}, &Options{
+		Format:  imaging.GIF,
+		Text:    "picfit",
+		Color:   "ff0000",
+		Opacity: 100,
+		Gravity: constants.NorthWest,
+	})
+	assert.Nil(t, err)
+
+	original, err := gif.DecodeAll(bytes.NewReader(source))
+	assert.Nil(t, err)
+
+	g, err := gif.DecodeAll(bytes.NewReader(content))
+	assert.Nil(t, err)
+	assert.Equal(t, len(original.Image), len(g.Image))
+
+	// every frame holds the red text
+	for i := range g.Image {
+		var red int
+		for y := 0; y < 20; y++ {
+			for x := 0; x < 60; x++ {
+				c := color.NRGBAModel.Convert(g.Image[i].At(x, y)).(color.NRGBA)
+				if c.R > 200 && c.G < 80 && c.B < 80 {
+					red++
+				}
+			}
+		}
+		assert.True(t, red > 20, "frame %d", i)
+	}
+}
@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/discordapp/lilliput"
+)
+
+// Header is the size of an image read without decoding its pixels
+type Header struct {
+	Width  int
+	Height int
+	Frames int
+}
+
+// DecodeHeader reads the header of an image, formats unknown to the
+// image package are read by lilliput, frames are only counted for GIF images
+func DecodeHeader(source []byte) (*Header, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(source))
+	if err == image.ErrFormat {
+		return decodeLilliputHeader(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := &Header{
+		Width:  cfg.Width,
+		Height: cfg.Height,
+		Frames: 1,
+	}
+
+	if format == "gif" {
+		header.Frames, err = gifFrames(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return header, nil
+}
+
+func decodeLilliputHeader(source []byte) (*Header, error) {
+	decoder, err := lilliput.NewDecoder(source)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	header, err := decoder.Header()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Header{
+		Width:  header.Width(),
+		Height: header.Height(),
+		Frames: 1,
+	}, nil
+}
+
+// gifFrames counts the frames of a GIF image by skipping its data blocks
+func gifFrames(source []byte) (int, error) {
+	r := bytes.NewReader(source)
+
+	// header and logical screen descriptor
+	var screen [13]byte
+	if _, err := io.ReadFull(r, screen[:]); err != nil {
+		return 0, err
+	}
+	skipColorTable(r, screen[10])
+
+	var frames int
+	for {
+		block, err := r.ReadByte()
+		if err == io.EOF {
+			// the trailer is missing
+			return frames, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch block {
+		case 0x21: // extension
+			if _, err := r.ReadByte(); err != nil {
+				return frames, nil
+			}
+			skipSubBlocks(r)
+		case 0x2C: // image descriptor
+			frames++
+
+			var descriptor [9]byte
+			if _, err := io.ReadFull(r, descriptor[:]); err != nil {
+				return frames, nil
+			}
+			skipColorTable(r, descriptor[8])
+
+			// LZW minimum code size
+			if _, err := r.ReadByte(); err != nil {
+				return frames, nil
+			}
+			skipSubBlocks(r)
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("gif: unknown block type: 0x%.2x", block)
+		}
+	}
+}
+
+func skipColorTable(r *bytes.Reader, flags byte) {
+	if flags&0x80 != 0 {
+		r.Seek(int64(3*(1<<(flags&0x07+1))), io.SeekCurrent)
+	}
+}
+
+func skipSubBlocks(r *bytes.Reader) {
+	for {
+		size, err := r.ReadByte()
+		if err != nil || size == 0 {
+			return
+		}
+		r.Seek(int64(size), io.SeekCurrent)
+	}
+}
@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeHeader(t *testing.T) {
+	for _, filename := range []string{"avatar.png", "schwarzy.jpg"} {
+		source, err := ioutil.ReadFile(path.Join("..", "..", "tests", "fixtures", filename))
+		assert.Nil(t, err)
+
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(source))
+		assert.Nil(t, err)
+
+		header, err := DecodeHeader(source)
+		assert.Nil(t, err, filename)
+		assert.Equal(t, Header{Width: cfg.Width, Height: cfg.Height, Frames: 1}, *header, filename)
+	}
+
+	_, err := DecodeHeader([]byte("not an image"))
+	assert.NotNil(t, err)
+}
+
+func TestDecodeHeaderGIF(t *testing.T) {
+	source, err := ioutil.ReadFile(path.Join("..", "..", "tests", "fixtures", "giphy.gif"))
+	assert.Nil(t, err)
+
+	g, err := gif.DecodeAll(bytes.NewReader(source))
+	assert.Nil(t, err)
+
+	header, err := DecodeHeader(source)
+	assert.Nil(t, err)
+	assert.Equal(t, len(g.Image), header.Frames)
+	assert.Equal(t, g.Config.Width, header.Width)
+	assert.Equal(t, g.Config.Height, header.Height)
+}
+
+func TestDecodeHeaderBomb(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, png.Encode(buf, image.NewGray(image.Rect(0, 0, 1, 1))))
+
+	// the IHDR chunk claims 50000x50000 pixels
+	source := buf.Bytes()
+	binary.BigEndian.PutUint32(source[16:], 50000)
+	binary.BigEndian.PutUint32(source[20:], 50000)
+	binary.BigEndian.PutUint32(source[29:], crc32.ChecksumIEEE(source[12:29]))
+
+	header, err := DecodeHeader(source)
+	assert.Nil(t, err)
+	assert.Equal(t, Header{Width: 50000, Height: 50000, Frames: 1}, *header)
+}
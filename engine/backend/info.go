@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Info describes an image read without decoding its pixels
+type Info struct {
+	Width       int    `json:"w"`
+	Height      int    `json:"h"`
+	Size        int    `json:"size"`
+	Format      string `json:"format"`
+	ContentType string `json:"content_type"`
+	Frames      int    `json:"frames"`
+	Orientation int    `json:"orientation"`
+	ColorModel  string `json:"color_model"`
+	HasAlpha    bool   `json:"has_alpha"`
+}
+
+// colorModels are the names of the color models of the image package
+var colorModels = map[color.Model]string{
+	color.RGBAModel:    "rgba",
+	color.RGBA64Model:  "rgba64",
+	color.NRGBAModel:   "nrgba",
+	color.NRGBA64Model: "nrgba64",
+	color.AlphaModel:   "alpha",
+	color.Alpha16Model: "alpha16",
+	color.GrayModel:    "gray",
+	color.Gray16Model:  "gray16",
+	color.YCbCrModel:   "ycbcr",
+	color.NYCbCrAModel: "nycbcra",
+	color.CMYKModel:    "cmyk",
+}
+
+// DecodeInfo reads the information of an image from its header and its
+// EXIF metadata, formats unknown to the image package only report their
+// size, format and frames
+func DecodeInfo(source []byte) (*Info, error) {
+	header, err := DecodeHeader(source)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		Width:       header.Width,
+		Height:      header.Height,
+		Size:        len(source),
+		Frames:      header.Frames,
+		Orientation: 1,
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(source))
+	if err == nil {
+		info.Format = format
+		info.ColorModel, info.HasAlpha = describeColorModel(cfg.ColorModel)
+	} else {
+		info.Format = strings.TrimPrefix(http.DetectContentType(source), "image/")
+	}
+
+	info.ContentType = "image/" + info.Format
+
+	if orientation, err := strconv.Atoi(getOrientation(bytes.NewReader(source))); err == nil {
+		info.Orientation = orientation
+	}
+
+	return info, nil
+}
+
+// HasAlpha returns true if the color model of an image has transparency,
+// it is read from the header of the image without decoding it
+func HasAlpha(source []byte) bool {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		return false
+	}
+
+	_, alpha := describeColorModel(cfg.ColorModel)
+
+	return alpha
+}
+
+// describeColorModel returns the name of a color model and whether its
+// colors can be transparent
+func describeColorModel(model color.Model) (string, bool) {
+	if palette, ok := model.(color.Palette); ok {
+		for i := range palette {
+			if _, _, _, a := palette[i].RGBA(); a != 0xffff {
+				return "paletted", true
+			}
+		}
+
+		return "paletted", false
+	}
+
+	name, ok := colorModels[model]
+	if !ok {
+		return "unknown", false
+	}
+
+	// decoders only report non premultiplied models for transparent images
+	switch model {
+	case color.NRGBAModel, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model, color.NYCbCrAModel:
+		return name, true
+	}
+
+	return name, false
+}
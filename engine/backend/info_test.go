@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeInfo(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	img.Set(0, 0, color.NRGBA{R: 255, A: 128})
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, png.Encode(buf, img))
+
+	info, err := DecodeInfo(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, Info{
+		Width:       30,
+		Height:      20,
+		Size:        buf.Len(),
+		Format:      "png",
+		ContentType: "image/png",
+		Frames:      1,
+		Orientation: 1,
+		ColorModel:  "nrgba",
+		HasAlpha:    true,
+	}, *info)
+
+	source := orientedJPEG(t, 40, 20, 6)
+
+	info, err = DecodeInfo(source)
+	assert.Nil(t, err)
+	assert.Equal(t, Info{
+		Width:       40,
+		Height:      20,
+		Size:        len(source),
+		Format:      "jpeg",
+		ContentType: "image/jpeg",
+		Frames:      1,
+		Orientation: 6,
+		ColorModel:  "ycbcr",
+		HasAlpha:    false,
+	}, *info)
+
+	_, err = DecodeInfo([]byte("not an image"))
+	assert.NotNil(t, err)
+}
+
+func TestHasAlpha(t *testing.T) {
+	encode := func(img image.Image) []byte {
+		buf := &bytes.Buffer{}
+		assert.Nil(t, png.Encode(buf, img))
+
+		return buf.Bytes()
+	}
+
+	transparent := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	assert.True(t, HasAlpha(encode(transparent)))
+
+	opaque := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	for x := 0; x < 30; x++ {
+		for y := 0; y < 20; y++ {
+			opaque.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	assert.False(t, HasAlpha(encode(opaque)))
+
+	assert.False(t, HasAlpha([]byte("not an image")))
+}
@@ -2,11 +2,13 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"math"
 
 	"github.com/discordapp/lilliput"
 	"github.com/pkg/errors"
 
+	"github.com/thoas/picfit/constants"
 	"github.com/thoas/picfit/engine/config"
 	imagefile "github.com/thoas/picfit/image"
 )
@@ -56,7 +58,7 @@ func NewLilliput(cfg config.Config) *Lilliput {
 // Resize resizes the image to the specified width and height and
 // returns the transformed image. If one of width or height is 0,
 // the image aspect ratio is preserved.
-func (e *Lilliput) Resize(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *Lilliput) Resize(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	opts := &lilliput.ImageOptions{
 		FileType:             img.FilenameExt(),
 		Width:                options.Width,
@@ -66,10 +68,12 @@ func (e *Lilliput) Resize(img *imagefile.ImageFile, options *Options) ([]byte, e
 		EncodeOptions:        e.EncodeOptions,
 	}
 
-	return e.transform(img, opts, options.Upscale)
+	return e.transform(ctx, img, opts, options.Upscale)
 }
 
-func (e *Lilliput) UploadResize(img *imagefile.ImageFile, options *Options) ([]byte, int, int, error) {
+// UploadResize fits an uploaded image in the width and height of options,
+// it is only encoded again when it is resized or normalized
+func (e *Lilliput) UploadResize(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, int, int, error) {
 	decoder, err := lilliput.NewDecoder(img.Source)
 	if err != nil {
 		return nil, 0, 0, errors.WithStack(err)
@@ -81,35 +85,62 @@ func (e *Lilliput) UploadResize(img *imagefile.ImageFile, options *Options) ([]b
 		return nil, 0, 0, err
 	}
 
-	if float64(header.Width()) == math.Max(float64(header.Width()), float64(header.Height())) {
-		options.Width = 2000
-	} else {
-		options.Height = 2000
+	width, height := header.Width(), header.Height()
+	if options.AutoOrient {
+		same, err := sameInputAndOutputHeader(bytes.NewReader(img.Source))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		if !same {
+			width, height = height, width
+		}
+	}
+
+	w, h := uploadSize(width, height, options)
+	if w == width && h == height && !uploadEncoded(img, options) {
+		return img.Source, width, height, nil
+	}
+
+	encodeOptions := make(map[int]int, len(e.EncodeOptions))
+	for k, v := range e.EncodeOptions {
+		encodeOptions[k] = v
+	}
+
+	if options.Quality > 0 {
+		encodeOptions[lilliput.JpegQuality] = options.Quality
+		encodeOptions[lilliput.WebpQuality] = options.Quality
 	}
 
 	opts := &lilliput.ImageOptions{
 		FileType:             img.FilenameExt(),
-		Width:                options.Width,
-		Height:               options.Height,
-		NormalizeOrientation: true,
+		Width:                w,
+		Height:               h,
+		NormalizeOrientation: options.AutoOrient,
 		ResizeMethod:         lilliput.ImageOpsResize,
-		EncodeOptions:        e.EncodeOptions,
+		EncodeOptions:        encodeOptions,
 	}
 
-	return e.engTransform(decoder, img, opts, options.Upscale)
+	// the image is always transformed once the size is computed
+	return e.engTransform(ctx, decoder, img, opts, true)
 }
 
-func (e *Lilliput) Rotate(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *Lilliput) Rotate(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	return nil, MethodNotImplementedError
 }
 
-func (e *Lilliput) Flip(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *Lilliput) Flip(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	return nil, MethodNotImplementedError
 }
 
 // Thumbnail scales the image up or down using the specified resample filter, crops it
 // to the specified width and hight and returns the transformed image.
-func (e *Lilliput) Thumbnail(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *Lilliput) Thumbnail(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
+	// lilliput only crops the center, the smart crop is done in pure Go
+	if options.Crop == constants.SmartCrop {
+		return (&GoImage{}).Thumbnail(ctx, img, options)
+	}
+
 	opts := &lilliput.ImageOptions{
 		FileType:             img.FilenameExt(),
 		Width:                options.Width,
@@ -120,25 +151,34 @@ func (e *Lilliput) Thumbnail(img *imagefile.ImageFile, options *Options) ([]byte
 		EncodeOptions: e.EncodeOptions,
 	}
 
-	return e.transform(img, opts, options.Upscale)
+	return e.transform(ctx, img, opts, options.Upscale)
+}
+
+func (e *Lilliput) Fit(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
+	return nil, MethodNotImplementedError
 }
 
-func (e *Lilliput) Fit(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *Lilliput) Blur(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	return nil, MethodNotImplementedError
 }
 
-func (e *Lilliput) Blur(img *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *Lilliput) Crop(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
 	return nil, MethodNotImplementedError
 }
 
-func (e *Lilliput) transform(img *imagefile.ImageFile, options *lilliput.ImageOptions, upscale bool) ([]byte, error) {
+// Watermark is done in pure Go, lilliput cannot draw over an image.
+func (e *Lilliput) Watermark(ctx context.Context, img *imagefile.ImageFile, options *Options) ([]byte, error) {
+	return (&GoImage{}).Watermark(ctx, img, options)
+}
+
+func (e *Lilliput) transform(ctx context.Context, img *imagefile.ImageFile, options *lilliput.ImageOptions, upscale bool) ([]byte, error) {
 	decoder, err := lilliput.NewDecoder(img.Source)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	defer decoder.Close()
 
-	out, _, _, err := e.engTransform(decoder, img, options, upscale)
+	out, _, _, err := e.engTransform(ctx, decoder, img, options, upscale)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -146,7 +186,7 @@ func (e *Lilliput) transform(img *imagefile.ImageFile, options *lilliput.ImageOp
 	return out, nil
 }
 
-func (e *Lilliput) engTransform(decoder lilliput.Decoder, img *imagefile.ImageFile, options *lilliput.ImageOptions, upscale bool) ([]byte, int, int, error) {
+func (e *Lilliput) engTransform(ctx context.Context, decoder lilliput.Decoder, img *imagefile.ImageFile, options *lilliput.ImageOptions, upscale bool) ([]byte, int, int, error) {
 	header, err := decoder.Header()
 	if err != nil {
 		return nil, 0, 0, err
@@ -183,6 +223,11 @@ func (e *Lilliput) engTransform(decoder lilliput.Decoder, img *imagefile.ImageFi
 		options.Height = int(math.Max(1.0, math.Floor(tmpH+0.5)))
 	}
 
+	// frames are transformed by lilliput at once, ctx is only checked before
+	if err := ctx.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
 	ops := lilliput.NewImageOps(e.MaxBufferSize)
 	defer ops.Close()
 
@@ -200,6 +245,6 @@ func (e *Lilliput) String() string {
 	return "lilliput"
 }
 
-func (e *Lilliput) Flat(background *imagefile.ImageFile, options *Options) ([]byte, error) {
+func (e *Lilliput) Flat(ctx context.Context, background *imagefile.ImageFile, options *Options) ([]byte, error) {
 	return nil, MethodNotImplementedError
 }
@@ -0,0 +1,245 @@
+package backend
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// smartCropAnalysisSize is the largest side of the image scored by smartCrop
+	smartCropAnalysisSize = 256
+
+	edgeWeight       = 0.2
+	skinWeight       = 1.8
+	saturationWeight = 0.1
+
+	// skin tones are close to this normalized RGB color
+	skinR, skinG, skinB = 0.78, 0.57, 0.44
+	skinThreshold       = 0.8
+	skinLumaMin         = 0.2
+
+	saturationThreshold = 0.4
+	saturationLumaMin   = 0.05
+	saturationLumaMax   = 0.9
+
+	// edgeFalloff lowers the weight of the content near the edges of a crop
+	edgeFalloff = 0.5
+	// centerBias lowers the weight of the content near the edges of the image
+	centerBias = 0.3
+)
+
+// smartCrop returns the region of img with the aspect ratio of width x height
+// which holds the most interesting content. Regions are scored by their edge
+// density, skin tones and saturated colors; between regions with the same
+// score, the closest to the center of the image wins.
+func smartCrop(img image.Image, width int, height int) image.Rectangle {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	if width <= 0 || height <= 0 || srcW == 0 || srcH == 0 {
+		return bounds
+	}
+
+	cropW, cropH := srcW, srcH
+	if srcW*height > srcH*width {
+		cropW = clampInt(int(float64(srcH)*float64(width)/float64(height)+0.5), 1, srcW)
+	} else {
+		cropH = clampInt(int(float64(srcW)*float64(height)/float64(width)+0.5), 1, srcH)
+	}
+
+	if cropW == srcW && cropH == srcH {
+		return bounds
+	}
+
+	factor := math.Min(1, float64(smartCropAnalysisSize)/math.Max(float64(srcW), float64(srcH)))
+	analysisW := clampInt(int(float64(srcW)*factor+0.5), 1, srcW)
+	analysisH := clampInt(int(float64(srcH)*factor+0.5), 1, srcH)
+
+	var small *image.NRGBA
+	if analysisW == srcW && analysisH == srcH {
+		small = imaging.Clone(img)
+	} else {
+		small = imaging.Resize(img, analysisW, analysisH, imaging.Box)
+	}
+
+	scores := importance(small)
+
+	// the crop window spans the whole image on one axis, it only slides on
+	// the other one, so the scores are summed along the fixed axis
+	horizontal := cropW < srcW
+
+	var (
+		profile []float64
+		window  int
+		length  int
+	)
+
+	if horizontal {
+		length = analysisW
+		window = clampInt(int(float64(cropW)*float64(analysisW)/float64(srcW)+0.5), 1, analysisW)
+		profile = make([]float64, analysisW)
+		for y := 0; y < analysisH; y++ {
+			for x := 0; x < analysisW; x++ {
+				profile[x] += scores[y*analysisW+x]
+			}
+		}
+	} else {
+		length = analysisH
+		window = clampInt(int(float64(cropH)*float64(analysisH)/float64(srcH)+0.5), 1, analysisH)
+		profile = make([]float64, analysisH)
+		for y := 0; y < analysisH; y++ {
+			for x := 0; x < analysisW; x++ {
+				profile[y] += scores[y*analysisW+x]
+			}
+		}
+	}
+
+	// without a clear subject, the center of the image is preferred
+	for i := range profile {
+		d := (float64(i)+0.5)/float64(length)*2 - 1
+		profile[i] *= 1 - centerBias*d*d
+	}
+
+	best := bestWindow(profile, window)
+
+	if horizontal {
+		x := clampInt(int(float64(best)*float64(srcW)/float64(length)+0.5), 0, srcW-cropW)
+		return image.Rect(bounds.Min.X+x, bounds.Min.Y, bounds.Min.X+x+cropW, bounds.Max.Y)
+	}
+
+	y := clampInt(int(float64(best)*float64(srcH)/float64(length)+0.5), 0, srcH-cropH)
+	return image.Rect(bounds.Min.X, bounds.Min.Y+y, bounds.Max.X, bounds.Min.Y+y+cropH)
+}
+
+// bestWindow returns the offset of the window of the given size with the
+// highest score, values near the center of the window weigh more than the
+// ones near its edges. Ties are broken in favor of the most centered window.
+func bestWindow(values []float64, window int) int {
+	const epsilon = 1e-9
+
+	weights := make([]float64, window)
+	for i := range weights {
+		d := (float64(i)+0.5)/float64(window)*2 - 1
+		weights[i] = 1 - edgeFalloff*d*d
+	}
+
+	center := float64(len(values)-window) / 2
+
+	best, bestScore := -1, 0.0
+	for offset := 0; offset+window <= len(values); offset++ {
+		var score float64
+		for i := range weights {
+			score += values[offset+i] * weights[i]
+		}
+
+		if best < 0 || score > bestScore+epsilon ||
+			(score > bestScore-epsilon && math.Abs(float64(offset)-center) < math.Abs(float64(best)-center)) {
+			best, bestScore = offset, score
+		}
+	}
+
+	return best
+}
+
+// importance returns the score of each pixel of img.
+func importance(img *image.NRGBA) []float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	lumas := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			lumas[y*w+x] = luma(img.NRGBAAt(x, y))
+		}
+	}
+
+	at := func(x, y int) float64 {
+		return lumas[clampInt(y, 0, h-1)*w+clampInt(x, 0, w-1)]
+	}
+
+	scores := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.NRGBAAt(x, y)
+			l := lumas[y*w+x]
+
+			edge := math.Abs(4*l - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1))
+
+			score := edgeWeight*math.Min(edge, 1) +
+				skinWeight*skinScore(c, l) +
+				saturationWeight*saturationScore(c, l)
+
+			// transparent pixels are not interesting
+			scores[y*w+x] = score * float64(c.A) / 255
+		}
+	}
+
+	return scores
+}
+
+// skinScore returns how close the color is to a skin tone, from 0 to 1.
+func skinScore(c color.NRGBA, l float64) float64 {
+	r, g, b := float64(c.R), float64(c.G), float64(c.B)
+
+	mag := math.Sqrt(r*r + g*g + b*b)
+	if mag == 0 || l < skinLumaMin {
+		return 0
+	}
+
+	dr, dg, db := r/mag-skinR, g/mag-skinG, b/mag-skinB
+
+	skin := 1 - math.Sqrt(dr*dr+dg*dg+db*db)
+	if skin <= skinThreshold {
+		return 0
+	}
+
+	return (skin - skinThreshold) / (1 - skinThreshold)
+}
+
+// saturationScore returns the HSL saturation of colors which are neither too
+// dark nor too bright, from 0 to 1.
+func saturationScore(c color.NRGBA, l float64) float64 {
+	if l < saturationLumaMin || l > saturationLumaMax {
+		return 0
+	}
+
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	if max == min {
+		return 0
+	}
+
+	lightness := (max + min) / 2
+
+	var s float64
+	if lightness > 0.5 {
+		s = (max - min) / (2 - max - min)
+	} else {
+		s = (max - min) / (max + min)
+	}
+
+	if s <= saturationThreshold {
+		return 0
+	}
+
+	return (s - saturationThreshold) / (1 - saturationThreshold)
+}
+
+// luma returns the luminance of the color, from 0 to 1.
+func luma(c color.NRGBA) float64 {
+	return (0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)) / 255
+}
+
+func clampInt(v int, min int, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
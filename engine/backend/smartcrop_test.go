@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thoas/picfit/constants"
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// checkerboard returns a flat gray image with a skin toned checkerboard drawn
+// in the given region.
+func checkerboard(width int, height int, region image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{128, 128, 128, 255}), image.ZP, draw.Src)
+
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			if (x/4+y/4)%2 == 0 {
+				img.SetNRGBA(x, y, color.NRGBA{224, 172, 138, 255})
+			} else {
+				img.SetNRGBA(x, y, color.NRGBA{120, 70, 50, 255})
+			}
+		}
+	}
+
+	return img
+}
+
+func TestSmartCrop(t *testing.T) {
+	region := image.Rect(220, 20, 280, 80)
+	rect := smartCrop(checkerboard(300, 100, region), 100, 100)
+	assert.Equal(t, 100, rect.Dx())
+	assert.Equal(t, 100, rect.Dy())
+	assert.True(t, region.In(rect), "%v does not contain %v", rect, region)
+
+	region = image.Rect(10, 15, 90, 60)
+	rect = smartCrop(checkerboard(100, 400, region), 50, 100)
+	assert.Equal(t, 100, rect.Dx())
+	assert.Equal(t, 200, rect.Dy())
+	assert.True(t, region.In(rect), "%v does not contain %v", rect, region)
+
+	// a flat image is cropped on its center
+	rect = smartCrop(checkerboard(300, 100, image.ZR), 100, 100)
+	assert.Equal(t, image.Rect(100, 0, 200, 100), rect)
+
+	// same aspect ratio
+	rect = smartCrop(checkerboard(300, 100, region), 60, 20)
+	assert.Equal(t, image.Rect(0, 0, 300, 100), rect)
+}
+
+func TestSmartCropFixtures(t *testing.T) {
+	for _, filename := range []string{"schwarzy.jpg", "avatar.png", "BIG.jpg"} {
+		img, err := imaging.Open(path.Join("..", "..", "tests", "fixtures", filename))
+		assert.Nil(t, err)
+
+		for _, size := range [][2]int{{100, 300}, {300, 100}, {100, 100}} {
+			rect := smartCrop(img, size[0], size[1])
+			assert.True(t, rect.In(img.Bounds()))
+			assert.InDelta(t, float64(size[0])/float64(size[1]), float64(rect.Dx())/float64(rect.Dy()), 0.02)
+
+			// the crop is deterministic
+			assert.Equal(t, rect, smartCrop(img, size[0], size[1]))
+		}
+	}
+}
+
+func TestGoImageSmartThumbnail(t *testing.T) {
+	for _, filename := range []string{"schwarzy.jpg", "giphy.gif"} {
+		source, err := ioutil.ReadFile(path.Join("..", "..", "tests", "fixtures", filename))
+		assert.Nil(t, err)
+
+		format, _ := imaging.FormatFromFilename(filename)
+
+		content, err := (&GoImage{}).Thumbnail(context.Background(), &imagefile.ImageFile{Source: source, Filepath: filename}, &Options{
+			Width:   60,
+			Height:  120,
+			Format:  format,
+			Quality: 90,
+			Crop:    constants.SmartCrop,
+		})
+		assert.Nil(t, err)
+
+		img, err := decode(bytes.NewReader(content))
+		assert.Nil(t, err)
+		assert.Equal(t, 60, img.Bounds().Dx())
+		assert.Equal(t, 120, img.Bounds().Dy())
+	}
+}
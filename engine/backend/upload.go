@@ -0,0 +1,36 @@
+package backend
+
+import (
+	"bytes"
+	"math"
+
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// uploadSize returns the size of an uploaded image of width x height fitting
+// in the width and height of options, the aspect ratio is preserved
+func uploadSize(width int, height int, options *Options) (int, int) {
+	w, h := float64(width), float64(height)
+
+	if options.Width > 0 && w > float64(options.Width) {
+		h = h * float64(options.Width) / w
+		w = float64(options.Width)
+	}
+
+	if options.Height > 0 && h > float64(options.Height) {
+		w = w * float64(options.Height) / h
+		h = float64(options.Height)
+	}
+
+	return int(math.Max(1.0, math.Floor(w+0.5))), int(math.Max(1.0, math.Floor(h+0.5)))
+}
+
+// uploadEncoded returns true if an uploaded image must be encoded again
+// even if it is not resized
+func uploadEncoded(img *imagefile.ImageFile, options *Options) bool {
+	if options.Normalize {
+		return true
+	}
+
+	return options.AutoOrient && getOrientation(bytes.NewReader(img.Source)) != "1"
+}
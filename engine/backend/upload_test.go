@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// orientedJPEG returns a width x height jpeg with an EXIF orientation
+func orientedJPEG(t *testing.T, width int, height int, orientation byte) []byte {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil))
+
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08" +
+		"\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00" + string(orientation) + "\x00\x00" +
+		"\x00\x00\x00\x00")
+	app1 := append([]byte{0xff, 0xe1, 0x00, byte(len(exif) + 2)}, exif...)
+
+	source := buf.Bytes()
+
+	return append(append([]byte{0xff, 0xd8}, app1...), source[2:]...)
+}
+
+func TestUploadSize(t *testing.T) {
+	for _, tc := range []struct {
+		width, height, maxWidth, maxHeight int
+		w, h                               int
+	}{
+		{400, 300, 2000, 2000, 400, 300},
+		{4000, 3000, 2000, 2000, 2000, 1500},
+		{3000, 4000, 2000, 2000, 1500, 2000},
+		{400, 300, 200, 0, 200, 150},
+		{400, 300, 0, 100, 133, 100},
+		{400, 300, 0, 0, 400, 300},
+	} {
+		w, h := uploadSize(tc.width, tc.height, &Options{Width: tc.maxWidth, Height: tc.maxHeight})
+		assert.Equal(t, []int{tc.w, tc.h}, []int{w, h}, tc)
+	}
+}
+
+func TestGoImageUploadResize(t *testing.T) {
+	source := orientedJPEG(t, 40, 20, 6)
+
+	upload := func(options *Options) ([]byte, int, int) {
+		options.Format = imaging.JPEG
+		options.Quality = 90
+
+		out, w, h, err := (&GoImage{}).UploadResize(context.Background(),
+			&imagefile.ImageFile{Source: source, Filepath: "oriented.jpg"}, options)
+		assert.Nil(t, err)
+
+		return out, w, h
+	}
+
+	// the image is kept as is
+	out, w, h := upload(&Options{Width: 100, Height: 100})
+	assert.Equal(t, source, out)
+	assert.Equal(t, []int{40, 20}, []int{w, h})
+
+	// the image is rotated and the EXIF orientation removed
+	out, w, h = upload(&Options{Width: 100, Height: 100, AutoOrient: true})
+	assert.NotEqual(t, source, out)
+	assert.Equal(t, []int{20, 40}, []int{w, h})
+	assert.Equal(t, "1", getOrientation(bytes.NewReader(out)))
+
+	// the image is encoded again without being rotated
+	out, w, h = upload(&Options{Width: 100, Height: 100, Normalize: true})
+	assert.NotEqual(t, source, out)
+	assert.Equal(t, []int{40, 20}, []int{w, h})
+	assert.Equal(t, "1", getOrientation(bytes.NewReader(out)))
+
+	out, w, h = upload(&Options{Width: 10, AutoOrient: true})
+	assert.Equal(t, []int{10, 20}, []int{w, h})
+
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Pt(10, 20), img.Bounds().Size())
+}
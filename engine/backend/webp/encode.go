@@ -0,0 +1,126 @@
+// Package webp implements a WebP encoder.
+//
+// Lossy images are coded as VP8 key frames (RFC 6386), with their alpha
+// channel, if any, compressed losslessly in an ALPH chunk. Lossless images
+// are coded with VP8L. The output can be read by any WebP decoder.
+package webp
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// DefaultQuality is the quality used when Options.Quality is not set.
+const DefaultQuality = 75
+
+// maxDimension is the largest width or height of a WebP image.
+const maxDimension = 1 << 14
+
+// Options are the encoding parameters.
+type Options struct {
+	// Lossless selects the VP8L lossless format.
+	Lossless bool
+	// Quality ranges from 1 to 100 inclusive, higher is better. It is
+	// ignored for lossless images.
+	Quality int
+}
+
+// Encode writes the image m to w in WebP format.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	b := m.Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 || b.Dx() > maxDimension || b.Dy() > maxDimension {
+		return errors.New("webp: invalid image size")
+	}
+
+	nrgba, ok := m.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(b)
+		draw.Draw(nrgba, b, m, b.Min, draw.Src)
+	}
+
+	quality := DefaultQuality
+	lossless := false
+	if o != nil {
+		lossless = o.Lossless
+		if o.Quality > 0 {
+			quality = o.Quality
+		}
+	}
+	if quality > 100 {
+		quality = 100
+	}
+
+	var chunks []byte
+	if lossless {
+		chunks = chunk(chunks, "VP8L", encodeVP8L(nrgba, !nrgba.Opaque()))
+	} else if nrgba.Opaque() {
+		chunks = chunk(chunks, "VP8 ", encodeVP8(nrgba, quality))
+	} else {
+		chunks = chunk(chunks, "VP8X", extendedHeader(b.Dx(), b.Dy()))
+		chunks = chunk(chunks, "ALPH", encodeAlpha(nrgba))
+		chunks = chunk(chunks, "VP8 ", encodeVP8(nrgba, quality))
+	}
+
+	header := make([]byte, 12)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(4+len(chunks)))
+	copy(header[8:12], "WEBP")
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(chunks)
+	return err
+}
+
+// chunk appends a RIFF chunk to dst, padded to an even size.
+func chunk(dst []byte, fourCC string, data []byte) []byte {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(data)))
+
+	dst = append(dst, fourCC...)
+	dst = append(dst, size[:]...)
+	dst = append(dst, data...)
+	if len(data)%2 == 1 {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+// extendedHeader returns the VP8X chunk of an image with an alpha channel.
+func extendedHeader(width, height int) []byte {
+	const alphaFlag = 1 << 4
+
+	w, h := width-1, height-1
+	return []byte{
+		alphaFlag, 0, 0, 0,
+		uint8(w), uint8(w >> 8), uint8(w >> 16),
+		uint8(h), uint8(h >> 8), uint8(h >> 16),
+	}
+}
+
+// encodeAlpha returns the ALPH chunk of m: its alpha channel compressed
+// as the green channel of a VP8L image without header.
+func encodeAlpha(m *image.NRGBA) []byte {
+	const vp8lCompression = 1
+
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	pix := make([]uint8, 4*w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := 4 * (y*w + x)
+			pix[p+1] = m.Pix[m.PixOffset(b.Min.X+x, b.Min.Y+y)+3]
+			pix[p+3] = 0xff
+		}
+	}
+
+	bw := &bitWriter{buf: []byte{vp8lCompression}}
+	writeVP8LImage(bw, pix, w, h, false)
+
+	return bw.flush()
+}
@@ -0,0 +1,151 @@
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	_ "image/jpeg"
+	_ "image/png"
+
+	"golang.org/x/image/webp"
+)
+
+func fixture(t *testing.T, name string) image.Image {
+	f, err := os.Open(path.Join("..", "..", "..", "tests", "fixtures", name))
+	assert.Nil(t, err)
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	assert.Nil(t, err)
+
+	return img
+}
+
+func gradient(width, height int, alpha bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := uint8(255)
+			if alpha {
+				a = uint8(x * 255 / width)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / width), uint8(y * 255 / height), uint8((x + y) % 256), a})
+		}
+	}
+	return img
+}
+
+func encode(t *testing.T, img image.Image, o *Options) image.Image {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, Encode(buf, img, o))
+
+	cfg, err := webp.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, img.Bounds().Dx(), cfg.Width)
+	assert.Equal(t, img.Bounds().Dy(), cfg.Height)
+
+	out, err := webp.Decode(buf)
+	assert.Nil(t, err)
+
+	return out
+}
+
+// lumaPSNR compares the luma of the decoded image with the one of the source.
+func lumaPSNR(src image.Image, out image.Image) float64 {
+	var (
+		b   = src.Bounds()
+		mse float64
+	)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+			expected := (16839*int(c.R) + 33059*int(c.G) + 6420*int(c.B) + 16<<16 + 1<<15) >> 16
+
+			var actual uint8
+			switch o := out.(type) {
+			case *image.YCbCr:
+				actual = o.Y[o.YOffset(x-b.Min.X, y-b.Min.Y)]
+			case *image.NYCbCrA:
+				actual = o.Y[o.YOffset(x-b.Min.X, y-b.Min.Y)]
+			}
+
+			d := float64(expected) - float64(actual)
+			mse += d * d
+		}
+	}
+	mse /= float64(b.Dx() * b.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+func TestEncodeLossless(t *testing.T) {
+	for _, img := range []image.Image{
+		gradient(1, 1, false),
+		gradient(37, 21, true),
+		fixture(t, "avatar.png"),
+		fixture(t, "schwarzy.jpg"),
+	} {
+		out := encode(t, img, &Options{Lossless: true})
+
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				expected := color.NRGBAModel.Convert(img.At(x, y))
+				actual := color.NRGBAModel.Convert(out.At(x-b.Min.X, y-b.Min.Y))
+				if !assert.Equal(t, expected, actual, "pixel %d,%d", x, y) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeLossy(t *testing.T) {
+	img := fixture(t, "schwarzy.jpg")
+
+	out := encode(t, img, &Options{Quality: 90})
+	assert.True(t, lumaPSNR(img, out) > 35)
+
+	high, low := &bytes.Buffer{}, &bytes.Buffer{}
+	assert.Nil(t, Encode(high, img, &Options{Quality: 90}))
+	assert.Nil(t, Encode(low, img, &Options{Quality: 30}))
+	assert.True(t, low.Len() < high.Len())
+
+	// Encoding is deterministic.
+	again := &bytes.Buffer{}
+	assert.Nil(t, Encode(again, img, &Options{Quality: 90}))
+	assert.Equal(t, high.Bytes(), again.Bytes())
+}
+
+func TestEncodeLossyAlpha(t *testing.T) {
+	img := gradient(45, 33, true)
+
+	out := encode(t, img, &Options{Quality: 90})
+
+	nycbcra, ok := out.(*image.NYCbCrA)
+	assert.True(t, ok)
+	if !ok {
+		return
+	}
+
+	for y := 0; y < 33; y++ {
+		for x := 0; x < 45; x++ {
+			assert.Equal(t, img.NRGBAAt(x, y).A, nycbcra.A[nycbcra.AOffset(x, y)])
+		}
+	}
+	assert.True(t, lumaPSNR(img, out) > 35)
+}
+
+func TestEncodeInvalidSize(t *testing.T) {
+	err := Encode(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, maxDimension+1, 1)), nil)
+	assert.NotNil(t, err)
+}
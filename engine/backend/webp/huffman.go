@@ -0,0 +1,287 @@
+package webp
+
+import (
+	"sort"
+)
+
+// maxCodeLength is the longest Huffman code VP8L decoders accept.
+const maxCodeLength = 15
+
+// codeLengthCodeOrder is the order in which the code lengths of the code
+// length code are written, specified in section 5.2.2 of the VP8L spec.
+var codeLengthCodeOrder = [19]uint8{
+	17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// huffmanCode maps symbols to their canonical Huffman codes. Codes are
+// stored bit-reversed since VP8L streams are written least significant
+// bit first.
+type huffmanCode struct {
+	codes   []uint32
+	lengths []uint8
+}
+
+// write writes the code of symbol to w.
+func (h *huffmanCode) write(w *bitWriter, symbol int) {
+	w.write(h.codes[symbol], uint(h.lengths[symbol]))
+}
+
+// buildCodeLengths returns the lengths of a Huffman code for histogram
+// whose codes are not longer than maxLength bits. Unused symbols get a
+// zero length.
+func buildCodeLengths(histogram []uint32, maxLength int) []uint8 {
+	lengths := make([]uint8, len(histogram))
+
+	type node struct {
+		count  uint64
+		symbol int
+		left   int
+		right  int
+	}
+
+	// Symbols that are too rare would get codes longer than allowed, in
+	// that case their counts are raised until the tree is shallow enough.
+	for minCount := uint64(1); ; minCount *= 2 {
+		var nodes []node
+		for s, c := range histogram {
+			if c == 0 {
+				continue
+			}
+			count := uint64(c)
+			if count < minCount {
+				count = minCount
+			}
+			nodes = append(nodes, node{count: count, symbol: s, left: -1, right: -1})
+		}
+
+		if len(nodes) == 0 {
+			return lengths
+		}
+		if len(nodes) == 1 {
+			lengths[nodes[0].symbol] = 1
+			return lengths
+		}
+
+		sort.Slice(nodes, func(i, j int) bool {
+			if nodes[i].count != nodes[j].count {
+				return nodes[i].count < nodes[j].count
+			}
+			return nodes[i].symbol < nodes[j].symbol
+		})
+
+		// Two queues algorithm: leaves are sorted and internal nodes are
+		// created in increasing order of count.
+		leaves := len(nodes)
+		next, merged := 0, leaves
+		pick := func() int {
+			if next < leaves && (merged >= len(nodes) || nodes[next].count <= nodes[merged].count) {
+				next++
+				return next - 1
+			}
+			merged++
+			return merged - 1
+		}
+		for len(nodes) < 2*leaves-1 {
+			a := pick()
+			b := pick()
+			nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, symbol: -1, left: a, right: b})
+		}
+
+		depths := make([]int, len(nodes))
+		tooLong := false
+		for i := len(nodes) - 1; i >= 0; i-- {
+			n := nodes[i]
+			if n.symbol >= 0 {
+				if depths[i] > maxLength {
+					tooLong = true
+				}
+				lengths[n.symbol] = uint8(depths[i])
+				continue
+			}
+			depths[n.left] = depths[i] + 1
+			depths[n.right] = depths[i] + 1
+		}
+
+		if !tooLong {
+			return lengths
+		}
+	}
+}
+
+// newHuffmanCode returns the canonical Huffman code for the given lengths.
+func newHuffmanCode(lengths []uint8) *huffmanCode {
+	var (
+		histogram [maxCodeLength + 1]uint32
+		nextCodes [maxCodeLength + 1]uint32
+		used      int
+	)
+	for _, l := range lengths {
+		histogram[l]++
+		if l > 0 {
+			used++
+		}
+	}
+	histogram[0] = 0
+
+	code := uint32(0)
+	for l := 1; l <= maxCodeLength; l++ {
+		code = (code + histogram[l-1]) << 1
+		nextCodes[l] = code
+	}
+
+	h := &huffmanCode{
+		codes:   make([]uint32, len(lengths)),
+		lengths: make([]uint8, len(lengths)),
+	}
+
+	// A code with a single symbol takes no bits at all.
+	if used < 2 {
+		return h
+	}
+
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		h.codes[s] = reverse(nextCodes[l], l)
+		h.lengths[s] = l
+		nextCodes[l]++
+	}
+	return h
+}
+
+// writeHuffmanCode writes a Huffman code for histogram to w, as specified
+// in section 5.2.2 of the VP8L spec, and returns it.
+func writeHuffmanCode(w *bitWriter, histogram []uint32) *huffmanCode {
+	var symbols []int
+	for s, c := range histogram {
+		if c > 0 {
+			symbols = append(symbols, s)
+			if len(symbols) > 2 {
+				break
+			}
+		}
+	}
+
+	// Codes with up to two symbols below 256 are written as simple codes.
+	if len(symbols) <= 2 && (len(symbols) == 0 || symbols[len(symbols)-1] < 256) {
+		lengths := make([]uint8, len(histogram))
+		if len(symbols) == 0 {
+			symbols = append(symbols, 0)
+		}
+
+		w.write(1, 1)
+		w.write(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(symbols[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			w.write(uint32(symbols[1]), 8)
+		}
+
+		h := &huffmanCode{
+			codes:   make([]uint32, len(histogram)),
+			lengths: lengths,
+		}
+		if len(symbols) == 2 {
+			h.codes[symbols[1]] = 1
+			lengths[symbols[0]], lengths[symbols[1]] = 1, 1
+		}
+		return h
+	}
+
+	lengths := buildCodeLengths(histogram, maxCodeLength)
+
+	// The code lengths are themselves run-length encoded with the
+	// alphabet of section 5.2.2: 0-15 are literal lengths, 16 repeats the
+	// previous non-zero length, 17 and 18 repeat zeros.
+	type token struct {
+		symbol, extra, extraBits int
+	}
+	var (
+		tokens []token
+		counts = make([]uint32, len(codeLengthCodeOrder))
+	)
+	emit := func(symbol, extra, extraBits int) {
+		tokens = append(tokens, token{symbol, extra, extraBits})
+		counts[symbol]++
+	}
+	for i := 0; i < len(lengths); {
+		l, run := lengths[i], 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+
+		if l == 0 {
+			for run > 0 {
+				switch {
+				case run < 3:
+					emit(0, 0, 0)
+					run--
+				case run <= 10:
+					emit(17, run-3, 3)
+					run = 0
+				default:
+					n := run
+					if n > 138 {
+						n = 138
+					}
+					emit(18, n-11, 7)
+					run -= n
+				}
+			}
+			continue
+		}
+
+		emit(int(l), 0, 0)
+		run--
+		for run >= 3 {
+			n := run
+			if n > 6 {
+				n = 6
+			}
+			emit(16, n-3, 2)
+			run -= n
+		}
+		for ; run > 0; run-- {
+			emit(int(l), 0, 0)
+		}
+	}
+
+	codeLengthLengths := buildCodeLengths(counts, 7)
+	nCodes := len(codeLengthCodeOrder)
+	for nCodes > 4 && codeLengthLengths[codeLengthCodeOrder[nCodes-1]] == 0 {
+		nCodes--
+	}
+
+	w.write(0, 1)
+	w.write(uint32(nCodes-4), 4)
+	for _, s := range codeLengthCodeOrder[:nCodes] {
+		w.write(uint32(codeLengthLengths[s]), 3)
+	}
+	// All the code lengths are written.
+	w.write(0, 1)
+
+	codeLengthCode := newHuffmanCode(codeLengthLengths)
+	for _, t := range tokens {
+		codeLengthCode.write(w, t.symbol)
+		w.write(uint32(t.extra), uint(t.extraBits))
+	}
+
+	return newHuffmanCode(lengths)
+}
+
+// reverse returns the n least significant bits of v in reverse order.
+func reverse(v uint32, n uint8) uint32 {
+	r := uint32(0)
+	for i := uint8(0); i < n; i++ {
+		r = r<<1 | v&1
+		v >>= 1
+	}
+	return r
+}
@@ -0,0 +1,977 @@
+package webp
+
+import (
+	"image"
+	"math"
+)
+
+// Prediction modes for 16x16 luma and 8x8 chroma blocks, specified in
+// section 12.2. The values follow the order used by decoders.
+const (
+	predDC = iota
+	predTM
+	predVE
+	predHE
+	nPred
+)
+
+const (
+	// dcBias and acBias are the rounding offsets used when quantizing
+	// DC and AC coefficients. A bias below one half favours zeros, which
+	// are cheaper to code, over small levels.
+	dcBias = 0.5
+	acBias = 0.375
+
+	// maxLevel is the largest quantized level the token alphabet can code.
+	maxLevel = 2047
+)
+
+// boolEncoder is the boolean entropy encoder specified in section 7.3.
+type boolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+// putBit codes a bit whose probability of being false is prob/256.
+func (e *boolEncoder) putBit(bit bool, prob uint8) {
+	split := 1 + ((e.rng-1)*uint32(prob))>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.carry()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, uint8(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// putLiteral codes the n least significant bits of v, most significant first.
+func (e *boolEncoder) putLiteral(v uint32, n uint) {
+	for n > 0 {
+		n--
+		e.putBit(v>>n&1 == 1, 128)
+	}
+}
+
+// carry propagates an overflow of bottom into the bytes already written.
+func (e *boolEncoder) carry() {
+	i := len(e.buf) - 1
+	for ; i >= 0 && e.buf[i] == 255; i-- {
+		e.buf[i] = 0
+	}
+	if i >= 0 {
+		e.buf[i]++
+	}
+}
+
+// flush writes the pending bits and returns the coded partition.
+func (e *boolEncoder) flush() []byte {
+	c, v := e.bitCount, e.bottom
+	if v&(1<<uint(32-c)) != 0 {
+		e.carry()
+	}
+	v <<= uint(c & 7)
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for i := 0; i < 4; i++ {
+		e.buf = append(e.buf, uint8(v>>24))
+		v <<= 8
+	}
+	return e.buf
+}
+
+// tokenWriter receives the decisions taken while coding DCT coefficients.
+type tokenWriter interface {
+	// putToken codes a decision whose probability is looked up in the
+	// token probability table.
+	putToken(bit bool, plane int, band uint8, ctx int, i int)
+	// putBit codes a decision with a fixed probability.
+	putBit(bit bool, prob uint8)
+}
+
+// tokenEncoder codes tokens with a boolEncoder.
+type tokenEncoder struct {
+	*boolEncoder
+	prob *[nPlane][nBand][nContext][nProb]uint8
+}
+
+func (t tokenEncoder) putToken(bit bool, plane int, band uint8, ctx int, i int) {
+	t.boolEncoder.putBit(bit, t.prob[plane][band][ctx][i])
+}
+
+// tokenCounter records how often each token probability is used, it is
+// used to adapt the probabilities to the image before coding it.
+type tokenCounter [nPlane][nBand][nContext][nProb][2]uint32
+
+func (t *tokenCounter) putToken(bit bool, plane int, band uint8, ctx int, i int) {
+	t[plane][band][ctx][i][btoi(bit)]++
+}
+
+func (t *tokenCounter) putBit(bit bool, prob uint8) {}
+
+// quant holds the quantizer step sizes of a frame, index 0 is for the DC
+// coefficient and index 1 for the AC coefficients.
+type quant struct {
+	y1, y2, uv [2]int32
+}
+
+// macroblock holds the coding decisions of a 16x16 macroblock. Levels are
+// stored in zigzag order.
+type macroblock struct {
+	ymode, uvmode uint8
+	skip          bool
+	y2            [16]int16
+	y             [16][16]int16
+	u, v          [4][16]int16
+}
+
+func (mb *macroblock) empty() bool {
+	for i := range mb.y2 {
+		if mb.y2[i] != 0 {
+			return false
+		}
+	}
+	for n := range mb.y {
+		for i := range mb.y[n] {
+			if mb.y[n][i] != 0 {
+				return false
+			}
+		}
+	}
+	for n := range mb.u {
+		for i := range mb.u[n] {
+			if mb.u[n][i] != 0 || mb.v[n][i] != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// nzContext holds the "has non-zero coefficients" flags of the blocks on
+// the edge of a macroblock, they are the contexts of the neighbouring blocks.
+type nzContext struct {
+	y    [4]uint8
+	u, v [2]uint8
+	y2   uint8
+}
+
+// vp8Encoder encodes a key frame as specified in RFC 6386.
+//
+// Every macroblock is predicted as a whole (16x16 luma and 8x8 chroma
+// modes) and its residuals are coded in a single token partition.
+type vp8Encoder struct {
+	width, height int
+	mbw, mbh      int
+
+	// y, u and v hold the source samples, padded to whole macroblocks.
+	y, u, v []uint8
+	// ry, ru and rv hold the samples a decoder reconstructs before loop
+	// filtering, later macroblocks are predicted from them.
+	ry, ru, rv       []uint8
+	yStride, cStride int
+
+	qi        int
+	quant     quant
+	mbs       []macroblock
+	tokenProb [nPlane][nBand][nContext][nProb]uint8
+}
+
+// encodeVP8 returns the VP8 key frame of m at the given quality.
+func encodeVP8(m *image.NRGBA, quality int) []byte {
+	e := newVP8Encoder(m, quality)
+	e.analyze()
+	return e.frame()
+}
+
+func newVP8Encoder(m *image.NRGBA, quality int) *vp8Encoder {
+	b := m.Bounds()
+
+	e := &vp8Encoder{
+		width:     b.Dx(),
+		height:    b.Dy(),
+		mbw:       (b.Dx() + 15) >> 4,
+		mbh:       (b.Dy() + 15) >> 4,
+		tokenProb: defaultTokenProb,
+	}
+	e.yStride, e.cStride = 16*e.mbw, 8*e.mbw
+	e.y = make([]uint8, e.yStride*16*e.mbh)
+	e.u = make([]uint8, e.cStride*8*e.mbh)
+	e.v = make([]uint8, e.cStride*8*e.mbh)
+	e.ry = make([]uint8, len(e.y))
+	e.ru = make([]uint8, len(e.u))
+	e.rv = make([]uint8, len(e.v))
+	e.mbs = make([]macroblock, e.mbw*e.mbh)
+
+	e.qi = clip((100-quality)*127/100, 0, 127)
+	e.quant.y1 = [2]int32{int32(dequantTableDC[e.qi]), int32(dequantTableAC[e.qi])}
+	e.quant.y2 = [2]int32{int32(dequantTableDC[e.qi]) * 2, int32(dequantTableAC[e.qi]) * 155 / 100}
+	if e.quant.y2[1] < 8 {
+		e.quant.y2[1] = 8
+	}
+	e.quant.uv = [2]int32{int32(dequantTableDC[clip(e.qi, 0, 117)]), int32(dequantTableAC[e.qi])}
+
+	e.convert(m)
+
+	return e
+}
+
+// convert fills the Y'CbCr planes from m, using the BT.601 studio swing
+// conversion decoders expect. Chroma is averaged over 2x2 pixels and the
+// planes are padded by replicating the right and bottom edges.
+func (e *vp8Encoder) convert(m *image.NRGBA) {
+	b := m.Bounds()
+
+	rgb := func(x, y int) (int32, int32, int32) {
+		if x >= e.width {
+			x = e.width - 1
+		}
+		if y >= e.height {
+			y = e.height - 1
+		}
+		i := m.PixOffset(b.Min.X+x, b.Min.Y+y)
+		return int32(m.Pix[i+0]), int32(m.Pix[i+1]), int32(m.Pix[i+2])
+	}
+
+	for y := 0; y < 16*e.mbh; y++ {
+		for x := 0; x < e.yStride; x++ {
+			r, g, b := rgb(x, y)
+			e.y[y*e.yStride+x] = uint8((16839*r + 33059*g + 6420*b + 16<<16 + 1<<15) >> 16)
+		}
+	}
+
+	for y := 0; y < 8*e.mbh; y++ {
+		for x := 0; x < e.cStride; x++ {
+			var r, g, b int32
+			for j := 0; j < 2; j++ {
+				for i := 0; i < 2; i++ {
+					rr, gg, bb := rgb(2*x+i, 2*y+j)
+					r, g, b = r+rr, g+gg, b+bb
+				}
+			}
+			e.u[y*e.cStride+x] = clip8((-9719*r - 19081*g + 28800*b + 128<<18 + 1<<17) >> 18)
+			e.v[y*e.cStride+x] = clip8((28800*r - 24116*g - 4684*b + 128<<18 + 1<<17) >> 18)
+		}
+	}
+}
+
+// analyze chooses the prediction modes and quantizes the residuals of
+// every macroblock, in the order a decoder reconstructs them.
+func (e *vp8Encoder) analyze() {
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &e.mbs[mby*e.mbw+mbx]
+			e.analyzeLuma(mb, mbx, mby)
+			e.analyzeChroma(mb, mbx, mby)
+			mb.skip = mb.empty()
+		}
+	}
+}
+
+func (e *vp8Encoder) analyzeLuma(mb *macroblock, mbx, mby int) {
+	var (
+		src, pred [256]uint8
+		offset    = 16*mby*e.yStride + 16*mbx
+	)
+
+	for j := 0; j < 16; j++ {
+		copy(src[16*j:16*j+16], e.y[offset+j*e.yStride:])
+	}
+
+	mb.ymode = e.predict(pred[:], src[:], e.ry, e.yStride, 16, mbx, mby)
+
+	// Each 4x4 block is transformed on its own, their DC coefficients
+	// are then gathered in the Y2 block and transformed again.
+	var (
+		coeffs [16][16]float64
+		dc     [16]float64
+	)
+	for n := 0; n < 16; n++ {
+		var residual [16]float64
+		base := 64*(n/4) + 4*(n%4)
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				residual[4*j+i] = float64(src[base+16*j+i]) - float64(pred[base+16*j+i])
+			}
+		}
+		forwardDCT(&residual, &coeffs[n])
+		dc[n] = coeffs[n][0]
+	}
+
+	var wht [16]float64
+	forwardWHT(&dc, &wht)
+
+	var dequantized [16]int16
+	for i := 0; i < 16; i++ {
+		z := zigzag[i]
+		q := e.quant.y2[btoi(z > 0)]
+		mb.y2[i] = quantize(wht[z], q, dcBias)
+		dequantized[z] = int16(int32(mb.y2[i]) * q)
+	}
+
+	dcs := inverseWHT(&dequantized)
+
+	for n := 0; n < 16; n++ {
+		var c [16]int16
+		c[0] = dcs[n]
+		for i := 1; i < 16; i++ {
+			z := zigzag[i]
+			mb.y[n][i] = quantize(coeffs[n][z], e.quant.y1[1], acBias)
+			c[z] = int16(int32(mb.y[n][i]) * e.quant.y1[1])
+		}
+
+		base := 64*(n/4) + 4*(n%4)
+		inverseDCT(&c, pred[base:], 16)
+	}
+
+	for j := 0; j < 16; j++ {
+		copy(e.ry[offset+j*e.yStride:], pred[16*j:16*j+16])
+	}
+}
+
+func (e *vp8Encoder) analyzeChroma(mb *macroblock, mbx, mby int) {
+	var (
+		src, pred [2][64]uint8
+		planes    = [2][]uint8{e.u, e.v}
+		recon     = [2][]uint8{e.ru, e.rv}
+		levels    = [2]*[4][16]int16{&mb.u, &mb.v}
+		offset    = 8*mby*e.cStride + 8*mbx
+	)
+
+	for p := range planes {
+		for j := 0; j < 8; j++ {
+			copy(src[p][8*j:8*j+8], planes[p][offset+j*e.cStride:])
+		}
+	}
+
+	// Both chroma planes share a single prediction mode.
+	var (
+		best    = -1
+		bestSAD int
+	)
+	for mode := 0; mode < nPred; mode++ {
+		sad := 0
+		for p := range planes {
+			predictBlock(pred[p][:], recon[p], e.cStride, 8, mode, mbx, mby)
+			sad += sumAbsDiff(src[p][:], pred[p][:])
+		}
+		if best < 0 || sad < bestSAD {
+			best, bestSAD = mode, sad
+		}
+	}
+	mb.uvmode = uint8(best)
+
+	for p := range planes {
+		predictBlock(pred[p][:], recon[p], e.cStride, 8, best, mbx, mby)
+
+		for n := 0; n < 4; n++ {
+			var residual, coeffs [16]float64
+			base := 32*(n/2) + 4*(n%2)
+			for j := 0; j < 4; j++ {
+				for i := 0; i < 4; i++ {
+					residual[4*j+i] = float64(src[p][base+8*j+i]) - float64(pred[p][base+8*j+i])
+				}
+			}
+			forwardDCT(&residual, &coeffs)
+
+			var c [16]int16
+			for i := 0; i < 16; i++ {
+				z := zigzag[i]
+				q, bias := e.quant.uv[btoi(z > 0)], acBias
+				if z == 0 {
+					bias = dcBias
+				}
+				levels[p][n][i] = quantize(coeffs[z], q, bias)
+				c[z] = int16(int32(levels[p][n][i]) * q)
+			}
+			inverseDCT(&c, pred[p][base:], 8)
+		}
+
+		for j := 0; j < 8; j++ {
+			copy(recon[p][offset+j*e.cStride:], pred[p][8*j:8*j+8])
+		}
+	}
+}
+
+// predict writes into pred the luma prediction closest to src and
+// returns its mode.
+func (e *vp8Encoder) predict(pred []uint8, src []uint8, recon []uint8, stride, size, mbx, mby int) uint8 {
+	var (
+		best    = -1
+		bestSAD int
+	)
+	for mode := 0; mode < nPred; mode++ {
+		predictBlock(pred, recon, stride, size, mode, mbx, mby)
+		sad := sumAbsDiff(src, pred[:size*size])
+		if best < 0 || sad < bestSAD {
+			best, bestSAD = mode, sad
+		}
+	}
+	predictBlock(pred, recon, stride, size, best, mbx, mby)
+	return uint8(best)
+}
+
+// predictBlock computes the size x size prediction of the macroblock at
+// mbx, mby from the reconstructed samples above and on its left, exactly
+// as decoders do (section 12.2), frame edges included.
+func predictBlock(pred []uint8, recon []uint8, stride, size, mode, mbx, mby int) {
+	var (
+		top, left [16]int32
+		corner    int32
+		x0, y0    = size * mbx, size * mby
+	)
+
+	for i := 0; i < size; i++ {
+		if mby == 0 {
+			top[i] = 0x7f
+		} else {
+			top[i] = int32(recon[(y0-1)*stride+x0+i])
+		}
+		if mbx == 0 {
+			left[i] = 0x81
+		} else {
+			left[i] = int32(recon[(y0+i)*stride+x0-1])
+		}
+	}
+	switch {
+	case mby == 0:
+		corner = 0x7f
+	case mbx == 0:
+		corner = 0x81
+	default:
+		corner = int32(recon[(y0-1)*stride+x0-1])
+	}
+
+	switch mode {
+	case predDC:
+		// Decoders average the edges that exist, like the DCTop, DCLeft and
+		// DCTopLeft predictors of the reference decoder.
+		var (
+			avg uint8 = 0x80
+			sum int32
+			n   = int32(size)
+		)
+		switch {
+		case mbx == 0 && mby == 0:
+			n = 0
+		case mby == 0:
+			for i := 0; i < size; i++ {
+				sum += left[i]
+			}
+		case mbx == 0:
+			for i := 0; i < size; i++ {
+				sum += top[i]
+			}
+		default:
+			for i := 0; i < size; i++ {
+				sum += top[i] + left[i]
+			}
+			n *= 2
+		}
+		if n != 0 {
+			avg = uint8((sum + n/2) / n)
+		}
+		for i := range pred[:size*size] {
+			pred[i] = avg
+		}
+	case predTM:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				pred[j*size+i] = clip8(left[j] + top[i] - corner)
+			}
+		}
+	case predVE:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				pred[j*size+i] = uint8(top[i])
+			}
+		}
+	case predHE:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				pred[j*size+i] = uint8(left[j])
+			}
+		}
+	}
+}
+
+// frame returns the coded key frame: the frame header, the first partition
+// holding the headers and modes, then the token partition.
+func (e *vp8Encoder) frame() []byte {
+	var counts tokenCounter
+	e.writeTokens(&counts)
+	e.adaptTokenProb(&counts)
+
+	tokens := newBoolEncoder()
+	e.writeTokens(tokenEncoder{boolEncoder: tokens, prob: &e.tokenProb})
+
+	first := newBoolEncoder()
+	e.writeHeaders(first)
+
+	part1, part2 := first.flush(), tokens.flush()
+
+	size := uint32(len(part1))
+	tag := 1<<4 | size<<5 // key frame, version 0, shown.
+
+	out := make([]byte, 0, 10+len(part1)+len(part2))
+	out = append(out,
+		uint8(tag), uint8(tag>>8), uint8(tag>>16),
+		0x9d, 0x01, 0x2a,
+		uint8(e.width), uint8(e.width>>8),
+		uint8(e.height), uint8(e.height>>8),
+	)
+	out = append(out, part1...)
+	return append(out, part2...)
+}
+
+func (e *vp8Encoder) writeHeaders(w *boolEncoder) {
+	// Color space and clamping type.
+	w.putBit(false, 128)
+	w.putBit(false, 128)
+	// No segmentation.
+	w.putBit(false, 128)
+	// Normal loop filter, no sharpness nor delta adjustments.
+	w.putBit(false, 128)
+	w.putLiteral(uint32(e.qi*3/8), 6)
+	w.putLiteral(0, 3)
+	w.putBit(false, 128)
+	// A single token partition.
+	w.putLiteral(0, 2)
+	// Base quantizer index, without deltas.
+	w.putLiteral(uint32(e.qi), 7)
+	for i := 0; i < 5; i++ {
+		w.putBit(false, 128)
+	}
+	// Refresh entropy probabilities.
+	w.putBit(false, 128)
+
+	for i := range e.tokenProb {
+		for j := range e.tokenProb[i] {
+			for k := range e.tokenProb[i][j] {
+				for l, p := range e.tokenProb[i][j][k] {
+					update := p != defaultTokenProb[i][j][k][l]
+					w.putBit(update, tokenProbUpdateProb[i][j][k][l])
+					if update {
+						w.putLiteral(uint32(p), 8)
+					}
+				}
+			}
+		}
+	}
+
+	skipped := 0
+	for i := range e.mbs {
+		if e.mbs[i].skip {
+			skipped++
+		}
+	}
+	skipProb := uint8(clip((len(e.mbs)-skipped)*256/len(e.mbs), 1, 255))
+	w.putBit(skipped > 0, 128)
+	if skipped > 0 {
+		w.putLiteral(uint32(skipProb), 8)
+	}
+
+	for i := range e.mbs {
+		mb := &e.mbs[i]
+		if skipped > 0 {
+			w.putBit(mb.skip, skipProb)
+		}
+
+		w.putBit(true, 145)
+		switch mb.ymode {
+		case predDC:
+			w.putBit(false, 156)
+			w.putBit(false, 163)
+		case predVE:
+			w.putBit(false, 156)
+			w.putBit(true, 163)
+		case predHE:
+			w.putBit(true, 156)
+			w.putBit(false, 128)
+		case predTM:
+			w.putBit(true, 156)
+			w.putBit(true, 128)
+		}
+
+		w.putBit(mb.uvmode != predDC, 142)
+		if mb.uvmode != predDC {
+			w.putBit(mb.uvmode != predVE, 114)
+			if mb.uvmode != predVE {
+				w.putBit(mb.uvmode == predTM, 183)
+			}
+		}
+	}
+}
+
+// adaptTokenProb replaces the default token probabilities by the observed
+// ones whenever the savings outweigh the cost of the update.
+func (e *vp8Encoder) adaptTokenProb(counts *tokenCounter) {
+	for i := range e.tokenProb {
+		for j := range e.tokenProb[i] {
+			for k := range e.tokenProb[i][j] {
+				for l := range e.tokenProb[i][j][k] {
+					n0, n1 := counts[i][j][k][l][0], counts[i][j][k][l][1]
+					if n0+n1 == 0 {
+						continue
+					}
+
+					old := defaultTokenProb[i][j][k][l]
+					p := uint8(clip(int((uint64(n0)*256+uint64(n0+n1)/2)/uint64(n0+n1)), 1, 255))
+
+					upd := tokenProbUpdateProb[i][j][k][l]
+					oldCost := branchCost(n0, n1, old) + branchCost(1, 0, upd)
+					newCost := branchCost(n0, n1, p) + branchCost(0, 1, upd) + 8
+					if newCost < oldCost {
+						e.tokenProb[i][j][k][l] = p
+					}
+				}
+			}
+		}
+	}
+}
+
+// branchCost returns the number of bits needed to code n0 false and n1
+// true decisions with the given probability.
+func branchCost(n0, n1 uint32, prob uint8) float64 {
+	p := float64(prob) / 256
+	return -float64(n0)*math.Log2(p) - float64(n1)*math.Log2(1-p)
+}
+
+// writeTokens codes the coefficients of every macroblock, in the order
+// specified in section 13.
+func (e *vp8Encoder) writeTokens(w tokenWriter) {
+	up := make([]nzContext, e.mbw)
+	for mby := 0; mby < e.mbh; mby++ {
+		var left nzContext
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &e.mbs[mby*e.mbw+mbx]
+			if mb.skip {
+				left, up[mbx] = nzContext{}, nzContext{}
+				continue
+			}
+
+			nz := writeCoeffs(w, planeY2, int(left.y2+up[mbx].y2), 0, &mb.y2)
+			left.y2, up[mbx].y2 = nz, nz
+
+			for y := 0; y < 4; y++ {
+				nz := left.y[y]
+				for x := 0; x < 4; x++ {
+					nz = writeCoeffs(w, planeY1WithY2, int(nz+up[mbx].y[x]), 1, &mb.y[4*y+x])
+					up[mbx].y[x] = nz
+				}
+				left.y[y] = nz
+			}
+
+			for y := 0; y < 2; y++ {
+				nz := left.u[y]
+				for x := 0; x < 2; x++ {
+					nz = writeCoeffs(w, planeUV, int(nz+up[mbx].u[x]), 0, &mb.u[2*y+x])
+					up[mbx].u[x] = nz
+				}
+				left.u[y] = nz
+			}
+
+			for y := 0; y < 2; y++ {
+				nz := left.v[y]
+				for x := 0; x < 2; x++ {
+					nz = writeCoeffs(w, planeUV, int(nz+up[mbx].v[x]), 0, &mb.v[2*y+x])
+					up[mbx].v[x] = nz
+				}
+				left.v[y] = nz
+			}
+		}
+	}
+}
+
+// writeCoeffs codes the levels of a 4x4 block from index first onwards, as
+// specified in section 13.2, and returns whether any of them is non-zero.
+func writeCoeffs(w tokenWriter, plane int, ctx int, first int, levels *[16]int16) uint8 {
+	last := -1
+	for n := first; n < 16; n++ {
+		if levels[n] != 0 {
+			last = n
+		}
+	}
+
+	n := first
+	band := bands[n]
+	if last < 0 {
+		w.putToken(false, plane, band, ctx, 0)
+		return 0
+	}
+	w.putToken(true, plane, band, ctx, 0)
+
+	for n < 16 {
+		v := levels[n]
+		n++
+
+		if v == 0 {
+			w.putToken(false, plane, band, ctx, 1)
+			band, ctx = bands[n], 0
+			continue
+		}
+		w.putToken(true, plane, band, ctx, 1)
+
+		a := int(v)
+		if a < 0 {
+			a = -a
+		}
+
+		next := 2
+		switch {
+		case a == 1:
+			w.putToken(false, plane, band, ctx, 2)
+			next = 1
+		case a <= 4:
+			w.putToken(true, plane, band, ctx, 2)
+			w.putToken(false, plane, band, ctx, 3)
+			w.putToken(a != 2, plane, band, ctx, 4)
+			if a != 2 {
+				w.putToken(a == 4, plane, band, ctx, 5)
+			}
+		case a <= 10:
+			w.putToken(true, plane, band, ctx, 2)
+			w.putToken(true, plane, band, ctx, 3)
+			w.putToken(false, plane, band, ctx, 6)
+			w.putToken(a > 6, plane, band, ctx, 7)
+			if a <= 6 {
+				w.putBit(a == 6, 159)
+			} else {
+				w.putBit((a-7)&2 != 0, 165)
+				w.putBit((a-7)&1 != 0, 145)
+			}
+		default:
+			w.putToken(true, plane, band, ctx, 2)
+			w.putToken(true, plane, band, ctx, 3)
+			w.putToken(true, plane, band, ctx, 6)
+
+			cat := 3
+			for c := 0; c < 3; c++ {
+				if a < 3+(8<<uint(c+1)) {
+					cat = c
+					break
+				}
+			}
+			b1 := cat >> 1
+			w.putToken(b1 == 1, plane, band, ctx, 8)
+			w.putToken(cat&1 == 1, plane, band, ctx, 9+b1)
+
+			extra, probs := a-(3+(8<<uint(cat))), cat3456[cat]
+			for i, p := range probs {
+				w.putBit(extra>>uint(len(probs)-1-i)&1 == 1, p)
+			}
+		}
+
+		w.putBit(v < 0, 128)
+
+		band, ctx = bands[n], next
+		if n == 16 {
+			break
+		}
+
+		more := last >= n
+		w.putToken(more, plane, band, ctx, 0)
+		if !more {
+			break
+		}
+	}
+
+	return 1
+}
+
+// dctBasis[n][k] is the k-th basis function of the 4-point DCT at n,
+// scaled like the inverse transform of section 14.3.
+var dctBasis = func() (t [4][4]float64) {
+	for n := 0; n < 4; n++ {
+		for k := 0; k < 4; k++ {
+			c := math.Sqrt2
+			if k == 0 {
+				c = 1
+			}
+			t[n][k] = c * math.Cos(float64((2*n+1)*k)*math.Pi/8)
+		}
+	}
+	return
+}()
+
+// forwardDCT is the inverse of inverseDCT, before rounding.
+func forwardDCT(in *[16]float64, out *[16]float64) {
+	var tmp [16]float64
+	for y := 0; y < 4; y++ {
+		for u := 0; u < 4; u++ {
+			var s float64
+			for x := 0; x < 4; x++ {
+				s += in[4*y+x] * dctBasis[x][u]
+			}
+			tmp[4*y+u] = s
+		}
+	}
+	for v := 0; v < 4; v++ {
+		for u := 0; u < 4; u++ {
+			var s float64
+			for y := 0; y < 4; y++ {
+				s += dctBasis[y][v] * tmp[4*y+u]
+			}
+			out[4*v+u] = s / 2
+		}
+	}
+}
+
+// whtBasis is the Walsh-Hadamard matrix of section 14.3, it is symmetric.
+var whtBasis = [4][4]float64{
+	{1, 1, 1, 1},
+	{1, 1, -1, -1},
+	{1, -1, -1, 1},
+	{1, -1, 1, -1},
+}
+
+// forwardWHT is the inverse of inverseWHT, before rounding.
+func forwardWHT(in *[16]float64, out *[16]float64) {
+	var tmp [16]float64
+	for i := 0; i < 4; i++ {
+		for u := 0; u < 4; u++ {
+			var s float64
+			for k := 0; k < 4; k++ {
+				s += in[4*i+k] * whtBasis[k][u]
+			}
+			tmp[4*i+u] = s
+		}
+	}
+	for v := 0; v < 4; v++ {
+		for u := 0; u < 4; u++ {
+			var s float64
+			for i := 0; i < 4; i++ {
+				s += whtBasis[v][i] * tmp[4*i+u]
+			}
+			out[4*v+u] = s / 2
+		}
+	}
+}
+
+// inverseDCT adds the inverse transform of c to the 4x4 block at dst, with
+// the exact integer arithmetic of section 14.3.
+func inverseDCT(c *[16]int16, dst []uint8, stride int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2).
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2).
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := int32(c[i+0]) + int32(c[i+8])
+		b := int32(c[i+0]) - int32(c[i+8])
+		cc := (int32(c[i+4])*c2)>>16 - (int32(c[i+12])*c1)>>16
+		d := (int32(c[i+4])*c1)>>16 + (int32(c[i+12])*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + cc
+		m[i][2] = b - cc
+		m[i][3] = a - d
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		cc := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := dst[j*stride:]
+		row[0] = clip8(int32(row[0]) + (a+d)>>3)
+		row[1] = clip8(int32(row[1]) + (b+cc)>>3)
+		row[2] = clip8(int32(row[2]) + (b-cc)>>3)
+		row[3] = clip8(int32(row[3]) + (a-d)>>3)
+	}
+}
+
+// inverseWHT returns the DC coefficients of the 16 luma blocks coded in the
+// Y2 block c, with the exact integer arithmetic of section 14.3.
+func inverseWHT(c *[16]int16) (dc [16]int16) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := int32(c[0+i]) + int32(c[12+i])
+		a1 := int32(c[4+i]) + int32(c[8+i])
+		a2 := int32(c[4+i]) - int32(c[8+i])
+		a3 := int32(c[0+i]) - int32(c[12+i])
+		m[0+i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		d := m[0+i*4] + 3
+		a0 := d + m[3+i*4]
+		a1 := m[1+i*4] + m[2+i*4]
+		a2 := m[1+i*4] - m[2+i*4]
+		a3 := d - m[3+i*4]
+		dc[4*i+0] = int16((a0 + a1) >> 3)
+		dc[4*i+1] = int16((a3 + a2) >> 3)
+		dc[4*i+2] = int16((a0 - a1) >> 3)
+		dc[4*i+3] = int16((a3 - a2) >> 3)
+	}
+	return
+}
+
+func quantize(c float64, q int32, bias float64) int16 {
+	level := int32(math.Abs(c)/float64(q) + bias)
+	if level > maxLevel {
+		level = maxLevel
+	}
+	if c < 0 {
+		return int16(-level)
+	}
+	return int16(level)
+}
+
+func sumAbsDiff(a, b []uint8) int {
+	sum := 0
+	for i := range a {
+		d := int(a[i]) - int(b[i])
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum
+}
+
+func clip(x, min, max int) int {
+	if x < min {
+		return min
+	}
+	if x > max {
+		return max
+	}
+	return x
+}
+
+func clip8(x int32) uint8 {
+	if x < 0 {
+		return 0
+	}
+	if x > 255 {
+		return 255
+	}
+	return uint8(x)
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,421 @@
+package webp
+
+import (
+	"image"
+	"math/bits"
+)
+
+// The transform types are specified in section 3 of the VP8L spec.
+const (
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+)
+
+const (
+	nLiteralCodes  = 256
+	nLengthCodes   = 24
+	nDistanceCodes = 40
+
+	// predictorBits is the log-2 size of the predictor transform tiles.
+	predictorBits = 4
+
+	// Backward references are searched in a hash chain of at most
+	// maxChainLength entries, within a window of maxDistance pixels.
+	hashBits       = 16
+	maxChainLength = 32
+	minMatchLength = 3
+	maxMatchLength = 4096
+	maxDistance    = 1<<20 - 120
+)
+
+// bitWriter writes the least significant bit first stream used by VP8L.
+type bitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint
+}
+
+// write writes the n least significant bits of v.
+func (w *bitWriter) write(v uint32, n uint) {
+	w.bits |= uint64(v) << w.nBits
+	w.nBits += n
+	for w.nBits >= 8 {
+		w.buf = append(w.buf, uint8(w.bits))
+		w.bits >>= 8
+		w.nBits -= 8
+	}
+}
+
+// flush pads the stream to a whole byte and returns it.
+func (w *bitWriter) flush() []byte {
+	if w.nBits > 0 {
+		w.buf = append(w.buf, uint8(w.bits))
+		w.bits, w.nBits = 0, 0
+	}
+	return w.buf
+}
+
+// encodeVP8L returns the VP8L lossless bitstream of m.
+func encodeVP8L(m *image.NRGBA, hasAlpha bool) []byte {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	pix := make([]uint8, 4*w*h)
+	for y := 0; y < h; y++ {
+		i := m.PixOffset(b.Min.X, b.Min.Y+y)
+		copy(pix[4*w*y:4*w*(y+1)], m.Pix[i:i+4*w])
+	}
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(w-1), 14)
+	bw.write(uint32(h-1), 14)
+	bw.write(uint32(btoi(hasAlpha)), 1)
+	bw.write(0, 3)
+
+	writeVP8LImage(bw, pix, w, h, true)
+
+	return bw.flush()
+}
+
+// writeVP8LImage writes the transforms and the entropy-coded pixels of an
+// image given in RGBA order. The alpha plane of lossy images is coded in
+// the green channel, where subtracting green would defeat its purpose.
+func writeVP8LImage(bw *bitWriter, pix []uint8, w, h int, subtractGreen bool) {
+	if subtractGreen {
+		bw.write(1, 1)
+		bw.write(transformSubtractGreen, 2)
+		for p := 0; p < len(pix); p += 4 {
+			pix[p+0] -= pix[p+1]
+			pix[p+2] -= pix[p+1]
+		}
+	}
+
+	bw.write(1, 1)
+	bw.write(transformPredictor, 2)
+	bw.write(predictorBits-2, 3)
+	modes, residuals := applyPredictor(pix, w, h)
+	writeEntropyImage(bw, modes, nTiles(w), nTiles(h), false)
+
+	// No more transforms.
+	bw.write(0, 1)
+
+	writeEntropyImage(bw, residuals, w, h, true)
+}
+
+func nTiles(size int) int {
+	return (size + 1<<predictorBits - 1) >> predictorBits
+}
+
+// applyPredictor picks, for each tile, the predictor mode of section 4.1
+// leaving the smallest residuals. It returns the sub-image of the modes
+// and the residuals.
+func applyPredictor(pix []uint8, w, h int) ([]uint8, []uint8) {
+	var (
+		tw, th    = nTiles(w), nTiles(h)
+		modes     = make([]uint8, 4*tw*th)
+		residuals = make([]uint8, len(pix))
+	)
+
+	residual := func(mode uint8, x, y int, dst []uint8) {
+		p := 4 * (y*w + x)
+		var pred [4]uint8
+		switch {
+		case x == 0 && y == 0:
+			pred = [4]uint8{0, 0, 0, 0xff}
+		case y == 0:
+			copy(pred[:], pix[p-4:p])
+		case x == 0:
+			copy(pred[:], pix[p-4*w:p-4*w+4])
+		default:
+			pred = predict(mode, pix, p, p-4*w)
+		}
+		for c := 0; c < 4; c++ {
+			dst[c] = pix[p+c] - pred[c]
+		}
+	}
+
+	var res [4]uint8
+	for ty := 0; ty < th; ty++ {
+		for tx := 0; tx < tw; tx++ {
+			best, bestCost := uint8(0), -1
+			for mode := uint8(0); mode < 14; mode++ {
+				cost := 0
+				for y := ty << predictorBits; y < h && y < (ty+1)<<predictorBits; y++ {
+					for x := tx << predictorBits; x < w && x < (tx+1)<<predictorBits; x++ {
+						residual(mode, x, y, res[:])
+						for _, r := range res {
+							cost += abs8(r)
+						}
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+
+			modes[4*(ty*tw+tx)+1] = best
+			modes[4*(ty*tw+tx)+3] = 0xff
+
+			for y := ty << predictorBits; y < h && y < (ty+1)<<predictorBits; y++ {
+				for x := tx << predictorBits; x < w && x < (tx+1)<<predictorBits; x++ {
+					p := 4 * (y*w + x)
+					residual(best, x, y, residuals[p:p+4])
+				}
+			}
+		}
+	}
+
+	return modes, residuals
+}
+
+// predict returns the prediction of the pixel at offset p, whose top
+// neighbour is at offset top, with the given mode.
+func predict(mode uint8, pix []uint8, p, top int) (pred [4]uint8) {
+	for c := 0; c < 4; c++ {
+		var (
+			l  = pix[p-4+c]
+			t  = pix[top+c]
+			tr = pix[top+4+c]
+			tl = pix[top-4+c]
+		)
+		switch mode {
+		case 0:
+			if c == 3 {
+				pred[c] = 0xff
+			}
+		case 1:
+			pred[c] = l
+		case 2:
+			pred[c] = t
+		case 3:
+			pred[c] = tr
+		case 4:
+			pred[c] = tl
+		case 5:
+			pred[c] = avg2(avg2(l, tr), t)
+		case 6:
+			pred[c] = avg2(l, tl)
+		case 7:
+			pred[c] = avg2(l, t)
+		case 8:
+			pred[c] = avg2(tl, t)
+		case 9:
+			pred[c] = avg2(t, tr)
+		case 10:
+			pred[c] = avg2(avg2(l, tl), avg2(t, tr))
+		case 12:
+			pred[c] = clampAddSubtractFull(l, t, tl)
+		case 13:
+			pred[c] = clampAddSubtractHalf(avg2(l, t), tl)
+		}
+	}
+
+	if mode == 11 {
+		var pl, pt int
+		for c := 0; c < 4; c++ {
+			pl += abs(int(pix[top-4+c]) - int(pix[top+c]))
+			pt += abs(int(pix[top-4+c]) - int(pix[p-4+c]))
+		}
+		src := top
+		if pl < pt {
+			src = p - 4
+		}
+		copy(pred[:], pix[src:src+4])
+	}
+
+	return pred
+}
+
+// writeEntropyImage writes pixels given in RGBA order with LZ77 backward
+// references and a single group of Huffman codes, as specified in
+// section 5 of the VP8L spec.
+func writeEntropyImage(bw *bitWriter, pix []uint8, w, h int, topLevel bool) {
+	argb := make([]uint32, w*h)
+	for i := range argb {
+		argb[i] = uint32(pix[4*i+3])<<24 | uint32(pix[4*i+0])<<16 | uint32(pix[4*i+1])<<8 | uint32(pix[4*i+2])
+	}
+
+	refs := backwardReferences(argb, w)
+
+	var (
+		green    = make([]uint32, nLiteralCodes+nLengthCodes)
+		red      = make([]uint32, 256)
+		blue     = make([]uint32, 256)
+		alpha    = make([]uint32, 256)
+		distance = make([]uint32, nDistanceCodes)
+	)
+	for _, r := range refs {
+		if r.length == 0 {
+			green[r.argb>>8&0xff]++
+			red[r.argb>>16&0xff]++
+			blue[r.argb&0xff]++
+			alpha[r.argb>>24]++
+			continue
+		}
+		symbol, _, _ := prefixEncode(r.length)
+		green[nLiteralCodes+symbol]++
+		symbol, _, _ = prefixEncode(r.distanceCode)
+		distance[symbol]++
+	}
+
+	// No color cache.
+	bw.write(0, 1)
+	if topLevel {
+		// A single group of Huffman codes for the whole image.
+		bw.write(0, 1)
+	}
+
+	var (
+		greenCode = writeHuffmanCode(bw, green)
+		redCode   = writeHuffmanCode(bw, red)
+		blueCode  = writeHuffmanCode(bw, blue)
+		alphaCode = writeHuffmanCode(bw, alpha)
+		distCode  = writeHuffmanCode(bw, distance)
+	)
+
+	for _, r := range refs {
+		if r.length == 0 {
+			greenCode.write(bw, int(r.argb>>8&0xff))
+			redCode.write(bw, int(r.argb>>16&0xff))
+			blueCode.write(bw, int(r.argb&0xff))
+			alphaCode.write(bw, int(r.argb>>24))
+			continue
+		}
+		symbol, extraBits, extra := prefixEncode(r.length)
+		greenCode.write(bw, nLiteralCodes+symbol)
+		bw.write(uint32(extra), uint(extraBits))
+		symbol, extraBits, extra = prefixEncode(r.distanceCode)
+		distCode.write(bw, symbol)
+		bw.write(uint32(extra), uint(extraBits))
+	}
+}
+
+// backwardRef is either a literal pixel, when length is zero, or a copy
+// of length pixels.
+type backwardRef struct {
+	argb         uint32
+	length       int
+	distanceCode int
+}
+
+// backwardReferences greedily replaces repeated runs of pixels by
+// references to their previous occurrence.
+func backwardReferences(argb []uint32, w int) []backwardRef {
+	var (
+		refs  = make([]backwardRef, 0, len(argb))
+		head  = make([]int32, 1<<hashBits)
+		chain = make([]int32, len(argb))
+	)
+	for i := range head {
+		head[i] = -1
+	}
+
+	hash := func(i int) uint32 {
+		return (argb[i]*0x1e35a7bd ^ argb[i+1]*0x9e3779b1) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+1 < len(argb) {
+			k := hash(i)
+			chain[i] = head[k]
+			head[k] = int32(i)
+		}
+	}
+	matchLength := func(i, j int) int {
+		n := 0
+		for i+n < len(argb) && n < maxMatchLength && argb[i+n] == argb[j+n] {
+			n++
+		}
+		return n
+	}
+
+	for i := 0; i < len(argb); {
+		bestLength, bestDistance := 0, 0
+
+		// Runs and repeated rows are the most frequent matches.
+		for _, d := range [2]int{1, w} {
+			if d <= i {
+				if n := matchLength(i, i-d); n > bestLength {
+					bestLength, bestDistance = n, d
+				}
+			}
+		}
+
+		if i+1 < len(argb) {
+			for j, tries := head[hash(i)], 0; j >= 0 && tries < maxChainLength; j, tries = chain[j], tries+1 {
+				d := i - int(j)
+				if d > maxDistance {
+					break
+				}
+				if n := matchLength(i, int(j)); n > bestLength {
+					bestLength, bestDistance = n, d
+				}
+			}
+		}
+
+		if bestLength < minMatchLength {
+			refs = append(refs, backwardRef{argb: argb[i]})
+			insert(i)
+			i++
+			continue
+		}
+
+		refs = append(refs, backwardRef{length: bestLength, distanceCode: distanceCode(bestDistance, w)})
+		for n := 0; n < bestLength; n++ {
+			insert(i + n)
+		}
+		i += bestLength
+	}
+
+	return refs
+}
+
+// distanceCode maps a distance in pixels to its code, using the short codes
+// of section 4.2.2 for the pixel above and the pixel on the left.
+func distanceCode(distance, w int) int {
+	switch distance {
+	case w:
+		return 1
+	case 1:
+		return 2
+	}
+	return distance + 120
+}
+
+// prefixEncode splits a length or distance code into its prefix symbol and
+// extra bits, as specified in section 5.2.2 of the VP8L spec.
+func prefixEncode(v int) (symbol, extraBits, extra int) {
+	if v <= 4 {
+		return v - 1, 0, 0
+	}
+	d := v - 1
+	highest := bits.Len(uint(d)) - 1
+	second := d >> uint(highest-1) & 1
+	extraBits = highest - 1
+	extra = d & (1<<uint(extraBits) - 1)
+	return 2*highest + second, extraBits, extra
+}
+
+func avg2(a, b uint8) uint8 {
+	return uint8((int32(a) + int32(b)) / 2)
+}
+
+func clampAddSubtractFull(a, b, c uint8) uint8 {
+	return clip8(int32(a) + int32(b) - int32(c))
+}
+
+func clampAddSubtractHalf(a, b uint8) uint8 {
+	return clip8(int32(a) + (int32(a)-int32(b))/2)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// abs8 returns the magnitude of a residual, seen as a signed byte.
+func abs8(r uint8) int {
+	return abs(int(int8(r)))
+}
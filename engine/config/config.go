@@ -17,9 +17,33 @@ type CommandBackend struct {
 	Weight    int
 }
 
+// Limits rejects images before they are decoded, zero values fall back to their default
+type Limits struct {
+	MaxWidth       int   `mapstructure:"max_width"`
+	MaxHeight      int   `mapstructure:"max_height"`
+	MaxPixels      int64 `mapstructure:"max_pixels"`
+	MaxTotalPixels int64 `mapstructure:"max_total_pixels"`
+	MaxFrames      int   `mapstructure:"max_frames"`
+	MaxBytes       int64 `mapstructure:"max_bytes"`
+}
+
+// Upload normalizes uploaded images, zero values fall back to their default,
+// an empty Format keeps the format of the uploaded image
+type Upload struct {
+	MaxWidth         int      `mapstructure:"max_width"`
+	MaxHeight        int      `mapstructure:"max_height"`
+	Format           string   `mapstructure:"format"`
+	Quality          int      `mapstructure:"quality"`
+	StripExif        bool     `mapstructure:"strip_exif"`
+	AutoOrient       *bool    `mapstructure:"auto_orient"`
+	AllowedMimetypes []string `mapstructure:"allowed_mimetypes"`
+	MaxBytes         int64    `mapstructure:"max_bytes"`
+}
+
 // Config is the engine config
 type Config struct {
 	Backends        *Backends `mapstructure:"backends"`
+	AutoFormat      bool      `mapstructure:"auto_format"`
 	DefaultFormat   string    `mapstructure:"default_format"`
 	Format          string    `mapstructure:"format"`
 	Quality         int       `mapstructure:"quality"`
@@ -28,4 +52,6 @@ type Config struct {
 	JpegQuality     int       `mapstructure:"jpeg_quality"`
 	PngCompression  int       `mapstructure:"png_compression"`
 	WebpQuality     int       `mapstructure:"webp_quality"`
+	Limits          *Limits   `mapstructure:"limits"`
+	Upload          *Upload   `mapstructure:"upload"`
 }
@@ -11,3 +11,28 @@ const DefaultMaxBufferSize = 8192
 
 // DefaultImageBufferSize is the default image buffer size for lilliput
 const DefaultImageBufferSize = 50 * 1024 * 1024
+
+// DefaultMaxWidth is the default maximum width of a source image
+const DefaultMaxWidth = 16384
+
+// DefaultMaxHeight is the default maximum height of a source image
+const DefaultMaxHeight = 16384
+
+// DefaultMaxPixels is the default maximum number of pixels of a source image
+const DefaultMaxPixels = 100 * 1000 * 1000
+
+// DefaultMaxFrames is the default maximum number of frames of a source image
+const DefaultMaxFrames = 1000
+
+// DefaultMaxTotalPixels is the default maximum number of pixels of all
+// the frames of a source image
+const DefaultMaxTotalPixels = 500 * 1000 * 1000
+
+// DefaultMaxBytes is the default maximum size of a source image
+const DefaultMaxBytes = 50 * 1024 * 1024
+
+// DefaultUploadMaxWidth is the default maximum width of an uploaded image
+const DefaultUploadMaxWidth = 2000
+
+// DefaultUploadMaxHeight is the default maximum height of an uploaded image
+const DefaultUploadMaxHeight = 2000
@@ -14,4 +14,11 @@ var MimeTypes = []string{
 	"image/png",
 	"image/bmp",
 	"image/gif",
+	"image/webp",
+}
+
+// NegotiatedFormats are the formats picked from the Accept header of a
+// request, by order of preference
+var NegotiatedFormats = []string{
+	"webp",
 }
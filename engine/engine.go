@@ -1,20 +1,30 @@
 package engine
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
 	"sort"
 	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/thoas/picfit/engine/backend"
 	"github.com/thoas/picfit/engine/config"
+	"github.com/thoas/picfit/failure"
 	"github.com/thoas/picfit/image"
+	"github.com/thoas/picfit/metrics"
+	"github.com/thoas/picfit/tracing"
 )
 
 type Engine struct {
+	AutoFormat     bool
 	DefaultFormat  string
 	Format         string
 	DefaultQuality int
+	Limits         config.Limits
+	Upload         UploadPolicy
 
 	backends []Backend
 }
@@ -75,9 +85,13 @@ func New(cfg config.Config) *Engine {
 	}
 
 	return &Engine{
+		// a forced format takes precedence over the negotiated one
+		AutoFormat:     cfg.AutoFormat && cfg.Format == "",
 		DefaultFormat:  cfg.DefaultFormat,
 		Format:         cfg.Format,
 		DefaultQuality: quality,
+		Limits:         newLimits(cfg.Limits),
+		Upload:         newUploadPolicy(cfg.Upload, quality),
 		backends:       b,
 	}
 }
@@ -91,6 +105,37 @@ func (e Engine) String() string {
 	return strings.Join(backendNames, " ")
 }
 
+// NegotiatedFormats returns the formats which can be negotiated with
+// the Accept header, by order of preference
+func (e Engine) NegotiatedFormats() []string {
+	formats := []string{}
+	for _, format := range NegotiatedFormats {
+		if e.Supports(format) {
+			formats = append(formats, format)
+		}
+	}
+
+	return formats
+}
+
+// Supports returns true if a backend is able to output the format
+func (e Engine) Supports(format string) bool {
+	ct, ok := ContentTypes[format]
+	if !ok {
+		return false
+	}
+
+	for j := range e.backends {
+		for k := range e.backends[j].mimetypes {
+			if ct == e.backends[j].mimetypes[k] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func (e Engine) getBackend(output *image.ImageFile) (*Backend, error) {
 	var (
 		err error
@@ -108,21 +153,37 @@ func (e Engine) getBackend(output *image.ImageFile) (*Backend, error) {
 	return nil, err
 }
 
-func (e Engine) UploadTransform(output *image.ImageFile, options *backend.Options) (*image.ImageFile, int, int, error) {
+func (e Engine) UploadTransform(ctx context.Context, output *image.ImageFile, options *backend.Options) (*image.ImageFile, int, int, error) {
 	var (
 		err       error
 		processed []byte
 		source    = output.Source
 	)
 
+	if err = e.CheckUpload(output); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if err = e.CheckLimits(output); err != nil {
+		return nil, 0, 0, err
+	}
+
 	bcnd, err := e.getBackend(output)
 	if err != nil {
 		return nil, 0, 0, err
 	}
+	if bcnd == nil {
+		return nil, 0, 0, failure.ErrUnsupportedFormat
+	}
 
-	processed, width, height, err := bcnd.UploadResize(output, options)
+	processed, width, height, err := bcnd.UploadResize(ctx, output, options)
 	if err != nil {
-		return nil, 0, 0, err
+		if ctx.Err() != nil {
+			return nil, 0, 0, ctx.Err()
+		}
+
+		// the header was decoded, the pixels are not valid
+		return nil, 0, 0, errors.Wrapf(failure.ErrInvalidImage, "unable to normalize: %s", err)
 	}
 
 	output.Source = source
@@ -131,21 +192,69 @@ func (e Engine) UploadTransform(output *image.ImageFile, options *backend.Option
 	return output, width, height, nil
 }
 
-func (e Engine) Transform(output *image.ImageFile, operations []EngineOperation) (*image.ImageFile, error) {
+// Backend returns the name of the backend transforming images to the format of output,
+// empty when no backend supports it
+func (e Engine) Backend(output *image.ImageFile) string {
+	bcnd, err := e.getBackend(output)
+	if err != nil || bcnd == nil {
+		return ""
+	}
+
+	return bcnd.String()
+}
+
+// Transform applies operations to the image, each operation is traced
+// as a child span of the span carried by ctx, it stops with the error
+// of ctx once ctx is done, the image and the images of the operations
+// are checked against the limits before being decoded
+func (e Engine) Transform(ctx context.Context, output *image.ImageFile, operations []EngineOperation) (*image.ImageFile, error) {
 	var (
 		err       error
 		processed []byte
 		source    = output.Source
 	)
 
+	if err = e.CheckLimits(output); err != nil {
+		return nil, err
+	}
+
+	for i := range operations {
+		for j := range operations[i].Options.Images {
+			if err = e.CheckLimits(&operations[i].Options.Images[j]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	bcnd, err := e.getBackend(output)
+	if err == nil && bcnd == nil && len(operations) > 0 {
+		return nil, failure.ErrUnsupportedFormat
+	}
 
 	for i := range operations {
 		if err != nil {
 			break
 		}
 
-		processed, err = operate(bcnd, output, operations[i].Operation, operations[i].Options)
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		_, span := tracing.Start(ctx, "engine."+operations[i].Operation.String(),
+			tracing.String("backend", bcnd.String()),
+			tracing.String("format", output.Format()))
+
+		processed, err = operate(ctx, bcnd, output, operations[i].Operation, operations[i].Options)
+		if err == backend.MethodNotImplementedError {
+			span.SetAttributes(tracing.Bool("not_implemented", true))
+		} else {
+			span.RecordError(err)
+			metrics.TransformDuration.
+				WithLabelValues(operations[i].Operation.String(), bcnd.String(), output.Format()).
+				Observe(time.Since(start).Seconds())
+		}
+		span.Finish()
 		if err == nil {
 			output.Source = processed
 			continue
@@ -161,22 +270,26 @@ func (e Engine) Transform(output *image.ImageFile, operations []EngineOperation)
 	return output, err
 }
 
-func operate(b backend.Backend, img *image.ImageFile, operation Operation, options *backend.Options) ([]byte, error) {
+func operate(ctx context.Context, b backend.Backend, img *image.ImageFile, operation Operation, options *backend.Options) ([]byte, error) {
 	switch operation {
 	case Flip:
-		return b.Flip(img, options)
+		return b.Flip(ctx, img, options)
 	case Rotate:
-		return b.Rotate(img, options)
+		return b.Rotate(ctx, img, options)
 	case Resize:
-		return b.Resize(img, options)
+		return b.Resize(ctx, img, options)
 	case Thumbnail:
-		return b.Thumbnail(img, options)
+		return b.Thumbnail(ctx, img, options)
 	case Fit:
-		return b.Fit(img, options)
+		return b.Fit(ctx, img, options)
 	case Flat:
-		return b.Flat(img, options)
+		return b.Flat(ctx, img, options)
 	case Blur:
-		return b.Blur(img, options)
+		return b.Blur(ctx, img, options)
+	case Crop:
+		return b.Crop(ctx, img, options)
+	case Watermark:
+		return b.Watermark(ctx, img, options)
 	default:
 		return nil, fmt.Errorf("Operation not found for %s", operation)
 	}
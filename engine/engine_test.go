@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/disintegration/imaging"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thoas/picfit/engine/backend"
+	"github.com/thoas/picfit/engine/config"
+	"github.com/thoas/picfit/failure"
+	"github.com/thoas/picfit/image"
+	"github.com/thoas/picfit/tracing"
+)
+
+func TestEngineWithoutBackend(t *testing.T) {
+	e := New(config.Config{
+		Backends: &config.Backends{
+			GoImage: &config.Backend{Mimetypes: []string{"image/png"}},
+		},
+	})
+
+	output := &image.ImageFile{
+		Source:   gifHeader(10, 10, 1),
+		Filepath: "image.gif",
+		Headers:  map[string]string{},
+	}
+
+	assert.Equal(t, "", e.Backend(output))
+
+	_, err := e.Transform(context.Background(), output, []EngineOperation{
+		{Operation: Resize, Options: &backend.Options{Width: 5, Height: 5}},
+	})
+	assert.Equal(t, failure.ErrUnsupportedFormat, err)
+}
+
+type recorder struct {
+	spans []*tracing.Span
+}
+
+func (r *recorder) Export(span *tracing.Span) { r.spans = append(r.spans, span) }
+
+func (r *recorder) Shutdown() error { return nil }
+
+func TestTransformNotImplementedSpan(t *testing.T) {
+	e := New(config.Config{
+		Backends: &config.Backends{
+			Lilliput: &config.Backend{Mimetypes: []string{"image/png"}},
+		},
+	})
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, png.Encode(buf, imaging.New(10, 10, color.White)))
+
+	exporter := &recorder{}
+	ctx, root := tracing.NewTracer(exporter, 1).Start(context.Background(), "root", tracing.KindServer)
+
+	_, err := e.Transform(ctx, &image.ImageFile{
+		Source:   buf.Bytes(),
+		Filepath: "image.png",
+		Headers:  map[string]string{},
+	}, []EngineOperation{
+		{Operation: Rotate, Options: &backend.Options{Degree: 90}},
+	})
+	assert.Equal(t, backend.MethodNotImplementedError, err)
+	root.Finish()
+
+	// the span of the operation is exported before its parent
+	assert.Len(t, exporter.spans, 2)
+	assert.Equal(t, "engine.rotate", exporter.spans[0].Name)
+	assert.Contains(t, exporter.spans[0].Attributes(), tracing.Bool("not_implemented", true))
+}
@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/engine/backend"
+	"github.com/thoas/picfit/engine/config"
+	"github.com/thoas/picfit/failure"
+	"github.com/thoas/picfit/image"
+)
+
+// Names of the limits reported by failure.LimitError
+const (
+	BytesLimit       = "bytes"
+	WidthLimit       = "width"
+	HeightLimit      = "height"
+	PixelsLimit      = "pixels"
+	TotalPixelsLimit = "total_pixels"
+	FramesLimit      = "frames"
+)
+
+func newLimits(cfg *config.Limits) config.Limits {
+	limits := config.Limits{
+		MaxWidth:       config.DefaultMaxWidth,
+		MaxHeight:      config.DefaultMaxHeight,
+		MaxPixels:      config.DefaultMaxPixels,
+		MaxTotalPixels: config.DefaultMaxTotalPixels,
+		MaxFrames:      config.DefaultMaxFrames,
+		MaxBytes:       config.DefaultMaxBytes,
+	}
+
+	if cfg == nil {
+		return limits
+	}
+
+	if cfg.MaxWidth > 0 {
+		limits.MaxWidth = cfg.MaxWidth
+	}
+	if cfg.MaxHeight > 0 {
+		limits.MaxHeight = cfg.MaxHeight
+	}
+	if cfg.MaxPixels > 0 {
+		limits.MaxPixels = cfg.MaxPixels
+	}
+	if cfg.MaxTotalPixels > 0 {
+		limits.MaxTotalPixels = cfg.MaxTotalPixels
+	}
+	if cfg.MaxFrames > 0 {
+		limits.MaxFrames = cfg.MaxFrames
+	}
+	if cfg.MaxBytes > 0 {
+		limits.MaxBytes = cfg.MaxBytes
+	}
+
+	return limits
+}
+
+// CheckLimits returns a failure.LimitError if the image exceeds a limit,
+// only its header is read so an image is rejected before being decoded
+func (e Engine) CheckLimits(img *image.ImageFile) error {
+	if size := int64(len(img.Source)); size > e.Limits.MaxBytes {
+		return &failure.LimitError{Limit: BytesLimit, Value: size, Max: e.Limits.MaxBytes}
+	}
+
+	header, err := backend.DecodeHeader(img.Source)
+	if err != nil {
+		return errors.Wrapf(failure.ErrInvalidImage, "unable to decode header: %s", err)
+	}
+
+	// each frame of a GIF image is decoded at the size of the image
+	pixels := int64(header.Width) * int64(header.Height)
+
+	switch {
+	case header.Width > e.Limits.MaxWidth:
+		return &failure.LimitError{Limit: WidthLimit, Value: int64(header.Width), Max: int64(e.Limits.MaxWidth)}
+	case header.Height > e.Limits.MaxHeight:
+		return &failure.LimitError{Limit: HeightLimit, Value: int64(header.Height), Max: int64(e.Limits.MaxHeight)}
+	case pixels > e.Limits.MaxPixels:
+		return &failure.LimitError{Limit: PixelsLimit, Value: pixels, Max: e.Limits.MaxPixels}
+	case header.Frames > e.Limits.MaxFrames:
+		return &failure.LimitError{Limit: FramesLimit, Value: int64(header.Frames), Max: int64(e.Limits.MaxFrames)}
+	case pixels*int64(header.Frames) > e.Limits.MaxTotalPixels:
+		return &failure.LimitError{Limit: TotalPixelsLimit, Value: pixels * int64(header.Frames), Max: e.Limits.MaxTotalPixels}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thoas/picfit/engine/config"
+	"github.com/thoas/picfit/failure"
+	"github.com/thoas/picfit/image"
+)
+
+// gifHeader returns a GIF image of the size with empty frames, only its
+// header can be read
+func gifHeader(width uint16, height uint16, frames int) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("GIF89a")
+	binary.Write(buf, binary.LittleEndian, []uint16{width, height})
+	buf.Write([]byte{0, 0, 0})
+
+	for i := 0; i < frames; i++ {
+		buf.WriteByte(0x2c)
+		binary.Write(buf, binary.LittleEndian, []uint16{0, 0, width, height})
+		buf.Write([]byte{0, 2, 0})
+	}
+
+	buf.WriteByte(0x3b)
+
+	return buf.Bytes()
+}
+
+func TestCheckLimitsTotalPixels(t *testing.T) {
+	e := New(config.Config{})
+
+	// 100 megapixels by frame, the maximum of a single image
+	for frames, limit := range map[int]string{
+		1:  "",
+		5:  "",
+		6:  TotalPixelsLimit,
+		50: TotalPixelsLimit,
+	} {
+		err := e.CheckLimits(&image.ImageFile{Source: gifHeader(10000, 10000, frames)})
+		if limit == "" {
+			assert.Nil(t, err, frames)
+			continue
+		}
+
+		limitErr, ok := errors.Cause(err).(*failure.LimitError)
+		assert.True(t, ok, frames)
+		assert.Equal(t, limit, limitErr.Limit, frames)
+		assert.Equal(t, int64(frames)*100*1000*1000, limitErr.Value, frames)
+	}
+}
@@ -17,6 +17,9 @@ const (
 	//Noop      = Operation("noop")
 	Flat = Operation("flat")
 	Blur = Operation("blur")
+	Crop = Operation("crop")
+
+	Watermark = Operation("watermark")
 )
 
 var Operations = map[string]Operation{
@@ -27,6 +30,8 @@ var Operations = map[string]Operation{
 	Fit.String():       Fit,
 	Flat.String():      Flat,
 	Blur.String():      Blur,
+	Crop.String():      Crop,
+	Watermark.String(): Watermark,
 }
 
 type EngineOperation struct {
@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/engine/config"
+	"github.com/thoas/picfit/failure"
+	"github.com/thoas/picfit/image"
+)
+
+// UploadPolicy normalizes uploaded images, an empty Format keeps
+// the format of the uploaded image and a zero MaxBytes only applies limits
+type UploadPolicy struct {
+	MaxWidth   int
+	MaxHeight  int
+	Format     string
+	Quality    int
+	StripExif  bool
+	AutoOrient bool
+	Mimetypes  []string
+	MaxBytes   int64
+}
+
+func newUploadPolicy(cfg *config.Upload, quality int) UploadPolicy {
+	policy := UploadPolicy{
+		MaxWidth:   config.DefaultUploadMaxWidth,
+		MaxHeight:  config.DefaultUploadMaxHeight,
+		Quality:    quality,
+		AutoOrient: true,
+		Mimetypes:  MimeTypes,
+	}
+
+	if cfg == nil {
+		return policy
+	}
+
+	if cfg.MaxWidth > 0 {
+		policy.MaxWidth = cfg.MaxWidth
+	}
+	if cfg.MaxHeight > 0 {
+		policy.MaxHeight = cfg.MaxHeight
+	}
+	if cfg.Quality > 0 {
+		policy.Quality = cfg.Quality
+	}
+	if cfg.AutoOrient != nil {
+		policy.AutoOrient = *cfg.AutoOrient
+	}
+	if len(cfg.AllowedMimetypes) > 0 {
+		policy.Mimetypes = cfg.AllowedMimetypes
+	}
+
+	policy.Format = strings.ToLower(cfg.Format)
+	policy.StripExif = cfg.StripExif
+	policy.MaxBytes = cfg.MaxBytes
+
+	return policy
+}
+
+// CheckUpload returns an error if an uploaded image is not allowed by the
+// upload policy, its type is detected from its content before it is decoded
+func (e Engine) CheckUpload(img *image.ImageFile) error {
+	if mimetype := UploadMimetype(img.Source); !e.UploadAllowed(mimetype) {
+		return errors.Wrapf(failure.ErrUnsupportedFormat, "%s is not allowed", mimetype)
+	}
+
+	if size := int64(len(img.Source)); e.Upload.MaxBytes > 0 && size > e.Upload.MaxBytes {
+		return &failure.LimitError{Limit: BytesLimit, Value: size, Max: e.Upload.MaxBytes}
+	}
+
+	return nil
+}
+
+// UploadAllowed returns true if images of mimetype can be uploaded
+func (e Engine) UploadAllowed(mimetype string) bool {
+	for i := range e.Upload.Mimetypes {
+		if e.Upload.Mimetypes[i] == mimetype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UploadMimetype returns the mimetype of an uploaded image detected from its content
+func UploadMimetype(content []byte) string {
+	return http.DetectContentType(content)
+}
@@ -2,6 +2,8 @@ package failure
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 var (
@@ -14,9 +16,87 @@ var (
 	// ErrQuality is an error when the quality requested is higher than expected
 	ErrQuality = errors.New("Quality should be <= 100")
 
+	// ErrTextTooLong is an error when the text of a watermark is longer than expected
+	ErrTextTooLong = errors.New("Text should be <= 100 characters")
+
 	// ErrUnprocessable is an error when parameters are missing
 	ErrUnprocessable = errors.New("Unprocessable request, missing parameters")
 
 	// ErrFileNotModified is an error when file is not modified
 	ErrFileNotModified = errors.New("File not modified")
+
+	// ErrFetchTooLarge is an error when a remote file exceeds the maximum size
+	ErrFetchTooLarge = errors.New("Remote file is too large")
+
+	// ErrFetchTimeout is an error when a remote file is not retrieved in time
+	ErrFetchTimeout = errors.New("Remote file retrieval timed out")
+
+	// ErrUpstream is an error when the server of a remote file fails
+	ErrUpstream = errors.New("Remote server error")
+
+	// ErrURLForbidden is an error when an url is not an allowed source
+	ErrURLForbidden = errors.New("URL is not allowed")
+
+	// ErrProcessingTimeout is an error when an image is not processed in time
+	ErrProcessingTimeout = errors.New("Processing timed out")
+
+	// ErrFileExists is an error when an uploaded file would replace an existing one
+	ErrFileExists = errors.New("File already exists")
+
+	// ErrInvalidPath is an error when the path of an uploaded file is not valid
+	ErrInvalidPath = errors.New("Invalid path")
+
+	// ErrUnsupportedFormat is an error when the format of an uploaded file is not supported
+	ErrUnsupportedFormat = errors.New("Unsupported image format")
+
+	// ErrInvalidImage is an error when an image cannot be decoded
+	ErrInvalidImage = errors.New("Invalid image")
+
+	// ErrInvalidURL is an error when the url of an uploaded file is not valid
+	ErrInvalidURL = errors.New("Invalid URL")
+
+	// ErrTooManyFiles is an error when a batch upload contains too many files
+	ErrTooManyFiles = errors.New("Too many files")
+
+	// ErrShuttingDown is an error when the server is shutting down
+	ErrShuttingDown = errors.New("Server is shutting down")
 )
+
+// StatusClientClosedRequest is the status of a request canceled by its client
+const StatusClientClosedRequest = 499
+
+// QueueFullError is an error when the server cannot accept more work,
+// the request can be retried after RetryAfter
+type QueueFullError struct {
+	RetryAfter time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	return "Server is busy, queue is full"
+}
+
+// ParameterError is an error when a parameter of a request is missing or not valid
+type ParameterError struct {
+	Message string
+}
+
+// NewParameterError returns a ParameterError with a formatted message
+func NewParameterError(format string, args ...interface{}) error {
+	return &ParameterError{Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *ParameterError) Error() string {
+	return e.Message
+}
+
+// LimitError is an error when a source image exceeds a limit,
+// it is returned before the image is decoded
+type LimitError struct {
+	Limit string
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Image exceeds the maximum %s: %d > %d", e.Limit, e.Value, e.Max)
+}
@@ -1,7 +1,10 @@
 package failure
 
 import (
+	"context"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/mholt/binding"
@@ -10,7 +13,21 @@ import (
 
 type Handler func(*gin.Context) error
 
+// Handle writes the errors of h as text
 func Handle(h Handler) gin.HandlerFunc {
+	return handle(h, func(c *gin.Context, status int, msg string) {
+		c.String(status, msg)
+	})
+}
+
+// HandleJSON writes the errors of h as a json object with an error key
+func HandleJSON(h Handler) gin.HandlerFunc {
+	return handle(h, func(c *gin.Context, status int, msg string) {
+		c.JSON(status, gin.H{"error": msg})
+	})
+}
+
+func handle(h Handler, write func(c *gin.Context, status int, msg string)) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		err := h(c)
 		if err != nil {
@@ -26,9 +43,96 @@ func Handle(h Handler) gin.HandlerFunc {
 				return
 			}
 
-			switch cerr.(type) {
+			if cerr == ErrFetchTooLarge {
+				write(c, http.StatusRequestEntityTooLarge, cerr.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == ErrFetchTimeout {
+				write(c, http.StatusGatewayTimeout, cerr.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == ErrURLForbidden {
+				write(c, http.StatusForbidden, cerr.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == ErrFileExists {
+				write(c, http.StatusConflict, cerr.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == ErrInvalidPath || cerr == ErrInvalidURL || cerr == ErrInvalidImage || cerr == ErrTextTooLong {
+				write(c, http.StatusBadRequest, cerr.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == ErrUnprocessable {
+				write(c, http.StatusUnprocessableEntity, cerr.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == ErrTooManyFiles {
+				write(c, http.StatusRequestEntityTooLarge, cerr.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == ErrUnsupportedFormat {
+				write(c, http.StatusUnsupportedMediaType, cerr.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == ErrShuttingDown {
+				write(c, http.StatusServiceUnavailable, cerr.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == ErrUpstream {
+				write(c, http.StatusBadGateway, cerr.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == context.DeadlineExceeded {
+				write(c, http.StatusGatewayTimeout, ErrProcessingTimeout.Error())
+				c.Abort()
+				return
+			}
+
+			if cerr == context.Canceled {
+				// the client is gone, the status is only logged
+				c.AbortWithStatus(StatusClientClosedRequest)
+				return
+			}
+
+			switch e := cerr.(type) {
+			case *QueueFullError:
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+				write(c, http.StatusServiceUnavailable, cerr.Error())
+				c.Abort()
+				return
+			case *LimitError:
+				write(c, http.StatusUnprocessableEntity, cerr.Error())
+				c.Abort()
+				return
+			case *ParameterError:
+				write(c, http.StatusBadRequest, cerr.Error())
+				c.Abort()
+				return
 			case binding.Errors:
-				c.String(http.StatusBadRequest, cerr.Error())
+				write(c, http.StatusBadRequest, cerr.Error())
+				c.Abort()
+				return
 			}
 
 			panic(err)
@@ -26,7 +26,7 @@ require (
 	github.com/mattn/go-colorable v0.1.1 // indirect
 	github.com/mholt/binding v0.0.0-20170917043419-f4f58459f5f7
 	github.com/mitchellh/goamz v0.0.0-20141203194042-e99a7300be96
-	github.com/mitchellh/mapstructure v0.0.0-20180220230111-00c29f56e238 // indirect
+	github.com/mitchellh/mapstructure v0.0.0-20180220230111-00c29f56e238
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/motain/gocheck v0.0.0-20131023154940-9beb271d26e6 // indirect
@@ -55,12 +55,13 @@ require (
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.10.0
 	golang.org/x/image v0.0.0-20200430140353-33d19683fad8
+	golang.org/x/sync v0.0.0-20190227155943-e225da77a7e6
 	gopkg.in/DATA-DOG/go-sqlmock.v1 v1.3.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/fukata/golang-stats-api-handler.v1 v1.0.0
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 	gopkg.in/go-playground/validator.v8 v8.18.2 // indirect
-	gopkg.in/redis.v5 v5.2.9 // indirect
+	gopkg.in/redis.v5 v5.2.9
 	gopkg.in/yaml.v2 v2.2.2 // indirect
 	launchpad.net/gocheck v0.0.0-20140225173054-000000000087 // indirect
 )
@@ -1,24 +1,19 @@
 package image
 
 import (
+	"context"
 	"io/ioutil"
 	"net/url"
+	"strings"
 
 	"github.com/ulule/gostorages"
 
 	"github.com/thoas/picfit/storage"
 )
 
-// FromURL retrieves an ImageFile from an url
-func FromURL(u *url.URL, userAgent string) (*ImageFile, error) {
-	storage := &storage.HTTPStorage{UserAgent: userAgent}
-
-	content, err := storage.OpenFromURL(u)
-	if err != nil {
-		return nil, err
-	}
-
-	headers, err := storage.HeadersFromURL(u)
+// FromURL retrieves an ImageFile from an url, the request is canceled with ctx
+func FromURL(ctx context.Context, storage *storage.HTTPStorage, u *url.URL) (*ImageFile, error) {
+	content, headers, err := storage.FetchFromURL(ctx, u)
 	if err != nil {
 		return nil, err
 	}
@@ -26,15 +21,20 @@ func FromURL(u *url.URL, userAgent string) (*ImageFile, error) {
 	return &ImageFile{
 		Source:   content,
 		Headers:  headers,
-		Filepath: u.Path[1:],
+		Filepath: strings.TrimPrefix(u.Path, "/"),
 	}, nil
 }
 
-// FromStorage retrieves an ImageFile from storage
-func FromStorage(storage gostorages.Storage, filepath string) (*ImageFile, error) {
+// FromStorage retrieves an ImageFile from storage, ctx is checked
+// before the file is opened and before it is read
+func FromStorage(ctx context.Context, storage gostorages.Storage, filepath string) (*ImageFile, error) {
 	var file *ImageFile
 	var err error
 
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	f, err := storage.Open(filepath)
 	if err != nil {
 		return nil, err
@@ -59,6 +59,10 @@ func FromStorage(storage gostorages.Storage, filepath string) (*ImageFile, error
 		"Content-Type":  contentType,
 	}
 
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	buf, err := ioutil.ReadAll(f)
 	if err != nil {
 		return nil, err
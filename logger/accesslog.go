@@ -0,0 +1,100 @@
+package logger
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Fields of the access log
+const (
+	MethodField     = "method"
+	PathField       = "path"
+	StatusField     = "status"
+	LatencyField    = "latency"
+	ClientIPField   = "client_ip"
+	KeyField        = "key"
+	CacheField      = "cache"
+	OperationsField = "operations"
+	SourceSizeField = "source_size"
+	OutputSizeField = "output_size"
+	FormatField     = "format"
+	BackendField    = "backend"
+	KeyIDField      = "key_id"
+)
+
+// AccessLogFields are the fields logged by default for each request
+var AccessLogFields = []string{
+	MethodField,
+	PathField,
+	StatusField,
+	LatencyField,
+	ClientIPField,
+	KeyField,
+	CacheField,
+	OperationsField,
+	SourceSizeField,
+	OutputSizeField,
+	FormatField,
+	BackendField,
+	KeyIDField,
+}
+
+// AccessLogConfig is a struct to configure the access log
+type AccessLogConfig struct {
+	Enabled  bool
+	Fields   []string
+	Sampling *SamplingConfig
+}
+
+// SamplingConfig is a struct to configure the sampling of the access log,
+// each second the first Initial requests are logged then every Thereafter-th
+type SamplingConfig struct {
+	Initial    int
+	Thereafter int
+}
+
+// GetFields returns the fields of the access log, all of them by default
+func (c *AccessLogConfig) GetFields() ([]string, error) {
+	if len(c.Fields) == 0 {
+		return AccessLogFields, nil
+	}
+
+	for _, field := range c.Fields {
+		if !isAccessLogField(field) {
+			return nil, fmt.Errorf("access log field %s is not supported", field)
+		}
+	}
+
+	return c.Fields, nil
+}
+
+func isAccessLogField(field string) bool {
+	for i := range AccessLogFields {
+		if AccessLogFields[i] == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewAccessLogger returns the logger of the access log, sampled when configured
+func NewAccessLogger(log Logger, cfg *AccessLogConfig) Logger {
+	l := log.With(String("logger", "access"))
+
+	if cfg.Sampling == nil {
+		return l
+	}
+
+	initial, thereafter := cfg.Sampling.Initial, cfg.Sampling.Thereafter
+	if thereafter <= 0 {
+		thereafter = 1
+	}
+
+	return l.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewSampler(core, time.Second, initial, thereafter)
+	}))
+}
@@ -10,7 +10,8 @@ const (
 
 // Config is a struct to configure logger
 type Config struct {
-	Level string
+	Level     string
+	AccessLog *AccessLogConfig `mapstructure:"access_log"`
 }
 
 // GetLevel returns the level of the logger
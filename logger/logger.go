@@ -46,6 +46,10 @@ func Time(key string, val time.Time) Field {
 	return zap.Time(key, val)
 }
 
+func Bool(k string, b bool) Field {
+	return zap.Bool(k, b)
+}
+
 func Int(k string, i int) Field {
 	return zap.Int(k, i)
 }
@@ -0,0 +1,9 @@
+package metadata
+
+// Config is a struct to configure the metadata returned, GPS fields are
+// removed unless GPS is true and the fields or sections of Exclude are
+// always removed
+type Config struct {
+	GPS     bool     `mapstructure:"gps"`
+	Exclude []string `mapstructure:"exclude"`
+}
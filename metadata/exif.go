@@ -0,0 +1,169 @@
+package metadata
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// skippedEXIFFields are the fields describing the structure of the
+// image rather than the image itself
+var skippedEXIFFields = map[exif.FieldName]bool{
+	exif.ExifIFDPointer:                   true,
+	exif.GPSInfoIFDPointer:                true,
+	exif.InteroperabilityIFDPointer:       true,
+	exif.ThumbJPEGInterchangeFormat:       true,
+	exif.ThumbJPEGInterchangeFormatLength: true,
+	exif.MakerNote:                        true,
+}
+
+// decodeEXIF returns the EXIF fields of an image and its location,
+// nil when the image has no EXIF
+func decodeEXIF(source []byte) (map[string]interface{}, *GPS) {
+	x, err := exif.Decode(bytes.NewReader(source))
+	if x == nil || (err != nil && exif.IsCriticalError(err)) {
+		return nil, nil
+	}
+
+	fields := map[string]interface{}{}
+	x.Walk(walker(func(name exif.FieldName, tag *tiff.Tag) error {
+		if skippedEXIFFields[name] {
+			return nil
+		}
+
+		if value, ok := exifValue(tag); ok {
+			fields[string(name)] = value
+		}
+
+		return nil
+	}))
+
+	if len(fields) == 0 {
+		fields = nil
+	}
+
+	lat, ok := gpsCoordinate(x, exif.GPSLatitude, exif.GPSLatitudeRef, "S")
+	if !ok {
+		return fields, nil
+	}
+
+	long, ok := gpsCoordinate(x, exif.GPSLongitude, exif.GPSLongitudeRef, "W")
+	if !ok {
+		return fields, nil
+	}
+
+	gps := &GPS{Latitude: lat, Longitude: long}
+
+	if tag, err := x.Get(exif.GPSAltitude); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && den != 0 {
+			altitude := float64(num) / float64(den)
+
+			// a reference of 1 is below the sea level
+			if ref, err := x.Get(exif.GPSAltitudeRef); err == nil {
+				if v, err := ref.Int(0); err == nil && v == 1 {
+					altitude = -altitude
+				}
+			}
+
+			gps.Altitude = &altitude
+		}
+	}
+
+	return fields, gps
+}
+
+// gpsCoordinate returns a coordinate in degrees from the degrees, minutes
+// and seconds of its tag, negative when its reference is negative, false
+// when a rational has a zero denominator
+func gpsCoordinate(x *exif.Exif, name exif.FieldName, refName exif.FieldName, negative string) (float64, bool) {
+	tag, err := x.Get(name)
+	if err != nil || tag.Format() != tiff.RatVal || tag.Count != 3 {
+		return 0, false
+	}
+
+	ref, err := x.Get(refName)
+	if err != nil {
+		return 0, false
+	}
+
+	var coordinate float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num, den, err := tag.Rat2(i)
+		if err != nil || den == 0 {
+			return 0, false
+		}
+
+		coordinate += float64(num) / float64(den) / unit
+	}
+
+	if v, err := ref.StringVal(); err == nil && strings.TrimSpace(v) == negative {
+		coordinate = -coordinate
+	}
+
+	return coordinate, true
+}
+
+// walker is a function implementing exif.Walker
+type walker func(name exif.FieldName, tag *tiff.Tag) error
+
+func (w walker) Walk(name exif.FieldName, tag *tiff.Tag) error {
+	return w(name, tag)
+}
+
+// exifValue returns the value of a tag, a single value is returned as is
+// and rationals as floats, undefined values are only returned when they
+// are text such as versions
+func exifValue(tag *tiff.Tag) (interface{}, bool) {
+	switch tag.Format() {
+	case tiff.StringVal:
+		value, err := tag.StringVal()
+		if err != nil {
+			return nil, false
+		}
+
+		value = strings.TrimSpace(value)
+
+		return value, value != ""
+	case tiff.UndefVal:
+		value := strings.TrimRight(string(tag.Val), "\x00 ")
+		if value == "" || !utf8.ValidString(value) || strings.IndexFunc(value, func(r rune) bool {
+			return !unicode.IsPrint(r)
+		}) != -1 {
+			return nil, false
+		}
+
+		return value, true
+	}
+
+	var values []interface{}
+	for i := 0; i < int(tag.Count); i++ {
+		switch tag.Format() {
+		case tiff.IntVal:
+			if v, err := tag.Int64(i); err == nil {
+				values = append(values, v)
+			}
+		case tiff.FloatVal:
+			if v, err := tag.Float(i); err == nil && !math.IsNaN(v) && !math.IsInf(v, 0) {
+				values = append(values, v)
+			}
+		case tiff.RatVal:
+			if num, den, err := tag.Rat2(i); err == nil && den != 0 {
+				values = append(values, float64(num)/float64(den))
+			}
+		}
+	}
+
+	switch len(values) {
+	case 0:
+		return nil, false
+	case 1:
+		return values[0], true
+	}
+
+	return values, true
+}
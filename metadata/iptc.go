@@ -0,0 +1,199 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"unicode/utf8"
+)
+
+// iptcFields are the names of the datasets of the application record,
+// the datasets of repeatedIPTCFields are returned as lists
+var iptcFields = map[byte]string{
+	5:   "object_name",
+	25:  "keywords",
+	40:  "special_instructions",
+	55:  "date_created",
+	60:  "time_created",
+	80:  "byline",
+	85:  "byline_title",
+	90:  "city",
+	92:  "sublocation",
+	95:  "province_state",
+	100: "country_code",
+	101: "country",
+	105: "headline",
+	110: "credit",
+	115: "source",
+	116: "copyright",
+	120: "caption",
+	122: "writer",
+}
+
+var repeatedIPTCFields = map[string]bool{
+	"keywords": true,
+	"byline":   true,
+}
+
+const (
+	photoshopHeader  = "Photoshop 3.0\x00"
+	iptcResourceID   = 0x0404
+	iptcApplication  = 2
+	iptcTagMarker    = 0x1c
+	jpegMarkerPrefix = 0xff
+	jpegSOI          = 0xd8
+	jpegSOS          = 0xda
+	jpegAPP13        = 0xed
+)
+
+// decodeIPTC returns the IPTC fields stored in the APP13 segment
+// of a JPEG image, nil when the image has none
+func decodeIPTC(source []byte) map[string]interface{} {
+	var fields map[string]interface{}
+
+	for _, segment := range jpegSegments(source, jpegAPP13) {
+		if !bytes.HasPrefix(segment, []byte(photoshopHeader)) {
+			continue
+		}
+
+		data := photoshopResource(segment[len(photoshopHeader):], iptcResourceID)
+		if data == nil {
+			continue
+		}
+
+		if fields == nil {
+			fields = map[string]interface{}{}
+		}
+
+		decodeIPTCRecords(data, fields)
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return fields
+}
+
+// jpegSegments returns the payloads of the segments of a JPEG image
+// with the marker, segments after the start of the scan are not read
+func jpegSegments(source []byte, marker byte) [][]byte {
+	if len(source) < 2 || source[0] != jpegMarkerPrefix || source[1] != jpegSOI {
+		return nil
+	}
+
+	var segments [][]byte
+	for i := 2; i+4 <= len(source); {
+		if source[i] != jpegMarkerPrefix {
+			return segments
+		}
+
+		current := source[i+1]
+		if current == jpegMarkerPrefix {
+			i++
+			continue
+		}
+
+		if current == jpegSOS {
+			return segments
+		}
+
+		length := int(binary.BigEndian.Uint16(source[i+2:]))
+		if length < 2 || i+2+length > len(source) {
+			return segments
+		}
+
+		if current == marker {
+			segments = append(segments, source[i+4:i+2+length])
+		}
+
+		i += 2 + length
+	}
+
+	return segments
+}
+
+// photoshopResource returns the data of the image resource with the id,
+// nil when it is not found
+func photoshopResource(data []byte, id uint16) []byte {
+	for len(data) >= 12 && string(data[:4]) == "8BIM" {
+		resourceID := binary.BigEndian.Uint16(data[4:])
+
+		// the name is a pascal string padded to an even size
+		nameLength := int(data[6]) + 1
+		if nameLength%2 != 0 {
+			nameLength++
+		}
+
+		offset := 6 + nameLength
+		if offset+4 > len(data) {
+			return nil
+		}
+
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		offset += 4
+		if size < 0 || offset+size > len(data) {
+			return nil
+		}
+
+		if resourceID == id {
+			return data[offset : offset+size]
+		}
+
+		if size%2 != 0 {
+			size++
+		}
+
+		if offset+size > len(data) {
+			return nil
+		}
+
+		data = data[offset+size:]
+	}
+
+	return nil
+}
+
+// decodeIPTCRecords adds the datasets of the application record to fields
+func decodeIPTCRecords(data []byte, fields map[string]interface{}) {
+	for len(data) >= 5 && data[0] == iptcTagMarker {
+		record, dataset := data[1], data[2]
+
+		// extended datasets are not used by text fields
+		size := int(binary.BigEndian.Uint16(data[3:]))
+		if size&0x8000 != 0 || 5+size > len(data) {
+			return
+		}
+
+		value := iptcString(data[5 : 5+size])
+		data = data[5+size:]
+
+		name, ok := iptcFields[dataset]
+		if record != iptcApplication || !ok || value == "" {
+			continue
+		}
+
+		if !repeatedIPTCFields[name] {
+			fields[name] = value
+			continue
+		}
+
+		values, _ := fields[name].([]string)
+		fields[name] = append(values, value)
+	}
+}
+
+// iptcString returns the text of a dataset, text which is not UTF-8
+// is read as Latin-1
+func iptcString(value []byte) string {
+	if utf8.Valid(value) {
+		return strings.TrimSpace(string(value))
+	}
+
+	runes := make([]rune, len(value))
+	for i := range value {
+		runes[i] = rune(value[i])
+	}
+
+	return strings.TrimSpace(string(runes))
+}
@@ -0,0 +1,111 @@
+package metadata
+
+import (
+	"strings"
+)
+
+// Sections of the metadata, they can be excluded as a whole
+const (
+	EXIFSection = "exif"
+	GPSSection  = "gps"
+	IPTCSection = "iptc"
+	XMPSection  = "xmp"
+)
+
+// Metadata is the metadata embedded in an image, sections not found
+// in the image are nil
+type Metadata struct {
+	EXIF map[string]interface{} `json:"exif,omitempty"`
+	GPS  *GPS                   `json:"gps,omitempty"`
+	IPTC map[string]interface{} `json:"iptc,omitempty"`
+	XMP  map[string]interface{} `json:"xmp,omitempty"`
+}
+
+// GPS is the location of an image in decimal degrees, the altitude
+// is in meters when it is known
+type GPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// Decode reads the EXIF, IPTC and XMP metadata of an image, metadata
+// which cannot be read is ignored
+func Decode(source []byte) *Metadata {
+	m := &Metadata{
+		IPTC: decodeIPTC(source),
+		XMP:  decodeXMP(source),
+	}
+
+	m.EXIF, m.GPS = decodeEXIF(source)
+
+	return m
+}
+
+// Filter removes the fields of the metadata which should not be disclosed
+type Filter struct {
+	gps     bool
+	exclude map[string]bool
+}
+
+// NewFilter returns the filter of a config, GPS fields are removed
+// when cfg is nil
+func NewFilter(cfg *Config) *Filter {
+	f := &Filter{exclude: map[string]bool{}}
+	if cfg == nil {
+		return f
+	}
+
+	f.gps = cfg.GPS
+	for _, name := range cfg.Exclude {
+		f.exclude[strings.ToLower(name)] = true
+	}
+
+	return f
+}
+
+// Apply returns a copy of m without the excluded fields
+func (f *Filter) Apply(m *Metadata) *Metadata {
+	filtered := &Metadata{
+		EXIF: f.fields(EXIFSection, m.EXIF, func(name string) bool {
+			return strings.HasPrefix(name, "GPS")
+		}),
+		IPTC: f.fields(IPTCSection, m.IPTC, nil),
+		XMP: f.fields(XMPSection, m.XMP, func(name string) bool {
+			return strings.HasPrefix(name, "exif:GPS")
+		}),
+	}
+
+	if f.gps && !f.exclude[GPSSection] {
+		filtered.GPS = m.GPS
+	}
+
+	return filtered
+}
+
+// fields returns the fields of a section which are not excluded,
+// isGPS reports the fields holding a location
+func (f *Filter) fields(section string, fields map[string]interface{}, isGPS func(string) bool) map[string]interface{} {
+	if len(fields) == 0 || f.exclude[section] {
+		return nil
+	}
+
+	filtered := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		if f.exclude[strings.ToLower(name)] {
+			continue
+		}
+
+		if !f.gps && isGPS != nil && isGPS(name) {
+			continue
+		}
+
+		filtered[name] = value
+	}
+
+	if len(filtered) == 0 {
+		return nil
+	}
+
+	return filtered
+}
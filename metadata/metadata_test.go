@@ -0,0 +1,104 @@
+package metadata
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fixture(t *testing.T, filename string) []byte {
+	source, err := ioutil.ReadFile(path.Join("..", "tests", "fixtures", filename))
+	assert.Nil(t, err)
+
+	return source
+}
+
+func TestDecode(t *testing.T) {
+	m := Decode(fixture(t, "metadata.jpg"))
+
+	assert.Equal(t, "Canon", m.EXIF["Make"])
+	assert.Equal(t, "Canon EOS 5D", m.EXIF["Model"])
+	assert.Equal(t, float64(72), m.EXIF["XResolution"])
+	assert.Equal(t, "2020:06:01 21:30:00", m.EXIF["DateTime"])
+	assert.Equal(t, "picfit", m.EXIF["Copyright"])
+	assert.Equal(t, "N", m.EXIF["GPSLatitudeRef"])
+	assert.Equal(t, []interface{}{float64(48), float64(51), float64(24)}, m.EXIF["GPSLatitude"])
+	assert.NotContains(t, m.EXIF, "GPSInfoIFDPointer")
+
+	assert.NotNil(t, m.GPS)
+	assert.InDelta(t, 48.8567, m.GPS.Latitude, 0.0001)
+	assert.InDelta(t, -2.35, m.GPS.Longitude, 0.0001)
+	assert.NotNil(t, m.GPS.Altitude)
+	assert.Equal(t, float64(35), *m.GPS.Altitude)
+
+	assert.Equal(t, map[string]interface{}{
+		"caption":   "The Eiffel tower at night",
+		"copyright": "picfit",
+		"byline":    []string{"Jane Doe"},
+		"keywords":  []string{"paris", "night"},
+		"city":      "Paris",
+	}, m.IPTC)
+
+	assert.Equal(t, map[string]interface{}{
+		"xmp:CreatorTool":    "picfit",
+		"photoshop:Headline": "Eiffel tower",
+		"dc:description":     "The Eiffel tower at night",
+		"dc:rights":          "© picfit",
+		"dc:creator":         []string{"Jane Doe"},
+		"dc:subject":         []string{"paris", "night"},
+		"exif:GPSLatitude":   "48,51.4N",
+	}, m.XMP)
+
+	for _, filename := range []string{"schwarzy.jpg", "avatar.png", "giphy.gif"} {
+		assert.Equal(t, &Metadata{}, Decode(fixture(t, filename)), filename)
+	}
+}
+
+func TestDecodeGPSZeroDenominator(t *testing.T) {
+	// the denominator of the degrees of the latitude is zero
+	m := Decode(fixture(t, "metadata-gps-zero.jpg"))
+
+	assert.Equal(t, "Canon", m.EXIF["Make"])
+	assert.Nil(t, m.GPS)
+
+	_, err := json.Marshal(m)
+	assert.Nil(t, err)
+}
+
+func TestFilter(t *testing.T) {
+	m := Decode(fixture(t, "metadata.jpg"))
+
+	// GPS fields are removed by default
+	filtered := NewFilter(nil).Apply(m)
+	assert.Nil(t, filtered.GPS)
+	assert.Equal(t, "Canon", filtered.EXIF["Make"])
+	assert.NotContains(t, filtered.EXIF, "GPSLatitude")
+	assert.NotContains(t, filtered.EXIF, "GPSLatitudeRef")
+	assert.NotContains(t, filtered.XMP, "exif:GPSLatitude")
+	assert.Equal(t, m.IPTC, filtered.IPTC)
+
+	// the metadata is not modified
+	assert.Contains(t, m.EXIF, "GPSLatitude")
+
+	filtered = NewFilter(&Config{GPS: true}).Apply(m)
+	assert.Equal(t, m, filtered)
+
+	filtered = NewFilter(&Config{
+		GPS:     true,
+		Exclude: []string{"model", "Copyright", "dc:creator", "xmp"},
+	}).Apply(m)
+	assert.Equal(t, m.GPS, filtered.GPS)
+	assert.Contains(t, filtered.EXIF, "GPSLatitude")
+	assert.NotContains(t, filtered.EXIF, "Model")
+	assert.NotContains(t, filtered.EXIF, "Copyright")
+	assert.NotContains(t, filtered.IPTC, "copyright")
+	assert.Equal(t, "Paris", filtered.IPTC["city"])
+	assert.Nil(t, filtered.XMP)
+
+	filtered = NewFilter(&Config{GPS: true, Exclude: []string{"gps"}}).Apply(m)
+	assert.Nil(t, filtered.GPS)
+	assert.Contains(t, filtered.EXIF, "GPSLatitude")
+}
@@ -0,0 +1,171 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+const rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+// xmpNamespaces are the prefixes of the XMP namespaces returned,
+// properties of other namespaces are ignored
+var xmpNamespaces = map[string]string{
+	"http://purl.org/dc/elements/1.1/":            "dc",
+	"http://ns.adobe.com/xap/1.0/":                "xmp",
+	"http://ns.adobe.com/xap/1.0/rights/":         "xmpRights",
+	"http://ns.adobe.com/photoshop/1.0/":          "photoshop",
+	"http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/": "Iptc4xmpCore",
+	"http://ns.adobe.com/exif/1.0/":               "exif",
+	"http://ns.adobe.com/exif/1.0/aux/":           "aux",
+	"http://ns.adobe.com/tiff/1.0/":               "tiff",
+}
+
+var (
+	xmpStart = []byte("<x:xmpmeta")
+	xmpEnd   = []byte("</x:xmpmeta>")
+)
+
+// decodeXMP returns the simple properties of the XMP packet of an image
+// named after their prefix, the packet is searched as is in the image,
+// nil when the image has none
+func decodeXMP(source []byte) map[string]interface{} {
+	start := bytes.Index(source, xmpStart)
+	if start == -1 {
+		return nil
+	}
+
+	end := bytes.Index(source[start:], xmpEnd)
+	if end == -1 {
+		return nil
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(source[start : start+end+len(xmpEnd)]))
+
+	properties := map[string]interface{}{}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok || element.Name.Space != rdfNamespace || element.Name.Local != "Description" {
+			continue
+		}
+
+		for _, attr := range element.Attr {
+			if name, ok := xmpName(attr.Name); ok && attr.Value != "" {
+				properties[name] = attr.Value
+			}
+		}
+
+		if err := decodeXMPProperties(decoder, properties); err != nil {
+			break
+		}
+	}
+
+	if len(properties) == 0 {
+		return nil
+	}
+
+	return properties
+}
+
+// decodeXMPProperties adds the properties of a description to properties
+// until the end of the description
+func decodeXMPProperties(decoder *xml.Decoder, properties map[string]interface{}) error {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			value, err := decodeXMPValue(decoder)
+			if err != nil {
+				return err
+			}
+
+			if name, ok := xmpName(t.Name); ok && value != nil {
+				properties[name] = value
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// decodeXMPValue returns the value of a property until its end, the first
+// item of alternatives such as localized texts, the items of lists and
+// nil for structures
+func decodeXMPValue(decoder *xml.Decoder) (interface{}, error) {
+	var (
+		text  strings.Builder
+		items []string
+		alt   bool
+		depth int
+	)
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Space == rdfNamespace && t.Name.Local == "li" {
+				var item string
+				if err := decoder.DecodeElement(&item, &t); err != nil {
+					return nil, err
+				}
+
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+				continue
+			}
+
+			if t.Name.Space == rdfNamespace && t.Name.Local == "Alt" {
+				alt = true
+			}
+
+			depth++
+		case xml.EndElement:
+			if depth > 0 {
+				depth--
+				continue
+			}
+
+			switch {
+			case alt && len(items) > 0:
+				return items[0], nil
+			case len(items) > 0:
+				return items, nil
+			}
+
+			if value := strings.TrimSpace(text.String()); value != "" {
+				return value, nil
+			}
+
+			return nil, nil
+		case xml.CharData:
+			if depth == 0 {
+				text.Write(t)
+			}
+		}
+	}
+}
+
+// xmpName returns the prefixed name of a property, false when its
+// namespace is not returned
+func xmpName(name xml.Name) (string, bool) {
+	prefix, ok := xmpNamespaces[name.Space]
+	if !ok {
+		return "", false
+	}
+
+	return prefix + ":" + name.Local, true
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import "time"
+
+// DefaultRegistry is the registry of the picfit metrics
+var DefaultRegistry = NewRegistry()
+
+var (
+	// Requests counts the HTTP requests by endpoint and status code
+	Requests = DefaultRegistry.NewCounterVec(
+		"picfit_http_requests_total",
+		"Number of HTTP requests by endpoint and status code.",
+		"endpoint", "status")
+
+	// TransformDuration observes the duration of each operation
+	// of a transformation by backend and output format
+	TransformDuration = DefaultRegistry.NewHistogramVec(
+		"picfit_transform_duration_seconds",
+		"Duration of image operations by operation, backend and format.",
+		nil, "operation", "backend", "format")
+
+	// KVStoreRequests counts the lookups of processed images in the kvstore
+	// by result: hit, miss or error
+	KVStoreRequests = DefaultRegistry.NewCounterVec(
+		"picfit_kvstore_requests_total",
+		"Number of kvstore lookups by result.",
+		"result")
+
+	// StorageDuration observes the duration of reads and writes on the
+	// source and destination storages
+	StorageDuration = DefaultRegistry.NewHistogramVec(
+		"picfit_storage_duration_seconds",
+		"Duration of storage operations by storage and operation.",
+		nil, "storage", "operation")
+
+	// FetchBytes counts the bytes of the images retrieved from urls
+	FetchBytes = DefaultRegistry.NewCounterVec(
+		"picfit_fetch_bytes_total",
+		"Number of bytes retrieved from source urls.")
+)
+
+const (
+	// SourceStorage is the label of the source storage
+	SourceStorage = "source"
+	// DestinationStorage is the label of the destination storage
+	DestinationStorage = "destination"
+
+	// ReadOperation is the label of storage reads
+	ReadOperation = "read"
+	// WriteOperation is the label of storage writes
+	WriteOperation = "write"
+
+	// Hit is the label of images found in the kvstore
+	Hit = "hit"
+	// Miss is the label of images not found in the kvstore
+	Miss = "miss"
+	// Error is the label of failed kvstore lookups
+	Error = "error"
+)
+
+// ObserveStorage observes the duration of a storage operation started at start
+func ObserveStorage(storage string, operation string, start time.Time) {
+	StorageDuration.WithLabelValues(storage, operation).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounterVec("requests_total", "Number of requests.", "endpoint", "status")
+	requests.WithLabelValues("display", "200").Inc()
+	requests.WithLabelValues("display", "200").Add(2)
+	requests.WithLabelValues("get", "404").Inc()
+	requests.WithLabelValues(`a"b\c`, "500").Inc()
+
+	size := registry.NewCounterVec("bytes_total", "Number of bytes.")
+	size.WithLabelValues().Add(1024)
+
+	duration := registry.NewHistogramVec("duration_seconds", "Duration\nof operations.", []float64{0.1, 1}, "operation")
+	duration.WithLabelValues("resize").Observe(0.05)
+	duration.WithLabelValues("resize").Observe(0.5)
+	duration.WithLabelValues("resize").Observe(2)
+
+	expected := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{endpoint="a\"b\\c",status="500"} 1
+requests_total{endpoint="display",status="200"} 3
+requests_total{endpoint="get",status="404"} 1
+# HELP bytes_total Number of bytes.
+# TYPE bytes_total counter
+bytes_total 1024
+# HELP duration_seconds Duration\nof operations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{operation="resize",le="0.1"} 1
+duration_seconds_bucket{operation="resize",le="1"} 2
+duration_seconds_bucket{operation="resize",le="+Inf"} 3
+duration_seconds_sum{operation="resize"} 2.55
+duration_seconds_count{operation="resize"} 3
+`
+
+	res := httptest.NewRecorder()
+	registry.ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, ContentType, res.Header().Get("Content-Type"))
+	assert.Equal(t, expected, res.Body.String())
+
+	assert.Panics(t, func() {
+		requests.WithLabelValues("display")
+	})
+}
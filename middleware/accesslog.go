@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/thoas/picfit/constants"
+	"github.com/thoas/picfit/logger"
+)
+
+// AccessLog logs each request with the fields given, including the
+// metadata of the image set in the context by the processor
+func AccessLog(log logger.Logger, fields []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+
+		defer func() {
+			status := c.Writer.Status()
+
+			// handlers panic on unexpected errors which are recovered as 500
+			r := recover()
+			if r != nil {
+				status = http.StatusInternalServerError
+			}
+
+			values := accessLogFields(c, fields, path, status, time.Since(start))
+			if status >= http.StatusInternalServerError {
+				log.Error("Request", values...)
+			} else {
+				log.Info("Request", values...)
+			}
+
+			if r != nil {
+				panic(r)
+			}
+		}()
+
+		c.Next()
+	}
+}
+
+func accessLogFields(c *gin.Context, fields []string, path string, status int, latency time.Duration) []logger.Field {
+	values := make([]logger.Field, 0, len(fields))
+
+	for _, field := range fields {
+		switch field {
+		case logger.MethodField:
+			values = append(values, logger.String(field, c.Request.Method))
+		case logger.PathField:
+			values = append(values, logger.String(field, path))
+		case logger.StatusField:
+			values = append(values, logger.Int(field, status))
+		case logger.LatencyField:
+			values = append(values, logger.Duration(field, latency))
+		case logger.ClientIPField:
+			values = append(values, logger.String(field, c.ClientIP()))
+		case logger.KeyField:
+			if key := c.GetString("key"); key != "" {
+				values = append(values, logger.String(field, key))
+			}
+		case logger.CacheField:
+			if cache := c.GetString(constants.CacheContextKey); cache != "" {
+				values = append(values, logger.String(field, cache))
+			}
+		case logger.OperationsField:
+			if operations := operationsFromContext(c); operations != "" {
+				values = append(values, logger.String(field, operations))
+			}
+		case logger.SourceSizeField:
+			if size, ok := c.Get(constants.SourceSizeContextKey); ok {
+				values = append(values, logger.Int(field, size.(int)))
+			}
+		case logger.OutputSizeField:
+			if size, ok := c.Get(constants.OutputSizeContextKey); ok {
+				values = append(values, logger.Int(field, size.(int)))
+			}
+		case logger.FormatField:
+			if format := c.GetString(constants.FormatContextKey); format != "" {
+				values = append(values, logger.String(field, format))
+			}
+		case logger.BackendField:
+			if backend := c.GetString(constants.BackendContextKey); backend != "" {
+				values = append(values, logger.String(field, backend))
+			}
+		case logger.KeyIDField:
+			if id := c.GetString(constants.KeyIDContextKey); id != "" {
+				values = append(values, logger.String(field, id))
+			}
+		}
+	}
+
+	return values
+}
+
+// operationsFromContext returns the names of the operations set by
+// OperationParser, a single operation or a list of operations with parameters
+func operationsFromContext(c *gin.Context) string {
+	switch operations := c.Value(constants.OperationParamName).(type) {
+	case string:
+		return operations
+	case []string:
+		names := make([]string, len(operations))
+		for i := range operations {
+			names[i] = operations[i]
+			for _, p := range strings.Split(operations[i], " ") {
+				if strings.HasPrefix(p, constants.OperationParamName+":") {
+					names[i] = strings.TrimPrefix(p, constants.OperationParamName+":")
+				}
+			}
+		}
+		return strings.Join(names, ",")
+	}
+
+	return ""
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/thoas/picfit/constants"
+	"github.com/thoas/picfit/logger"
+)
+
+func newBufferLogger(buf *bytes.Buffer) logger.Logger {
+	encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	return zap.New(zapcore.NewCore(encoder, zapcore.AddSync(buf), zapcore.DebugLevel))
+}
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var entry map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+		lines = append(lines, entry)
+	}
+
+	return lines
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+
+	router := gin.New()
+	router.Use(AccessLog(newBufferLogger(&buf), logger.AccessLogFields))
+	router.GET("/display", func(c *gin.Context) {
+		c.Set("key", "abc")
+		c.Set(constants.OperationParamName, []string{"op:resize w:100 h:100", "op:flip pos:top"})
+		c.Set(constants.CacheContextKey, "miss")
+		c.Set(constants.SourceSizeContextKey, 1024)
+		c.Set(constants.OutputSizeContextKey, 512)
+		c.Set(constants.FormatContextKey, "png")
+		c.Set(constants.BackendContextKey, "goimage")
+		c.String(http.StatusOK, "ok")
+	})
+	router.GET("/error", func(c *gin.Context) {
+		c.String(http.StatusBadGateway, "ko")
+	})
+
+	for _, path := range []string{"/display?url=http://example.com/a.png", "/error"} {
+		request, _ := http.NewRequest("GET", path, nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	lines := decodeLines(t, &buf)
+	assert.Len(t, lines, 2)
+
+	entry := lines[0]
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "Request", entry["msg"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/display", entry["path"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, "192.0.2.1", entry["client_ip"])
+	assert.Equal(t, "abc", entry["key"])
+	assert.Equal(t, "miss", entry["cache"])
+	assert.Equal(t, "resize,flip", entry["operations"])
+	assert.Equal(t, float64(1024), entry["source_size"])
+	assert.Equal(t, float64(512), entry["output_size"])
+	assert.Equal(t, "png", entry["format"])
+	assert.Equal(t, "goimage", entry["backend"])
+	assert.Contains(t, entry, "latency")
+
+	entry = lines[1]
+	assert.Equal(t, "error", entry["level"])
+	assert.Equal(t, float64(502), entry["status"])
+	assert.NotContains(t, entry, "key")
+	assert.NotContains(t, entry, "backend")
+}
+
+func TestAccessLogFields(t *testing.T) {
+	var buf bytes.Buffer
+
+	cfg := &logger.AccessLogConfig{Fields: []string{"status", "path"}}
+	fields, err := cfg.GetFields()
+	assert.Nil(t, err)
+
+	router := gin.New()
+	router.Use(AccessLog(newBufferLogger(&buf), fields))
+	router.GET("/get", func(c *gin.Context) {
+		c.Set("key", "abc")
+		c.String(http.StatusOK, "ok")
+	})
+
+	request, _ := http.NewRequest("GET", "/get", nil)
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	lines := decodeLines(t, &buf)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, float64(200), lines[0]["status"])
+	assert.Equal(t, "/get", lines[0]["path"])
+	assert.NotContains(t, lines[0], "key")
+	assert.NotContains(t, lines[0], "method")
+
+	_, err = (&logger.AccessLogConfig{Fields: []string{"status", "referer"}}).GetFields()
+	assert.NotNil(t, err)
+
+	fields, err = (&logger.AccessLogConfig{}).GetFields()
+	assert.Nil(t, err)
+	assert.Equal(t, logger.AccessLogFields, fields)
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+
+	log := logger.NewAccessLogger(newBufferLogger(&buf), &logger.AccessLogConfig{
+		Sampling: &logger.SamplingConfig{Initial: 2, Thereafter: 5},
+	})
+
+	router := gin.New()
+	router.Use(AccessLog(log, logger.AccessLogFields))
+	router.GET("/get", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	for i := 0; i < 12; i++ {
+		request, _ := http.NewRequest("GET", "/get", nil)
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	// the first two requests then the 7th and the 12th
+	lines := decodeLines(t, &buf)
+	assert.Len(t, lines, 4)
+	assert.Equal(t, "access", lines[0]["logger"])
+}
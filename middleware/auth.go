@@ -7,16 +7,20 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/thoas/go-funk"
+	"github.com/thoas/picfit/auth"
 	"github.com/thoas/picfit/config"
+	"github.com/thoas/picfit/constants"
+	"github.com/thoas/picfit/logger"
 	"github.com/thoas/picfit/signature"
 )
 
-// Security wraps the request and confront sent parameters with secret key
-func Security(secretKey string) gin.HandlerFunc {
+// Security wraps the request and confront sent parameters with the keys of the verifier,
+// requests are not verified when verifier is nil
+func Security(verifier *signature.Verifier) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if secretKey != "" {
-			if !signature.VerifyParameters(secretKey, c.MustGet("parameters").(map[string]interface{})) {
-				c.String(http.StatusUnauthorized, "Invalid signature")
+		if verifier != nil {
+			if err := verifier.Verify(c.MustGet("parameters").(map[string]interface{})); err != nil {
+				c.String(http.StatusUnauthorized, err.Error())
 				c.Abort()
 				return
 			}
@@ -26,6 +30,54 @@ func Security(secretKey string) gin.HandlerFunc {
 	}
 }
 
+// Authenticate requires the API key of the request to have the scope,
+// requests are not authenticated when authenticator is nil. The ID of the
+// key is set in the context and logged with the status of the request
+func Authenticate(authenticator *auth.Authenticator, scope string, log logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authenticator == nil {
+			c.Next()
+			return
+		}
+
+		key, err := authenticator.Authenticate(c.Request)
+		if err != nil {
+			log.Info("Request not authenticated",
+				logger.String("method", c.Request.Method),
+				logger.String("path", c.Request.URL.Path),
+				logger.String("client_ip", c.ClientIP()),
+				logger.Error(err))
+
+			c.String(http.StatusUnauthorized, err.Error())
+			c.Abort()
+			return
+		}
+
+		if !key.Allows(scope) {
+			log.Info("Request not allowed",
+				logger.String("key_id", key.ID),
+				logger.String("scope", scope),
+				logger.String("method", c.Request.Method),
+				logger.String("path", c.Request.URL.Path))
+
+			c.String(http.StatusForbidden, "Key not allowed to "+scope)
+			c.Abort()
+			return
+		}
+
+		c.Set(constants.KeyIDContextKey, key.ID)
+
+		c.Next()
+
+		log.Info("Authenticated request",
+			logger.String("key_id", key.ID),
+			logger.String("scope", scope),
+			logger.String("method", c.Request.Method),
+			logger.String("path", c.Request.URL.Path),
+			logger.Int("status", c.Writer.Status()))
+	}
+}
+
 func RestrictIPAddresses(ipAddresses []string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if len(ipAddresses) > 0 {
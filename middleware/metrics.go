@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/thoas/picfit/metrics"
+)
+
+// Metrics counts the requests of an endpoint by status code
+func Metrics(endpoint string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			// handlers panic on unexpected errors which are recovered as 500
+			if r := recover(); r != nil {
+				metrics.Requests.WithLabelValues(endpoint, strconv.Itoa(http.StatusInternalServerError)).Inc()
+				panic(r)
+			}
+		}()
+
+		c.Next()
+
+		metrics.Requests.WithLabelValues(endpoint, strconv.Itoa(c.Writer.Status())).Inc()
+	}
+}
@@ -5,14 +5,18 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 
 	"github.com/thoas/picfit/constants"
 	"github.com/thoas/picfit/engine"
+	"github.com/thoas/picfit/failure"
 	"github.com/thoas/picfit/hash"
 	"github.com/thoas/picfit/image"
+	"github.com/thoas/picfit/storage"
 	"github.com/thoas/picfit/util"
 )
 
@@ -50,6 +54,54 @@ func ParametersParser() gin.HandlerFunc {
 	}
 }
 
+// AcceptParser negotiates the output format with the Accept header when the
+// format is "auto" or when no format is given and autoFormat is enabled,
+// formats are the negotiable formats by order of preference
+func AcceptParser(autoFormat bool, formats []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format := c.Query(constants.FormatParamName)
+
+		if format == constants.AutoFormat || (format == "" && autoFormat) {
+			c.Set(constants.AcceptParamName, negotiateFormat(c.GetHeader("Accept"), formats))
+		}
+
+		c.Next()
+	}
+}
+
+// negotiateFormat returns the first format explicitly accepted by the
+// Accept header, wildcards are ignored since browsers send them without
+// supporting every image format
+func negotiateFormat(header string, formats []string) string {
+	accepted := make(map[string]bool)
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if value, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+					q = value
+				}
+			}
+		}
+
+		accepted[mediaType] = q > 0
+	}
+
+	for _, format := range formats {
+		contentType, ok := engine.ContentTypes[format]
+		if ok && accepted[contentType] {
+			return format
+		}
+	}
+
+	return ""
+}
+
 // KeyParser injects an unique key from query parameters
 func KeyParser() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -64,6 +116,15 @@ func KeyParser() gin.HandlerFunc {
 		delete(sorted, constants.SigParamName)
 		delete(sorted, constants.ForceParamName)
 
+		// urls signed with other keys or expiring later share the same image
+		delete(sorted, constants.KeyIDParamName)
+		delete(sorted, constants.ExpiresParamName)
+
+		// the negotiated format changes the output for the same parameters
+		if accept, ok := c.Get(constants.AcceptParamName); ok {
+			sorted[constants.AcceptParamName] = accept
+		}
+
 		if len(sorted) != 0 {
 			serialized := hash.Serialize(sorted)
 
@@ -101,8 +162,9 @@ func setParamsFromURLValues(params map[string]interface{}, values url.Values) ma
 	return util.SortMapString(params)
 }
 
-// URLParser extracts the url query string and add a url.URL to the context
-func URLParser(mimetypeDetectorType string) gin.HandlerFunc {
+// URLParser extracts the url query string and add a url.URL to the context,
+// urls rejected by the policy are forbidden
+func URLParser(mimetypeDetectorType string, policy *storage.URLPolicy) gin.HandlerFunc {
 	mimetypeDetector := image.GetMimetypeDetector(mimetypeDetectorType)
 
 	return func(c *gin.Context) {
@@ -117,6 +179,18 @@ func URLParser(mimetypeDetectorType string) gin.HandlerFunc {
 				return
 			}
 
+			if policy != nil {
+				if err := policy.Validate(url); err != nil {
+					if errors.Cause(err) == failure.ErrURLForbidden {
+						c.String(http.StatusForbidden, fmt.Sprintf("URL %s is not allowed", value))
+					} else {
+						c.String(http.StatusBadGateway, fmt.Sprintf("URL %s cannot be resolved", value))
+					}
+					c.Abort()
+					return
+				}
+			}
+
 			mimetype, _ := mimetypeDetector(url)
 
 			_, ok := image.Extensions[mimetype]
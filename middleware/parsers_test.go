@@ -31,3 +31,15 @@ func TestSetParamsFromURLValues(t *testing.T) {
 	assert.Equal(t, params["op"].([]string)[0], "resize")
 	assert.Equal(t, params["op"].([]string)[1], "rotate")
 }
+
+func TestNegotiateFormat(t *testing.T) {
+	formats := []string{"webp"}
+
+	assert.Equal(t, negotiateFormat("image/avif,image/webp,image/apng,*/*;q=0.8", formats), "webp")
+	assert.Equal(t, negotiateFormat("image/avif,*/*", formats), "")
+	assert.Equal(t, negotiateFormat("image/webp;q=0.5, image/*", formats), "webp")
+	assert.Equal(t, negotiateFormat("image/webp;q=0, image/*", formats), "")
+	assert.Equal(t, negotiateFormat("IMAGE/WEBP", formats), "webp")
+	assert.Equal(t, negotiateFormat("image/*,*/*", formats), "")
+	assert.Equal(t, negotiateFormat("", formats), "")
+}
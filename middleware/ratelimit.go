@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/thoas/picfit/auth"
+	"github.com/thoas/picfit/constants"
+	"github.com/thoas/picfit/logger"
+	"github.com/thoas/picfit/ratelimit"
+)
+
+// Rate limit headers set on the responses of limited endpoints
+const (
+	RateLimitLimitHeader     = "X-RateLimit-Limit"
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset"
+)
+
+// RateLimit takes a token of the limit returned by name for the client of
+// each request, requests are let through when the limiter fails
+func RateLimit(limiter *ratelimit.Limiter, authenticator *auth.Authenticator, log logger.Logger, name func(c *gin.Context) (string, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := rateLimitClient(c, authenticator)
+
+		limit, err := name(c)
+		if err != nil {
+			log.Error("Unable to rate limit request",
+				logger.String("client", client),
+				logger.Error(err))
+			c.Next()
+			return
+		}
+
+		result, ok, err := limiter.Take(limit, client)
+		if err != nil {
+			log.Error("Unable to rate limit request",
+				logger.String("client", client),
+				logger.String("limit", limit),
+				logger.Error(err))
+			c.Next()
+			return
+		}
+
+		if !ok {
+			c.Next()
+			return
+		}
+
+		c.Header(RateLimitLimitHeader, strconv.Itoa(result.Limit))
+		c.Header(RateLimitRemainingHeader, strconv.Itoa(result.Remaining))
+		c.Header(RateLimitResetHeader, ceilSeconds(result.Reset))
+
+		if !result.Allowed {
+			c.Header("Retry-After", ceilSeconds(result.RetryAfter))
+			c.String(http.StatusTooManyRequests, "Too many requests")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// rateLimitClient identifies the client of a request by the ID of its API
+// key once authenticated or by its IP address, unauthenticated keys are
+// ignored since any value would get its own bucket
+func rateLimitClient(c *gin.Context, authenticator *auth.Authenticator) string {
+	if id := c.GetString(constants.KeyIDContextKey); id != "" {
+		return "key:" + id
+	}
+
+	if authenticator != nil {
+		if key, err := authenticator.Authenticate(c.Request); err == nil {
+			return "key:" + key.ID
+		}
+	}
+
+	return "ip:" + c.ClientIP()
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thoas/picfit/auth"
+	"github.com/thoas/picfit/logger"
+	"github.com/thoas/picfit/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), map[string]ratelimit.Limit{
+		ratelimit.Upload: {Rate: 0.5, Burst: 2},
+	})
+
+	authenticator, err := auth.New(&auth.Config{Keys: []auth.Key{{ID: "client", Secret: "s3cr3t"}}})
+	assert.Nil(t, err)
+
+	log, err := logger.NewNopLogger()
+	assert.Nil(t, err)
+
+	router := gin.New()
+	router.GET("/", RateLimit(limiter, authenticator, log, func(c *gin.Context) (string, error) {
+		return ratelimit.Upload, nil
+	}), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	do := func(key string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if key != "" {
+			req.Header.Set(auth.APIKeyHeader, key)
+		}
+
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := do("")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "2", res.Header().Get(RateLimitLimitHeader))
+	assert.Equal(t, "1", res.Header().Get(RateLimitRemainingHeader))
+	assert.Equal(t, "2", res.Header().Get(RateLimitResetHeader))
+
+	res = do("")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "0", res.Header().Get(RateLimitRemainingHeader))
+
+	res = do("")
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "2", res.Header().Get("Retry-After"))
+
+	// keys which are not valid are ignored
+	res = do("secret")
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+
+	// authenticated clients are limited separately from their IP address
+	res = do("s3cr3t")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "1", res.Header().Get(RateLimitRemainingHeader))
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/thoas/picfit/tracing"
+)
+
+// Tracing starts a server span for the requests of an endpoint, continuing
+// the trace of the traceparent header when provided
+func Tracing(tracer *tracing.Tracer, endpoint string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if sc, err := tracing.ParseTraceparent(c.GetHeader(tracing.TraceparentHeader)); err == nil {
+			ctx = tracing.ContextWithRemote(ctx, sc)
+		}
+
+		ctx, span := tracer.Start(ctx, fmt.Sprintf("%s /%s", c.Request.Method, endpoint), tracing.KindServer,
+			tracing.String("http.method", c.Request.Method),
+			tracing.String("http.target", c.Request.URL.RequestURI()),
+			tracing.String("http.route", endpoint))
+
+		c.Request = c.Request.WithContext(ctx)
+
+		defer func() {
+			// handlers panic on unexpected errors which are recovered as 500
+			if r := recover(); r != nil {
+				span.SetAttributes(tracing.Int("http.status_code", http.StatusInternalServerError))
+				span.RecordError(fmt.Errorf("%v", r))
+				span.Finish()
+				panic(r)
+			}
+		}()
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(tracing.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.RecordError(fmt.Errorf("%s", http.StatusText(status)))
+		}
+		span.Finish()
+	}
+}
@@ -1,9 +1,10 @@
 package picfit
 
 import (
-	"fmt"
+	"context"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/disintegration/imaging"
 	"github.com/pkg/errors"
@@ -21,6 +22,12 @@ const (
 	defaultHeight  = 0
 	defaultDegree  = 90
 	defaultSigma   = 0.0
+	defaultX       = 0
+	defaultY       = 0
+	defaultOpacity = 100
+	defaultPadding = 0
+	defaultScale   = 0
+	maxTextLength  = 100
 )
 
 var formats = map[string]imaging.Format{
@@ -29,6 +36,7 @@ var formats = map[string]imaging.Format{
 	"png":  imaging.PNG,
 	"gif":  imaging.GIF,
 	"bmp":  imaging.BMP,
+	"webp": backend.WEBP,
 }
 
 type Parameters struct {
@@ -36,27 +44,38 @@ type Parameters struct {
 	Operations []engine.EngineOperation
 }
 
-// newParameters returns Parameters for engine.
+// UploadParmaOptions returns the options normalizing an uploaded image with
+// the upload policy, input is saved in its format and its source is the uploaded one
 func (p *Processor) UploadParmaOptions(input *image.ImageFile) *backend.Options {
+	var (
+		policy = p.Engine.Upload
+		format = input.Format()
+	)
+
 	return &backend.Options{
-		Upscale: false,
-		Format:  formats[input.Format()],
-		Quality: p.Engine.DefaultQuality,
-		Height:  defaultHeight,
-		Width:   defaultWidth,
-		Degree:  defaultDegree,
-		Sigma:   defaultSigma,
+		Upscale:    false,
+		Format:     formats[format],
+		Quality:    policy.Quality,
+		Height:     policy.MaxHeight,
+		Width:      policy.MaxWidth,
+		Degree:     defaultDegree,
+		Sigma:      defaultSigma,
+		AutoOrient: policy.AutoOrient,
+		Normalize:  policy.StripExif || image.Extensions[engine.UploadMimetype(input.Source)] != format,
 	}
 }
 
 // newParameters returns Parameters for engine.
-func (p *Processor) NewParameters(input *image.ImageFile, qs map[string]interface{}) (*Parameters, error) {
-	format, ok := qs["fmt"].(string)
+func (p *Processor) NewParameters(ctx context.Context, input *image.ImageFile, qs map[string]interface{}) (*Parameters, error) {
+	format, ok := qs[constants.FormatParamName].(string)
 	filepath := input.Filepath
 
-	if ok {
+	if format == constants.AutoFormat {
+		accept, _ := qs[constants.AcceptParamName].(string)
+		format = negotiateFormat(input, accept)
+	} else if ok {
 		if _, ok := engine.ContentTypes[format]; !ok {
-			return nil, fmt.Errorf("Unknown format %s", format)
+			return nil, failure.NewParameterError("Unknown format %s", format)
 		}
 
 	}
@@ -95,7 +114,7 @@ func (p *Processor) NewParameters(input *image.ImageFile, qs map[string]interfac
 	op, ok := qs["op"].(string)
 	if ok {
 		operation := engine.Operation(op)
-		opts, err := p.newBackendOptionsFromParameters(operation, qs)
+		opts, err := p.newBackendOptionsFromParameters(ctx, operation, qs)
 		if err != nil {
 			return nil, err
 		}
@@ -115,12 +134,12 @@ func (p *Processor) NewParameters(input *image.ImageFile, qs map[string]interfac
 			operation, k := engine.Operations[ops[i]]
 			if k {
 				engineOperation.Operation = operation
-				engineOperation.Options, err = p.newBackendOptionsFromParameters(operation, qs)
+				engineOperation.Options, err = p.newBackendOptionsFromParameters(ctx, operation, qs)
 				if err != nil {
 					return nil, err
 				}
 			} else {
-				engineOperation, err = p.NewEngineOperationFromQuery(ops[i])
+				engineOperation, err = p.NewEngineOperationFromQuery(ctx, ops[i])
 				if err != nil {
 					return nil, err
 				}
@@ -139,7 +158,27 @@ func (p *Processor) NewParameters(input *image.ImageFile, qs map[string]interfac
 	}, nil
 }
 
-func (p Processor) NewEngineOperationFromQuery(op string) (*engine.EngineOperation, error) {
+// negotiateFormat returns the output format of an auto formatted image:
+// the format accepted by the client, otherwise PNG when the color model of
+// the source has an alpha channel and JPEG when it has not, animated GIFs are
+// left unchanged, the source is not decoded before its limits are checked
+func negotiateFormat(input *image.ImageFile, accept string) string {
+	if input.Format() == "gif" {
+		return "gif"
+	}
+
+	if accept != "" {
+		return accept
+	}
+
+	if input.Format() != "jpg" && backend.HasAlpha(input.Source) {
+		return "png"
+	}
+
+	return "jpg"
+}
+
+func (p Processor) NewEngineOperationFromQuery(ctx context.Context, op string) (*engine.EngineOperation, error) {
 	params := make(map[string]interface{})
 	var imagePaths []string
 	for _, p := range strings.Split(op, " ") {
@@ -159,7 +198,7 @@ func (p Processor) NewEngineOperationFromQuery(op string) (*engine.EngineOperati
 	}
 
 	operation := engine.Operation(op)
-	opts, err := p.newBackendOptionsFromParameters(operation, params)
+	opts, err := p.newBackendOptionsFromParameters(ctx, operation, params)
 	if err != nil {
 		return nil, err
 	}
@@ -169,7 +208,7 @@ func (p Processor) NewEngineOperationFromQuery(op string) (*engine.EngineOperati
 			return nil, errors.Wrapf(failure.ErrFileNotExists, "file does not exist: %s", imagePaths[i])
 		}
 
-		file, err := image.FromStorage(p.SourceStorage, imagePaths[i])
+		file, err := image.FromStorage(ctx, p.SourceStorage, imagePaths[i])
 		if err != nil {
 			return nil, errors.Wrapf(err, "unable to load file from storage: %s", imagePaths[i])
 		}
@@ -182,7 +221,7 @@ func (p Processor) NewEngineOperationFromQuery(op string) (*engine.EngineOperati
 	}, nil
 }
 
-func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, qs map[string]interface{}) (*backend.Options, error) {
+func (p Processor) newBackendOptionsFromParameters(ctx context.Context, operation engine.Operation, qs map[string]interface{}) (*backend.Options, error) {
 	var (
 		err     error
 		quality = p.Engine.DefaultQuality
@@ -191,6 +230,13 @@ func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, q
 		width   = defaultWidth
 		degree  = defaultDegree
 		sigma   = defaultSigma
+		x       = defaultX
+		y       = defaultY
+		opacity = defaultOpacity
+		padding = defaultPadding
+		scale   = defaultScale
+		tile    bool
+		images  []image.ImageFile
 	)
 
 	q, ok := qs["q"].(string)
@@ -207,7 +253,7 @@ func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, q
 
 	position, ok := qs["pos"].(string)
 	if !ok && operation == engine.Flip {
-		return nil, fmt.Errorf("Parameter \"pos\" not found in query string")
+		return nil, failure.NewParameterError("Parameter \"pos\" not found in query string")
 	}
 
 	stick, _ := qs["stick"].(string)
@@ -220,12 +266,133 @@ func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, q
 			}
 		}
 		if !exists {
-			return nil, fmt.Errorf("Parameter \"stick\" has wrong value. Available values are: %v", constants.StickPositions)
+			return nil, failure.NewParameterError("Parameter \"stick\" has wrong value. Available values are: %v", constants.StickPositions)
 		}
 	}
 
 	color, _ := qs["color"].(string)
 
+	gravity, _ := qs["gravity"].(string)
+	if gravity != "" {
+		var exists bool
+		for i := range constants.Gravities {
+			if gravity == constants.Gravities[i] {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			return nil, failure.NewParameterError("Parameter \"gravity\" has wrong value. Available values are: %v", constants.Gravities)
+		}
+	}
+
+	crop, _ := qs["crop"].(string)
+	if crop != "" {
+		var exists bool
+		for i := range constants.CropModes {
+			if crop == constants.CropModes[i] {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			return nil, failure.NewParameterError("Parameter \"crop\" has wrong value. Available values are: %v", constants.CropModes)
+		}
+	}
+
+	xs, hasX := qs["x"].(string)
+	if hasX {
+		x, err = strconv.Atoi(xs)
+		if err != nil {
+			return nil, failure.NewParameterError("Parameter \"x\" must be an integer")
+		}
+	}
+
+	ys, hasY := qs["y"].(string)
+	if hasY {
+		y, err = strconv.Atoi(ys)
+		if err != nil {
+			return nil, failure.NewParameterError("Parameter \"y\" must be an integer")
+		}
+	}
+
+	if gravity != "" && (hasX || hasY) {
+		return nil, failure.NewParameterError("Parameter \"gravity\" cannot be used with \"x\" or \"y\"")
+	}
+
+	if operation == engine.Crop && gravity == "" && !hasX && !hasY {
+		gravity = constants.Center
+	}
+
+	text, _ := qs["text"].(string)
+	logo, _ := qs["logo"].(string)
+
+	if operation == engine.Watermark {
+		if text == "" && logo == "" {
+			return nil, failure.NewParameterError("Parameter \"text\" or \"logo\" not found in query string")
+		}
+
+		if utf8.RuneCountInString(text) > maxTextLength {
+			return nil, failure.ErrTextTooLong
+		}
+
+		if gravity == "" {
+			gravity = constants.SouthEast
+		}
+
+		if logo != "" {
+			if !p.SourceStorage.Exists(logo) {
+				return nil, errors.Wrapf(failure.ErrFileNotExists, "file does not exist: %s", logo)
+			}
+
+			file, err := image.FromStorage(ctx, p.SourceStorage, logo)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to load file from storage: %s", logo)
+			}
+			images = append(images, *file)
+		}
+	}
+
+	if o, ok := qs["opacity"].(string); ok {
+		opacity, err = strconv.Atoi(o)
+		if err != nil {
+			return nil, failure.NewParameterError("Parameter \"opacity\" must be an integer")
+		}
+
+		if opacity < 0 || opacity > 100 {
+			return nil, failure.NewParameterError("Parameter \"opacity\" must be between 0 and 100")
+		}
+	}
+
+	if pad, ok := qs["padding"].(string); ok {
+		padding, err = strconv.Atoi(pad)
+		if err != nil {
+			return nil, failure.NewParameterError("Parameter \"padding\" must be an integer")
+		}
+
+		if padding < 0 {
+			return nil, failure.NewParameterError("Parameter \"padding\" must be positive")
+		}
+	}
+
+	if sc, ok := qs["scale"].(string); ok {
+		scale, err = strconv.Atoi(sc)
+		if err != nil {
+			return nil, failure.NewParameterError("Parameter \"scale\" must be an integer")
+		}
+
+		if scale < 0 || scale > 100 {
+			return nil, failure.NewParameterError("Parameter \"scale\" must be between 0 and 100")
+		}
+	}
+
+	if t, ok := qs["tile"].(string); ok {
+		tile, err = strconv.ParseBool(t)
+		if err != nil {
+			return nil, failure.NewParameterError("Parameter \"tile\" must be a boolean")
+		}
+	}
+
 	if deg, ok := qs["deg"].(string); ok {
 		degree, err = strconv.Atoi(deg)
 		if err != nil {
@@ -264,6 +431,10 @@ func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, q
 	return &backend.Options{
 		Width:    width,
 		Height:   height,
+		X:        x,
+		Y:        y,
+		Gravity:  gravity,
+		Crop:     crop,
 		Upscale:  upscale,
 		Position: position,
 		Stick:    stick,
@@ -271,5 +442,11 @@ func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, q
 		Degree:   degree,
 		Color:    color,
 		Sigma:    sigma,
+		Images:   images,
+		Text:     text,
+		Opacity:  opacity,
+		Padding:  padding,
+		Scale:    scale,
+		Tile:     tile,
 	}, nil
 }
@@ -1,16 +1,23 @@
 package picfit_test
 
 import (
+	"bytes"
+	"context"
+	"image"
+	"image/draw"
+	"image/png"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	picfitimage "github.com/thoas/picfit/image"
 	"github.com/thoas/picfit/tests"
 )
 
 func TestEngineOperationFromQuery(t *testing.T) {
 	op := "op:resize w:123 h:321 upscale:true pos:top q:99 s:30"
 	processor := tests.NewDummyProcessor()
-	operation, err := processor.NewEngineOperationFromQuery(op)
+	operation, err := processor.NewEngineOperationFromQuery(context.Background(), op)
 	assert.Nil(t, err)
 
 	assert.Equal(t, operation.Operation.String(), "resize")
@@ -21,3 +28,112 @@ func TestEngineOperationFromQuery(t *testing.T) {
 	assert.Equal(t, operation.Options.Sigma, 30.0)
 	assert.True(t, operation.Options.Upscale)
 }
+
+func TestCropOperationFromQuery(t *testing.T) {
+	processor := tests.NewDummyProcessor()
+
+	operation, err := processor.NewEngineOperationFromQuery(context.Background(), "op:crop x:10 y:20 w:30 h:40")
+	assert.Nil(t, err)
+	assert.Equal(t, operation.Operation.String(), "crop")
+	assert.Equal(t, operation.Options.X, 10)
+	assert.Equal(t, operation.Options.Y, 20)
+	assert.Equal(t, operation.Options.Width, 30)
+	assert.Equal(t, operation.Options.Height, 40)
+	assert.Equal(t, operation.Options.Gravity, "")
+
+	operation, err = processor.NewEngineOperationFromQuery(context.Background(), "op:crop w:30 h:40")
+	assert.Nil(t, err)
+	assert.Equal(t, operation.Options.Gravity, "center")
+
+	operation, err = processor.NewEngineOperationFromQuery(context.Background(), "op:crop w:30 h:40 gravity:north-west")
+	assert.Nil(t, err)
+	assert.Equal(t, operation.Options.Gravity, "north-west")
+
+	_, err = processor.NewEngineOperationFromQuery(context.Background(), "op:crop w:30 h:40 gravity:top")
+	assert.NotNil(t, err)
+
+	_, err = processor.NewEngineOperationFromQuery(context.Background(), "op:crop x:10 w:30 h:40 gravity:north")
+	assert.NotNil(t, err)
+}
+
+func TestSmartCropOperationFromQuery(t *testing.T) {
+	processor := tests.NewDummyProcessor()
+
+	operation, err := processor.NewEngineOperationFromQuery(context.Background(), "op:thumbnail w:30 h:40 crop:smart")
+	assert.Nil(t, err)
+	assert.Equal(t, operation.Options.Crop, "smart")
+
+	operation, err = processor.NewEngineOperationFromQuery(context.Background(), "op:thumbnail w:30 h:40")
+	assert.Nil(t, err)
+	assert.Equal(t, operation.Options.Crop, "")
+
+	_, err = processor.NewEngineOperationFromQuery(context.Background(), "op:thumbnail w:30 h:40 crop:face")
+	assert.NotNil(t, err)
+}
+
+func TestWatermarkOperationFromQuery(t *testing.T) {
+	processor := tests.NewDummyProcessor()
+
+	operation, err := processor.NewEngineOperationFromQuery(context.Background(), "op:watermark text:picfit opacity:40 padding:5 scale:30 tile:true")
+	assert.Nil(t, err)
+	assert.Equal(t, operation.Operation.String(), "watermark")
+	assert.Equal(t, operation.Options.Text, "picfit")
+	assert.Equal(t, operation.Options.Opacity, 40)
+	assert.Equal(t, operation.Options.Padding, 5)
+	assert.Equal(t, operation.Options.Scale, 30)
+	assert.True(t, operation.Options.Tile)
+	assert.Equal(t, operation.Options.Gravity, "south-east")
+
+	operation, err = processor.NewEngineOperationFromQuery(context.Background(), "op:watermark text:picfit gravity:north")
+	assert.Nil(t, err)
+	assert.Equal(t, operation.Options.Opacity, 100)
+	assert.Equal(t, operation.Options.Gravity, "north")
+
+	_, err = processor.NewEngineOperationFromQuery(context.Background(), "op:watermark opacity:40")
+	assert.NotNil(t, err)
+
+	_, err = processor.NewEngineOperationFromQuery(context.Background(), "op:watermark text:picfit scale:101")
+	assert.NotNil(t, err)
+
+	_, err = processor.NewEngineOperationFromQuery(context.Background(), "op:watermark logo:missing.png")
+	assert.NotNil(t, err)
+}
+
+func TestAutoFormatParameters(t *testing.T) {
+	processor := tests.NewDummyProcessor()
+
+	alpha := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	opaque := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(opaque, opaque.Bounds(), image.White, image.Point{}, draw.Src)
+
+	for _, test := range []struct {
+		img         image.Image
+		accept      string
+		contentType string
+		filepath    string
+	}{
+		{alpha, "", "image/png", "image.png"},
+		{opaque, "", "image/jpeg", "image.jpg"},
+		{alpha, "webp", "image/webp", "image.webp"},
+	} {
+		buf := &bytes.Buffer{}
+		assert.Nil(t, png.Encode(buf, test.img))
+
+		input := &picfitimage.ImageFile{
+			Source:   buf.Bytes(),
+			Filepath: "image.png",
+			Headers:  map[string]string{},
+		}
+
+		parameters, err := processor.NewParameters(context.Background(), input, map[string]interface{}{
+			"fmt":    "auto",
+			"accept": test.accept,
+			"op":     "resize",
+			"w":      "5",
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, test.contentType, parameters.Output.ContentType())
+		assert.Equal(t, test.filepath, parameters.Output.Filepath)
+		assert.Equal(t, 1, len(parameters.Operations))
+	}
+}
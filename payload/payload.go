@@ -9,12 +9,51 @@ import (
 
 // Multipart represents a multipart upload
 type Multipart struct {
-	Data *multipart.FileHeader `json:"data"`
+	Data   *multipart.FileHeader `json:"data"`
+	Path   string                `json:"path"`
+	Prefix string                `json:"prefix"`
 }
 
 // FieldMap defines excepted inputs
 func (f *Multipart) FieldMap(req *http.Request) binding.FieldMap {
 	return binding.FieldMap{
-		&f.Data: "data",
+		&f.Data:   "data",
+		&f.Path:   "path",
+		&f.Prefix: "prefix",
+	}
+}
+
+// URL represents the upload of an image retrieved from an url
+type URL struct {
+	URL    string `json:"url"`
+	Path   string `json:"path"`
+	Prefix string `json:"prefix"`
+}
+
+// FieldMap defines excepted inputs
+func (f *URL) FieldMap(req *http.Request) binding.FieldMap {
+	return binding.FieldMap{
+		&f.URL: binding.Field{
+			Form:     "url",
+			Required: true,
+		},
+		&f.Path:   "path",
+		&f.Prefix: "prefix",
+	}
+}
+
+// Batch represents the upload of several multipart files or urls
+type Batch struct {
+	Data   []*multipart.FileHeader `json:"-"`
+	URLs   []string                `json:"urls"`
+	Prefix string                  `json:"prefix"`
+}
+
+// FieldMap defines excepted inputs
+func (f *Batch) FieldMap(req *http.Request) binding.FieldMap {
+	return binding.FieldMap{
+		&f.Data:   "data",
+		&f.URLs:   "urls",
+		&f.Prefix: "prefix",
 	}
 }
@@ -1,11 +1,19 @@
 package picfit
 
 import (
+	"fmt"
+
+	"golang.org/x/sync/singleflight"
+
 	"github.com/thoas/picfit/config"
 	"github.com/thoas/picfit/engine"
 	"github.com/thoas/picfit/logger"
+	"github.com/thoas/picfit/metadata"
+	"github.com/thoas/picfit/ratelimit"
 	"github.com/thoas/picfit/storage"
 	"github.com/thoas/picfit/store"
+	"github.com/thoas/picfit/tracing"
+	"github.com/thoas/picfit/worker"
 )
 
 // NewProcessor returns a Processor instance from a config.Config instance
@@ -25,8 +33,47 @@ func NewProcessor(cfg *config.Config) (*Processor, error) {
 		return nil, err
 	}
 
+	locker, err := store.NewLocker(
+		log.With(logger.String("logger", "store")),
+		cfg.KVStore)
+	if err != nil {
+		return nil, err
+	}
+
 	e := engine.New(*cfg.Engine)
 
+	if format := e.Upload.Format; format != "" && !e.Supports(format) {
+		return nil, fmt.Errorf("Upload format %s is not supported", format)
+	}
+
+	policy, err := storage.NewURLPolicy(cfg.Options.URLSources)
+	if err != nil {
+		return nil, err
+	}
+
+	httpStorage := newHTTPStorage(cfg.Options, policy)
+
+	// storages loaded over HTTP share the limits of urls, their base url is
+	// set by the operator so the policy of urls does not apply
+	configuredStorage := newHTTPStorage(cfg.Options, nil)
+	for _, s := range []interface{}{sourceStorage, destinationStorage} {
+		if s, ok := s.(*storage.HTTPStorage); ok {
+			s.UserAgent = configuredStorage.UserAgent
+			s.Client = configuredStorage.Client
+			s.MaxSize = configuredStorage.MaxSize
+		}
+	}
+
+	tracer, err := tracing.New(cfg.Tracing)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter, err := ratelimit.New(cfg.RateLimit, cfg.KVStore)
+	if err != nil {
+		return nil, err
+	}
+
 	log.Debug("Image engine configured",
 		logger.String("engine", e.String()))
 
@@ -36,6 +83,117 @@ func NewProcessor(cfg *config.Config) (*Processor, error) {
 		SourceStorage:      sourceStorage,
 		DestinationStorage: destinationStorage,
 		store:              s,
+		httpStorage:        httpStorage,
+		group:              &singleflight.Group{},
+		Locker:             locker,
+		transformPool:      newTransformPool(cfg.Options),
+		storeQueue:         newStoreQueue(cfg.Options),
+		batch:              newUploadBatch(cfg.Options),
+		metadataFilter:     metadata.NewFilter(cfg.Metadata),
+		URLPolicy:          policy,
+		Tracer:             tracer,
+		RateLimiter:        limiter,
 		Engine:             e,
 	}, nil
 }
+
+// newHTTPStorage returns the storage retrieving images from URLs,
+// unset limits fall back to their default value
+func newHTTPStorage(opts *config.Options, policy *storage.URLPolicy) *storage.HTTPStorage {
+	var (
+		maxSize        = int64(config.DefaultFetchMaxSize)
+		timeout        = config.DefaultFetchTimeout
+		connectTimeout = config.DefaultFetchConnectTimeout
+		maxRedirects   = config.DefaultFetchMaxRedirects
+	)
+
+	if opts.FetchMaxSize != 0 {
+		maxSize = opts.FetchMaxSize
+	}
+
+	if opts.FetchTimeout != 0 {
+		timeout = opts.FetchTimeout
+	}
+
+	if opts.FetchConnectTimeout != 0 {
+		connectTimeout = opts.FetchConnectTimeout
+	}
+
+	if opts.FetchMaxRedirects != 0 {
+		maxRedirects = opts.FetchMaxRedirects
+	}
+
+	return &storage.HTTPStorage{
+		UserAgent: opts.DefaultUserAgent,
+		Client:    storage.NewHTTPClient(timeout, connectTimeout, maxRedirects, policy),
+		MaxSize:   maxSize,
+		Policy:    policy,
+	}
+}
+
+// newTransformPool returns the pool bounding concurrent transformations,
+// unset limits fall back to their default value
+func newTransformPool(opts *config.Options) *worker.Pool {
+	var (
+		workers    = config.DefaultTransformWorkers()
+		queueSize  = config.DefaultTransformQueueSize
+		retryAfter = config.DefaultRetryAfter
+	)
+
+	if opts.TransformWorkers != 0 {
+		workers = opts.TransformWorkers
+	}
+
+	if opts.TransformQueueSize != 0 {
+		queueSize = opts.TransformQueueSize
+	}
+
+	if opts.RetryAfter != 0 {
+		retryAfter = opts.RetryAfter
+	}
+
+	return worker.NewPool(workers, queueSize, retryAfter)
+}
+
+// newStoreQueue returns the queue storing images in the background,
+// unset limits fall back to their default value
+func newStoreQueue(opts *config.Options) *worker.Queue {
+	var (
+		workers    = config.DefaultStoreWorkers
+		queueSize  = config.DefaultStoreQueueSize
+		retryAfter = config.DefaultRetryAfter
+	)
+
+	if opts.StoreWorkers != 0 {
+		workers = opts.StoreWorkers
+	}
+
+	if opts.StoreQueueSize != 0 {
+		queueSize = opts.StoreQueueSize
+	}
+
+	if opts.RetryAfter != 0 {
+		retryAfter = opts.RetryAfter
+	}
+
+	return worker.NewQueue(workers, queueSize, retryAfter)
+}
+
+// newUploadBatch returns the limits of batch uploads,
+// unset limits fall back to their default value
+func newUploadBatch(opts *config.Options) uploadBatch {
+	batch := uploadBatch{
+		workers:  config.DefaultUploadBatchWorkers,
+		maxFiles: config.DefaultUploadBatchMaxFiles,
+	}
+
+	if opts.UploadBatchWorkers != 0 {
+		batch.workers = opts.UploadBatchWorkers
+	}
+
+	if opts.UploadBatchMaxFiles != 0 {
+		batch.maxFiles = opts.UploadBatchMaxFiles
+	}
+
+	return batch
+}
@@ -2,27 +2,42 @@ package picfit
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/thoas/picfit/constants"
-	"io"
+	"mime/multipart"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	conv "github.com/cstockton/go-conv"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	"github.com/ulule/gostorages"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/thoas/picfit/config"
 	"github.com/thoas/picfit/engine"
+	"github.com/thoas/picfit/engine/backend"
 	"github.com/thoas/picfit/failure"
 	"github.com/thoas/picfit/hash"
 	"github.com/thoas/picfit/image"
 	"github.com/thoas/picfit/logger"
+	"github.com/thoas/picfit/metadata"
+	"github.com/thoas/picfit/metrics"
 	"github.com/thoas/picfit/payload"
+	"github.com/thoas/picfit/ratelimit"
+	"github.com/thoas/picfit/storage"
 	"github.com/thoas/picfit/store"
+	"github.com/thoas/picfit/tracing"
+	"github.com/thoas/picfit/worker"
 )
 
 type Processor struct {
@@ -31,55 +46,335 @@ type Processor struct {
 	SourceStorage      gostorages.Storage
 	DestinationStorage gostorages.Storage
 	store              store.Store
+	httpStorage        *storage.HTTPStorage
+	group              *singleflight.Group
+	Locker             store.Locker
+	transformPool      *worker.Pool
+	storeQueue         *worker.Queue
+	batch              uploadBatch
+	metadataFilter     *metadata.Filter
+	URLPolicy          *storage.URLPolicy
+	Tracer             *tracing.Tracer
+	RateLimiter        *ratelimit.Limiter
 	Engine             *engine.Engine
 }
 
+// UploadOptions defines where an uploaded file is saved, the file is saved
+// at Path when it is set, otherwise under Prefix with a random name
+type UploadOptions struct {
+	Path   string
+	Prefix string
+}
+
+// uploadBatch defines the limits of batch uploads
+type uploadBatch struct {
+	workers  int
+	maxFiles int
+}
+
+// BatchFile is a file of a batch upload, either a multipart file or an url
+type BatchFile struct {
+	Data *multipart.FileHeader
+	URL  string
+}
+
+// Uploaded is an uploaded image with its size, Deduplicated is true when an
+// identical image was already stored under the content addressed name
+type Uploaded struct {
+	*image.ImageFile
+	Width        int
+	Height       int
+	Deduplicated bool
+}
+
+// BatchResult is the result of the upload of a file of a batch,
+// Error is set when the file has not been uploaded
+type BatchResult struct {
+	Name         string `json:"name"`
+	Filename     string `json:"filename,omitempty"`
+	URL          string `json:"url,omitempty"`
+	Width        int    `json:"w,omitempty"`
+	Height       int    `json:"h,omitempty"`
+	Deduplicated bool   `json:"deduplicated,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
 // Upload uploads a file to its storage
-func (p *Processor) Upload(c *gin.Context, payload *payload.Multipart) (*image.ImageFile, int, int, error) {
-	var fh io.ReadCloser
+func (p *Processor) Upload(c *gin.Context, payload *payload.Multipart) (*Uploaded, error) {
+	content, err := readMultipart(payload.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.UploadContent(c.Request.Context(), content, payload.Data.Filename,
+		payload.Data.Header.Get("Content-Type"), UploadOptions{Path: payload.Path, Prefix: payload.Prefix})
+}
+
+// UploadURL uploads the image retrieved from an url to its storage
+func (p *Processor) UploadURL(ctx context.Context, value string, opts UploadOptions) (*Uploaded, error) {
+	u, err := url.Parse(value)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return nil, errors.Wrapf(failure.ErrInvalidURL, "unable to upload: %s", value)
+	}
+
+	file, err := image.FromURL(ctx, p.httpStorage, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.UploadContent(ctx, file.Source, file.Filepath, file.Headers["Content-Type"], opts)
+}
+
+// UploadBatch uploads files concurrently to their storage with random names in
+// the prefix of opts, a file failing to upload does not stop the others
+func (p *Processor) UploadBatch(ctx context.Context, files []BatchFile, opts UploadOptions) ([]BatchResult, error) {
+	if len(files) > p.batch.maxFiles {
+		return nil, errors.Wrapf(failure.ErrTooManyFiles, "%d > %d", len(files), p.batch.maxFiles)
+	}
+
+	var (
+		results = make([]BatchResult, len(files))
+		workers = make(chan struct{}, p.batch.workers)
+		wg      sync.WaitGroup
+	)
+
+	opts.Path = ""
+
+	for i := range files {
+		wg.Add(1)
+		workers <- struct{}{}
+
+		go func(i int) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			results[i] = p.uploadBatchFile(ctx, files[i], opts)
+		}(i)
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
+
+func (p *Processor) uploadBatchFile(ctx context.Context, f BatchFile, opts UploadOptions) BatchResult {
+	var (
+		result   = BatchResult{Name: f.URL}
+		uploaded *Uploaded
+		err      error
+	)
+
+	if f.Data != nil {
+		result.Name = f.Data.Filename
+
+		var content []byte
+		content, err = readMultipart(f.Data)
+		if err == nil {
+			uploaded, err = p.UploadContent(ctx, content, f.Data.Filename,
+				f.Data.Header.Get("Content-Type"), opts)
+		}
+	} else {
+		uploaded, err = p.UploadURL(ctx, f.URL, opts)
+	}
 
-	fh, err := payload.Data.Open()
 	if err != nil {
-		return nil, 0, 0, err
+		p.logger.Error("Unable to upload file of batch",
+			logger.String("name", result.Name),
+			logger.Error(err))
+
+		result.Error = errors.Cause(err).Error()
+
+		return result
 	}
-	defer fh.Close()
+
+	result.Filename = uploaded.Filename()
+	result.URL = uploaded.URL()
+	result.Width = uploaded.Width
+	result.Height = uploaded.Height
+	result.Deduplicated = uploaded.Deduplicated
+
+	return result
+}
+
+// readMultipart returns the content of a multipart file
+func readMultipart(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
 	dataBytes := bytes.Buffer{}
 
-	_, err = dataBytes.ReadFrom(fh)
+	_, err = dataBytes.ReadFrom(f)
 	if err != nil {
-		return nil, 0, 0, errors.Wrapf(err, "unable to read data from uploaded file")
+		return nil, errors.Wrapf(err, "unable to read data from uploaded file")
 	}
 
-	uuid, err := hash.UUID()
+	return dataBytes.Bytes(), nil
+}
+
+// UploadContent uploads the content of a file to its storage, the extension
+// of the saved file is taken from name, then from the content type, files
+// without a path are named after their normalized content when uploads are
+// content addressed
+func (p *Processor) UploadContent(ctx context.Context, content []byte, name string, contentType string, opts UploadOptions) (*Uploaded, error) {
+	ext, err := uploadExt(content, name, contentType, p.Engine.Upload.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	filename, err := uploadFilename(ext, p.Engine.Upload.Format != "", opts)
 	if err != nil {
-		return nil, 0, 0, errors.Wrapf(err, "error crypto/rand function")
+		return nil, err
 	}
 
-	filename := fmt.Sprintf("%s%s", uuid, path.Ext(payload.Data.Filename))
+	if opts.Path != "" && p.FileExists(filename) {
+		return nil, errors.Wrapf(failure.ErrFileExists, "unable to upload to: %s", filename)
+	}
 
 	output := &image.ImageFile{
 		Filepath: filename,
 		Storage:  p.SourceStorage,
-		Source:   dataBytes.Bytes(),
+		Source:   content,
 	}
 
-	output, width, height, err := p.Engine.UploadTransform(output, p.UploadParmaOptions(output))
+	output, width, height, err := p.Engine.UploadTransform(ctx, output, p.UploadParmaOptions(output))
 	if err != nil {
-		return nil, 0, 0, errors.Wrapf(err, "unable to resize data of: %s", filename)
+		return nil, errors.Wrapf(err, "unable to resize data of: %s", filename)
+	}
+
+	uploaded := &Uploaded{ImageFile: output, Width: width, Height: height}
+
+	if p.config.Options.ContentAddressedUpload && opts.Path == "" {
+		// the random name is replaced in the cleaned prefix
+		output.Filepath = p.contentFilename(output.Content(), ext, path.Dir(filename))
+
+		if p.FileExists(output.Filepath) {
+			uploaded.Deduplicated = true
+
+			return uploaded, nil
+		}
 	}
 
-	err = p.SourceStorage.Save(filename, gostorages.NewContentFile(output.Content()))
+	start := time.Now()
+	err = p.SourceStorage.Save(output.Filepath, gostorages.NewContentFile(output.Content()))
+	metrics.ObserveStorage(metrics.SourceStorage, metrics.WriteOperation, start)
 	if err != nil {
-		return nil, 0, 0, errors.Wrapf(err, "unable to save data on storage as: %s", filename)
+		return nil, errors.Wrapf(err, "unable to save data on storage as: %s", output.Filepath)
 	}
 
-	return output, width, height, nil
+	return uploaded, nil
+}
+
+// contentFilename returns the path of an uploaded file named after the
+// SHA-256 of its content, sharded in prefix
+func (p *Processor) contentFilename(content []byte, ext string, prefix string) string {
+	sum := sha256.Sum256(content)
+
+	return path.Join(prefix, p.ShardFilename(hex.EncodeToString(sum[:]))+ext)
+}
+
+// uploadExt returns the extension of an uploaded file, the one of format
+// when it is set
+func uploadExt(content []byte, name string, contentType string, format string) (string, error) {
+	ext := strings.ToLower(path.Ext(name))
+	if _, ok := engine.ContentTypes[strings.TrimPrefix(ext, ".")]; !ok {
+		ext = ""
+	}
+
+	// the declared content type is trusted before the detected one
+	for _, ct := range []string{contentType, http.DetectContentType(content)} {
+		if ext != "" {
+			break
+		}
+
+		if extension, ok := image.Extensions[strings.TrimSpace(strings.Split(ct, ";")[0])]; ok {
+			ext = "." + extension
+		}
+	}
+
+	if ext == "" {
+		return "", failure.ErrUnsupportedFormat
+	}
+
+	if format != "" {
+		ext = "." + format
+	}
+
+	return ext, nil
+}
+
+// uploadFilename returns the path of an uploaded file from its options,
+// paths are cleaned and cannot leave the root of the storage
+func uploadFilename(ext string, converted bool, opts UploadOptions) (string, error) {
+	if opts.Path != "" {
+		filepath, err := cleanUploadPath(opts.Path)
+		if err != nil {
+			return "", err
+		}
+
+		// the image extension of a path is replaced when images are converted
+		current := path.Ext(filepath)
+		if _, ok := engine.ContentTypes[strings.TrimPrefix(strings.ToLower(current), ".")]; ok && converted {
+			filepath = strings.TrimSuffix(filepath, current)
+			current = ""
+		}
+
+		if current == "" {
+			filepath += ext
+		}
+
+		return filepath, nil
+	}
+
+	uuid, err := hash.UUID()
+	if err != nil {
+		return "", errors.Wrapf(err, "error crypto/rand function")
+	}
+
+	filename := fmt.Sprintf("%s%s", uuid, ext)
+
+	if opts.Prefix == "" {
+		return filename, nil
+	}
+
+	prefix, err := cleanUploadPath(opts.Prefix)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(prefix, filename), nil
+}
+
+// cleanUploadPath returns a relative path without any parent reference
+func cleanUploadPath(filepath string) (string, error) {
+	for _, part := range strings.Split(filepath, "/") {
+		if part == ".." {
+			return "", failure.ErrInvalidPath
+		}
+	}
+
+	filepath = strings.TrimPrefix(path.Clean("/"+filepath), "/")
+	if filepath == "" {
+		return "", failure.ErrInvalidPath
+	}
+
+	return filepath, nil
 }
 
 // Store stores an image file with the defined filepath
-func (p *Processor) Store(filepath string, i *image.ImageFile) error {
+func (p *Processor) Store(ctx context.Context, filepath string, i *image.ImageFile) error {
+	_, span := tracing.Start(ctx, "storage.write",
+		tracing.String("storage", metrics.DestinationStorage),
+		tracing.String("filepath", i.Filepath))
+	start := time.Now()
 	err := i.Save()
+	metrics.ObserveStorage(metrics.DestinationStorage, metrics.WriteOperation, start)
+	span.RecordError(err)
+	span.Finish()
 	if err != nil {
 		return err
 	}
@@ -87,7 +382,10 @@ func (p *Processor) Store(filepath string, i *image.ImageFile) error {
 	p.logger.Info("Save file to storage",
 		logger.String("file", i.Filepath))
 
+	_, span = tracing.Start(ctx, "kvstore.set", tracing.String("key", i.Key))
 	err = p.store.Set(i.Key, i.Filepath)
+	span.RecordError(err)
+	span.Finish()
 	if err != nil {
 		return err
 	}
@@ -102,7 +400,10 @@ func (p *Processor) Store(filepath string, i *image.ImageFile) error {
 
 		parentKey = fmt.Sprintf("%s:children", parentKey)
 
+		_, span = tracing.Start(ctx, "kvstore.append", tracing.String("key", parentKey))
 		err = p.store.AppendSlice(parentKey, i.Key)
+		span.RecordError(err)
+		span.Finish()
 		if err != nil {
 			return err
 		}
@@ -166,6 +467,11 @@ func (p *Processor) Delete(filepath string) error {
 		return errors.Wrapf(err, "unable to delete %s on source storage", filepath)
 	}
 
+	// a file uploaded later at the same path has its own metadata
+	if err := p.store.Delete(metadataKey(filepath)); err != nil {
+		return errors.Wrapf(err, "unable to delete key %s", metadataKey(filepath))
+	}
+
 	parentKey := hash.Tokey(filepath)
 
 	childrenKey := fmt.Sprintf("%s:children", parentKey)
@@ -221,13 +527,39 @@ func (p *Processor) Delete(filepath string) error {
 }
 
 // ProcessContext processes a gin.Context generates and retrieves an ImageFile
-func (p *Processor) ProcessContext(c *gin.Context, opts ...Option) (*image.ImageFile, error) {
+func (p *Processor) ProcessContext(c *gin.Context, opts ...Option) (img *image.ImageFile, err error) {
 	var (
 		storeKey = c.MustGet("key").(string)
 		force    = c.Query("force")
 		options  = newOptions(opts...)
 	)
 
+	ctx := c.Request.Context()
+	if timeout := p.config.Options.ProcessingTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ctx, span := tracing.Start(ctx, "picfit.process",
+		tracing.String("key", storeKey),
+		tracing.Bool("force", force != ""))
+	defer func() {
+		span.RecordError(err)
+		span.Finish()
+	}()
+
+	defer func() {
+		if img == nil {
+			return
+		}
+
+		if content := img.Content(); len(content) > 0 {
+			c.Set(constants.OutputSizeContextKey, len(content))
+		}
+		c.Set(constants.FormatContextKey, img.Format())
+	}()
+
 	qs := c.MustGet("parameters").(map[string]interface{})
 	_, ok := qs[constants.OperationParamName].(string)
 
@@ -243,7 +575,10 @@ func (p *Processor) ProcessContext(c *gin.Context, opts ...Option) (*image.Image
 	}
 
 	if modifiedSince != "" && force == "" {
+		_, span := tracing.Start(ctx, "kvstore.exists", tracing.String("key", storeKey))
 		exists, err := p.store.Exists(storeKey)
+		span.RecordError(err)
+		span.Finish()
 		if err != nil {
 			return nil, err
 		}
@@ -259,29 +594,23 @@ func (p *Processor) ProcessContext(c *gin.Context, opts ...Option) (*image.Image
 
 	if force == "" {
 		// try to retrieve image from the k/v rtore
-		filepathRaw, err := p.store.Get(storeKey)
+		img, err := p.imageFromStore(ctx, storeKey, options.Load)
 		if err != nil {
+			metrics.KVStoreRequests.WithLabelValues(metrics.Error).Inc()
 			return nil, err
 		}
 
-		if filepathRaw != nil {
-			filepath, err := conv.String(filepathRaw)
-			if err != nil {
-				return nil, err
-			}
-
-			p.logger.Info("Key found in store",
-				logger.String("key", storeKey),
-				logger.String("filepath", filepath))
-
-			img, err := p.fileFromStorage(storeKey, filepath, options.Load)
-			//no such file, just reprocess (maybe file cache was purged)
-			if err != nil && os.IsNotExist(err) {
-				return p.processImage(c, storeKey, options, qs)
-			}
-			return img, err
+		if img != nil {
+			metrics.KVStoreRequests.WithLabelValues(metrics.Hit).Inc()
+			span.SetAttributes(tracing.String("kvstore.result", metrics.Hit))
+			c.Set(constants.CacheContextKey, metrics.Hit)
+			return img, nil
 		}
 
+		metrics.KVStoreRequests.WithLabelValues(metrics.Miss).Inc()
+		span.SetAttributes(tracing.String("kvstore.result", metrics.Miss))
+		c.Set(constants.CacheContextKey, metrics.Miss)
+
 		// Image not found from the Store, we need to process it
 		// URL available in Query String
 		p.logger.Info("Key not found in store",
@@ -289,12 +618,183 @@ func (p *Processor) ProcessContext(c *gin.Context, opts ...Option) (*image.Image
 	} else {
 		p.logger.Info("Force activated, key will be re-processed",
 			logger.String("key", storeKey))
+
+		c.Set(constants.CacheContextKey, metrics.Miss)
+	}
+
+	return p.processOnce(ctx, c, storeKey, options, qs)
+}
+
+// imageFromStore retrieves the image of a key found in the store,
+// nil if the key is not found or its file has been purged
+func (p *Processor) imageFromStore(ctx context.Context, storeKey string, load bool) (*image.ImageFile, error) {
+	_, span := tracing.Start(ctx, "kvstore.get", tracing.String("key", storeKey))
+	filepathRaw, err := p.store.Get(storeKey)
+	span.RecordError(err)
+	span.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	if filepathRaw == nil {
+		return nil, nil
+	}
+
+	filepath, err := conv.String(filepathRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	p.logger.Info("Key found in store",
+		logger.String("key", storeKey),
+		logger.String("filepath", filepath))
+
+	img, err := p.fileFromStorage(ctx, storeKey, filepath, load)
+	//no such file, just reprocess (maybe file cache was purged)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return img, err
+}
+
+// sharedContextKeys are the keys set on the context of the request
+// processing an image which are shared with the coalesced requests
+var sharedContextKeys = []string{
+	constants.SourceSizeContextKey,
+	constants.BackendContextKey,
+}
+
+// processed is the result of an image processed once for concurrent
+// requests with the values set on the context of the processing request
+type processed struct {
+	file   *image.ImageFile
+	values map[string]interface{}
+}
+
+// processOnce processes the image of a key once for concurrent requests,
+// they all share the result or the error of the first one, unless the first
+// one has been canceled while the others are still waiting for the image
+func (p *Processor) processOnce(ctx context.Context, c *gin.Context, storeKey string, options Options, qs map[string]interface{}) (*image.ImageFile, error) {
+	var (
+		result interface{}
+		err    error
+		shared bool
+	)
+
+	for {
+		result, err, shared = p.group.Do(fmt.Sprintf("%s:%t", storeKey, options.Load), func() (interface{}, error) {
+			file, err := p.processLocked(ctx, c, storeKey, options, qs)
+			if err != nil {
+				return nil, err
+			}
+
+			values := make(map[string]interface{}, len(sharedContextKeys))
+			for _, key := range sharedContextKeys {
+				if value, ok := c.Get(key); ok {
+					values[key] = value
+				}
+			}
+
+			return &processed{file: file, values: values}, nil
+		})
+		if !shared || ctx.Err() != nil || !isContextError(err) {
+			break
+		}
+
+		p.logger.Info("Shared processing canceled, processing again",
+			logger.String("key", storeKey))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := result.(*processed)
+	if !shared {
+		return res.file, nil
+	}
+
+	for key, value := range res.values {
+		c.Set(key, value)
+	}
+
+	file := res.file
+
+	p.logger.Info("Processed image shared between requests",
+		logger.String("key", storeKey))
+
+	tracing.SpanFromContext(ctx).SetAttributes(tracing.Bool("shared", true))
+
+	// each request gets its own headers
+	copied := *file
+	copied.Headers = make(map[string]string, len(file.Headers))
+	for k, v := range file.Headers {
+		copied.Headers[k] = v
+	}
+
+	return &copied, nil
+}
+
+// processLocked processes the image of a key while holding its lock, other
+// requests and instances wait for the image to be stored and retrieve it
+// instead of processing it again, the lock is held until the image is stored
+func (p *Processor) processLocked(ctx context.Context, c *gin.Context, storeKey string, options Options, qs map[string]interface{}) (*image.ImageFile, error) {
+	if p.Locker == nil {
+		return p.processImage(ctx, c, storeKey, options, qs, func() {})
+	}
+
+	force := c.Query("force")
+
+	var release func()
+	for {
+		unlock, ok, err := p.Locker.TryLock(storeKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to lock key %s", storeKey)
+		}
+
+		if ok {
+			release = func() {
+				if err := unlock(); err != nil {
+					p.logger.Error("Unable to unlock key",
+						logger.String("key", storeKey),
+						logger.Error(err))
+				}
+			}
+
+			break
+		}
+
+		p.logger.Info("Key locked by another instance, waiting",
+			logger.String("key", storeKey))
+
+		// a canceled request stops waiting for the lock
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(p.Locker.RetryInterval()):
+		}
+
+		if force == "" {
+			img, err := p.imageFromStore(ctx, storeKey, options.Load)
+			if err != nil || img != nil {
+				return img, err
+			}
+		}
+	}
+
+	// the image may have been stored while acquiring the lock
+	if force == "" {
+		img, err := p.imageFromStore(ctx, storeKey, options.Load)
+		if err != nil || img != nil {
+			release()
+			return img, err
+		}
 	}
 
-	return p.processImage(c, storeKey, options, qs)
+	return p.processImage(ctx, c, storeKey, options, qs, release)
 }
 
-func (p *Processor) fileFromStorage(key string, filepath string, load bool) (*image.ImageFile, error) {
+func (p *Processor) fileFromStorage(ctx context.Context, key string, filepath string, load bool) (*image.ImageFile, error) {
 	var (
 		file = &image.ImageFile{
 			Key:      key,
@@ -306,7 +806,14 @@ func (p *Processor) fileFromStorage(key string, filepath string, load bool) (*im
 	)
 
 	if load {
-		file, err = image.FromStorage(p.DestinationStorage, filepath)
+		_, span := tracing.Start(ctx, "storage.read",
+			tracing.String("storage", metrics.DestinationStorage),
+			tracing.String("filepath", filepath))
+		start := time.Now()
+		file, err = image.FromStorage(ctx, p.DestinationStorage, filepath)
+		metrics.ObserveStorage(metrics.DestinationStorage, metrics.ReadOperation, start)
+		span.RecordError(err)
+		span.Finish()
 		if err != nil {
 			return nil, err
 		}
@@ -316,67 +823,292 @@ func (p *Processor) fileFromStorage(key string, filepath string, load bool) (*im
 	return file, nil
 }
 
-func (p *Processor) processImage(c *gin.Context, storeKey string, options Options, qs map[string]interface{}) (*image.ImageFile, error) {
+// sourceImage retrieves the source image of a request from its url
+// or from the source storage
+func (p *Processor) sourceImage(ctx context.Context, c *gin.Context, qs map[string]interface{}) (*image.ImageFile, error) {
 	var (
-		filepath string
-		err      error
+		file *image.ImageFile
+		err  error
 	)
 
-	file := &image.ImageFile{
-		Key:     storeKey,
-		Storage: p.DestinationStorage,
-		Headers: map[string]string{},
-	}
-
 	u, exists := c.Get("url")
 	if exists {
-		file, err = image.FromURL(u.(*url.URL), p.config.Options.DefaultUserAgent)
-	} else {
-		// URL provided we use http protocol to retrieve it
-		filepath = qs["path"].(string)
-		if !p.SourceStorage.Exists(filepath) {
-			return nil, errors.Wrapf(failure.ErrFileNotExists, "unable to process image, file does exist: %s", filepath)
+		_, span := tracing.StartKind(ctx, "fetch", tracing.KindClient,
+			tracing.String("url", u.(*url.URL).String()))
+		file, err = image.FromURL(ctx, p.httpStorage, u.(*url.URL))
+		if err == nil {
+			span.SetAttributes(tracing.Int("size", len(file.Source)))
 		}
+		span.RecordError(err)
+		span.Finish()
+
+		return file, err
+	}
+
+	// URL provided we use http protocol to retrieve it
+	filepath, ok := qs["path"].(string)
+	if !ok {
+		return nil, failure.ErrUnprocessable
+	}
+
+	if !p.SourceStorage.Exists(filepath) {
+		return nil, errors.Wrapf(failure.ErrFileNotExists, "unable to process image, file does exist: %s", filepath)
+	}
+
+	_, span := tracing.Start(ctx, "storage.read",
+		tracing.String("storage", metrics.SourceStorage),
+		tracing.String("filepath", filepath))
+	start := time.Now()
+	file, err = image.FromStorage(ctx, p.SourceStorage, filepath)
+	metrics.ObserveStorage(metrics.SourceStorage, metrics.ReadOperation, start)
+	span.RecordError(err)
+	span.Finish()
+
+	return file, err
+}
 
-		file, err = image.FromStorage(p.SourceStorage, filepath)
+// Info returns the source image of a request and its information, the
+// image is not transformed
+func (p *Processor) Info(c *gin.Context) (*image.ImageFile, *backend.Info, error) {
+	ctx := c.Request.Context()
+	if timeout := p.config.Options.ProcessingTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
+
+	file, err := p.sourceImage(ctx, c, c.MustGet("parameters").(map[string]interface{}))
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to process image")
+		return nil, nil, errors.Wrap(err, "unable to retrieve image")
+	}
+
+	c.Set(constants.SourceSizeContextKey, len(file.Source))
+
+	if err := p.Engine.CheckLimits(file); err != nil {
+		return nil, nil, err
 	}
 
-	parameters, err := p.NewParameters(file, qs)
+	info, err := backend.DecodeInfo(file.Source)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to process image")
+		return nil, nil, errors.Wrap(err, "unable to read image")
 	}
 
-	if len(parameters.Operations) != 0 {
-		file, err = p.Engine.Transform(parameters.Output, parameters.Operations)
+	return file, info, nil
+}
+
+// Metadata returns the metadata of the source image of a request without
+// its filtered fields, the metadata is cached in the store under the
+// metadata key of the image unless force is set
+func (p *Processor) Metadata(c *gin.Context) (*metadata.Metadata, error) {
+	ctx := c.Request.Context()
+	if timeout := p.config.Options.ProcessingTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	qs := c.MustGet("parameters").(map[string]interface{})
+
+	var source string
+	if u, exists := c.Get("url"); exists {
+		source = u.(*url.URL).String()
+	} else if filepath, ok := qs["path"].(string); ok {
+		source = filepath
+	} else {
+		return nil, failure.ErrUnprocessable
+	}
+
+	key := metadataKey(source)
+
+	if c.Query("force") == "" {
+		_, span := tracing.Start(ctx, "kvstore.get", tracing.String("key", key))
+		raw, err := p.store.Get(key)
+		span.RecordError(err)
+		span.Finish()
 		if err != nil {
-			return nil, errors.Wrap(err, "unable to process image")
+			return nil, err
 		}
 
-		filename := p.ShardFilename(storeKey)
-		file.Filepath = fmt.Sprintf("%s.%s", filename, file.Format())
-		file.Storage = p.DestinationStorage
-		file.Key = storeKey
-
-		if options.Async == true {
-			go p.Store(filepath, file)
-		} else {
-			err = p.Store(filepath, file)
+		if raw != nil {
+			content, err := conv.String(raw)
 			if err != nil {
-				return nil, errors.Wrapf(err, "unable to store processed image: %s", filepath)
+				return nil, errors.Wrapf(err, "unable to cast %v to string", raw)
 			}
+
+			m := &metadata.Metadata{}
+			if err := json.Unmarshal([]byte(content), m); err != nil {
+				return nil, errors.Wrapf(err, "unable to decode metadata of key %s", key)
+			}
+
+			c.Set(constants.CacheContextKey, metrics.Hit)
+
+			return p.metadataFilter.Apply(m), nil
+		}
+	}
+
+	c.Set(constants.CacheContextKey, metrics.Miss)
+
+	file, err := p.sourceImage(ctx, c, qs)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to retrieve image")
+	}
+
+	c.Set(constants.SourceSizeContextKey, len(file.Source))
+
+	// the metadata is stored unfiltered, the filter may change
+	m := metadata.Decode(file.Source)
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode metadata")
+	}
+
+	_, span := tracing.Start(ctx, "kvstore.set", tracing.String("key", key))
+	err = p.store.Set(key, string(content))
+	span.RecordError(err)
+	span.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	p.logger.Info("Save metadata to store",
+		logger.String("key", key),
+		logger.String("source", source))
+
+	return p.metadataFilter.Apply(m), nil
+}
+
+// metadataKey returns the key of the metadata of an image in the store
+func metadataKey(source string) string {
+	return fmt.Sprintf("%s:metadata", hash.Tokey(source))
+}
+
+// processImage processes the image of a key and stores it, release is
+// called once the image is stored or once processing has failed
+func (p *Processor) processImage(ctx context.Context, c *gin.Context, storeKey string, options Options, qs map[string]interface{}, release func()) (*image.ImageFile, error) {
+	// release is handed to the task storing the image in the background
+	defer func() {
+		if release != nil {
+			release()
 		}
+	}()
+
+	file, err := p.sourceImage(ctx, c, qs)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to process image")
+	}
+
+	c.Set(constants.SourceSizeContextKey, len(file.Source))
+
+	// children of images of the source storage are stored with their path
+	var filepath string
+	if _, exists := c.Get("url"); !exists {
+		filepath = file.Filepath
+	}
+
+	if accept, ok := c.Get(constants.AcceptParamName); ok {
+		qs[constants.FormatParamName] = constants.AutoFormat
+		qs[constants.AcceptParamName] = accept
+	}
+
+	parameters, err := p.NewParameters(ctx, file, qs)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to process image")
 	}
 
+	if len(parameters.Operations) == 0 {
+		file.Storage = p.DestinationStorage
+		file.Key = storeKey
+		file.Headers["ETag"] = storeKey
+
+		return file, nil
+	}
+
+	c.Set(constants.BackendContextKey, p.Engine.Backend(parameters.Output))
+
+	err = p.transformPool.Do(func() error {
+		file, err = p.Engine.Transform(ctx, parameters.Output, parameters.Operations)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to process image")
+	}
+
+	filename := p.ShardFilename(storeKey)
+	file.Filepath = fmt.Sprintf("%s.%s", filename, file.Format())
 	file.Storage = p.DestinationStorage
 	file.Key = storeKey
 	file.Headers["ETag"] = storeKey
 
+	// the image is stored in the background even if the request
+	// has been canceled since, the transformation is already done
+	if options.Async == true {
+		stored := release
+		err = p.storeQueue.Push(func() {
+			defer stored()
+
+			if err := p.Store(ctx, filepath, file); err != nil {
+				p.logger.Error("Unable to store processed image",
+					logger.String("key", storeKey),
+					logger.Error(err))
+			}
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to queue processed image: %s", filepath)
+		}
+
+		release = nil
+
+		return file, nil
+	}
+
+	if err = ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to process image")
+	}
+
+	err = p.Store(ctx, filepath, file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to store processed image: %s", filepath)
+	}
+
 	return file, nil
 }
 
+// isContextError returns true if err is caused by a canceled context
+// or by a context whose deadline has passed
+func isContextError(err error) bool {
+	cause := errors.Cause(err)
+
+	return cause == context.Canceled || cause == context.DeadlineExceeded
+}
+
+// Shutdown waits for the images queued to be stored in the background
+// then exports the pending spans, it gives up when ctx is done
+func (p *Processor) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.storeQueue.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		stats := p.storeQueue.Stats()
+		return errors.Wrapf(ctx.Err(), "%d images not stored", stats.Depth+stats.Active)
+	}
+
+	return p.Tracer.Shutdown()
+}
+
+// QueueStats returns the activity of the transformation pool and of the store queue
+func (p *Processor) QueueStats() map[string]worker.Stats {
+	return map[string]worker.Stats{
+		"transform": p.transformPool.Stats(),
+		"store":     p.storeQueue.Stats(),
+	}
+}
+
 // ShardFilename shards a filename based on config
 func (p Processor) ShardFilename(filename string) string {
 	cfg := p.config
@@ -386,6 +1118,11 @@ func (p Processor) ShardFilename(filename string) string {
 	return strings.Join(results, "/")
 }
 
+// Cached returns true if the image of a key has been processed and stored
+func (p *Processor) Cached(key string) (bool, error) {
+	return p.store.Exists(key)
+}
+
 func (p Processor) GetKey(key string) (interface{}, error) {
 	return p.store.Get(key)
 }
@@ -2,11 +2,17 @@ package picfit_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	goimage "image"
+	_ "image/jpeg"
 	"io/ioutil"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -15,20 +21,31 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	conv "github.com/cstockton/go-conv"
 
 	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/buger/jsonparser"
+	"github.com/thoas/picfit"
+	"github.com/thoas/picfit/auth"
 	"github.com/thoas/picfit/config"
+	"github.com/thoas/picfit/constants"
+	"github.com/thoas/picfit/engine/backend"
+	"github.com/thoas/picfit/failure"
+	picfitimage "github.com/thoas/picfit/image"
 	"github.com/thoas/picfit/server"
 	"github.com/thoas/picfit/signature"
+	"github.com/thoas/picfit/storage"
 	"github.com/thoas/picfit/tests"
+	"github.com/ulule/gostorages"
 )
 
 func TestSignatureApplicationNotAuthorized(t *testing.T) {
@@ -99,6 +116,52 @@ func TestSignatureApplicationAuthorized(t *testing.T) {
 
 }
 
+func TestSignatureApplicationExpiresAndKeys(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "secret_key": "dummy",
+	  "signing_keys": [
+		{"id": "2021", "secret": "rotated", "algorithm": "sha256"}
+	  ]
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		u, _ := url.Parse(ts.URL + "/avatar.png")
+
+		for _, c := range []struct {
+			algorithm string
+			key       string
+			params    string
+			code      int
+		}{
+			{signature.SHA1, "dummy", fmt.Sprintf("expires=%d", time.Now().Add(time.Hour).Unix()), 200},
+			{signature.SHA1, "dummy", fmt.Sprintf("expires=%d", time.Now().Add(-time.Hour).Unix()), 401},
+			{signature.SHA256, "rotated", "kid=2021", 200},
+			{signature.SHA256, "dummy", "kid=2021", 401},
+			{signature.SHA256, "rotated", "kid=2020", 401},
+		} {
+			params := fmt.Sprintf("h=100&op=resize&url=%s&w=100&%s", u.String(), c.params)
+
+			sig, err := signature.SignRawWith(c.algorithm, c.key, params)
+			assert.Nil(t, err)
+
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?%s&sig=%s", params, sig), nil)
+
+			res := httptest.NewRecorder()
+
+			server.ServeHTTP(res, request)
+
+			assert.Equal(t, c.code, res.Code, c.params)
+		}
+	}, tests.WithConfig(content))
+}
+
 func TestSizeRestrictedApplicationNotAuthorized(t *testing.T) {
 	ts := tests.NewImageServer()
 	defer ts.Close()
@@ -328,163 +391,96 @@ func TestUploadBIGFileHandler(t *testing.T) {
 	}, tests.WithConfig(content))
 }
 
-func TestDeleteHandler(t *testing.T) {
-	tmp, err := ioutil.TempDir("", tests.RandString(10))
-
-	assert.Nil(t, err)
-
-	tmpSrcStorage := filepath.Join(tmp, "src")
-	tmpDstStorage := filepath.Join(tmp, "dst")
-
-	os.MkdirAll(tmpSrcStorage, 0755)
-	os.MkdirAll(tmpDstStorage, 0755)
+func TestUploadURLHandler(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
 
-	img, err := ioutil.ReadFile("tests/fixtures/schwarzy.jpg")
+	tmp, err := ioutil.TempDir("", "picfit")
 	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
 
-	// copy 5 images to src storage
-	for i := 0; i < 5; i++ {
-		fn := fmt.Sprintf("image%d.jpg", i+1)
-		err = ioutil.WriteFile(filepath.Join(tmpSrcStorage, fn), img, 0644)
-		assert.Nil(t, err)
-	}
-
-	checkDirCount := func(dir string, count int, context string) {
-		dircontents, err := ioutil.ReadDir(dir)
-		assert.Nil(t, err)
-		assert.Equal(t, count, len(dircontents), "%s (%s)", context, dir)
-	}
-	checkDirCount(tmpSrcStorage, 5, "initial copy")
-	checkDirCount(tmpDstStorage, 0, "initial copy")
-
-	cfg := `
-{
-	"debug": true,
-	"port": 3001,
-	"options": {
-		"enable_delete": true,
-		"enable_cascade_delete": true
-	},
-	"kvstore": {"type": "cache"},
-	"storage": {
+	content := fmt.Sprintf(`{
+	  "options": {
+		"enable_upload": true,
+		"url_sources": {"allow_private": true}
+	  },
+	  "storage": {
 		"src": {
-			"type": "fs",
-			"location": "%s"
-		},
-		"dst": {
-			"type": "fs",
-			"location": "%s"
+		  "type": "fs",
+		  "location": "%s",
+		  "base_url": "http://img.example.com"
 		}
-	}
-}
-	`
+	  }
+	}`, tmp)
 
-	cfg = fmt.Sprintf(cfg, tmpSrcStorage, tmpDstStorage)
 	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
 		server, err := server.New(suite.Config)
 		assert.Nil(t, err)
 
-		// generate 5 resized image1.jpg
-		for i := 0; i < 5; i++ {
-			// use "get" instead of "display" here to force synchronized behaviour
-			url := fmt.Sprintf("http://www.example.com/get/resize/100x%d/image1.jpg", 100+i*10)
-			req, err := http.NewRequest("GET", url, nil)
+		upload := func(body string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("POST", "http://www.example.com/upload", strings.NewReader(body))
 			assert.Nil(t, err)
+			req.Header.Set("Content-Type", "application/json")
 
 			res := httptest.NewRecorder()
 			server.ServeHTTP(res, req)
-			assert.Equal(t, res.Code, 200)
-		}
-
-		checkDirCount(tmpDstStorage, 5, "after resize requests")
-
-		// generate 2 resized image2.jpg
-		for i := 0; i < 2; i++ {
-			// use "get" instead of "display" here to force synchronized behaviour
-			url := fmt.Sprintf("http://www.example.com/get/resize/100x%d/image2.jpg", 100+i*10)
-			req, err := http.NewRequest("GET", url, nil)
-			assert.Nil(t, err)
 
-			res := httptest.NewRecorder()
-			server.ServeHTTP(res, req)
-			assert.Equal(t, res.Code, 200)
+			return res
 		}
 
-		checkDirCount(tmpSrcStorage, 5, "after resize requests")
-		checkDirCount(tmpDstStorage, 7, "after resize requests")
-		assert.True(t, suite.Processor.FileExists("image1.jpg"))
+		res := upload(fmt.Sprintf(`{"url": "%s/avatar.png", "prefix": "avatars"}`, ts.URL))
+		assert.Equal(t, http.StatusOK, res.Code)
 
-		// Delete image1.jpg and all of the derived images
-		req, err := http.NewRequest("DELETE", "http://www.example.com/image1.jpg", nil)
+		v, _, _, err := jsonparser.Get(res.Body.Bytes(), "url")
 		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(string(v), "http://img.example.com/avatars/"))
+		assert.Equal(t, ".png", path.Ext(string(v)))
 
-		res := httptest.NewRecorder()
-		server.ServeHTTP(res, req)
-		assert.Equal(t, res.Code, 200)
+		w, err := jsonparser.GetInt(res.Body.Bytes(), "w")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(400), w)
 
-		checkDirCount(tmpSrcStorage, 4, "after 1st delete request")
-		checkDirCount(tmpDstStorage, 2, "after 1st delete request")
-		assert.False(t, suite.Processor.FileExists("image1.jpg"))
+		res = upload(fmt.Sprintf(`{"url": "%s/avatar.png", "path": "users/1/avatar"}`, ts.URL))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.True(t, suite.Processor.FileExists("users/1/avatar.png"))
 
-		// Try to delete image1.jpg again
-		req, err = http.NewRequest("DELETE", "http://www.example.com/image1.jpg", nil)
+		v, _, _, err = jsonparser.Get(res.Body.Bytes(), "filename")
 		assert.Nil(t, err)
+		assert.Equal(t, "avatar.png", string(v))
 
-		res = httptest.NewRecorder()
-		server.ServeHTTP(res, req)
-		assert.Equal(t, res.Code, 404)
-
-		checkDirCount(tmpSrcStorage, 4, "after 2nd delete request")
-		checkDirCount(tmpDstStorage, 2, "after 2nd delete request")
+		res = upload(fmt.Sprintf(`{"url": "%s/avatar.png", "path": "users/1/avatar.png"}`, ts.URL))
+		assert.Equal(t, http.StatusConflict, res.Code)
 
-		assert.False(t, suite.Processor.FileExists("image1.jpg"))
+		res = upload(fmt.Sprintf(`{"url": "%s/avatar.png", "path": "../avatar.png"}`, ts.URL))
+		assert.Equal(t, http.StatusBadRequest, res.Code)
 
-		assert.True(t, suite.Processor.FileExists("image2.jpg"))
+		res = upload(`{"url": "avatar.png"}`)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
 
-		// Delete image2.jpg and all of the derived images
-		req, err = http.NewRequest("DELETE", "http://www.example.com/image2.jpg", nil)
-		assert.Nil(t, err)
+		corrupted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("\x89PNG\r\n\x1a\nnot an image"))
+		}))
+		defer corrupted.Close()
 
-		res = httptest.NewRecorder()
-		server.ServeHTTP(res, req)
-		assert.Equal(t, res.Code, 200)
+		res = upload(fmt.Sprintf(`{"url": "%s/corrupted.png"}`, corrupted.URL))
+		assert.Equal(t, http.StatusBadRequest, res.Code)
 
-		checkDirCount(tmpSrcStorage, 3, "after 3rd delete request")
-		checkDirCount(tmpDstStorage, 0, "after 3rd delete request")
-		assert.False(t, suite.Processor.FileExists("image2.jpg"))
-	}, tests.WithConfig(cfg))
+		msg, err := jsonparser.GetString(res.Body.Bytes(), "error")
+		assert.Nil(t, err)
+		assert.Equal(t, "Invalid image", msg)
+	}, tests.WithConfig(content))
 }
 
-func TestStorageApplicationWithPath(t *testing.T) {
-	ts := tests.NewImageServer()
-	defer ts.Close()
-	defer ts.CloseClientConnections()
-
-	tmp := os.TempDir()
-
-	f, err := os.Open("tests/fixtures/avatar.png")
-	assert.Nil(t, err)
-	defer f.Close()
-
-	body, err := ioutil.ReadAll(f)
+func TestUploadRawHandler(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "picfit")
 	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
 
-	// We store the image at the tmp location to access it
-	// with the SourceStorage
-	ioutil.WriteFile(path.Join(tmp, "avatar.png"), body, 0755)
-
-	content := `{
-	  "debug": true,
-	  "port": 3001,
-	  "kvstore": {
-		"prefix": "picfit:",
-		"type": "redis",
-		"redis": {
-			"host": "127.0.0.1",
-			"db": 0,
-			"password": "",
-			"port": 6379
-		}
+	content := fmt.Sprintf(`{
+	  "options": {
+		"enable_upload": true
 	  },
 	  "storage": {
 		"src": {
@@ -492,272 +488,2030 @@ func TestStorageApplicationWithPath(t *testing.T) {
 		  "location": "%s",
 		  "base_url": "http://img.example.com"
 		}
-	  },
-	  "shard": {
-		"width": 1,
-		"depth": 2
 	  }
-	}`
-
-	content = fmt.Sprintf(content, tmp)
+	}`, tmp)
 
 	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
 		server, err := server.New(suite.Config)
 		assert.Nil(t, err)
 
-		location := "http://example.com/display/resize/100x100/avatar.png"
-
-		request, _ := http.NewRequest("GET", location, nil)
-
-		res := httptest.NewRecorder()
-
-		server.ServeHTTP(res, request)
-
-		assert.Equal(t, 200, res.Code)
-
-		// We wait until the goroutine to save the file on disk is finished
-		timer1 := time.NewTimer(time.Second * 2)
-		<-timer1.C
-
-		etag := res.Header().Get("ETag")
-
-		exists, err := suite.Processor.KeyExists(etag)
-		assert.Nil(t, err)
-		assert.True(t, exists)
-
-		raw, err := suite.Processor.GetKey(etag)
-		assert.Nil(t, err)
-
-		filepath, err := conv.String(raw)
+		source, err := ioutil.ReadFile("tests/fixtures/schwarzy.jpg")
 		assert.Nil(t, err)
 
-		parts := strings.Split(filepath, "/")
-
-		assert.Equal(t, len(parts), 3)
-		assert.Equal(t, len(parts[0]), 1)
-		assert.Equal(t, len(parts[1]), 1)
-
-		assert.True(t, suite.Processor.FileExists(filepath))
-
-		location = "http://example.com/get/resize/100x100/avatar.png"
-
-		request, _ = http.NewRequest("GET", location, nil)
-
-		res = httptest.NewRecorder()
+		upload := func(name string, contentType string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("PUT", "http://www.example.com/upload/"+name, bytes.NewReader(source))
+			assert.Nil(t, err)
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
 
-		server.ServeHTTP(res, request)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
 
-		assert.Equal(t, 200, res.Code)
-		assert.Equal(t, "application/json; charset=utf-8", res.Header().Get("Content-Type"))
+			return res
+		}
 
-		var dat map[string]interface{}
+		res := upload("movies/schwarzy.jpg", "image/jpeg")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.True(t, suite.Processor.FileExists("movies/schwarzy.jpg"))
 
-		err = json.Unmarshal(res.Body.Bytes(), &dat)
+		h, err := jsonparser.GetInt(res.Body.Bytes(), "h")
 		assert.Nil(t, err)
+		assert.Equal(t, int64(357), h)
 
-		expected := "http://img.example.com/" + filepath
-
-		assert.Equal(t, expected, dat["url"].(string))
-
-		location = "http://example.com/redirect/resize/100x100/avatar.png"
-
-		request, _ = http.NewRequest("GET", location, nil)
+		v, _, _, err := jsonparser.Get(res.Body.Bytes(), "url")
+		assert.Nil(t, err)
+		assert.Equal(t, "http://img.example.com/movies/schwarzy.jpg", string(v))
 
-		res = httptest.NewRecorder()
+		// the extension is detected from the content
+		res = upload("movies/terminator", "")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.True(t, suite.Processor.FileExists("movies/terminator.jpg"))
 
-		server.ServeHTTP(res, request)
+		res = upload("movies/schwarzy.jpg", "image/jpeg")
+		assert.Equal(t, http.StatusConflict, res.Code)
 
-		assert.Equal(t, expected, res.Header().Get("Location"))
-		assert.Equal(t, 301, res.Code)
+		// the header of a corrupted image cannot be decoded
+		source = append([]byte("\x89PNG\r\n\x1a\n"), "not an image"...)
 
+		res = upload("movies/corrupted.png", "image/png")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.False(t, suite.Processor.FileExists("movies/corrupted.png"))
 	}, tests.WithConfig(content))
 }
 
-func TestStorageApplicationWithURL(t *testing.T) {
+func TestUploadBatchHandler(t *testing.T) {
 	ts := tests.NewImageServer()
 	defer ts.Close()
 	defer ts.CloseClientConnections()
 
-	tmp := os.TempDir()
+	tmp, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
 
-	content := `{
-	  "debug": true,
-	  "port": 3001,
-	  "kvstore": {
-		"prefix": "picfit:",
-		"type": "redis",
-		"redis": {
-			"host": "127.0.0.1",
-			"db": 0,
-			"password": "",
-			"port": 6379
-		}
+	content := fmt.Sprintf(`{
+	  "options": {
+		"enable_upload": true,
+		"upload_batch_workers": 2,
+		"upload_batch_max_files": 3,
+		"url_sources": {"allow_private": true}
 	  },
 	  "storage": {
 		"src": {
 		  "type": "fs",
-		  "location": "%s"
+		  "location": "%s",
+		  "base_url": "http://img.example.com"
 		}
 	  }
-	}`
-
-	content = fmt.Sprintf(content, tmp)
+	}`, tmp)
 
 	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
 		server, err := server.New(suite.Config)
 		assert.Nil(t, err)
 
-		filename := "avatar.png"
+		upload := func(body *bytes.Buffer, contentType string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("POST", "http://www.example.com/upload/batch", body)
+			assert.Nil(t, err)
+			req.Header.Set("Content-Type", contentType)
 
-		u, _ := url.Parse(ts.URL + "/" + filename)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
 
-		location := fmt.Sprintf("http://example.com/display?url=%s&w=100&h=100&op=resize", u.String())
+			return res
+		}
+
+		body := new(bytes.Buffer)
+		wr := multipart.NewWriter(body)
+
+		for _, name := range []string{"avatar.png", "schwarzy.jpg"} {
+			source, err := ioutil.ReadFile(path.Join("tests", "fixtures", name))
+			assert.Nil(t, err)
+
+			writer, err := wr.CreateFormFile("data", name)
+			assert.Nil(t, err)
+			writer.Write(source)
+		}
+
+		writer, err := wr.CreateFormFile("data", "broken.png")
+		assert.Nil(t, err)
+		writer.Write([]byte("not an image"))
+
+		assert.Nil(t, wr.WriteField("prefix", "gallery"))
+		assert.Nil(t, wr.Close())
+
+		res := upload(body, wr.FormDataContentType())
+		assert.Equal(t, http.StatusOK, res.Code)
+
+		var results []picfit.BatchResult
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &results))
+		assert.Len(t, results, 3)
+
+		assert.Equal(t, "avatar.png", results[0].Name)
+		assert.Equal(t, 400, results[0].Width)
+		assert.Empty(t, results[0].Error)
+		assert.True(t, suite.Processor.FileExists(path.Join("gallery", results[0].Filename)))
+
+		assert.Equal(t, "schwarzy.jpg", results[1].Name)
+		assert.Equal(t, 357, results[1].Height)
+		assert.True(t, strings.HasPrefix(results[1].URL, "http://img.example.com/gallery/"))
+
+		assert.Equal(t, "broken.png", results[2].Name)
+		assert.Empty(t, results[2].Filename)
+		assert.NotEmpty(t, results[2].Error)
+
+		res = upload(bytes.NewBufferString(fmt.Sprintf(`{"urls": ["%s/avatar.png", "%s/missing.png", "avatar.png"]}`,
+			ts.URL, ts.URL)), "application/json")
+		assert.Equal(t, http.StatusOK, res.Code)
+
+		results = nil
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &results))
+		assert.Len(t, results, 3)
+		assert.Empty(t, results[0].Error)
+		assert.Equal(t, 400, results[0].Height)
+		assert.NotEmpty(t, results[1].Error)
+		assert.Equal(t, failure.ErrInvalidURL.Error(), results[2].Error)
+
+		res = upload(bytes.NewBufferString(`{"urls": ["a", "b", "c", "d"]}`), "application/json")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+
+		res = upload(bytes.NewBufferString(`{"urls": []}`), "application/json")
+		assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+	}, tests.WithConfig(content))
+}
+
+func TestUploadPolicyApplication(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
+
+	content := fmt.Sprintf(`{
+	  "options": {
+		"enable_upload": true
+	  },
+	  "engine": {
+		"upload": {
+		  "max_width": 200,
+		  "format": "jpg",
+		  "quality": 80,
+		  "strip_exif": true,
+		  "allowed_mimetypes": ["image/png", "image/jpeg"],
+		  "max_bytes": 1000000
+		}
+	  },
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s",
+		  "base_url": "http://img.example.com"
+		}
+	  }
+	}`, tmp)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		upload := func(name string, source []byte) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("PUT", "http://www.example.com/upload/"+name, bytes.NewReader(source))
+			assert.Nil(t, err)
+
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
+
+			return res
+		}
+
+		fixture := func(name string) []byte {
+			source, err := ioutil.ReadFile(path.Join("tests", "fixtures", name))
+			assert.Nil(t, err)
+			return source
+		}
+
+		res := upload("avatars/avatar.png", fixture("avatar.png"))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.True(t, suite.Processor.FileExists("avatars/avatar.jpg"))
+
+		w, err := jsonparser.GetInt(res.Body.Bytes(), "w")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(200), w)
+
+		file, err := suite.Processor.OpenFile("avatars/avatar.jpg")
+		assert.Nil(t, err)
+		defer file.Close()
+
+		cfg, format, err := goimage.DecodeConfig(file)
+		assert.Nil(t, err)
+		assert.Equal(t, "jpeg", format)
+		assert.Equal(t, 200, cfg.Width)
+		assert.Equal(t, 200, cfg.Height)
+
+		for name, status := range map[string]int{
+			"giphy.gif": http.StatusUnsupportedMediaType,
+			"BIG.jpg":   http.StatusUnprocessableEntity,
+		} {
+			res = upload(name, fixture(name))
+			assert.Equal(t, status, res.Code, name)
+			assert.Equal(t, "application/json; charset=utf-8", res.Header().Get("Content-Type"))
+
+			msg, err := jsonparser.GetString(res.Body.Bytes(), "error")
+			assert.Nil(t, err)
+			assert.NotEmpty(t, msg)
+		}
+
+		res = upload("broken.png", []byte("not an image"))
+		assert.Equal(t, http.StatusUnsupportedMediaType, res.Code)
+
+		// the header of a truncated image is decoded but not its pixels
+		res = upload("truncated.png", fixture("avatar.png")[:200])
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.False(t, suite.Processor.FileExists("truncated.jpg"))
+	}, tests.WithConfig(content))
+}
+
+func TestContentAddressedUploadApplication(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
+
+	content := fmt.Sprintf(`{
+	  "options": {
+		"enable_upload": true,
+		"content_addressed_upload": true
+	  },
+	  "shard": {
+		"width": 2,
+		"depth": 1,
+		"restonly": true
+	  },
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s",
+		  "base_url": "http://img.example.com"
+		}
+	  }
+	}`, tmp)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		source, err := ioutil.ReadFile("tests/fixtures/avatar.png")
+		assert.Nil(t, err)
+
+		upload := func(filename string, prefix string) *httptest.ResponseRecorder {
+			body := new(bytes.Buffer)
+			wr := multipart.NewWriter(body)
+
+			writer, err := wr.CreateFormFile("data", filename)
+			assert.Nil(t, err)
+			writer.Write(source)
+
+			if prefix != "" {
+				assert.Nil(t, wr.WriteField("prefix", prefix))
+			}
+			assert.Nil(t, wr.Close())
+
+			req, err := http.NewRequest("POST", "http://www.example.com/upload", body)
+			assert.Nil(t, err)
+			req.Header.Set("Content-Type", wr.FormDataContentType())
+
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
+
+			return res
+		}
+
+		sum := sha256.Sum256(source)
+		name := hex.EncodeToString(sum[:])
+
+		for _, tc := range []struct {
+			filename     string
+			prefix       string
+			url          string
+			deduplicated bool
+		}{
+			{"avatar.png", "", fmt.Sprintf("http://img.example.com/%s/%s.png", name[:2], name[2:]), false},
+			{"copy.png", "", fmt.Sprintf("http://img.example.com/%s/%s.png", name[:2], name[2:]), true},
+			{"avatar.png", "avatars", fmt.Sprintf("http://img.example.com/avatars/%s/%s.png", name[:2], name[2:]), false},
+			{"avatar.png", "avatars", fmt.Sprintf("http://img.example.com/avatars/%s/%s.png", name[:2], name[2:]), true},
+		} {
+			res := upload(tc.filename, tc.prefix)
+			assert.Equal(t, http.StatusOK, res.Code)
+
+			u, err := jsonparser.GetString(res.Body.Bytes(), "url")
+			assert.Nil(t, err)
+			assert.Equal(t, tc.url, u)
+
+			deduplicated, err := jsonparser.GetBoolean(res.Body.Bytes(), "deduplicated")
+			assert.Nil(t, err)
+			assert.Equal(t, tc.deduplicated, deduplicated, tc.filename)
+		}
+
+		assert.True(t, suite.Processor.FileExists(path.Join(name[:2], name[2:]+".png")))
+	}, tests.WithConfig(content))
+}
+
+func TestGetAndInfoApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	tmp, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
+
+	content := fmt.Sprintf(`{
+	  "kvstore": {"type": "cache"},
+	  "options": {
+		"url_sources": {"allow_private": true}
+	  },
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "tests/fixtures",
+		  "base_url": "http://img.example.com"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s",
+		  "base_url": "http://cdn.example.com"
+		}
+	  }
+	}`, tmp)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		request := func(location string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", location, nil)
+			assert.Nil(t, err)
+
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
+
+			return res
+		}
+
+		// the image is processed then retrieved from the storage
+		for i := 0; i < 2; i++ {
+			res := request(fmt.Sprintf("http://example.com/get?url=%s/avatar.png&w=50&h=40&op=resize", ts.URL))
+			assert.Equal(t, http.StatusOK, res.Code)
+
+			var result map[string]interface{}
+			assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &result))
+			assert.Equal(t, float64(50), result["w"])
+			assert.Equal(t, float64(40), result["h"])
+			assert.Equal(t, "png", result["format"])
+			assert.Equal(t, "image/png", result["content_type"])
+			assert.True(t, result["size"].(float64) > 0)
+		}
+
+		for location, expected := range map[string]backend.Info{
+			fmt.Sprintf("http://example.com/info?url=%s/avatar.png", ts.URL): {
+				Width: 400, Height: 400, Format: "png", ContentType: "image/png",
+				Frames: 1, Orientation: 1, ColorModel: "rgba", HasAlpha: false,
+			},
+			"http://example.com/info/schwarzy.jpg": {
+				Width: 500, Height: 357, Format: "jpeg", ContentType: "image/jpeg",
+				Frames: 1, Orientation: 1, ColorModel: "ycbcr", HasAlpha: false,
+			},
+			"http://example.com/info?path=giphy.gif": {
+				Width: 400, Height: 300, Format: "gif", ContentType: "image/gif",
+				Orientation: 1, ColorModel: "paletted",
+			},
+		} {
+			res := request(location)
+			assert.Equal(t, http.StatusOK, res.Code, location)
+
+			var info backend.Info
+			assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &info))
+			assert.True(t, info.Size > 0)
+
+			if expected.Format == "gif" {
+				assert.True(t, info.Frames > 1)
+				expected.Frames = info.Frames
+				expected.HasAlpha = info.HasAlpha
+			}
+
+			expected.Size = info.Size
+			assert.Equal(t, expected, info, location)
+		}
+
+		assert.Equal(t, http.StatusNotFound, request("http://example.com/info/missing.png").Code)
+	}, tests.WithConfig(content))
+}
+
+func TestMetadataApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	tmp, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
+
+	source, err := ioutil.ReadFile("tests/fixtures/metadata.jpg")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path.Join(tmp, "image.jpg"), source, 0644))
+
+	other, err := ioutil.ReadFile("tests/fixtures/schwarzy.jpg")
+	assert.Nil(t, err)
+
+	content := fmt.Sprintf(`{
+	  "kvstore": {"type": "cache"},
+	  "metadata": {"exclude": ["Model", "dc:creator"]},
+	  "options": {
+		"enable_delete": true,
+		"url_sources": {"allow_private": true}
+	  },
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s",
+		  "base_url": "http://img.example.com"
+		}
+	  }
+	}`, tmp)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		request := func(method string, location string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest(method, location, nil)
+			assert.Nil(t, err)
+
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
+
+			return res
+		}
+
+		metadata := func(location string) map[string]interface{} {
+			res := request("GET", location)
+			assert.Equal(t, http.StatusOK, res.Code, location)
+
+			var result map[string]interface{}
+			assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &result))
+
+			return result
+		}
+
+		for _, location := range []string{
+			"http://example.com/metadata/image.jpg",
+			fmt.Sprintf("http://example.com/metadata?url=%s/metadata.jpg", ts.URL),
+		} {
+			result := metadata(location)
+
+			exif := result["exif"].(map[string]interface{})
+			assert.Equal(t, "Canon", exif["Make"], location)
+			assert.Equal(t, "2020:06:01 21:30:00", exif["DateTime"], location)
+			assert.NotContains(t, exif, "Model", location)
+			assert.NotContains(t, exif, "GPSLatitude", location)
+			assert.NotContains(t, result, "gps", location)
+
+			iptc := result["iptc"].(map[string]interface{})
+			assert.Equal(t, "The Eiffel tower at night", iptc["caption"], location)
+			assert.Equal(t, "picfit", iptc["copyright"], location)
+
+			xmp := result["xmp"].(map[string]interface{})
+			assert.Equal(t, "© picfit", xmp["dc:rights"], location)
+			assert.NotContains(t, xmp, "dc:creator", location)
+		}
+
+		// the metadata is cached until the image is deleted
+		assert.Nil(t, ioutil.WriteFile(path.Join(tmp, "image.jpg"), other, 0644))
+		assert.Contains(t, metadata("http://example.com/metadata/image.jpg"), "exif")
+		assert.Equal(t, map[string]interface{}{}, metadata("http://example.com/metadata/image.jpg?force=1"))
+
+		assert.Nil(t, ioutil.WriteFile(path.Join(tmp, "image.jpg"), source, 0644))
+		assert.Contains(t, metadata("http://example.com/metadata/image.jpg?force=1"), "exif")
+		assert.Equal(t, http.StatusOK, request("DELETE", "http://example.com/image.jpg").Code)
+		assert.Equal(t, http.StatusNotFound, request("GET", "http://example.com/metadata/image.jpg").Code)
+
+		assert.Nil(t, ioutil.WriteFile(path.Join(tmp, "image.jpg"), other, 0644))
+		assert.Equal(t, map[string]interface{}{}, metadata("http://example.com/metadata/image.jpg"))
+	}, tests.WithConfig(content))
+}
+
+func TestDeleteHandler(t *testing.T) {
+	tmp, err := ioutil.TempDir("", tests.RandString(10))
+
+	assert.Nil(t, err)
+
+	tmpSrcStorage := filepath.Join(tmp, "src")
+	tmpDstStorage := filepath.Join(tmp, "dst")
+
+	os.MkdirAll(tmpSrcStorage, 0755)
+	os.MkdirAll(tmpDstStorage, 0755)
+
+	img, err := ioutil.ReadFile("tests/fixtures/schwarzy.jpg")
+	assert.Nil(t, err)
+
+	// copy 5 images to src storage
+	for i := 0; i < 5; i++ {
+		fn := fmt.Sprintf("image%d.jpg", i+1)
+		err = ioutil.WriteFile(filepath.Join(tmpSrcStorage, fn), img, 0644)
+		assert.Nil(t, err)
+	}
+
+	checkDirCount := func(dir string, count int, context string) {
+		dircontents, err := ioutil.ReadDir(dir)
+		assert.Nil(t, err)
+		assert.Equal(t, count, len(dircontents), "%s (%s)", context, dir)
+	}
+	checkDirCount(tmpSrcStorage, 5, "initial copy")
+	checkDirCount(tmpDstStorage, 0, "initial copy")
+
+	cfg := `
+{
+	"debug": true,
+	"port": 3001,
+	"options": {
+		"enable_delete": true,
+		"enable_cascade_delete": true
+	},
+	"kvstore": {"type": "cache"},
+	"storage": {
+		"src": {
+			"type": "fs",
+			"location": "%s"
+		},
+		"dst": {
+			"type": "fs",
+			"location": "%s"
+		}
+	}
+}
+	`
+
+	cfg = fmt.Sprintf(cfg, tmpSrcStorage, tmpDstStorage)
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		// generate 5 resized image1.jpg
+		for i := 0; i < 5; i++ {
+			// use "get" instead of "display" here to force synchronized behaviour
+			url := fmt.Sprintf("http://www.example.com/get/resize/100x%d/image1.jpg", 100+i*10)
+			req, err := http.NewRequest("GET", url, nil)
+			assert.Nil(t, err)
+
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
+			assert.Equal(t, res.Code, 200)
+		}
+
+		checkDirCount(tmpDstStorage, 5, "after resize requests")
+
+		// generate 2 resized image2.jpg
+		for i := 0; i < 2; i++ {
+			// use "get" instead of "display" here to force synchronized behaviour
+			url := fmt.Sprintf("http://www.example.com/get/resize/100x%d/image2.jpg", 100+i*10)
+			req, err := http.NewRequest("GET", url, nil)
+			assert.Nil(t, err)
+
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
+			assert.Equal(t, res.Code, 200)
+		}
+
+		checkDirCount(tmpSrcStorage, 5, "after resize requests")
+		checkDirCount(tmpDstStorage, 7, "after resize requests")
+		assert.True(t, suite.Processor.FileExists("image1.jpg"))
+
+		// Delete image1.jpg and all of the derived images
+		req, err := http.NewRequest("DELETE", "http://www.example.com/image1.jpg", nil)
+		assert.Nil(t, err)
+
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		assert.Equal(t, res.Code, 200)
+
+		checkDirCount(tmpSrcStorage, 4, "after 1st delete request")
+		checkDirCount(tmpDstStorage, 2, "after 1st delete request")
+		assert.False(t, suite.Processor.FileExists("image1.jpg"))
+
+		// Try to delete image1.jpg again
+		req, err = http.NewRequest("DELETE", "http://www.example.com/image1.jpg", nil)
+		assert.Nil(t, err)
+
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		assert.Equal(t, res.Code, 404)
+
+		checkDirCount(tmpSrcStorage, 4, "after 2nd delete request")
+		checkDirCount(tmpDstStorage, 2, "after 2nd delete request")
+
+		assert.False(t, suite.Processor.FileExists("image1.jpg"))
+
+		assert.True(t, suite.Processor.FileExists("image2.jpg"))
+
+		// Delete image2.jpg and all of the derived images
+		req, err = http.NewRequest("DELETE", "http://www.example.com/image2.jpg", nil)
+		assert.Nil(t, err)
+
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		assert.Equal(t, res.Code, 200)
+
+		checkDirCount(tmpSrcStorage, 3, "after 3rd delete request")
+		checkDirCount(tmpDstStorage, 0, "after 3rd delete request")
+		assert.False(t, suite.Processor.FileExists("image2.jpg"))
+	}, tests.WithConfig(cfg))
+}
+
+func TestStorageApplicationWithPath(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	tmp := os.TempDir()
+
+	f, err := os.Open("tests/fixtures/avatar.png")
+	assert.Nil(t, err)
+	defer f.Close()
+
+	body, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+
+	// We store the image at the tmp location to access it
+	// with the SourceStorage
+	ioutil.WriteFile(path.Join(tmp, "avatar.png"), body, 0755)
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "kvstore": {
+		"prefix": "picfit:",
+		"type": "redis",
+		"redis": {
+			"host": "127.0.0.1",
+			"db": 0,
+			"password": "",
+			"port": 6379
+		}
+	  },
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s",
+		  "base_url": "http://img.example.com"
+		}
+	  },
+	  "shard": {
+		"width": 1,
+		"depth": 2
+	  }
+	}`
+
+	content = fmt.Sprintf(content, tmp)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		location := "http://example.com/display/resize/100x100/avatar.png"
+
+		request, _ := http.NewRequest("GET", location, nil)
+
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, request)
+
+		assert.Equal(t, 200, res.Code)
+
+		// We wait until the goroutine to save the file on disk is finished
+		timer1 := time.NewTimer(time.Second * 2)
+		<-timer1.C
+
+		etag := res.Header().Get("ETag")
+
+		exists, err := suite.Processor.KeyExists(etag)
+		assert.Nil(t, err)
+		assert.True(t, exists)
+
+		raw, err := suite.Processor.GetKey(etag)
+		assert.Nil(t, err)
+
+		filepath, err := conv.String(raw)
+		assert.Nil(t, err)
+
+		parts := strings.Split(filepath, "/")
+
+		assert.Equal(t, len(parts), 3)
+		assert.Equal(t, len(parts[0]), 1)
+		assert.Equal(t, len(parts[1]), 1)
+
+		assert.True(t, suite.Processor.FileExists(filepath))
+
+		location = "http://example.com/get/resize/100x100/avatar.png"
+
+		request, _ = http.NewRequest("GET", location, nil)
+
+		res = httptest.NewRecorder()
+
+		server.ServeHTTP(res, request)
+
+		assert.Equal(t, 200, res.Code)
+		assert.Equal(t, "application/json; charset=utf-8", res.Header().Get("Content-Type"))
+
+		var dat map[string]interface{}
+
+		err = json.Unmarshal(res.Body.Bytes(), &dat)
+		assert.Nil(t, err)
+
+		expected := "http://img.example.com/" + filepath
+
+		assert.Equal(t, expected, dat["url"].(string))
+
+		location = "http://example.com/redirect/resize/100x100/avatar.png"
+
+		request, _ = http.NewRequest("GET", location, nil)
+
+		res = httptest.NewRecorder()
+
+		server.ServeHTTP(res, request)
+
+		assert.Equal(t, expected, res.Header().Get("Location"))
+		assert.Equal(t, 301, res.Code)
+
+	}, tests.WithConfig(content))
+}
+
+func TestStorageApplicationWithURL(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	tmp := os.TempDir()
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "kvstore": {
+		"prefix": "picfit:",
+		"type": "redis",
+		"redis": {
+			"host": "127.0.0.1",
+			"db": 0,
+			"password": "",
+			"port": 6379
+		}
+	  },
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`
+
+	content = fmt.Sprintf(content, tmp)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		filename := "avatar.png"
+
+		u, _ := url.Parse(ts.URL + "/" + filename)
+
+		location := fmt.Sprintf("http://example.com/display?url=%s&w=100&h=100&op=resize", u.String())
+
+		request, _ := http.NewRequest("GET", location, nil)
+
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, request)
+
+		assert.Equal(t, res.Code, 200)
+
+		// We wait until the goroutine to save the file on disk is finished
+		timer1 := time.NewTimer(time.Second * 2)
+		<-timer1.C
+
+		etag := res.Header().Get("ETag")
+
+		exists, err := suite.Processor.KeyExists(etag)
+		assert.Nil(t, err)
+		assert.True(t, exists)
+
+		raw, err := suite.Processor.GetKey(etag)
+		assert.Nil(t, err)
+
+		filepath, err := conv.String(raw)
+		assert.Nil(t, err)
+
+		parts := strings.Split(filepath, "/")
+
+		assert.Equal(t, len(parts), 1)
+
+		assert.True(t, suite.Processor.FileExists(filepath))
+	}, tests.WithConfig(content))
+}
+
+func TestDummyApplicationErrors(t *testing.T) {
+	location := "http://example.com/display/resize/100x100/avatar.png"
+
+	request, _ := http.NewRequest("GET", location, nil)
+
+	res := httptest.NewRecorder()
+
+	server, err := server.New(config.DefaultConfig())
+	assert.Nil(t, err)
+
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 404, res.Code)
+}
+
+func TestParametersErrorsApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(tests.DefaultConfig())
+	assert.Nil(t, err)
+
+	for _, query := range []string{
+		"w=50&h=40&op=crop&gravity=middle",
+		"w=50&h=40&op=thumbnail&crop=random",
+		"w=50&h=40&op=crop&gravity=north&x=10",
+		"w=50&h=40&op=crop&x=left",
+	} {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/avatar.png&%s", ts.URL, query), nil)
+
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, request)
+
+		assert.Equal(t, http.StatusBadRequest, res.Code, query)
+		assert.Contains(t, res.Body.String(), "Parameter", query)
+	}
+}
+
+func TestDummyApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(tests.DefaultConfig())
+	assert.Nil(t, err)
+
+	for _, filename := range []string{"avatar.png", "schwarzy.jpg", "giphy.gif"} {
+		u, _ := url.Parse(ts.URL + "/" + filename)
+
+		contentType := mime.TypeByExtension(path.Ext(filename))
+
+		tests := []*tests.TestRequest{
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=50&op=resize", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 50,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=100&h=30&op=resize", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  100,
+					Height: 30,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=50&op=thumbnail", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 50,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:resize+w:100+h:50&op=op:watermark+text:picfit+opacity:50+padding:5+gravity:south-west", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  100,
+					Height: 50,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=30&h=60&op=thumbnail&crop=smart", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  30,
+					Height: 60,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=50&op=thumbnail&fmt=jpg", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 50,
+				},
+				ContentType: "image/jpeg",
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=50&op=thumbnail&fmt=webp", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 50,
+				},
+				ContentType: "image/webp",
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=60&h=40&op=resize&fmt=webp&q=100", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  60,
+					Height: 40,
+				},
+				ContentType: "image/webp",
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:resize+w:100+h:50&op=op:rotate+deg:90", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 100,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&op=resize&w=100&h=50&op=op:rotate+deg:90", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 100,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:resize+w:100+h:50&op=op:blur+s:30", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  100,
+					Height: 50,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&op=resize&w=100&h=50&op=op:blur+s:30", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  100,
+					Height: 50,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=40&op=crop", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 40,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&x=10&y=5&w=30&h=20&op=crop", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  30,
+					Height: 20,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:resize+w:100+h:100&op=op:crop+w:60+h:30+gravity:south-east", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  60,
+					Height: 30,
+				},
+			},
+		}
+
+		for _, test := range tests {
+			request, _ := http.NewRequest("GET", test.URL, nil)
+
+			res := httptest.NewRecorder()
+
+			server.ServeHTTP(res, request)
+
+			img, err := imaging.Decode(res.Body)
+
+			assert.Nil(t, err)
+
+			if test.ContentType != "" {
+				assert.Equal(t, res.Header().Get("Content-Type"), test.ContentType)
+			} else {
+				assert.Equal(t, res.Header().Get("Content-Type"), contentType)
+			}
+
+			assert.Equal(t, res.Code, 200)
+
+			if img.Bounds().Max.X != test.Dimensions.Width {
+				t.Fatalf("Invalid width for %s: %d != %d", filename, img.Bounds().Max.X, test.Dimensions.Width)
+			}
+
+			if img.Bounds().Max.Y != test.Dimensions.Height {
+				t.Fatalf("Invalid width for %s: %d != %d", filename, img.Bounds().Max.Y, test.Dimensions.Height)
+			}
+		}
+	}
+}
+
+func TestAutoFormatApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	cfg := tests.DefaultConfig()
+	cfg.Engine.AutoFormat = true
+
+	server, err := server.New(cfg)
+	assert.Nil(t, err)
+
+	for _, test := range []struct {
+		filename    string
+		accept      string
+		contentType string
+	}{
+		{"schwarzy.jpg", "image/avif,image/webp,image/apng,*/*;q=0.8", "image/webp"},
+		{"avatar.png", "image/webp", "image/webp"},
+		{"schwarzy.jpg", "image/webp;q=0,image/*", "image/jpeg"},
+		{"schwarzy.jpg", "", "image/jpeg"},
+		{"avatar.png", "*/*", "image/jpeg"},
+		{"giphy.gif", "image/webp", "image/gif"},
+	} {
+		u, _ := url.Parse(ts.URL + "/" + test.filename)
+
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s&w=50&h=40&op=resize", u.String()), nil)
+		if test.accept != "" {
+			request.Header.Set("Accept", test.accept)
+		}
+
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, request)
+
+		assert.Equal(t, 200, res.Code)
+		assert.Equal(t, test.contentType, res.Header().Get("Content-Type"))
+		assert.Equal(t, "Accept", res.Header().Get("Vary"))
+
+		img, err := imaging.Decode(res.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, 50, img.Bounds().Dx())
+		assert.Equal(t, 40, img.Bounds().Dy())
+	}
+}
+
+func TestAutoFormatKey(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(tests.DefaultConfig())
+	assert.Nil(t, err)
+
+	u, _ := url.Parse(ts.URL + "/schwarzy.jpg")
+
+	etag := func(format string, accept string) string {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s&w=50&h=40&op=resize%s", u.String(), format), nil)
+		request.Header.Set("Accept", accept)
+
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, request)
+
+		assert.Equal(t, 200, res.Code)
+		if format == "" {
+			assert.Equal(t, "", res.Header().Get("Vary"))
+		}
+
+		return res.Header().Get("ETag")
+	}
+
+	webp := etag("&fmt=auto", "image/webp")
+	legacy := etag("&fmt=auto", "image/png")
+
+	assert.NotEqual(t, webp, legacy)
+	assert.Equal(t, webp, etag("&fmt=auto", "image/webp,*/*"))
+
+	// the Accept header is ignored when the format is not negotiated
+	assert.Equal(t, etag("", "image/webp"), etag("", "image/png"))
+}
+
+func TestWatermarkApplication(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
+
+	content := fmt.Sprintf(`{
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "tests/fixtures"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmp)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		for _, test := range []struct {
+			url  string
+			code int
+		}{
+			{"http://example.com/display?path=schwarzy.jpg&op=watermark&logo=avatar.png&scale=20&opacity=60&tile=1&padding=10", 200},
+			{"http://example.com/display?path=schwarzy.jpg&op=watermark&text=picfit&gravity=north&color=ff0000", 200},
+			{"http://example.com/display?path=schwarzy.jpg&op=watermark&logo=missing.png", 404},
+			{"http://example.com/display?path=schwarzy.jpg&op=watermark&text=" + strings.Repeat("a", 101), 400},
+			{"http://example.com/display?path=schwarzy.jpg&op=watermark", 400},
+			{"http://example.com/display?path=schwarzy.jpg&op=watermark&text=picfit&opacity=101", 400},
+			{"http://example.com/display?path=schwarzy.jpg&op=watermark&text=picfit&padding=-1", 400},
+			{"http://example.com/display?path=schwarzy.jpg&op=watermark&text=picfit&scale=200", 400},
+			{"http://example.com/display?path=schwarzy.jpg&op=watermark&text=picfit&tile=sometimes", 400},
+		} {
+			request, _ := http.NewRequest("GET", test.url, nil)
+
+			res := httptest.NewRecorder()
+
+			server.ServeHTTP(res, request)
+
+			assert.Equal(t, test.code, res.Code, test.url)
+
+			if test.code != 200 {
+				continue
+			}
+
+			img, err := imaging.Decode(res.Body)
+			assert.Nil(t, err)
+			assert.Equal(t, "image/jpeg", res.Header().Get("Content-Type"))
+			assert.Equal(t, 500, img.Bounds().Dx())
+			assert.Equal(t, 357, img.Bounds().Dy())
+		}
+	}, tests.WithConfig(content))
+}
+
+func TestFetchErrorsApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "options": {
+		"fetch_max_size": 68000
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		for filename, code := range map[string]int{
+			"schwarzy.jpg": 200,
+			"avatar.png":   413,
+			"missing.png":  502,
+		} {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/%s&w=50&h=50&op=resize", ts.URL, filename), nil)
+
+			res := httptest.NewRecorder()
+
+			server.ServeHTTP(res, request)
+
+			assert.Equal(t, code, res.Code, filename)
+		}
+	}, tests.WithConfig(content))
+}
+
+func TestHTTPStorageApplication(t *testing.T) {
+	// files of storages are read with their Last-Modified header
+	ts := httptest.NewServer(http.FileServer(http.Dir("tests/fixtures")))
+	defer ts.Close()
+
+	tmp, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
+
+	// the base url of a storage is on a private address denied for urls
+	content := fmt.Sprintf(`{
+	  "options": {
+		"url_sources": {"allow_private": false}
+	  },
+	  "storage": {
+		"src": {
+		  "type": "http+fs",
+		  "location": "tests/fixtures",
+		  "base_url": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, ts.URL, tmp)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		// the config of the storages is changed once they are created
+		server, err := server.NewHTTPServer(suite.Config, suite.Processor)
+		assert.Nil(t, err)
+
+		for u, code := range map[string]int{
+			"http://example.com/display?path=avatar.png&w=50&h=50&op=resize":                        200,
+			fmt.Sprintf("http://example.com/display?url=%s/avatar.png&w=50&h=50&op=resize", ts.URL): 403,
+		} {
+			request, _ := http.NewRequest("GET", u, nil)
+
+			res := httptest.NewRecorder()
+
+			server.ServeHTTP(res, request)
+
+			assert.Equal(t, code, res.Code, u)
+		}
+	}, tests.WithConfig(content))
+}
+
+func TestURLSourcesApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	for content, code := range map[string]int{
+		`{"options": {"url_sources": {}}}`:                                                          403,
+		`{"options": {"url_sources": {"allow_private": true}}}`:                                     200,
+		`{"options": {"url_sources": {"allow_private": true, "allowed_schemes": ["https"]}}}`:       403,
+		`{"options": {"url_sources": {"allow_private": true, "allowed_hosts": ["*.example.com"]}}}`: 403,
+		`{"options": {"url_sources": {"allow_private": true, "denied_cidrs": ["127.0.0.0/8"]}}}`:    403,
+	} {
+		tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+			server, err := server.New(suite.Config)
+			assert.Nil(t, err)
+
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/avatar.png&w=50&h=50&op=resize", ts.URL), nil)
+
+			res := httptest.NewRecorder()
+
+			server.ServeHTTP(res, request)
+
+			assert.Equal(t, code, res.Code, content)
+		}, tests.WithConfig(content))
+	}
+}
+
+func TestCoalescedApplication(t *testing.T) {
+	var requests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		// leave time to concurrent requests to reach the processor
+		time.Sleep(200 * time.Millisecond)
+
+		if r.URL.Path == "/error.png" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		http.ServeFile(w, r, path.Join("tests", "fixtures", r.URL.Path))
+	}))
+	defer ts.Close()
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		for filename, code := range map[string]int{
+			"avatar.png": 200,
+			"error.png":  502,
+		} {
+			atomic.StoreInt32(&requests, 0)
+
+			var wg sync.WaitGroup
+
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/%s&w=50&h=50&op=resize", ts.URL, filename), nil)
+
+					res := httptest.NewRecorder()
+
+					server.ServeHTTP(res, request)
+
+					assert.Equal(t, code, res.Code, filename)
+
+					if code == 200 {
+						img, err := imaging.Decode(res.Body)
+						assert.Nil(t, err)
+						assert.Equal(t, 50, img.Bounds().Dx())
+					}
+				}()
+			}
+
+			wg.Wait()
+
+			assert.Equal(t, int32(1), atomic.LoadInt32(&requests), filename)
+		}
+	})
+}
+
+func TestCoalescedContextApplication(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// leave time to concurrent requests to reach the processor
+		time.Sleep(200 * time.Millisecond)
+
+		http.ServeFile(w, r, path.Join("tests", "fixtures", r.URL.Path))
+	}))
+	defer ts.Close()
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		u, err := url.Parse(ts.URL + "/avatar.png")
+		assert.Nil(t, err)
+
+		var wg sync.WaitGroup
+
+		contexts := make([]*gin.Context, 10)
+		for i := range contexts {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request, _ = http.NewRequest("GET", "http://example.com/display", nil)
+			c.Set("key", "coalesced")
+			c.Set("url", u)
+			c.Set("parameters", map[string]interface{}{
+				"w":  "50",
+				"h":  "50",
+				"op": "resize",
+			})
+			contexts[i] = c
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				_, err := suite.Processor.ProcessContext(c)
+				assert.Nil(t, err)
+			}()
+		}
+
+		wg.Wait()
+
+		source, err := ioutil.ReadFile(path.Join("tests", "fixtures", "avatar.png"))
+		assert.Nil(t, err)
+
+		for _, c := range contexts {
+			size, ok := c.Get(constants.SourceSizeContextKey)
+			assert.True(t, ok)
+			assert.Equal(t, len(source), size)
+			assert.Equal(t, "goimage", c.GetString(constants.BackendContextKey))
+		}
+	})
+}
+
+type fakeLocker struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func (l *fakeLocker) TryLock(key string) (func() error, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.keys[key] {
+		return nil, false, nil
+	}
+
+	l.keys[key] = true
+
+	return func() error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		delete(l.keys, key)
+
+		return nil
+	}, true, nil
+}
+
+func (l *fakeLocker) RetryInterval() time.Duration {
+	return 10 * time.Millisecond
+}
+
+type blockingStorage struct {
+	gostorages.Storage
+	saved chan struct{}
+}
+
+func (s *blockingStorage) Save(filepath string, file gostorages.File) error {
+	<-s.saved
+
+	return s.Storage.Save(filepath, file)
+}
+
+func TestLockedAsyncStoreApplication(t *testing.T) {
+	var requests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		http.ServeFile(w, r, path.Join("tests", "fixtures", r.URL.Path))
+	}))
+	defer ts.Close()
+
+	tmp, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
+
+	content := fmt.Sprintf(`{
+	  "kvstore": {"type": "cache"},
+	  "storage": {
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmp)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		u, err := url.Parse(ts.URL + "/avatar.png")
+		assert.Nil(t, err)
+
+		storage := &blockingStorage{
+			Storage: suite.Processor.DestinationStorage,
+			saved:   make(chan struct{}),
+		}
+		suite.Processor.DestinationStorage = storage
+		suite.Processor.Locker = &fakeLocker{keys: map[string]bool{}}
+
+		process := func() (*picfitimage.ImageFile, error) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request, _ = http.NewRequest("GET", "http://example.com/display", nil)
+			c.Set("key", "locked")
+			c.Set("url", u)
+			c.Set("parameters", map[string]interface{}{
+				"w":  "50",
+				"h":  "50",
+				"op": "resize",
+			})
+
+			return suite.Processor.ProcessContext(c, picfit.WithAsync(true), picfit.WithLoad(true))
+		}
+
+		// the first request returns before its image is stored
+		_, err = process()
+		assert.Nil(t, err)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			img, err := process()
+			assert.Nil(t, err)
+			assert.NotNil(t, img)
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("the second request did not wait for the image to be stored")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(storage.saved)
+		<-done
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	}, tests.WithConfig(content))
+}
+
+func TestQueueStatsApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "options": {
+		"enable_stats": true,
+		"transform_workers": 2,
+		"store_queue_size": 10
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/avatar.png&w=50&h=50&op=resize", ts.URL), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		request, _ = http.NewRequest("GET", "http://example.com/sys/stats", nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		body := res.Body.Bytes()
+
+		count, err := jsonparser.GetInt(body, "total_count")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), count)
+
+		workers, err := jsonparser.GetInt(body, "queues", "transform", "workers")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(2), workers)
+
+		count, err = jsonparser.GetInt(body, "queues", "transform", "count")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), count)
+
+		size, err := jsonparser.GetInt(body, "queues", "store", "queue_size")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(10), size)
+
+		_, err = jsonparser.GetFloat(body, "queues", "transform", "average_wait_time_sec")
+		assert.Nil(t, err)
+	}, tests.WithConfig(content))
+}
+
+func TestMetricsApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "kvstore": {
+		"type": "cache"
+	  },
+	  "options": {
+		"enable_metrics": true,
+		"allowed_ip_addresses": ["192.0.2.1"]
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		dst, err := ioutil.TempDir("", "picfit")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dst)
+
+		suite.Config.Storage = &storage.Config{
+			Destination: &storage.StorageConfig{Type: "fs", Location: dst},
+		}
+
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		// get stores the image before responding, display finds it
+		for _, endpoint := range []string{"get", "display"} {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/%s?url=%s/avatar.png&w=50&h=50&op=resize", endpoint, ts.URL), nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, 200, res.Code)
+		}
+
+		request, _ := http.NewRequest("GET", "http://example.com/metrics", nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 401, res.Code)
+
+		request, _ = http.NewRequest("GET", "http://example.com/metrics", nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		body := res.Body.String()
+
+		for _, line := range []string{
+			`picfit_http_requests_total{endpoint="get",status="200"}`,
+			`picfit_http_requests_total{endpoint="display",status="200"}`,
+			`picfit_transform_duration_seconds_count{operation="resize",backend="goimage",format="png"}`,
+			`picfit_kvstore_requests_total{result="hit"}`,
+			`picfit_kvstore_requests_total{result="miss"}`,
+			`picfit_storage_duration_seconds_count{storage="destination",operation="write"}`,
+			`picfit_storage_duration_seconds_count{storage="destination",operation="read"}`,
+			`picfit_fetch_bytes_total `,
+		} {
+			assert.Contains(t, body, line)
+		}
+	}, tests.WithConfig(content))
+}
 
-		request, _ := http.NewRequest("GET", location, nil)
+func TestTracingApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
 
-		res := httptest.NewRecorder()
+	var (
+		mu    sync.Mutex
+		spans = map[string]string{}
+		auth  string
+	)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		auth = r.Header.Get("Authorization")
+
+		jsonparser.ArrayEach(body, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+			name, _ := jsonparser.GetString(value, "name")
+			traceID, _ := jsonparser.GetString(value, "traceId")
+			spans[name] = traceID
+		}, "resourceSpans", "[0]", "scopeSpans", "[0]", "spans")
+	}))
+	defer collector.Close()
+
+	content := fmt.Sprintf(`{
+	  "kvstore": {
+		"type": "cache"
+	  },
+	  "tracing": {
+		"exporter": "otlp",
+		"endpoint": "%s/v1/traces",
+		"headers": {"Authorization": "Bearer token"}
+	  }
+	}`, collector.URL)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		dst, err := ioutil.TempDir("", "picfit")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dst)
+
+		suite.Config.Storage = &storage.Config{
+			Destination: &storage.StorageConfig{Type: "fs", Location: dst},
+		}
+
+		processor, err := picfit.NewProcessor(suite.Config)
+		assert.Nil(t, err)
+
+		server, err := server.NewHTTPServer(suite.Config, processor)
+		assert.Nil(t, err)
+
+		traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
 
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/get?url=%s/avatar.png&w=50&h=50&op=resize", ts.URL), nil)
+		request.Header.Set("traceparent", fmt.Sprintf("00-%s-00f067aa0ba902b7-01", traceID))
+		res := httptest.NewRecorder()
 		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
 
-		assert.Equal(t, res.Code, 200)
+		assert.Nil(t, processor.Tracer.Shutdown())
 
-		// We wait until the goroutine to save the file on disk is finished
-		timer1 := time.NewTimer(time.Second * 2)
-		<-timer1.C
+		mu.Lock()
+		defer mu.Unlock()
 
-		etag := res.Header().Get("ETag")
+		assert.Equal(t, "Bearer token", auth)
 
-		exists, err := suite.Processor.KeyExists(etag)
+		for _, name := range []string{
+			"GET /get",
+			"picfit.process",
+			"kvstore.get",
+			"fetch",
+			"engine.resize",
+			"storage.write",
+			"kvstore.set",
+		} {
+			assert.Equal(t, traceID, spans[name], name)
+		}
+	}, tests.WithConfig(content))
+}
+
+func TestGracefulShutdownApplication(t *testing.T) {
+	var (
+		requested = make(chan struct{})
+		release   = make(chan struct{})
+	)
+
+	images := tests.NewImageServer()
+	defer images.Close()
+
+	// the image is served once the shutdown has started
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-release
+		images.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	content := fmt.Sprintf(`{
+	  "port": %d,
+	  "kvstore": {
+		"type": "cache"
+	  },
+	  "server": {
+		"shutdown_timeout": "10s"
+	  }
+	}`, port)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		dst, err := ioutil.TempDir("", "picfit")
 		assert.Nil(t, err)
-		assert.True(t, exists)
+		defer os.RemoveAll(dst)
 
-		raw, err := suite.Processor.GetKey(etag)
+		suite.Config.Storage = &storage.Config{
+			Destination: &storage.StorageConfig{Type: "fs", Location: dst},
+		}
+
+		s, err := server.New(suite.Config)
 		assert.Nil(t, err)
 
-		filepath, err := conv.String(raw)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- s.Run(server.WithContext(ctx))
+		}()
+
+		u := fmt.Sprintf("http://127.0.0.1:%d/display?url=%s/avatar.png&w=50&h=50&op=resize", port, ts.URL)
+
+		var res *http.Response
+		for i := 0; i < 100; i++ {
+			if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			res, err = http.Get(u)
+		}()
+
+		<-requested
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+
+		<-done
 		assert.Nil(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		res.Body.Close()
 
-		parts := strings.Split(filepath, "/")
+		select {
+		case err := <-stopped:
+			assert.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("server not stopped")
+		}
 
-		assert.Equal(t, len(parts), 1)
+		// the processed image has been stored in the background before stopping
+		files, err := ioutil.ReadDir(dst)
+		assert.Nil(t, err)
+		assert.Len(t, files, 1)
 
-		assert.True(t, suite.Processor.FileExists(filepath))
+		_, err = http.Get(u)
+		assert.NotNil(t, err)
 	}, tests.WithConfig(content))
 }
 
-func TestDummyApplicationErrors(t *testing.T) {
-	location := "http://example.com/display/resize/100x100/avatar.png"
+func TestProcessingTimeoutApplication(t *testing.T) {
+	images := tests.NewImageServer()
+	defer images.Close()
 
-	request, _ := http.NewRequest("GET", location, nil)
+	// the image is served after the processing deadline
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+			images.Config.Handler.ServeHTTP(w, r)
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer ts.CloseClientConnections()
 
-	res := httptest.NewRecorder()
+	content := `{
+	  "options": {
+		"processing_timeout": "100ms"
+	  }
+	}`
 
-	server, err := server.New(config.DefaultConfig())
-	assert.Nil(t, err)
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
 
-	server.ServeHTTP(res, request)
-	assert.Equal(t, 404, res.Code)
+		u := fmt.Sprintf("http://example.com/display?url=%s/avatar.png&w=50&h=50&op=resize", ts.URL)
+
+		request, _ := http.NewRequest("GET", u, nil)
+
+		res := httptest.NewRecorder()
+
+		start := time.Now()
+		server.ServeHTTP(res, request)
+
+		assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+		assert.True(t, time.Since(start) < time.Second)
+
+		// a request canceled by its client stops the processing
+		ctx, cancel := context.WithCancel(context.Background())
+		request, _ = http.NewRequest("GET", u+"&force=1", nil)
+		request = request.WithContext(ctx)
+
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		res = httptest.NewRecorder()
+
+		start = time.Now()
+		server.ServeHTTP(res, request)
+
+		assert.Equal(t, 499, res.Code)
+		assert.True(t, time.Since(start) < time.Second)
+	}, tests.WithConfig(content))
 }
 
-func TestDummyApplication(t *testing.T) {
+func TestLimitsApplication(t *testing.T) {
 	ts := tests.NewImageServer()
 	defer ts.Close()
 	defer ts.CloseClientConnections()
 
-	server, err := server.New(config.DefaultConfig())
-	assert.Nil(t, err)
+	content := `{
+	  "engine": {
+		"limits": {
+		  "max_width": 1000,
+		  "max_height": 380,
+		  "max_frames": 10,
+		  "max_bytes": 4000000
+		}
+	  }
+	}`
 
-	for _, filename := range []string{"avatar.png", "schwarzy.jpg", "giphy.gif"} {
-		u, _ := url.Parse(ts.URL + "/" + filename)
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
 
-		contentType := mime.TypeByExtension(path.Ext(filename))
+		for filename, limit := range map[string]string{
+			"schwarzy.jpg": "",
+			"avatar.png":   "height",
+			"giphy.gif":    "frames",
+			"BIG.jpg":      "width",
+		} {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/%s&w=50&h=50&op=resize", ts.URL, filename), nil)
 
-		tests := []*tests.TestRequest{
-			{
-				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=50&op=resize", u.String()),
-				Dimensions: &tests.Dimension{
-					Width:  50,
-					Height: 50,
-				},
-			},
-			{
-				URL: fmt.Sprintf("http://example.com/display?url=%s&w=100&h=30&op=resize", u.String()),
-				Dimensions: &tests.Dimension{
-					Width:  100,
-					Height: 30,
-				},
-			},
-			{
-				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=50&op=thumbnail", u.String()),
-				Dimensions: &tests.Dimension{
-					Width:  50,
-					Height: 50,
-				},
-			},
-			{
-				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=50&op=thumbnail&fmt=jpg", u.String()),
-				Dimensions: &tests.Dimension{
-					Width:  50,
-					Height: 50,
-				},
-				ContentType: "image/jpeg",
-			},
-			{
-				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:resize+w:100+h:50&op=op:rotate+deg:90", u.String()),
-				Dimensions: &tests.Dimension{
-					Width:  50,
-					Height: 100,
-				},
-			},
-			{
-				URL: fmt.Sprintf("http://example.com/display?url=%s&op=resize&w=100&h=50&op=op:rotate+deg:90", u.String()),
-				Dimensions: &tests.Dimension{
-					Width:  50,
-					Height: 100,
-				},
-			},
-			{
-				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:resize+w:100+h:50&op=op:blur+s:30", u.String()),
-				Dimensions: &tests.Dimension{
-					Width:  100,
-					Height: 50,
-				},
-			},
-			{
-				URL: fmt.Sprintf("http://example.com/display?url=%s&op=resize&w=100&h=50&op=op:blur+s:30", u.String()),
-				Dimensions: &tests.Dimension{
-					Width:  100,
-					Height: 50,
-				},
-			},
+			res := httptest.NewRecorder()
+
+			server.ServeHTTP(res, request)
+
+			if limit == "" {
+				assert.Equal(t, 200, res.Code, filename)
+				continue
+			}
+
+			assert.Equal(t, 422, res.Code, filename)
+			assert.Contains(t, res.Body.String(), "maximum "+limit, filename)
 		}
+	}, tests.WithConfig(content))
+}
 
-		for _, test := range tests {
-			request, _ := http.NewRequest("GET", test.URL, nil)
+func TestRateLimitApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "kvstore": {
+		"type": "cache"
+	  },
+	  "auth": {
+		"keys": [{"id": "client", "secret": "s3cr3t"}]
+	  },
+	  "rate_limit": {
+		"miss": {"rate": 0.01, "burst": 1},
+		"hit": {"rate": 0.01, "burst": 3}
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		dst, err := ioutil.TempDir("", "picfit")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dst)
+
+		suite.Config.Storage = &storage.Config{
+			Destination: &storage.StorageConfig{Type: "fs", Location: dst},
+		}
+
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		do := func(filename string, key string) *httptest.ResponseRecorder {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/get?url=%s/%s&w=50&h=50&op=resize", ts.URL, filename), nil)
+			if key != "" {
+				request.Header.Set("X-Api-Key", key)
+			}
 
 			res := httptest.NewRecorder()
 
 			server.ServeHTTP(res, request)
 
-			img, err := imaging.Decode(res.Body)
+			return res
+		}
+
+		res := do("avatar.png", "")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "1", res.Header().Get("X-RateLimit-Limit"))
+		assert.Equal(t, "0", res.Header().Get("X-RateLimit-Remaining"))
+
+		// the processed image is a hit
+		res = do("avatar.png", "")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "3", res.Header().Get("X-RateLimit-Limit"))
+		assert.Equal(t, "2", res.Header().Get("X-RateLimit-Remaining"))
+
+		res = do("schwarzy.jpg", "")
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.NotEmpty(t, res.Header().Get("Retry-After"))
+
+		// made up keys do not give clients new limits
+		res = do("schwarzy.jpg", "secret")
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+
+		// authenticated clients have their own limits
+		res = do("schwarzy.jpg", "s3cr3t")
+		assert.Equal(t, http.StatusOK, res.Code)
+	}, tests.WithConfig(content))
+}
+
+func TestAuthApplication(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmp)
+
+	content := fmt.Sprintf(`{
+	  "options": {
+		"enable_upload": true,
+		"enable_delete": true
+	  },
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  },
+	  "auth": {
+		"keys": [
+		  {"id": "uploader", "secret": "upl04d", "scopes": ["upload"]},
+		  {"id": "root", "secret": "r00t", "scopes": ["admin"]}
+		]
+	  }
+	}`, tmp)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(suite.Config)
+		assert.Nil(t, err)
+
+		upload := func(key string) *httptest.ResponseRecorder {
+			body := new(bytes.Buffer)
+			wr := multipart.NewWriter(body)
 
+			source, err := ioutil.ReadFile("tests/fixtures/avatar.png")
 			assert.Nil(t, err)
 
-			if test.ContentType != "" {
-				assert.Equal(t, res.Header().Get("Content-Type"), test.ContentType)
-			} else {
-				assert.Equal(t, res.Header().Get("Content-Type"), contentType)
-			}
+			writer, err := wr.CreateFormFile("data", "avatar.png")
+			assert.Nil(t, err)
+			writer.Write(source)
+			assert.Nil(t, wr.Close())
 
-			assert.Equal(t, res.Code, 200)
+			req, err := http.NewRequest("POST", "http://www.example.com/upload", body)
+			assert.Nil(t, err)
 
-			if img.Bounds().Max.X != test.Dimensions.Width {
-				t.Fatalf("Invalid width for %s: %d != %d", filename, img.Bounds().Max.X, test.Dimensions.Width)
+			req.Header.Add("Content-Type", wr.FormDataContentType())
+			if key != "" {
+				req.Header.Set(auth.APIKeyHeader, key)
 			}
 
-			if img.Bounds().Max.Y != test.Dimensions.Height {
-				t.Fatalf("Invalid width for %s: %d != %d", filename, img.Bounds().Max.Y, test.Dimensions.Height)
-			}
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
+
+			return res
 		}
-	}
+
+		assert.Equal(t, http.StatusUnauthorized, upload("").Code)
+		assert.Equal(t, http.StatusUnauthorized, upload("wrong").Code)
+
+		res := upload("upl04d")
+		assert.Equal(t, http.StatusOK, res.Code)
+
+		filename, err := jsonparser.GetString(res.Body.Bytes(), "filename")
+		assert.Nil(t, err)
+
+		req, err := http.NewRequest("DELETE", "http://www.example.com/"+filename, nil)
+		assert.Nil(t, err)
+		req.Header.Set(auth.APIKeyHeader, "upl04d")
+
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusForbidden, res.Code)
+		assert.True(t, suite.Processor.FileExists(filename))
+
+		// admin keys can sign their requests
+		req, err = http.NewRequest("DELETE", "http://www.example.com/"+filename, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, auth.SignRequest(req, auth.Key{ID: "root", Secret: "r00t"}, time.Now()))
+
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.False(t, suite.Processor.FileExists(filename))
+	}, tests.WithConfig(content))
 }
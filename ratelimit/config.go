@@ -0,0 +1,24 @@
+package ratelimit
+
+// Backends storing the buckets of the clients
+const (
+	MemoryBackend = "memory"
+	RedisBackend  = "redis"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second, holding at
+// most Burst tokens, Burst defaults to Rate rounded up
+type Limit struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// Config is a struct to configure the rate limits of the clients, a limit
+// left unset is not enforced, requests are keyed by the ID of their API key
+// once authenticated and by the client IP address otherwise
+type Config struct {
+	Backend string `mapstructure:"backend"`
+	Miss    *Limit `mapstructure:"miss"`
+	Hit     *Limit `mapstructure:"hit"`
+	Upload  *Limit `mapstructure:"upload"`
+}
@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/thoas/picfit/store"
+)
+
+// Names of the limits
+const (
+	Miss   = "miss"
+	Hit    = "hit"
+	Upload = "upload"
+)
+
+// Result is the state of a bucket after taking a token
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+
+	// RetryAfter is the time until a token is available, zero when allowed
+	RetryAfter time.Duration
+}
+
+// Store takes tokens from the buckets of the clients
+type Store interface {
+	Take(key string, limit Limit, now time.Time) (Result, error)
+}
+
+// Limiter enforces the limits of the clients
+type Limiter struct {
+	store  Store
+	limits map[string]Limit
+}
+
+// New returns a Limiter from config, nil when no limit is configured,
+// the redis backend shares the buckets through the redis kvstore
+func New(cfg *Config, kvstore *store.Config) (*Limiter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	limits := map[string]Limit{}
+	for name, limit := range map[string]*Limit{Miss: cfg.Miss, Hit: cfg.Hit, Upload: cfg.Upload} {
+		if limit == nil {
+			continue
+		}
+
+		if limit.Rate <= 0 {
+			return nil, fmt.Errorf("rate of the %s limit must be positive", name)
+		}
+
+		l := *limit
+		if l.Burst <= 0 {
+			l.Burst = int(math.Ceil(l.Rate))
+		}
+
+		limits[name] = l
+	}
+
+	if len(limits) == 0 {
+		return nil, nil
+	}
+
+	var s Store
+
+	switch cfg.Backend {
+	case "", MemoryBackend:
+		s = NewMemoryStore()
+	case RedisBackend:
+		if kvstore == nil {
+			return nil, fmt.Errorf("rate limit backend %s requires a redis kvstore", cfg.Backend)
+		}
+
+		client, err := store.NewRedisClient(kvstore)
+		if err != nil {
+			return nil, err
+		}
+
+		s = NewRedisStore(client, fmt.Sprint(kvstore.Prefix, "ratelimit:"))
+	default:
+		return nil, fmt.Errorf("rate limit backend %s does not exist", cfg.Backend)
+	}
+
+	return NewLimiter(s, limits), nil
+}
+
+// NewLimiter returns a Limiter taking the tokens of the named limits from s
+func NewLimiter(s Store, limits map[string]Limit) *Limiter {
+	return &Limiter{
+		store:  s,
+		limits: limits,
+	}
+}
+
+// Has returns true if one of the named limits is configured
+func (l *Limiter) Has(names ...string) bool {
+	for _, name := range names {
+		if _, ok := l.limits[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Take takes a token of the named limit for a client,
+// ok is false when the limit is not configured
+func (l *Limiter) Take(name string, client string) (result Result, ok bool, err error) {
+	limit, ok := l.limits[name]
+	if !ok {
+		return Result{}, false, nil
+	}
+
+	result, err = l.store.Take(fmt.Sprint(name, ":", client), limit, time.Now())
+
+	return result, true, err
+}
+
+// newResult returns the result of a bucket holding tokens after a token has been taken
+func newResult(limit Limit, tokens float64, allowed bool) Result {
+	result := Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(limit.Burst) - tokens) / limit.Rate),
+	}
+
+	if !allowed {
+		result.RetryAfter = seconds((1 - tokens) / limit.Rate)
+	}
+
+	return result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thoas/picfit/store"
+)
+
+func TestMemoryStore(t *testing.T) {
+	var (
+		s     = NewMemoryStore()
+		limit = Limit{Rate: 2, Burst: 3}
+		now   = time.Now()
+	)
+
+	for i := 2; i >= 0; i-- {
+		result, err := s.Take("client", limit, now)
+		assert.Nil(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 3, result.Limit)
+		assert.Equal(t, i, result.Remaining)
+	}
+
+	result, err := s.Take("client", limit, now)
+	assert.Nil(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, 500*time.Millisecond, result.RetryAfter)
+	assert.Equal(t, 1500*time.Millisecond, result.Reset)
+
+	// other clients have their own bucket
+	result, err = s.Take("other", limit, now)
+	assert.Nil(t, err)
+	assert.True(t, result.Allowed)
+
+	// a token is earned every 500ms
+	result, err = s.Take("client", limit, now.Add(500*time.Millisecond))
+	assert.Nil(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+
+	// full buckets are removed
+	assert.Equal(t, 2, s.Len())
+	_, err = s.Take("client", limit, now.Add(2*sweepInterval))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(NewMemoryStore(), map[string]Limit{Upload: {Rate: 1, Burst: 1}})
+
+	assert.True(t, limiter.Has(Miss, Upload))
+	assert.False(t, limiter.Has(Miss, Hit))
+
+	result, ok, err := limiter.Take(Upload, "client")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, result.Allowed)
+
+	result, ok, err = limiter.Take(Upload, "client")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.False(t, result.Allowed)
+
+	// limits are independent
+	_, ok, err = limiter.Take(Miss, "client")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestNew(t *testing.T) {
+	limiter, err := New(nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, limiter)
+
+	limiter, err = New(&Config{}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, limiter)
+
+	limiter, err = New(&Config{Miss: &Limit{Rate: 0.5}}, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, limiter)
+	assert.Equal(t, 1, limiter.limits[Miss].Burst)
+
+	_, err = New(&Config{Miss: &Limit{Rate: -1}}, nil)
+	assert.NotNil(t, err)
+
+	_, err = New(&Config{Backend: "memcached", Miss: &Limit{Rate: 1}}, nil)
+	assert.NotNil(t, err)
+
+	_, err = New(&Config{Backend: RedisBackend, Miss: &Limit{Rate: 1}}, &store.Config{Type: "cache"})
+	assert.NotNil(t, err)
+}
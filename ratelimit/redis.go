@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	redis "gopkg.in/redis.v5"
+)
+
+// takeScript refills the bucket of KEYS[1] then takes a token, the bucket
+// expires once it is full again
+const takeScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(bucket[1])
+local last = tonumber(bucket[2])
+if tokens == nil or last == nil then
+	tokens = burst
+	last = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+
+return {allowed, tostring(tokens)}`
+
+type redisClient interface {
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+}
+
+// RedisStore keeps the buckets in redis, they are shared between instances
+type RedisStore struct {
+	client redisClient
+	prefix string
+}
+
+// NewRedisStore returns a RedisStore prefixing its keys with prefix
+func NewRedisStore(client redisClient, prefix string) *RedisStore {
+	return &RedisStore{client: client, prefix: prefix}
+}
+
+// Take implements Store
+func (s *RedisStore) Take(key string, limit Limit, now time.Time) (Result, error) {
+	reply, err := s.client.Eval(takeScript, []string{fmt.Sprint(s.prefix, key)},
+		strconv.FormatFloat(limit.Rate, 'f', -1, 64),
+		limit.Burst,
+		strconv.FormatFloat(float64(now.UnixNano())/float64(time.Second), 'f', 6, 64),
+	).Result()
+	if err != nil {
+		return Result{}, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return Result{}, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+
+	allowed, _ := values[0].(int64)
+	raw, _ := values[1].(string)
+
+	tokens, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return newResult(limit, math.Max(0, tokens), allowed == 1), nil
+}
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"os"
 	"strconv"
 	"time"
 
@@ -14,11 +17,17 @@ import (
 
 	"github.com/gin-gonic/contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 	"github.com/thoas/picfit"
+	"github.com/thoas/picfit/auth"
 	"github.com/thoas/picfit/config"
 	"github.com/thoas/picfit/failure"
 	"github.com/thoas/picfit/logger"
+	"github.com/thoas/picfit/metrics"
 	"github.com/thoas/picfit/middleware"
+	"github.com/thoas/picfit/ratelimit"
+	"github.com/thoas/picfit/signature"
+	"github.com/thoas/picfit/worker"
 	"github.com/thoas/stats"
 )
 
@@ -26,12 +35,14 @@ type HTTPServer struct {
 	*gin.Engine
 	config    *config.Config
 	processor *picfit.Processor
+	logger    logger.Logger
 }
 
 func NewHTTPServer(cfg *config.Config, processor *picfit.Processor) (*HTTPServer, error) {
 	server := &HTTPServer{
 		config:    cfg,
 		processor: processor,
+		logger:    logger.New(cfg.Logger),
 	}
 	err := server.Init()
 	if err != nil {
@@ -64,11 +75,29 @@ func (s *HTTPServer) Init() error {
 		}
 	)
 
+	verifier, err := signature.NewVerifier(s.config.SecretKey, s.config.SigningKeys)
+	if err != nil {
+		return err
+	}
+
+	authenticator, err := auth.New(s.config.Auth)
+	if err != nil {
+		return err
+	}
+
 	if s.config.Debug {
 		router.Use(gin.Recovery())
 	}
 
-	if s.config.Logger.GetLevel() == logger.DevelopmentLevel {
+	if s.config.Logger.AccessLog != nil && s.config.Logger.AccessLog.Enabled {
+		fields, err := s.config.Logger.AccessLog.GetFields()
+		if err != nil {
+			return err
+		}
+
+		router.Use(middleware.AccessLog(
+			logger.NewAccessLogger(s.logger, s.config.Logger.AccessLog), fields))
+	} else if s.config.Logger.GetLevel() == logger.DevelopmentLevel {
 		router.Use(gin.Logger())
 	}
 
@@ -110,6 +139,7 @@ func (s *HTTPServer) Init() error {
 	restrictIPAddresses := middleware.RestrictIPAddresses(s.config.Options.AllowedIPAddresses)
 
 	if s.config.Options.EnableStats {
+		processor := s.processor
 		s := stats.New()
 
 		router.Use(func() gin.HandlerFunc {
@@ -121,7 +151,10 @@ func (s *HTTPServer) Init() error {
 		}())
 
 		router.GET("/sys/stats", func(c *gin.Context) {
-			c.JSON(http.StatusOK, s.Data())
+			c.JSON(http.StatusOK, struct {
+				*stats.Data
+				Queues map[string]worker.Stats `json:"queues"`
+			}{s.Data(), processor.QueueStats()})
 		})
 	}
 
@@ -134,17 +167,79 @@ func (s *HTTPServer) Init() error {
 			})
 	}
 
+	// instrument returns the handlers of an endpoint preceded by the
+	// metrics and tracing middlewares when they are enabled
+	instrument := func(endpoint string, views ...gin.HandlerFunc) []gin.HandlerFunc {
+		var handlers []gin.HandlerFunc
+
+		if s.config.Options.EnableMetrics {
+			handlers = append(handlers, middleware.Metrics(endpoint))
+		}
+
+		if s.processor.Tracer != nil {
+			handlers = append(handlers, middleware.Tracing(s.processor.Tracer, endpoint))
+		}
+
+		return append(handlers, views...)
+	}
+
+	if s.config.Options.EnableMetrics {
+		router.GET("/metrics",
+			restrictIPAddresses,
+			gin.WrapH(metrics.DefaultRegistry))
+	}
+
+	// rateLimit returns the rate limit middleware of the named limits,
+	// nil when none of them is configured
+	rateLimit := func(name func(c *gin.Context) (string, error), names ...string) gin.HandlerFunc {
+		limiter := s.processor.RateLimiter
+		if limiter == nil || !limiter.Has(names...) {
+			return nil
+		}
+
+		return middleware.RateLimit(limiter, authenticator, s.logger, name)
+	}
+
+	// images already processed are limited as hits, the others as misses
+	processingRateLimit := rateLimit(func(c *gin.Context) (string, error) {
+		if c.Query("force") != "" {
+			return ratelimit.Miss, nil
+		}
+
+		cached, err := s.processor.Cached(c.MustGet("key").(string))
+		if err != nil || !cached {
+			return ratelimit.Miss, err
+		}
+
+		return ratelimit.Hit, nil
+	}, ratelimit.Miss, ratelimit.Hit)
+
+	// source images are always retrieved, they are limited as misses
+	sourceRateLimit := rateLimit(func(c *gin.Context) (string, error) {
+		return ratelimit.Miss, nil
+	}, ratelimit.Miss)
+
+	uploadRateLimit := rateLimit(func(c *gin.Context) (string, error) {
+		return ratelimit.Upload, nil
+	}, ratelimit.Upload)
+
 	for _, e := range endpoints {
 		views := []gin.HandlerFunc{
 			middleware.ParametersParser(),
+			middleware.AcceptParser(s.processor.Engine.AutoFormat, s.processor.Engine.NegotiatedFormats()),
 			middleware.KeyParser(),
-			middleware.Security(s.config.SecretKey),
-			middleware.URLParser(s.config.Options.MimetypeDetector),
+			middleware.Security(verifier),
+			middleware.URLParser(s.config.Options.MimetypeDetector, s.processor.URLPolicy),
 			middleware.OperationParser(),
 			middleware.RestrictSizes(s.config.Options.AllowedSizes),
-			e.handler,
 		}
 
+		if processingRateLimit != nil {
+			views = append(views, processingRateLimit)
+		}
+
+		views = instrument(e.pattern, append(views, e.handler)...)
+
 		e.method(fmt.Sprintf("/%s", e.pattern), views...)
 
 		if s.config.Storage != nil && s.config.Storage.Source != nil {
@@ -152,18 +247,56 @@ func (s *HTTPServer) Init() error {
 		}
 	}
 
+	// source images are retrieved without being transformed
+	for pattern, handler := range map[string]gin.HandlerFunc{
+		"info":     failure.Handle(handlers.info),
+		"metadata": failure.Handle(handlers.metadata),
+	} {
+		views := []gin.HandlerFunc{
+			middleware.ParametersParser(),
+			middleware.KeyParser(),
+			middleware.Security(verifier),
+			middleware.URLParser(s.config.Options.MimetypeDetector, s.processor.URLPolicy),
+		}
+
+		if sourceRateLimit != nil {
+			views = append(views, sourceRateLimit)
+		}
+
+		views = instrument(pattern, append(views, handler)...)
+
+		router.GET(fmt.Sprintf("/%s", pattern), views...)
+
+		if s.config.Storage != nil && s.config.Storage.Source != nil {
+			router.GET(fmt.Sprintf("/%s/*parameters", pattern), views...)
+		}
+	}
+
 	if s.config.Options.EnableUpload {
-		router.POST("/upload",
+		views := []gin.HandlerFunc{
 			restrictIPAddresses,
-			failure.Handle(handlers.upload))
+			middleware.Authenticate(authenticator, auth.UploadScope, s.logger),
+		}
+
+		if uploadRateLimit != nil {
+			views = append(views, uploadRateLimit)
+		}
+
+		router.POST("/upload", instrument("upload",
+			append(views, failure.HandleJSON(handlers.upload))...)...)
+		router.POST("/upload/batch", instrument("upload_batch",
+			append(views, failure.HandleJSON(handlers.uploadBatch))...)...)
+		router.PUT("/upload/*name", instrument("upload",
+			append(views, failure.HandleJSON(handlers.uploadRaw))...)...)
 	}
 
 	if s.config.Options.EnableDelete {
-		router.DELETE("/*parameters",
+		router.DELETE("/*parameters", instrument("delete",
 			restrictIPAddresses,
+			middleware.Authenticate(authenticator, auth.DeleteScope, s.logger),
 			middleware.ParametersParser(),
 			middleware.KeyParser(),
-			failure.Handle(handlers.delete))
+			failure.Handle(handlers.delete))...)
 	}
 
 	router.GET("/error", handlers.internalError)
@@ -212,9 +345,144 @@ func (s *HTTPServer) Init() error {
 	return nil
 }
 
-// Run loads a new http server
-func (s *HTTPServer) Run() error {
-	s.Engine.Run(fmt.Sprintf(":%s", strconv.Itoa(s.config.Port)))
+// Run loads a new http server until ctx is done, then stops accepting
+// connections and waits for in-flight requests and background stores
+func (s *HTTPServer) Run(ctx context.Context) error {
+	cfg := serverConfig(s.config.Server)
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%s", strconv.Itoa(s.config.Port)),
+		Handler:           s.Engine,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+
+	listener, err := listen(srv.Addr, cfg.Socket)
+	if err != nil {
+		return err
+	}
+
+	serve := func() error { return srv.Serve(listener) }
+
+	if s.config.TLS != nil {
+		reloader, err := newCertReloader(s.config.TLS, s.logger)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+
+		watchCtx, stop := context.WithCancel(context.Background())
+		defer stop()
+		go reloader.watch(watchCtx)
+
+		// HTTP/2 is negotiated with the h2 protocol of the config
+		srv.TLSConfig = reloader.TLSConfig()
+		serve = func() error { return srv.ServeTLS(listener, "", "") }
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serve()
+	}()
+
+	s.logger.Info("Server started",
+		logger.String("addr", listener.Addr().String()),
+		logger.Bool("tls", s.config.TLS != nil))
+
+	select {
+	case err := <-errs:
+		s.processor.Shutdown(context.Background())
+		return err
+	case <-ctx.Done():
+	}
+
+	s.logger.Info("Server shutting down",
+		logger.Duration("timeout", cfg.ShutdownTimeout))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return errors.Wrap(err, "unable to drain requests")
+	}
+
+	if err := s.processor.Shutdown(shutdownCtx); err != nil {
+		return errors.Wrap(err, "unable to drain background stores")
+	}
+
+	s.logger.Info("Server stopped")
 
 	return nil
 }
+
+// listen listens on the unix socket when provided, on addr otherwise
+func listen(addr string, socket string) (net.Listener, error) {
+	if socket == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	// a previous process may have left its socket behind, any other
+	// file at its path is left untouched
+	info, err := os.Lstat(socket)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case info.Mode()&os.ModeSocket == 0:
+		return nil, errors.Errorf("unable to listen on %s: not a socket", socket)
+	default:
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", socket)
+}
+
+// serverConfig returns the config of the http server,
+// unset values fall back to their default value
+func serverConfig(cfg *config.Server) config.Server {
+	c := config.Server{
+		ReadTimeout:       config.DefaultReadTimeout,
+		ReadHeaderTimeout: config.DefaultReadHeaderTimeout,
+		WriteTimeout:      config.DefaultWriteTimeout,
+		IdleTimeout:       config.DefaultIdleTimeout,
+		MaxHeaderBytes:    config.DefaultMaxHeaderBytes,
+		ShutdownTimeout:   config.DefaultShutdownTimeout,
+	}
+
+	if cfg == nil {
+		return c
+	}
+
+	if cfg.ReadTimeout != 0 {
+		c.ReadTimeout = cfg.ReadTimeout
+	}
+
+	if cfg.ReadHeaderTimeout != 0 {
+		c.ReadHeaderTimeout = cfg.ReadHeaderTimeout
+	}
+
+	if cfg.WriteTimeout != 0 {
+		c.WriteTimeout = cfg.WriteTimeout
+	}
+
+	if cfg.IdleTimeout != 0 {
+		c.IdleTimeout = cfg.IdleTimeout
+	}
+
+	if cfg.MaxHeaderBytes != 0 {
+		c.MaxHeaderBytes = cfg.MaxHeaderBytes
+	}
+
+	if cfg.ShutdownTimeout != 0 {
+		c.ShutdownTimeout = cfg.ShutdownTimeout
+	}
+
+	c.Socket = cfg.Socket
+
+	return c
+}
@@ -2,7 +2,10 @@ package server
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,6 +17,8 @@ import (
 
 	"github.com/thoas/picfit"
 	"github.com/thoas/picfit/constants"
+	"github.com/thoas/picfit/engine"
+	"github.com/thoas/picfit/engine/backend"
 	"github.com/thoas/picfit/failure"
 	"github.com/thoas/picfit/payload"
 )
@@ -65,33 +70,132 @@ func (h handlers) display(c *gin.Context) error {
 
 	c.Header("Cache-Control", "must-revalidate")
 
+	// the output depends on the Accept header when the format is negotiated
+	if _, ok := c.Get(constants.AcceptParamName); ok {
+		c.Header("Vary", "Accept")
+	}
+
 	c.Data(http.StatusOK, file.ContentType(), file.Content())
 
 	return nil
 }
 
-// upload uploads an image to the destination storage
+// upload uploads an image to the destination storage, the image is
+// either a multipart file or retrieved from the url of a json payload
 func (h handlers) upload(c *gin.Context) error {
+	if strings.Contains(c.ContentType(), "json") {
+		return h.uploadURL(c)
+	}
+
 	multipartPayload := new(payload.Multipart)
 	errs := binding.Bind(c.Request, multipartPayload)
 	if errs != nil {
 		return errs
 	}
 
-	file, width, height, err := h.processor.Upload(c, multipartPayload)
+	file, err := h.processor.Upload(c, multipartPayload)
+	if err != nil {
+		return err
+	}
+
+	uploaded(c, file)
+
+	return nil
+}
+
+// uploadURL uploads an image retrieved from an url to the destination storage
+func (h handlers) uploadURL(c *gin.Context) error {
+	urlPayload := new(payload.URL)
+	errs := binding.Bind(c.Request, urlPayload)
+	if errs != nil {
+		return errs
+	}
+
+	file, err := h.processor.UploadURL(c.Request.Context(), urlPayload.URL, picfit.UploadOptions{
+		Path:   urlPayload.Path,
+		Prefix: urlPayload.Prefix,
+	})
+	if err != nil {
+		return err
+	}
+
+	uploaded(c, file)
+
+	return nil
+}
+
+// uploadRaw uploads the body of a request to the destination storage at
+// the path of the request
+func (h handlers) uploadRaw(c *gin.Context) error {
+	maxBytes := h.processor.Engine.Limits.MaxBytes
+
+	content, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxBytes+1))
+	if err != nil {
+		return errors.Wrap(err, "unable to read data from request body")
+	}
+
+	if int64(len(content)) > maxBytes {
+		return &failure.LimitError{
+			Limit: engine.BytesLimit,
+			Value: int64(len(content)),
+			Max:   maxBytes,
+		}
+	}
+
+	file, err := h.processor.UploadContent(c.Request.Context(), content, c.Param("name"),
+		c.ContentType(), picfit.UploadOptions{Path: c.Param("name")})
+	if err != nil {
+		return err
+	}
+
+	uploaded(c, file)
+
+	return nil
+}
+
+// uploadBatch uploads several multipart files or the images of a json list
+// of urls to the destination storage, the result of each file is returned
+func (h handlers) uploadBatch(c *gin.Context) error {
+	batchPayload := new(payload.Batch)
+	errs := binding.Bind(c.Request, batchPayload)
+	if errs != nil {
+		return errs
+	}
+
+	files := make([]picfit.BatchFile, 0, len(batchPayload.Data)+len(batchPayload.URLs))
+	for i := range batchPayload.Data {
+		files = append(files, picfit.BatchFile{Data: batchPayload.Data[i]})
+	}
+	for i := range batchPayload.URLs {
+		files = append(files, picfit.BatchFile{URL: batchPayload.URLs[i]})
+	}
+
+	if len(files) == 0 {
+		return failure.ErrUnprocessable
+	}
+
+	results, err := h.processor.UploadBatch(c.Request.Context(), files, picfit.UploadOptions{
+		Prefix: batchPayload.Prefix,
+	})
 	if err != nil {
 		return err
 	}
 
+	c.JSON(http.StatusOK, results)
+
+	return nil
+}
+
+// uploaded writes the response of an upload
+func uploaded(c *gin.Context, file *picfit.Uploaded) {
 	c.JSON(http.StatusOK, gin.H{
 		"filename": file.Filename(),
 		//"path":     file.Path(),
-		"url": file.URL(),
-		"w":   width,
-		"h":   height,
+		"url":          file.URL(),
+		"w":            file.Width,
+		"h":            file.Height,
+		"deduplicated": file.Deduplicated,
 	})
-
-	return nil
 }
 
 // delete deletes a file from storages
@@ -129,21 +233,55 @@ func (h handlers) delete(c *gin.Context) error {
 func (h handlers) get(c *gin.Context) error {
 	file, err := h.processor.ProcessContext(c,
 		picfit.WithAsync(false),
-		picfit.WithLoad(false))
+		picfit.WithLoad(true))
 	if err != nil {
 		return err
 	}
 
+	info, err := backend.DecodeInfo(file.Content())
+	if err != nil {
+		return errors.Wrapf(err, "unable to read image: %s", file.Filepath)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"filename": file.Filename(),
 		//"path":     file.Path(),
-		"url": file.URL(),
-		"key": file.Key,
+		"url":          file.URL(),
+		"key":          file.Key,
+		"w":            info.Width,
+		"h":            info.Height,
+		"size":         info.Size,
+		"format":       info.Format,
+		"content_type": info.ContentType,
 	})
 
 	return nil
 }
 
+// info displays the information of a source image without transforming it
+func (h handlers) info(c *gin.Context) error {
+	_, info, err := h.processor.Info(c)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, info)
+
+	return nil
+}
+
+// metadata displays the EXIF, IPTC and XMP metadata of a source image
+func (h handlers) metadata(c *gin.Context) error {
+	m, err := h.processor.Metadata(c)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, m)
+
+	return nil
+}
+
 // redirect redirects to the image using base url from storage
 func (h handlers) redirect(c *gin.Context) error {
 	file, err := h.processor.ProcessContext(c,
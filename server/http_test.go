@@ -0,0 +1,27 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenNotSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "picfit.conf")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("{}"), 0600))
+
+	// a file which is not a socket is not removed
+	_, err = listen("", file)
+	assert.NotNil(t, err)
+
+	content, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", string(content))
+}
@@ -1,7 +1,11 @@
 package server
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/thoas/picfit"
 	"github.com/thoas/picfit/config"
@@ -26,8 +30,32 @@ func New(cfg *config.Config) (*Server, error) {
 	return server, nil
 }
 
-func (s *Server) Run() error {
-	return s.http.Run()
+// Run runs the server until the context of the options is done
+// or until the process receives SIGINT or SIGTERM
+func (s *Server) Run(opts ...Option) error {
+	options := NewOptions(opts...)
+
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return s.http.Run(ctx)
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -35,7 +63,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 // Run runs the application and launch servers
-func Run(path string) error {
+func Run(path string, opts ...Option) error {
 	cfg, err := config.Load(path)
 	if err != nil {
 		return err
@@ -46,5 +74,5 @@ func Run(path string) error {
 		return err
 	}
 
-	return server.Run()
+	return server.Run(opts...)
 }
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/config"
+	"github.com/thoas/picfit/logger"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves the certificate and the client CAs of the config,
+// they are loaded again when their files change on disk
+type certReloader struct {
+	cfg        *config.TLS
+	minVersion uint16
+	clientAuth tls.ClientAuthType
+	logger     logger.Logger
+
+	mu      sync.RWMutex
+	current *tls.Config
+	stamps  map[string]time.Time
+}
+
+// newCertReloader returns a certReloader with the files of cfg loaded
+func newCertReloader(cfg *config.TLS, log logger.Logger) (*certReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("tls requires cert_file and key_file")
+	}
+
+	minVersion := cfg.MinVersion
+	if minVersion == "" {
+		minVersion = config.DefaultTLSMinVersion
+	}
+
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("tls min_version %s is not supported", minVersion)
+	}
+
+	clientAuth := tls.NoClientCert
+	if cfg.ClientCAFile != "" {
+		switch cfg.ClientAuth {
+		case "", config.RequireClientAuth:
+			clientAuth = tls.RequireAndVerifyClientCert
+		case config.OptionalClientAuth:
+			clientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("tls client_auth %s is not supported", cfg.ClientAuth)
+		}
+	}
+
+	r := &certReloader{
+		cfg:        cfg,
+		minVersion: version,
+		clientAuth: clientAuth,
+		logger:     log,
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+
+	return files
+}
+
+// load reads the files and replaces the served config
+func (r *certReloader) load() error {
+	stamps := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		stamps[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to load tls certificate")
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   r.minVersion,
+		ClientAuth:   r.clientAuth,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if r.cfg.ClientCAFile != "" {
+		content, err := ioutil.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "unable to load tls client CAs")
+		}
+
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(content) {
+			return fmt.Errorf("no certificate found in %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.current = cfg
+	r.stamps = stamps
+	r.mu.Unlock()
+
+	return nil
+}
+
+// changed returns true if a file has been modified since the last load
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(r.stamps[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch loads the files again when they change until ctx is done,
+// the previous certificate is kept when they cannot be loaded
+func (r *certReloader) watch(ctx context.Context) {
+	interval := r.cfg.ReloadInterval
+	if interval == 0 {
+		interval = config.DefaultTLSReloadInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+
+			if err := r.load(); err != nil {
+				r.logger.Error("Unable to reload tls certificate",
+					logger.Error(err))
+				continue
+			}
+
+			r.logger.Info("TLS certificate reloaded",
+				logger.String("cert_file", r.cfg.CertFile))
+		}
+	}
+}
+
+// TLSConfig returns the config of the server, each connection uses the
+// certificate and the client CAs loaded last
+func (r *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			return &r.current.Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			return r.current, nil
+		},
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thoas/picfit/config"
+	"github.com/thoas/picfit/tests"
+)
+
+type certificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	tls  tls.Certificate
+}
+
+// newCertificate returns a certificate signed by parent, self-signed when parent is nil
+func newCertificate(t *testing.T, serial int64, parent *certificate, usage x509.ExtKeyUsage) *certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("picfit %d", serial)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+
+	return &certificate{cert: cert, key: key, pem: keyPEM, tls: pair}
+}
+
+func writeCertificate(t *testing.T, c *certificate, certFile string, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	assert.Nil(t, ioutil.WriteFile(certFile+".tmp", certPEM, 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile+".tmp", c.pem, 0600))
+
+	// renames make both files change at once
+	assert.Nil(t, os.Rename(keyFile+".tmp", keyFile))
+	assert.Nil(t, os.Rename(certFile+".tmp", certFile))
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// start runs a server with cfg until the returned function is called
+func start(t *testing.T, cfg *config.Config, dial func() (net.Conn, error)) func() {
+	s, err := New(cfg)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Run(WithContext(ctx))
+	}()
+
+	for i := 0; i < 100; i++ {
+		if conn, err := dial(); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return func() {
+		cancel()
+		assert.Nil(t, <-stopped)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		ca       = newCertificate(t, 1, nil, x509.ExtKeyUsageAny)
+		srvCert  = newCertificate(t, 2, ca, x509.ExtKeyUsageServerAuth)
+		client   = newCertificate(t, 3, ca, x509.ExtKeyUsageClientAuth)
+		certFile = filepath.Join(dir, "cert.pem")
+		keyFile  = filepath.Join(dir, "key.pem")
+		caFile   = filepath.Join(dir, "ca.pem")
+		port     = freePort(t)
+	)
+
+	writeCertificate(t, srvCert, certFile, keyFile)
+	assert.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+
+	cfg := tests.DefaultConfig()
+	cfg.Port = port
+	cfg.TLS = &config.TLS{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ClientCAFile:   caFile,
+		MinVersion:     "1.3",
+		ReloadInterval: 20 * time.Millisecond,
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	stop := start(t, cfg, func() (net.Conn, error) { return net.Dial("tcp", addr) })
+	defer stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	newClient := func(certs []tls.Certificate, maxVersion uint16) *http.Client {
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      roots,
+				Certificates: certs,
+				MaxVersion:   maxVersion,
+			},
+			ForceAttemptHTTP2: true,
+		}
+
+		return &http.Client{Transport: transport}
+	}
+
+	res, err := newClient([]tls.Certificate{client.tls}, 0).Get(fmt.Sprintf("https://%s/healthcheck", addr))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "HTTP/2.0", res.Proto)
+	assert.Equal(t, big.NewInt(2), res.TLS.PeerCertificates[0].SerialNumber)
+	res.Body.Close()
+
+	// a client certificate is required
+	_, err = newClient(nil, 0).Get(fmt.Sprintf("https://%s/healthcheck", addr))
+	assert.NotNil(t, err)
+
+	// TLS 1.2 is below the minimum version
+	_, err = newClient([]tls.Certificate{client.tls}, tls.VersionTLS12).Get(fmt.Sprintf("https://%s/healthcheck", addr))
+	assert.NotNil(t, err)
+
+	// the certificate is reloaded once replaced on disk
+	writeCertificate(t, newCertificate(t, 4, ca, x509.ExtKeyUsageServerAuth), certFile, keyFile)
+
+	var serial *big.Int
+	for i := 0; i < 100; i++ {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.tls}})
+		assert.Nil(t, err)
+		serial = conn.ConnectionState().PeerCertificates[0].SerialNumber
+		conn.Close()
+
+		if serial.Int64() == 4 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, int64(4), serial.Int64())
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	_, err := newCertReloader(&config.TLS{CertFile: "cert.pem"}, nil)
+	assert.NotNil(t, err)
+
+	_, err = newCertReloader(&config.TLS{CertFile: "cert.pem", KeyFile: "key.pem", MinVersion: "1.4"}, nil)
+	assert.NotNil(t, err)
+
+	_, err = newCertReloader(&config.TLS{CertFile: "cert.pem", KeyFile: "key.pem", ClientCAFile: "ca.pem", ClientAuth: "always"}, nil)
+	assert.NotNil(t, err)
+
+	_, err = newCertReloader(&config.TLS{CertFile: "missing.pem", KeyFile: "missing.pem"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picfit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "picfit.sock")
+
+	// a stale socket is replaced
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	assert.Nil(t, err)
+	ln.SetUnlinkOnClose(false)
+	assert.Nil(t, ln.Close())
+
+	cfg := tests.DefaultConfig()
+	cfg.Server = &config.Server{Socket: socket}
+
+	dial := func() (net.Conn, error) { return net.Dial("unix", socket) }
+	stop := start(t, cfg, dial)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial()
+			},
+		},
+	}
+
+	res, err := client.Get("http://picfit/healthcheck")
+	assert.Nil(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	res.Body.Close()
+
+	stop()
+
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
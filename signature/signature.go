@@ -3,16 +3,45 @@ package signature
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"net/url"
 	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/thoas/picfit/constants"
 )
 
 var signRegex = regexp.MustCompile("&?sig=[^&]*")
 
+// Algorithms of the signatures
+const (
+	SHA1   = "sha1"
+	SHA256 = "sha256"
+)
+
+var (
+	// ErrInvalidSignature is an error when the signature is missing or does not match
+	ErrInvalidSignature = errors.New("Invalid signature")
+
+	// ErrUnknownKey is an error when the key identified by the kid parameter does not exist
+	ErrUnknownKey = errors.New("Unknown signing key")
+
+	// ErrExpired is an error when the time of the expires parameter has passed
+	ErrExpired = errors.New("Signature expired")
+)
+
 // VerifyParameters encodes map parameters with a key and returns if parameters match signature
 func VerifyParameters(key string, qs map[string]interface{}) bool {
+	return VerifySign(key, encodeParameters(qs).Encode())
+}
+
+// encodeParameters returns the values of map parameters
+func encodeParameters(qs map[string]interface{}) url.Values {
 	params := url.Values{}
 
 	for k, v := range qs {
@@ -30,12 +59,26 @@ func VerifyParameters(key string, qs map[string]interface{}) bool {
 		}
 	}
 
-	return VerifySign(key, params.Encode())
+	return params
 }
 
 // Sign encodes query string using a key
 func Sign(key string, qs string) string {
-	mac := hmac.New(sha1.New, []byte(key))
+	return sign(sha1.New, key, qs)
+}
+
+// SignWith encodes query string using a key and the HMAC of an algorithm
+func SignWith(algorithm string, key string, qs string) (string, error) {
+	h, err := hasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	return sign(h, key, qs), nil
+}
+
+func sign(h func() hash.Hash, key string, qs string) string {
+	mac := hmac.New(h, []byte(key))
 	mac.Write([]byte(qs))
 
 	byteArray := mac.Sum(nil)
@@ -43,14 +86,30 @@ func Sign(key string, qs string) string {
 	return hex.EncodeToString(byteArray)
 }
 
+func hasher(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case SHA1:
+		return sha1.New, nil
+	case SHA256:
+		return sha256.New, nil
+	}
+
+	return nil, fmt.Errorf("signature algorithm %s does not exist", algorithm)
+}
+
 // SignRaw encodes raw query string (not sorted) using a key
 func SignRaw(key string, queryString string) (string, error) {
+	return SignRawWith(SHA1, key, queryString)
+}
+
+// SignRawWith encodes raw query string (not sorted) using a key and the HMAC of an algorithm
+func SignRawWith(algorithm string, key string, queryString string) (string, error) {
 	values, err := url.ParseQuery(queryString)
 	if err != nil {
 		return "", err
 	}
 
-	return Sign(key, values.Encode()), nil
+	return SignWith(algorithm, key, values.Encode())
 }
 
 // AppendSign appends the signature to query string
@@ -72,3 +131,107 @@ func VerifySign(key string, qs string) bool {
 
 	return values.Get("sig") == sign
 }
+
+// Key is a signing key identified by the kid parameter,
+// both algorithms are accepted when Algorithm is empty
+type Key struct {
+	ID        string `mapstructure:"id"`
+	Secret    string `mapstructure:"secret"`
+	Algorithm string `mapstructure:"algorithm"`
+}
+
+// Verifier verifies the signature and the expiration of parameters
+type Verifier struct {
+	// Now returns the time compared to the expires parameter
+	Now func() time.Time
+
+	keys map[string]Key
+}
+
+// NewVerifier returns a Verifier of the signatures made with secretKey,
+// when no kid parameter is sent, or with keys, nil when there is no key
+func NewVerifier(secretKey string, keys []Key) (*Verifier, error) {
+	if secretKey == "" && len(keys) == 0 {
+		return nil, nil
+	}
+
+	verifier := &Verifier{
+		Now:  time.Now,
+		keys: make(map[string]Key, len(keys)+1),
+	}
+
+	if secretKey != "" {
+		verifier.keys[""] = Key{Secret: secretKey}
+	}
+
+	for _, key := range keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, errors.New("signing keys require an id and a secret")
+		}
+
+		if _, ok := verifier.keys[key.ID]; ok {
+			return nil, fmt.Errorf("signing key %s is duplicated", key.ID)
+		}
+
+		if key.Algorithm != "" {
+			if _, err := hasher(key.Algorithm); err != nil {
+				return nil, err
+			}
+		}
+
+		verifier.keys[key.ID] = key
+	}
+
+	return verifier, nil
+}
+
+// Verify returns an error if the parameters are not signed with a key
+// of the verifier or if the time of their expires parameter has passed,
+// the algorithm is given by the length of the signature
+func (v *Verifier) Verify(qs map[string]interface{}) error {
+	params := encodeParameters(qs)
+
+	sig := params.Get(constants.SigParamName)
+	params.Del(constants.SigParamName)
+
+	key, ok := v.keys[params.Get(constants.KeyIDParamName)]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	var algorithm string
+	switch len(sig) {
+	case hex.EncodedLen(sha1.Size):
+		algorithm = SHA1
+	case hex.EncodedLen(sha256.Size):
+		algorithm = SHA256
+	default:
+		return ErrInvalidSignature
+	}
+
+	if key.Algorithm != "" && key.Algorithm != algorithm {
+		return ErrInvalidSignature
+	}
+
+	expected, err := SignWith(algorithm, key.Secret, params.Encode())
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return ErrInvalidSignature
+	}
+
+	if expires := params.Get(constants.ExpiresParamName); expires != "" {
+		timestamp, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return ErrInvalidSignature
+		}
+
+		if v.Now().Unix() > timestamp {
+			return ErrExpired
+		}
+	}
+
+	return nil
+}
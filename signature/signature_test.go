@@ -2,7 +2,9 @@ package signature
 
 import (
 	"fmt"
+	"net/url"
 	"testing"
+	"time"
 )
 
 func TestSign(t *testing.T) {
@@ -30,3 +32,93 @@ func TestVerifySign(t *testing.T) {
 		t.Errorf("Signature should be found in query string")
 	}
 }
+
+func TestSignWith(t *testing.T) {
+	signature, err := SignWith(SHA256, "abcdef", "x=1&y=2&z=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signature != "974e8612f0dbff9734f67731a380d2740b784923d059ce3b7f684a703768c814" {
+		t.Errorf("Signature fails: %s", signature)
+	}
+
+	if _, err := SignWith("md5", "abcdef", "x=1&y=2&z=3"); err == nil {
+		t.Errorf("Unknown algorithm should fail")
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	verifier, err := NewVerifier("abcdef", []Key{
+		{ID: "2020", Secret: "old"},
+		{ID: "2021", Secret: "new", Algorithm: SHA256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1600000000, 0)
+	verifier.Now = func() time.Time { return now }
+
+	sign := func(algorithm string, key string, qs string) map[string]interface{} {
+		sig, err := SignRawWith(algorithm, key, qs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values, _ := url.ParseQuery(qs)
+
+		params := map[string]interface{}{"sig": sig}
+		for k := range values {
+			params[k] = values.Get(k)
+		}
+
+		return params
+	}
+
+	for _, c := range []struct {
+		params   map[string]interface{}
+		expected error
+	}{
+		{sign(SHA1, "abcdef", "x=1&y=2"), nil},
+		{sign(SHA256, "abcdef", "x=1&y=2"), nil},
+		{sign(SHA1, "old", "x=1&kid=2020"), nil},
+		{sign(SHA256, "new", "x=1&kid=2021"), nil},
+		{sign(SHA1, "new", "x=1&kid=2021"), ErrInvalidSignature},
+		{sign(SHA1, "old", "x=1&kid=2019"), ErrUnknownKey},
+		{sign(SHA1, "old", "x=1"), ErrInvalidSignature},
+		{sign(SHA1, "abcdef", "x=1&expires=1600000001"), nil},
+		{sign(SHA1, "abcdef", "x=1&expires=1599999999"), ErrExpired},
+		{sign(SHA1, "abcdef", "x=1&expires=tomorrow"), ErrInvalidSignature},
+		{map[string]interface{}{"x": "1"}, ErrInvalidSignature},
+	} {
+		if err := verifier.Verify(c.params); err != c.expected {
+			t.Errorf("Verify %v: %v, expected %v", c.params, err, c.expected)
+		}
+	}
+
+	// the expiration is covered by the signature
+	params := sign(SHA1, "abcdef", "x=1&expires=1599999999")
+	params["expires"] = "1600000001"
+	if err := verifier.Verify(params); err != ErrInvalidSignature {
+		t.Errorf("Verify %v: %v, expected %v", params, err, ErrInvalidSignature)
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	verifier, err := NewVerifier("", nil)
+	if err != nil || verifier != nil {
+		t.Errorf("Verifier without keys should be nil")
+	}
+
+	for _, keys := range [][]Key{
+		{{ID: "", Secret: "abcdef"}},
+		{{ID: "1", Secret: ""}},
+		{{ID: "1", Secret: "abcdef"}, {ID: "1", Secret: "ghijkl"}},
+		{{ID: "1", Secret: "abcdef", Algorithm: "md5"}},
+	} {
+		if _, err := NewVerifier("", keys); err == nil {
+			t.Errorf("Keys %v should be invalid", keys)
+		}
+	}
+}
@@ -1,23 +1,33 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
 
-	"github.com/franela/goreq"
+	"github.com/pkg/errors"
 
 	"github.com/ulule/gostorages"
 
 	"github.com/thoas/picfit/failure"
+	"github.com/thoas/picfit/metrics"
 )
 
 // HTTPStorage wraps a storage
 type HTTPStorage struct {
 	gostorages.Storage
 	UserAgent string
+	// Client is the client used to retrieve files, http.DefaultClient if nil
+	Client *http.Client
+	// MaxSize is the maximum size in bytes of a retrieved file, 0 means no limit
+	MaxSize int64
+	// Policy restricts the urls files are retrieved from, no restriction if nil
+	Policy *URLPolicy
 }
 
 // HeaderKeys represents the list of headers
@@ -29,6 +39,51 @@ var HeaderKeys = []string{
 	"Etag",
 }
 
+// NewHTTPClient returns an http.Client which gives up after timeout, or
+// connectTimeout to establish the connection, and follows at most
+// maxRedirects redirects. A zero timeout means no timeout.
+//
+// When policy is not nil, every redirect and every address connected to
+// is checked against it, and proxies from the environment are ignored
+// since the address of the proxy would be checked instead of the one of
+// the server.
+func NewHTTPClient(timeout time.Duration, connectTimeout time.Duration, maxRedirects int, policy *URLPolicy) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if policy != nil {
+		dialer.Control = policy.Control
+		transport.Proxy = nil
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return errors.Wrapf(failure.ErrUpstream, "stopped after %d redirects", maxRedirects)
+			}
+
+			if policy != nil {
+				return policy.CheckURL(req.URL)
+			}
+
+			return nil
+		},
+	}
+}
+
 // Open retrieves a gostorages File from a filepath
 func (s *HTTPStorage) Open(filepath string) (gostorages.File, error) {
 	u, err := url.Parse(s.URL(filepath))
@@ -46,49 +101,140 @@ func (s *HTTPStorage) Open(filepath string) (gostorages.File, error) {
 
 // OpenFromURL retrieves bytes from an url
 func (s *HTTPStorage) OpenFromURL(u *url.URL) ([]byte, error) {
-	content, err := goreq.Request{
-		Uri:       u.String(),
-		UserAgent: s.UserAgent,
-	}.Do()
+	content, _, err := s.FetchFromURL(context.Background(), u)
+
+	return content, err
+}
+
+// FetchFromURL retrieves bytes and headers from an url with a single request,
+// the body is read up to MaxSize bytes, the request is canceled with ctx
+func (s *HTTPStorage) FetchFromURL(ctx context.Context, u *url.URL) ([]byte, map[string]string, error) {
+	resp, err := s.do(ctx, http.MethodGet, u)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	defer content.Body.Close()
+	defer resp.Body.Close()
 
-	if content.StatusCode == http.StatusNotFound {
-		return nil, failure.ErrFileNotExists
+	if s.MaxSize > 0 && resp.ContentLength > s.MaxSize {
+		return nil, nil, errors.Wrapf(failure.ErrFetchTooLarge, "%s [size: %d]", u.String(), resp.ContentLength)
+	}
+
+	body := io.Reader(resp.Body)
+	if s.MaxSize > 0 {
+		body = io.LimitReader(resp.Body, s.MaxSize+1)
 	}
 
-	if content.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s [status: %d]", u.String(), content.StatusCode)
+	content, err := ioutil.ReadAll(body)
+	metrics.FetchBytes.WithLabelValues().Add(float64(len(content)))
+	if err != nil {
+		return nil, nil, fetchError(ctx, u, err)
 	}
 
-	return ioutil.ReadAll(content.Body)
+	if s.MaxSize > 0 && int64(len(content)) > s.MaxSize {
+		return nil, nil, errors.Wrapf(failure.ErrFetchTooLarge, "%s [max size: %d]", u.String(), s.MaxSize)
+	}
+
+	return content, responseHeaders(resp), nil
 }
 
-// HeadersFromURL retrieves the headers from an url
-func (s *HTTPStorage) HeadersFromURL(u *url.URL) (map[string]string, error) {
-	var headers = make(map[string]string)
+// do sends a request to an url checked against the policy with the client
+// of the storage, a response without a 200 status is returned as an error
+func (s *HTTPStorage) do(ctx context.Context, method string, u *url.URL) (*http.Response, error) {
+	if s.Policy != nil {
+		if err := s.Policy.CheckURL(u); err != nil {
+			return nil, err
+		}
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
 
-	content, err := goreq.Request{
-		Uri:       u.String(),
-		Method:    "GET",
-		UserAgent: s.UserAgent,
-	}.Do()
+	req, err := http.NewRequest(method, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	defer content.Body.Close()
+	req = req.WithContext(ctx)
+
+	if s.UserAgent != "" {
+		req.Header.Set("User-Agent", s.UserAgent)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fetchError(ctx, u, err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, failure.ErrFileNotExists
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Wrapf(failure.ErrUpstream, "%s [status: %d]", u.String(), resp.StatusCode)
+	}
 
+	return resp, nil
+}
+
+// responseHeaders returns the headers of HeaderKeys sent in a response
+func responseHeaders(resp *http.Response) map[string]string {
+	headers := make(map[string]string)
 	for _, key := range HeaderKeys {
-		if value, ok := content.Header[key]; ok && len(value) > 0 {
-			headers[key] = value[0]
+		if value := resp.Header.Get(key); value != "" {
+			headers[key] = value
 		}
 	}
 
-	return headers, nil
+	return headers
+}
+
+// fetchError converts an error returned while fetching an url to a failure error,
+// the error of ctx is returned when ctx is done
+func fetchError(ctx context.Context, u *url.URL, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	for cause := err; cause != nil; {
+		switch e := errors.Cause(cause).(type) {
+		case *url.Error:
+			cause = e.Err
+			continue
+		case *net.OpError:
+			cause = e.Err
+			continue
+		}
+
+		if c := errors.Cause(cause); c == failure.ErrUpstream || c == failure.ErrURLForbidden {
+			return cause
+		}
+
+		break
+	}
+
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return errors.Wrapf(failure.ErrFetchTimeout, "%s: %s", u.String(), err)
+	}
+
+	return errors.Wrapf(failure.ErrUpstream, "%s: %s", u.String(), err)
+}
+
+// HeadersFromURL retrieves the headers from an url with a HEAD request,
+// the body of the file is not downloaded
+func (s *HTTPStorage) HeadersFromURL(u *url.URL) (map[string]string, error) {
+	resp, err := s.do(context.Background(), http.MethodHead, u)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	return responseHeaders(resp), nil
 }
 
 // Headers returns headers from a filepath
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thoas/picfit/failure"
+)
+
+func TestFetchFromURL(t *testing.T) {
+	var requests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		switch r.URL.Path {
+		case "/image.png":
+			assert.Equal(t, "picfit", r.Header.Get("User-Agent"))
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Etag", "abc")
+			w.Write([]byte(strings.Repeat("a", 100)))
+		case "/large.png":
+			w.Write([]byte(strings.Repeat("a", 101)))
+		case "/chunked.png":
+			for i := 0; i < 11; i++ {
+				w.Write([]byte(strings.Repeat("a", 10)))
+				w.(http.Flusher).Flush()
+			}
+		case "/slow.png":
+			time.Sleep(200 * time.Millisecond)
+		case "/error.png":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/redirect":
+			http.Redirect(w, r, "/redirect", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	storage := &HTTPStorage{
+		UserAgent: "picfit",
+		Client:    NewHTTPClient(100*time.Millisecond, time.Second, 3, nil),
+		MaxSize:   100,
+	}
+
+	fetch := func(path string) ([]byte, map[string]string, error) {
+		u, _ := url.Parse(ts.URL + path)
+		return storage.FetchFromURL(context.Background(), u)
+	}
+
+	content, headers, err := fetch("/image.png")
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(content))
+	assert.Equal(t, "image/png", headers["Content-Type"])
+	assert.Equal(t, "abc", headers["Etag"])
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	for path, expected := range map[string]error{
+		"/large.png":   failure.ErrFetchTooLarge,
+		"/chunked.png": failure.ErrFetchTooLarge,
+		"/slow.png":    failure.ErrFetchTimeout,
+		"/error.png":   failure.ErrUpstream,
+		"/redirect":    failure.ErrUpstream,
+		"/missing.png": failure.ErrFileNotExists,
+	} {
+		_, _, err := fetch(path)
+		assert.Equal(t, expected, errors.Cause(err), path)
+	}
+
+	// the redirect is followed 3 times
+	atomic.StoreInt32(&requests, 0)
+	fetch("/redirect")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+}
+
+func TestHeadersFromURL(t *testing.T) {
+	var methods []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+
+		if r.URL.Path != "/image.png" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write([]byte(strings.Repeat("a", 100)))
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL + "/image.png")
+
+	storage := &HTTPStorage{
+		Client:  NewHTTPClient(time.Second, time.Second, 3, nil),
+		MaxSize: 10,
+	}
+
+	// the body is not downloaded
+	headers, err := storage.HeadersFromURL(u)
+	assert.Nil(t, err)
+	assert.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", headers["Last-Modified"])
+	assert.Equal(t, []string{http.MethodHead}, methods)
+
+	u, _ = url.Parse(ts.URL + "/missing.png")
+	_, err = storage.HeadersFromURL(u)
+	assert.Equal(t, failure.ErrFileNotExists, errors.Cause(err))
+
+	// the url is checked against the policy
+	policy, err := NewURLPolicy(nil)
+	assert.Nil(t, err)
+
+	storage.Policy = policy
+	storage.Client = NewHTTPClient(time.Second, time.Second, 3, policy)
+
+	methods = nil
+	_, err = storage.HeadersFromURL(u)
+	assert.Equal(t, failure.ErrURLForbidden, errors.Cause(err))
+	assert.Nil(t, methods)
+}
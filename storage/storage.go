@@ -81,7 +81,7 @@ func newStorage(cfg *StorageConfig) (gostorages.Storage, error) {
 			return nil, err
 		}
 
-		return &HTTPStorage{storage, ""}, nil
+		return &HTTPStorage{Storage: storage}, nil
 	case s3StorageType:
 		acl, ok := gostorages.ACLs[cfg.ACL]
 		if !ok {
@@ -110,7 +110,7 @@ func newStorage(cfg *StorageConfig) (gostorages.Storage, error) {
 			return nil, err
 		}
 
-		return &HTTPStorage{storage, ""}, nil
+		return &HTTPStorage{Storage: storage}, nil
 	case DOs3StorageType:
 		acl, ok := gostorages.ACLs[cfg.ACL]
 		if !ok {
@@ -148,7 +148,7 @@ func newStorage(cfg *StorageConfig) (gostorages.Storage, error) {
 			return nil, err
 		}
 
-		return &HTTPStorage{storage, ""}, nil
+		return &HTTPStorage{Storage: storage}, nil
 	}
 
 	return nil, fmt.Errorf("storage %s does not exist", cfg.Type)
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/failure"
+)
+
+// DefaultURLSchemes are the schemes allowed when none are configured
+var DefaultURLSchemes = []string{"http", "https"}
+
+// privateCIDRs are the loopback, private, link-local, multicast, reserved
+// and unspecified ranges denied unless private addresses are allowed, NAT64
+// addresses are denied since they can map to private IPv4 addresses
+var privateCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// URLSourcesConfig is a struct to restrict the urls images are retrieved from
+type URLSourcesConfig struct {
+	AllowedHosts   []string `mapstructure:"allowed_hosts"`
+	DeniedCIDRs    []string `mapstructure:"denied_cidrs"`
+	AllowedSchemes []string `mapstructure:"allowed_schemes"`
+	AllowPrivate   bool     `mapstructure:"allow_private"`
+}
+
+// URLPolicy checks urls and the addresses they resolve to against
+// the url sources configuration
+type URLPolicy struct {
+	hosts   []string
+	schemes map[string]bool
+	denied  []*net.IPNet
+}
+
+// NewURLPolicy returns a URLPolicy from a configuration, a nil configuration
+// allows any host on a public address with http or https
+func NewURLPolicy(cfg *URLSourcesConfig) (*URLPolicy, error) {
+	if cfg == nil {
+		cfg = &URLSourcesConfig{}
+	}
+
+	policy := &URLPolicy{
+		schemes: make(map[string]bool),
+	}
+
+	for _, host := range cfg.AllowedHosts {
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, errors.Wrapf(err, "Invalid allowed host %s", host)
+		}
+
+		policy.hosts = append(policy.hosts, strings.ToLower(host))
+	}
+
+	schemes := cfg.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = DefaultURLSchemes
+	}
+
+	for _, scheme := range schemes {
+		policy.schemes[strings.ToLower(scheme)] = true
+	}
+
+	cidrs := cfg.DeniedCIDRs
+	if !cfg.AllowPrivate {
+		cidrs = append(privateCIDRs, cidrs...)
+	}
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid denied CIDR %s", cidr)
+		}
+
+		policy.denied = append(policy.denied, network)
+	}
+
+	return policy, nil
+}
+
+// CheckURL checks the scheme and the host of an url, and its address when
+// the host is an IP address
+func (p *URLPolicy) CheckURL(u *url.URL) error {
+	if !p.schemes[strings.ToLower(u.Scheme)] {
+		return errors.Wrapf(failure.ErrURLForbidden, "%s [scheme: %s]", u.String(), u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return errors.Wrapf(failure.ErrURLForbidden, "%s [no host]", u.String())
+	}
+
+	if !p.allowedHost(host) {
+		return errors.Wrapf(failure.ErrURLForbidden, "%s [host: %s]", u.String(), host)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+
+	return nil
+}
+
+// Validate checks an url and every address its host resolves to
+func (p *URLPolicy) Validate(u *url.URL) error {
+	if err := p.CheckURL(u); err != nil {
+		return err
+	}
+
+	if net.ParseIP(u.Hostname()) != nil {
+		return nil
+	}
+
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return errors.Wrapf(failure.ErrUpstream, "%s: %s", u.String(), err)
+	}
+
+	for _, ip := range ips {
+		if err := p.CheckIP(ip); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckIP checks an address against the denied networks
+func (p *URLPolicy) CheckIP(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, network := range p.denied {
+		if network.Contains(ip) {
+			return errors.Wrapf(failure.ErrURLForbidden, "address %s is denied", ip)
+		}
+	}
+
+	return nil
+}
+
+// Control checks the address a connection is established to, it is called
+// once the host is resolved so a host cannot resolve to a denied address
+// between the validation of an url and its retrieval
+func (p *URLPolicy) Control(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Wrapf(failure.ErrURLForbidden, "address %s is not an IP address", host)
+	}
+
+	return p.CheckIP(ip)
+}
+
+func (p *URLPolicy) allowedHost(host string) bool {
+	if len(p.hosts) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
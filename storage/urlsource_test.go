@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thoas/picfit/failure"
+)
+
+func TestURLPolicyCheckURL(t *testing.T) {
+	policy, err := NewURLPolicy(&URLSourcesConfig{
+		AllowedHosts: []string{"*.example.com", "example.org"},
+		DeniedCIDRs:  []string{"203.0.113.0/24"},
+	})
+	assert.Nil(t, err)
+
+	for rawurl, allowed := range map[string]bool{
+		"http://img.example.com/a.png":      true,
+		"https://a.b.example.com/a.png":     true,
+		"https://EXAMPLE.org/a.png":         true,
+		"http://example.com/a.png":          false,
+		"http://example.net/a.png":          false,
+		"ftp://img.example.com/a.png":       false,
+		"file:///etc/passwd":                false,
+		"http://img.example.com.evil/a.png": false,
+	} {
+		u, _ := url.Parse(rawurl)
+
+		err := policy.CheckURL(u)
+		if allowed {
+			assert.Nil(t, err, rawurl)
+		} else {
+			assert.Equal(t, failure.ErrURLForbidden, errors.Cause(err), rawurl)
+		}
+	}
+
+	policy, err = NewURLPolicy(&URLSourcesConfig{
+		DeniedCIDRs: []string{"203.0.113.0/24"},
+	})
+	assert.Nil(t, err)
+
+	for rawurl, allowed := range map[string]bool{
+		"http://93.184.216.34/a.png":          true,
+		"http://203.0.113.7/a.png":            false,
+		"http://127.0.0.1/a.png":              false,
+		"http://10.1.2.3/a.png":               false,
+		"http://172.20.0.1/a.png":             false,
+		"http://192.168.1.1/a.png":            false,
+		"http://169.254.169.254/latest/meta":  false,
+		"http://0.0.0.0/a.png":                false,
+		"http://[::1]/a.png":                  false,
+		"http://[fe80::1]/a.png":              false,
+		"http://[fd00::1]/a.png":              false,
+		"http://[::ffff:127.0.0.1]/a.png":     false,
+		"http://224.0.0.251/a.png":            false,
+		"http://239.255.255.250/a.png":        false,
+		"http://240.0.0.1/a.png":              false,
+		"http://255.255.255.255/a.png":        false,
+		"http://[64:ff9b::a00:1]/a.png":       false,
+		"http://[ff02::1]/a.png":              false,
+		"http://[2606:4700:4700::1111]/a.png": true,
+	} {
+		u, _ := url.Parse(rawurl)
+
+		err := policy.CheckURL(u)
+		if allowed {
+			assert.Nil(t, err, rawurl)
+		} else {
+			assert.Equal(t, failure.ErrURLForbidden, errors.Cause(err), rawurl)
+		}
+	}
+
+	policy, err = NewURLPolicy(&URLSourcesConfig{
+		AllowPrivate:   true,
+		AllowedSchemes: []string{"https"},
+	})
+	assert.Nil(t, err)
+
+	u, _ := url.Parse("https://127.0.0.1/a.png")
+	assert.Nil(t, policy.CheckURL(u))
+
+	u, _ = url.Parse("http://127.0.0.1/a.png")
+	assert.Equal(t, failure.ErrURLForbidden, errors.Cause(policy.CheckURL(u)))
+
+	_, err = NewURLPolicy(&URLSourcesConfig{DeniedCIDRs: []string{"10.0.0.0"}})
+	assert.NotNil(t, err)
+}
+
+func TestURLPolicyFetch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+		default:
+			w.Write([]byte(strings.Repeat("a", 10)))
+		}
+	}))
+	defer ts.Close()
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	fetch := func(policy *URLPolicy, rawurl string) error {
+		storage := &HTTPStorage{
+			Client: NewHTTPClient(time.Second, time.Second, 3, policy),
+			Policy: policy,
+		}
+
+		u, _ := url.Parse(rawurl)
+		_, _, err := storage.FetchFromURL(context.Background(), u)
+		return err
+	}
+
+	policy, err := NewURLPolicy(nil)
+	assert.Nil(t, err)
+
+	// the host name passes the url check, its address is denied on connection
+	err = fetch(policy, "http://localhost:"+port+"/image.png")
+	assert.Equal(t, failure.ErrURLForbidden, errors.Cause(err))
+
+	err = fetch(policy, ts.URL+"/image.png")
+	assert.Equal(t, failure.ErrURLForbidden, errors.Cause(err))
+
+	policy, err = NewURLPolicy(&URLSourcesConfig{
+		AllowPrivate: true,
+		DeniedCIDRs:  []string{"169.254.0.0/16"},
+	})
+	assert.Nil(t, err)
+
+	err = fetch(policy, "http://localhost:"+port+"/image.png")
+	assert.Nil(t, err)
+
+	err = fetch(policy, ts.URL+"/redirect")
+	assert.Equal(t, failure.ErrURLForbidden, errors.Cause(err))
+}
@@ -9,6 +9,7 @@ type Config struct {
 	Redis        RedisConfig        `mapstructure:"redis"`
 	Cache        CacheConfig        `mapstructure:"cache"`
 	RedisCluster RedisClusterConfig `mapstructure:"redis-cluster"`
+	Lock         LockConfig         `mapstructure:"lock"`
 }
 
 type RedisConfig struct {
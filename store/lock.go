@@ -0,0 +1,207 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	redis "gopkg.in/redis.v5"
+
+	"github.com/thoas/picfit/logger"
+)
+
+// DefaultLockExpiration is the default expiration in seconds of a lock
+const DefaultLockExpiration = 30
+
+// DefaultLockRetryInterval is the default interval in milliseconds between two attempts to acquire a lock
+const DefaultLockRetryInterval = 100
+
+// unlockScript deletes a lock only if it is still held by the same owner
+const unlockScript = `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+else
+	return 0
+end`
+
+// LockConfig is a struct to configure locks shared between instances
+type LockConfig struct {
+	Enabled       bool
+	Expiration    int
+	RetryInterval int `mapstructure:"retry_interval"`
+}
+
+// Locker acquires locks on keys
+type Locker interface {
+	// TryLock acquires the lock of a key, ok is false when it is
+	// already held, unlock releases it.
+	TryLock(key string) (unlock func() error, ok bool, err error)
+
+	// RetryInterval is the interval to wait before trying to
+	// acquire a lock again.
+	RetryInterval() time.Duration
+}
+
+type redisLockClient interface {
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+}
+
+type redisLocker struct {
+	client        redisLockClient
+	prefix        string
+	expiration    time.Duration
+	retryInterval time.Duration
+}
+
+// NewLocker returns a Locker from config, locks are held by the instance
+// when they are disabled. Locks expire so a crashed instance cannot hold
+// them forever.
+func NewLocker(log logger.Logger, cfg *Config) (Locker, error) {
+	if cfg == nil || !cfg.Lock.Enabled {
+		return NewLocalLocker(time.Duration(DefaultLockRetryInterval) * time.Millisecond), nil
+	}
+
+	if cfg.Type != redisKVStoreType && cfg.Type != redisClusterKVStoreType {
+		return nil, fmt.Errorf("kvstore %s does not support locks", cfg.Type)
+	}
+
+	client, err := NewRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	expiration := cfg.Lock.Expiration
+	if expiration == 0 {
+		expiration = DefaultLockExpiration
+	}
+
+	retryInterval := cfg.Lock.RetryInterval
+	if retryInterval == 0 {
+		retryInterval = DefaultLockRetryInterval
+	}
+
+	log.Debug("Lock configured",
+		logger.String("type", cfg.Type))
+
+	return &redisLocker{
+		client:        client,
+		prefix:        fmt.Sprint(cfg.Prefix, "lock:"),
+		expiration:    time.Duration(expiration) * time.Second,
+		retryInterval: time.Duration(retryInterval) * time.Millisecond,
+	}, nil
+}
+
+func (l *redisLocker) TryLock(key string) (func() error, bool, error) {
+	token, err := lockToken()
+	if err != nil {
+		return nil, false, err
+	}
+
+	key = fmt.Sprint(l.prefix, key)
+
+	ok, err := l.client.SetNX(key, token, l.expiration).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	unlock := func() error {
+		return l.client.Eval(unlockScript, []string{key}, token).Err()
+	}
+
+	return unlock, true, nil
+}
+
+func (l *redisLocker) RetryInterval() time.Duration {
+	return l.retryInterval
+}
+
+type localLocker struct {
+	mu            sync.Mutex
+	keys          map[string]uint64
+	tokens        uint64
+	retryInterval time.Duration
+}
+
+// NewLocalLocker returns a Locker holding locks in memory, they are
+// only shared by the requests of an instance
+func NewLocalLocker(retryInterval time.Duration) Locker {
+	return &localLocker{
+		keys:          make(map[string]uint64),
+		retryInterval: retryInterval,
+	}
+}
+
+func (l *localLocker) TryLock(key string) (func() error, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.keys[key]; ok {
+		return nil, false, nil
+	}
+
+	// the lock is released only if it is still held by the same owner
+	l.tokens++
+	token := l.tokens
+	l.keys[key] = token
+
+	unlock := func() error {
+		l.mu.Lock()
+		if l.keys[key] == token {
+			delete(l.keys, key)
+		}
+		l.mu.Unlock()
+
+		return nil
+	}
+
+	return unlock, true, nil
+}
+
+func (l *localLocker) RetryInterval() time.Duration {
+	return l.retryInterval
+}
+
+// lockToken returns a random value identifying the owner of a lock
+func lockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// NewRedisClient returns a client connected to the redis server
+// or cluster of a redis kvstore
+func NewRedisClient(cfg *Config) (redis.Cmdable, error) {
+	switch cfg.Type {
+	case redisKVStoreType:
+		c := redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr(),
+			DB:       cfg.Redis.DB,
+			Password: cfg.Redis.Password,
+		})
+
+		if err := c.Ping().Err(); err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	case redisClusterKVStoreType:
+		c := redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    cfg.RedisCluster.Addrs,
+			Password: cfg.RedisCluster.Password,
+		})
+
+		if err := c.Ping().Err(); err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("kvstore %s is not a redis store", cfg.Type)
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/thoas/picfit"
 	"github.com/thoas/picfit/config"
 	"github.com/thoas/picfit/image"
+	"github.com/thoas/picfit/storage"
 )
 
 type Dimension struct {
@@ -43,6 +44,21 @@ func NewDummyProcessor() *picfit.Processor {
 	return processor
 }
 
+// DefaultConfig returns the default config allowing images to be retrieved
+// from the test image servers
+func DefaultConfig() *config.Config {
+	cfg := config.DefaultConfig()
+	cfg.Options.URLSources = loopbackURLSources()
+
+	return cfg
+}
+
+// loopbackURLSources allows private addresses since test image servers
+// listen on the loopback interface
+func loopbackURLSources() *storage.URLSourcesConfig {
+	return &storage.URLSourcesConfig{AllowPrivate: true}
+}
+
 type Option func(*Options)
 
 // options are server options.
@@ -75,33 +91,27 @@ type FuncTest func(t *testing.T, s *Suite)
 
 func Run(t *testing.T, f FuncTest, opt ...Option) {
 	var (
-		opts  = newOptions(opt...)
-		suite *Suite
+		opts = newOptions(opt...)
+		cfg  = config.DefaultConfig()
+		err  error
 	)
 
 	if opts.Config != "" {
-		cfg, err := config.LoadFromContent(opts.Config)
-		assert.Nil(t, err)
-
-		processor, err := picfit.NewProcessor(cfg)
+		cfg, err = config.LoadFromContent(opts.Config)
 		assert.Nil(t, err)
+	}
 
-		suite = &Suite{
-			Config:    cfg,
-			Processor: processor,
-		}
-	} else {
-		cfg := config.DefaultConfig()
-
-		processor, _ := picfit.NewProcessor(cfg)
-
-		suite = &Suite{
-			Config:    cfg,
-			Processor: processor,
-		}
+	if cfg.Options.URLSources == nil {
+		cfg.Options.URLSources = loopbackURLSources()
 	}
 
-	f(t, suite)
+	processor, err := picfit.NewProcessor(cfg)
+	assert.Nil(t, err)
+
+	f(t, &Suite{
+		Config:    cfg,
+		Processor: processor,
+	})
 }
 
 func NewImageServer() *httptest.Server {
@@ -0,0 +1,39 @@
+package tracing
+
+import "time"
+
+const (
+	// ExporterStdout writes spans to the standard output, one JSON object per line
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends spans to an OTLP/HTTP endpoint with the JSON encoding
+	ExporterOTLP = "otlp"
+)
+
+const (
+	// DefaultServiceName is the default name of the service reported with spans
+	DefaultServiceName = "picfit"
+
+	// DefaultEndpoint is the default OTLP/HTTP endpoint of an OpenTelemetry collector
+	DefaultEndpoint = "http://localhost:4318/v1/traces"
+
+	// DefaultBatchSize is the default number of spans sent at once to the OTLP endpoint
+	DefaultBatchSize = 512
+
+	// DefaultQueueSize is the default number of spans waiting to be sent, spans are dropped beyond
+	DefaultQueueSize = 2048
+
+	// DefaultFlushInterval is the default interval between two exports to the OTLP endpoint
+	DefaultFlushInterval = 5 * time.Second
+)
+
+// Config is a struct to configure tracing, disabled when Exporter is empty
+type Config struct {
+	Exporter      string
+	Endpoint      string
+	Headers       map[string]string
+	ServiceName   string        `mapstructure:"service_name"`
+	SampleRatio   *float64      `mapstructure:"sample_ratio"`
+	BatchSize     int           `mapstructure:"batch_size"`
+	QueueSize     int           `mapstructure:"queue_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
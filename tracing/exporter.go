@@ -0,0 +1,315 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func newExporter(cfg *Config) (Exporter, error) {
+	switch cfg.Exporter {
+	case ExporterStdout:
+		return NewWriterExporter(os.Stdout, serviceName(cfg)), nil
+	case ExporterOTLP:
+		return NewOTLPExporter(cfg), nil
+	}
+
+	return nil, fmt.Errorf("tracing exporter %q not supported", cfg.Exporter)
+}
+
+func serviceName(cfg *Config) string {
+	if cfg.ServiceName == "" {
+		return DefaultServiceName
+	}
+
+	return cfg.ServiceName
+}
+
+// WriterExporter writes each span to a writer as a JSON object on its own line
+type WriterExporter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	service string
+}
+
+// NewWriterExporter returns a WriterExporter writing to w
+func NewWriterExporter(w io.Writer, service string) *WriterExporter {
+	return &WriterExporter{encoder: json.NewEncoder(w), service: service}
+}
+
+// Export writes the span
+func (e *WriterExporter) Export(span *Span) {
+	line := struct {
+		Service string `json:"service"`
+		*otlpSpan
+	}{e.service, newOTLPSpan(span)}
+
+	e.mu.Lock()
+	e.encoder.Encode(line)
+	e.mu.Unlock()
+}
+
+// Shutdown does nothing, spans are written as they end
+func (e *WriterExporter) Shutdown() error {
+	return nil
+}
+
+// OTLPExporter sends spans in batches to an OTLP/HTTP endpoint with the JSON encoding
+type OTLPExporter struct {
+	client        *http.Client
+	endpoint      string
+	headers       map[string]string
+	service       string
+	batchSize     int
+	flushInterval time.Duration
+
+	spans chan *Span
+	flush chan chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewOTLPExporter returns an OTLPExporter from config and starts sending spans
+func NewOTLPExporter(cfg *Config) *OTLPExporter {
+	e := &OTLPExporter{
+		client:        &http.Client{Timeout: 10 * time.Second},
+		endpoint:      cfg.Endpoint,
+		headers:       cfg.Headers,
+		service:       serviceName(cfg),
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		flush:         make(chan chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	if e.endpoint == "" {
+		e.endpoint = DefaultEndpoint
+	}
+	if e.batchSize <= 0 {
+		e.batchSize = DefaultBatchSize
+	}
+	if e.flushInterval <= 0 {
+		e.flushInterval = DefaultFlushInterval
+	}
+
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	e.spans = make(chan *Span, queueSize)
+
+	go e.run()
+
+	return e
+}
+
+// Export queues the span, it is dropped when the queue is full
+func (e *OTLPExporter) Export(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+	}
+}
+
+// Flush sends the queued spans
+func (e *OTLPExporter) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case e.flush <- flushed:
+		<-flushed
+	case <-e.done:
+	}
+}
+
+// Shutdown sends the queued spans and stops the exporter
+func (e *OTLPExporter) Shutdown() error {
+	e.Flush()
+	e.once.Do(func() { close(e.done) })
+
+	return nil
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, e.batchSize)
+
+	send := func() {
+		if len(batch) > 0 {
+			e.send(batch)
+			batch = make([]*Span, 0, e.batchSize)
+		}
+	}
+
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= e.batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-e.flush:
+			for n := len(e.spans); n > 0; n-- {
+				batch = append(batch, <-e.spans)
+				if len(batch) >= e.batchSize {
+					send()
+				}
+			}
+			send()
+			close(flushed)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) send(batch []*Span) error {
+	spans := make([]*otlpSpan, len(batch))
+	for i := range batch {
+		spans[i] = newOTLPSpan(batch[i])
+	}
+
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{newOTLPAttribute(String("service.name", e.service))},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/thoas/picfit"},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("tracing endpoint %s returned %d", e.endpoint, resp.StatusCode)
+	}
+
+	return nil
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+// statusError is the OTLP status code of failed spans
+const statusError = 2
+
+func newOTLPSpan(span *Span) *otlpSpan {
+	s := &otlpSpan{
+		TraceID:           span.Context.TraceID.String(),
+		SpanID:            span.Context.SpanID.String(),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+
+	if span.Parent != (SpanID{}) {
+		s.ParentSpanID = span.Parent.String()
+	}
+
+	for _, attr := range span.Attributes() {
+		s.Attributes = append(s.Attributes, newOTLPAttribute(attr))
+	}
+
+	if span.Error != "" {
+		s.Status = otlpStatus{Code: statusError, Message: span.Error}
+	}
+
+	return s
+}
+
+func newOTLPAttribute(attr Attribute) otlpAttribute {
+	var value otlpValue
+
+	switch v := attr.Value.(type) {
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		value.IntValue = &s
+	case bool:
+		value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		value.StringValue = &s
+	}
+
+	return otlpAttribute{Key: attr.Key, Value: value}
+}
@@ -0,0 +1,343 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header carrying the parent of a span
+const TraceparentHeader = "traceparent"
+
+// SpanKind is the role of a span in a trace
+type SpanKind int
+
+// Span kinds as defined by OpenTelemetry
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the part of a span propagated to its children
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid returns true if both identifiers are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent returns the W3C traceparent header value of the span context
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+
+	// future versions may append fields, version 00 has exactly four
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || len(parts[1]) != 32 {
+		return sc, fmt.Errorf("invalid trace id in traceparent %q", value)
+	}
+
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || len(parts[2]) != 16 {
+		return sc, fmt.Errorf("invalid span id in traceparent %q", value)
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, fmt.Errorf("invalid flags in traceparent %q", value)
+	}
+
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+
+	sc.Sampled = flags[0]&1 == 1
+
+	return sc, nil
+}
+
+// Attribute is a key/value pair describing a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an integer attribute
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+// Bool returns a boolean attribute
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is an operation of a trace, a nil Span records nothing
+type Span struct {
+	tracer *Tracer
+
+	Name     string
+	Kind     SpanKind
+	Context  SpanContext
+	Parent   SpanID
+	Start    time.Time
+	End      time.Time
+	Error    string
+	mu       sync.Mutex
+	attrs    []Attribute
+	finished bool
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// Attributes returns the attributes of the span
+func (s *Span) Attributes() []Attribute {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attrs := make([]Attribute, len(s.attrs))
+	copy(attrs, s.attrs)
+
+	return attrs
+}
+
+// RecordError marks the span as failed when err is not nil
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// Finish ends the span and exports it, further calls are ignored
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.exporter.Export(s)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying the span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, nil if none
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+type remoteKey struct{}
+
+// ContextWithRemote returns a copy of ctx carrying the span context of a
+// remote parent, extracted from a traceparent header
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Exporter sends finished spans to a backend
+type Exporter interface {
+	Export(span *Span)
+	Shutdown() error
+}
+
+// Tracer creates spans and exports the sampled ones
+type Tracer struct {
+	exporter    Exporter
+	sampleRatio float64
+}
+
+// New returns a Tracer from config, nil when tracing is disabled
+func New(cfg *Config) (*Tracer, error) {
+	if cfg == nil || cfg.Exporter == "" {
+		return nil, nil
+	}
+
+	exporter, err := newExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTracer(exporter, sampleRatio(cfg)), nil
+}
+
+// NewTracer returns a Tracer exporting a ratio of the root spans with exporter,
+// child spans follow the decision of their parent
+func NewTracer(exporter Exporter, sampleRatio float64) *Tracer {
+	return &Tracer{exporter: exporter, sampleRatio: sampleRatio}
+}
+
+// Shutdown exports the pending spans and stops the exporter
+func (t *Tracer) Shutdown() error {
+	if t == nil {
+		return nil
+	}
+
+	return t.exporter.Shutdown()
+}
+
+// Start starts a span, child of the span or of the remote parent carried
+// by ctx, it returns a copy of ctx carrying the new span
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	var parent SpanContext
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.Context
+	} else if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = sc
+	}
+
+	sc := SpanContext{SpanID: newSpanID()}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled
+	} else {
+		sc.TraceID = newTraceID()
+		sc.Sampled = t.sample(sc.TraceID)
+	}
+
+	if !sc.Sampled {
+		// unsampled spans are still propagated so children are not sampled
+		return ContextWithSpan(ctx, &Span{tracer: t, Context: sc, finished: true}), nil
+	}
+
+	span := &Span{
+		tracer:  t,
+		Name:    name,
+		Kind:    kind,
+		Context: sc,
+		Parent:  parent.SpanID,
+		Start:   time.Now(),
+		attrs:   attrs,
+	}
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// sample returns true for a ratio of the trace identifiers
+func (t *Tracer) sample(id TraceID) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+
+	if t.sampleRatio <= 0 {
+		return false
+	}
+
+	bound := uint64(t.sampleRatio * (1 << 63))
+
+	return binary.BigEndian.Uint64(id[8:])>>1 < bound
+}
+
+// Start starts an internal span with the tracer of the span carried by ctx
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal, attrs...)
+}
+
+// StartKind starts a span of kind with the tracer of the span carried by ctx,
+// nothing is traced when ctx carries no span
+func StartKind(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	return parent.tracer.Start(ctx, name, kind, attrs...)
+}
+
+func sampleRatio(cfg *Config) float64 {
+	if cfg.SampleRatio == nil {
+		return 1
+	}
+
+	return *cfg.SampleRatio
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,153 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Nil(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	sc, err = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.Nil(t, err)
+	assert.False(t, sc.Sampled)
+
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+type recorder struct {
+	spans []*Span
+}
+
+func (r *recorder) Export(span *Span) { r.spans = append(r.spans, span) }
+
+func (r *recorder) Shutdown() error { return nil }
+
+func TestTracer(t *testing.T) {
+	var (
+		exporter = &recorder{}
+		tracer   = NewTracer(exporter, 1)
+	)
+
+	ctx, root := tracer.Start(context.Background(), "root", KindServer)
+	_, child := Start(ctx, "child", String("key", "value"))
+	child.RecordError(errors.New("failure"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	assert.Len(t, exporter.spans, 2)
+	assert.Equal(t, root.Context.TraceID, child.Context.TraceID)
+	assert.Equal(t, root.Context.SpanID, child.Parent)
+	assert.Equal(t, SpanID{}, root.Parent)
+	assert.Equal(t, "failure", child.Error)
+	assert.Equal(t, []Attribute{String("key", "value")}, child.Attributes())
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, span := tracer.Start(ContextWithRemote(context.Background(), remote), "remote", KindServer)
+	assert.Equal(t, remote.TraceID, span.Context.TraceID)
+	assert.Equal(t, remote.SpanID, span.Parent)
+
+	// the sampling decision of the remote parent is followed
+	remote.Sampled = false
+	ctx, span = tracer.Start(ContextWithRemote(context.Background(), remote), "remote", KindServer)
+	assert.Nil(t, span)
+	_, span = tracer.Start(ctx, "child", KindInternal)
+	assert.Nil(t, span)
+
+	// spans are not started without the tracer of a parent span
+	_, span = Start(context.Background(), "orphan")
+	assert.Nil(t, span)
+
+	// nil tracers and spans record nothing
+	var disabled *Tracer
+	ctx, span = disabled.Start(context.Background(), "disabled", KindInternal)
+	assert.Nil(t, span)
+	assert.Nil(t, SpanFromContext(ctx))
+	span.SetAttributes(Int("size", 1))
+	span.RecordError(errors.New("failure"))
+	span.Finish()
+	assert.Nil(t, disabled.Shutdown())
+}
+
+func TestSampleRatio(t *testing.T) {
+	exporter := &recorder{}
+
+	tracer := NewTracer(exporter, 0)
+	for i := 0; i < 100; i++ {
+		_, span := tracer.Start(context.Background(), "span", KindInternal)
+		span.Finish()
+	}
+	assert.Len(t, exporter.spans, 0)
+
+	tracer = NewTracer(exporter, 0.5)
+	for i := 0; i < 1000; i++ {
+		_, span := tracer.Start(context.Background(), "span", KindInternal)
+		span.Finish()
+	}
+	assert.True(t, len(exporter.spans) > 350 && len(exporter.spans) < 650)
+}
+
+func TestWriterExporter(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		tracer = NewTracer(NewWriterExporter(&buf, "picfit"), 1)
+	)
+
+	_, span := tracer.Start(context.Background(), "engine.resize", KindInternal,
+		String("backend", "goimage"), Int("size", 42), Bool("shared", true))
+	span.RecordError(errors.New("failure"))
+	span.Finish()
+
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "picfit", line["service"])
+	assert.Equal(t, "engine.resize", line["name"])
+	assert.Equal(t, span.Context.TraceID.String(), line["traceId"])
+	assert.Equal(t, map[string]interface{}{"code": float64(2), "message": "failure"}, line["status"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "backend", "value": map[string]interface{}{"stringValue": "goimage"}},
+		map[string]interface{}{"key": "size", "value": map[string]interface{}{"intValue": "42"}},
+		map[string]interface{}{"key": "shared", "value": map[string]interface{}{"boolValue": true}},
+	}, line["attributes"])
+}
+
+func TestNew(t *testing.T) {
+	tracer, err := New(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, tracer)
+
+	tracer, err = New(&Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, tracer)
+
+	_, err = New(&Config{Exporter: "zipkin"})
+	assert.NotNil(t, err)
+
+	ratio := 0.25
+	tracer, err = New(&Config{Exporter: ExporterStdout, SampleRatio: &ratio})
+	assert.Nil(t, err)
+	assert.Equal(t, 0.25, tracer.sampleRatio)
+}
@@ -0,0 +1,203 @@
+package worker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thoas/picfit/failure"
+)
+
+// Stats is a struct to represent the activity of a pool or a queue
+type Stats struct {
+	Workers            int     `json:"workers"`
+	QueueSize          int     `json:"queue_size"`
+	Active             int64   `json:"active"`
+	Depth              int64   `json:"depth"`
+	Count              int64   `json:"count"`
+	Rejected           int64   `json:"rejected"`
+	TotalWaitTime      string  `json:"total_wait_time"`
+	TotalWaitTimeSec   float64 `json:"total_wait_time_sec"`
+	AverageWaitTime    string  `json:"average_wait_time"`
+	AverageWaitTimeSec float64 `json:"average_wait_time_sec"`
+}
+
+type counters struct {
+	active    int64
+	depth     int64
+	count     int64
+	rejected  int64
+	totalWait int64
+}
+
+func (c *counters) stats(workers int, queueSize int) Stats {
+	var (
+		count     = atomic.LoadInt64(&c.count)
+		totalWait = time.Duration(atomic.LoadInt64(&c.totalWait))
+		average   time.Duration
+	)
+
+	if count > 0 {
+		average = totalWait / time.Duration(count)
+	}
+
+	return Stats{
+		Workers:            workers,
+		QueueSize:          queueSize,
+		Active:             atomic.LoadInt64(&c.active),
+		Depth:              atomic.LoadInt64(&c.depth),
+		Count:              count,
+		Rejected:           atomic.LoadInt64(&c.rejected),
+		TotalWaitTime:      totalWait.String(),
+		TotalWaitTimeSec:   totalWait.Seconds(),
+		AverageWaitTime:    average.String(),
+		AverageWaitTimeSec: average.Seconds(),
+	}
+}
+
+func (c *counters) start(queued time.Time) {
+	atomic.AddInt64(&c.depth, -1)
+	atomic.AddInt64(&c.active, 1)
+	atomic.AddInt64(&c.totalWait, int64(time.Since(queued)))
+}
+
+func (c *counters) done() {
+	atomic.AddInt64(&c.active, -1)
+	atomic.AddInt64(&c.count, 1)
+}
+
+// Pool bounds the number of tasks running concurrently, tasks waiting
+// for a worker are rejected once the queue is full
+type Pool struct {
+	// RetryAfter is the delay advised to clients when a task is rejected
+	RetryAfter time.Duration
+
+	workers   chan struct{}
+	slots     chan struct{}
+	queueSize int
+	counters  counters
+}
+
+// NewPool returns a Pool running at most workers tasks, with at most
+// queueSize tasks waiting for them
+func NewPool(workers int, queueSize int, retryAfter time.Duration) *Pool {
+	return &Pool{
+		RetryAfter: retryAfter,
+		workers:    make(chan struct{}, workers),
+		slots:      make(chan struct{}, workers+queueSize),
+		queueSize:  queueSize,
+	}
+}
+
+// Do runs fn once a worker is available and returns its error,
+// a failure.QueueFullError if the queue is full
+func (p *Pool) Do(fn func() error) error {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&p.counters.rejected, 1)
+		return &failure.QueueFullError{RetryAfter: p.RetryAfter}
+	}
+	defer func() { <-p.slots }()
+
+	queued := time.Now()
+	atomic.AddInt64(&p.counters.depth, 1)
+
+	p.workers <- struct{}{}
+	defer func() { <-p.workers }()
+
+	p.counters.start(queued)
+	defer p.counters.done()
+
+	return fn()
+}
+
+// Stats returns the activity of the pool
+func (p *Pool) Stats() Stats {
+	return p.counters.stats(cap(p.workers), p.queueSize)
+}
+
+type task struct {
+	fn     func()
+	queued time.Time
+}
+
+// Queue runs tasks asynchronously with a fixed number of workers,
+// tasks are rejected once the queue is full
+type Queue struct {
+	// RetryAfter is the delay advised to clients when a task is rejected
+	RetryAfter time.Duration
+
+	tasks    chan task
+	workers  int
+	counters counters
+	wg       sync.WaitGroup
+	mu       sync.RWMutex
+	closed   bool
+}
+
+// NewQueue returns a Queue running tasks on workers goroutines, with at
+// most size tasks waiting for them
+func NewQueue(workers int, size int, retryAfter time.Duration) *Queue {
+	q := &Queue{
+		RetryAfter: retryAfter,
+		tasks:      make(chan task, size),
+		workers:    workers,
+	}
+
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.run()
+	}
+
+	return q
+}
+
+func (q *Queue) run() {
+	defer q.wg.Done()
+
+	for t := range q.tasks {
+		q.counters.start(t.queued)
+		t.fn()
+		q.counters.done()
+	}
+}
+
+// Push queues fn, a failure.QueueFullError is returned if the queue is full
+// and failure.ErrShuttingDown once the queue is closed
+func (q *Queue) Push(fn func()) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return failure.ErrShuttingDown
+	}
+
+	atomic.AddInt64(&q.counters.depth, 1)
+
+	select {
+	case q.tasks <- task{fn: fn, queued: time.Now()}:
+		return nil
+	default:
+		atomic.AddInt64(&q.counters.depth, -1)
+		atomic.AddInt64(&q.counters.rejected, 1)
+		return &failure.QueueFullError{RetryAfter: q.RetryAfter}
+	}
+}
+
+// Close stops accepting tasks and waits for the queued ones to be done
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.tasks)
+	}
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+// Stats returns the activity of the queue
+func (q *Queue) Stats() Stats {
+	return q.counters.stats(q.workers, cap(q.tasks))
+}
@@ -0,0 +1,127 @@
+package worker
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thoas/picfit/failure"
+)
+
+func TestPool(t *testing.T) {
+	var (
+		pool    = NewPool(2, 1, 3*time.Second)
+		release = make(chan struct{})
+		started = make(chan struct{}, 3)
+		running int32
+		maximum int32
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			err := pool.Do(func() error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&maximum)
+					if n <= m || atomic.CompareAndSwapInt32(&maximum, m, n) {
+						break
+					}
+				}
+
+				started <- struct{}{}
+				<-release
+
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+			assert.Nil(t, err)
+		}()
+	}
+
+	<-started
+	<-started
+
+	// two tasks are running, the third one is waiting
+	for i := 0; i < 100 && pool.Stats().Depth != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := pool.Stats()
+	assert.Equal(t, int64(2), stats.Active)
+	assert.Equal(t, 2, stats.Workers)
+	assert.Equal(t, 1, stats.QueueSize)
+
+	err := pool.Do(func() error { return nil })
+	assert.NotNil(t, err)
+
+	qerr, ok := errors.Cause(err).(*failure.QueueFullError)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, qerr.RetryAfter)
+
+	close(release)
+	wg.Wait()
+
+	stats = pool.Stats()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maximum))
+	assert.Equal(t, int64(0), stats.Active)
+	assert.Equal(t, int64(0), stats.Depth)
+	assert.Equal(t, int64(3), stats.Count)
+	assert.Equal(t, int64(1), stats.Rejected)
+	assert.True(t, stats.TotalWaitTimeSec > 0)
+
+	expected := errors.New("transformation failed")
+	assert.Equal(t, expected, pool.Do(func() error { return expected }))
+}
+
+func TestQueue(t *testing.T) {
+	var (
+		queue   = NewQueue(1, 2, time.Second)
+		release = make(chan struct{})
+		started = make(chan struct{})
+		done    int32
+	)
+
+	task := func() {
+		atomic.AddInt32(&done, 1)
+	}
+
+	assert.Nil(t, queue.Push(func() {
+		close(started)
+		<-release
+		task()
+	}))
+
+	<-started
+
+	// the worker is busy, two tasks can wait for it
+	assert.Nil(t, queue.Push(task))
+	assert.Nil(t, queue.Push(task))
+
+	stats := queue.Stats()
+	assert.Equal(t, int64(1), stats.Active)
+	assert.Equal(t, int64(2), stats.Depth)
+
+	err := queue.Push(task)
+	_, ok := err.(*failure.QueueFullError)
+	assert.True(t, ok)
+
+	close(release)
+	queue.Close()
+
+	stats = queue.Stats()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&done))
+	assert.Equal(t, int64(3), stats.Count)
+	assert.Equal(t, int64(1), stats.Rejected)
+	assert.Equal(t, int64(0), stats.Depth)
+
+	assert.Equal(t, failure.ErrShuttingDown, queue.Push(task))
+}